@@ -0,0 +1,17 @@
+package main
+
+import (
+	"github.com/Shopify/goose/logger"
+	"github.com/cds-snc/covid-alert-server/pkg/app"
+	"github.com/cds-snc/covid-alert-server/pkg/persistence"
+)
+
+var log = logger.New("migrate")
+
+// Applies any pending migrations to the database at DATABASE_URL and exits,
+// for deployments that run migrations as a separate step before rollout.
+func main() {
+	if err := persistence.MigrateDatabase(app.DatabaseURL()); err != nil {
+		log(nil, err).Fatal("error running database bootstrap / migrations")
+	}
+}
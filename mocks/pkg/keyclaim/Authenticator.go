@@ -57,3 +57,19 @@ func (_m *Authenticator) RegionFromAuthHeader(_a0 string) (string, string, bool)
 
 	return r0, r1, r2
 }
+
+// Regions provides a mock function with given fields:
+func (_m *Authenticator) Regions() []string {
+	ret := _m.Called()
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func() []string); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	return r0
+}
@@ -20,6 +20,57 @@ type Conn struct {
 	mock.Mock
 }
 
+// AddToDenylist provides a mock function with given fields: ctx, key
+func (_m *Conn) AddToDenylist(ctx context.Context, key []byte) error {
+	ret := _m.Called(ctx, key)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, []byte) error); ok {
+		r0 = rf(ctx, key)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// AddToDenylistUntil provides a mock function with given fields: ctx, key, until
+func (_m *Conn) AddToDenylistUntil(ctx context.Context, key []byte, until time.Time) error {
+	ret := _m.Called(ctx, key, until)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, []byte, time.Time) error); ok {
+		r0 = rf(ctx, key, until)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ApproximateTableRowCounts provides a mock function with given fields: ctx, tables
+func (_m *Conn) ApproximateTableRowCounts(ctx context.Context, tables []string) ([]persistence.TableRowCount, error) {
+	ret := _m.Called(ctx, tables)
+
+	var r0 []persistence.TableRowCount
+	if rf, ok := ret.Get(0).(func(context.Context, []string) []persistence.TableRowCount); ok {
+		r0 = rf(ctx, tables)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]persistence.TableRowCount)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, []string) error); ok {
+		r1 = rf(ctx, tables)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // CheckClaimKeyBan provides a mock function with given fields: _a0
 func (_m *Conn) CheckClaimKeyBan(_a0 string) (int, time.Duration, error) {
 	ret := _m.Called(_a0)
@@ -48,6 +99,27 @@ func (_m *Conn) CheckClaimKeyBan(_a0 string) (int, time.Duration, error) {
 	return r0, r1, r2
 }
 
+// ClaimEventsExport provides a mock function with given fields: ctx, date, staleAfter
+func (_m *Conn) ClaimEventsExport(ctx context.Context, date string, staleAfter time.Duration) (bool, error) {
+	ret := _m.Called(ctx, date, staleAfter)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(context.Context, string, time.Duration) bool); ok {
+		r0 = rf(ctx, date, staleAfter)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, time.Duration) error); ok {
+		r1 = rf(ctx, date, staleAfter)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // ClaimKey provides a mock function with given fields: _a0, _a1, _a2
 func (_m *Conn) ClaimKey(_a0 string, _a1 []byte, _a2 context.Context) ([]byte, error) {
 	ret := _m.Called(_a0, _a1, _a2)
@@ -252,6 +324,27 @@ func (_m *Conn) CountExpiredClaimedEncryptionKeysWithNoUploadsByOriginator() ([]
 	return r0, r1
 }
 
+// CountRejections provides a mock function with given fields: ctx, reason, since
+func (_m *Conn) CountRejections(ctx context.Context, reason string, since time.Time) (int64, error) {
+	ret := _m.Called(ctx, reason, since)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, string, time.Time) int64); ok {
+		r0 = rf(ctx, reason, since)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, time.Time) error); ok {
+		r1 = rf(ctx, reason, since)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // CountUnclaimedEncryptionKeysByOriginator provides a mock function with given fields:
 func (_m *Conn) CountUnclaimedEncryptionKeysByOriginator() ([]persistence.CountByOriginator, error) {
 	ret := _m.Called()
@@ -296,6 +389,27 @@ func (_m *Conn) CountUnclaimedOneTimeCodes() (int64, error) {
 	return r0, r1
 }
 
+// DeleteDiagnosisKeysOlderThan provides a mock function with given fields: ctx, region, days
+func (_m *Conn) DeleteDiagnosisKeysOlderThan(ctx context.Context, region string, days uint32) (int64, error) {
+	ret := _m.Called(ctx, region, days)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, string, uint32) int64); ok {
+		r0 = rf(ctx, region, days)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, uint32) error); ok {
+		r1 = rf(ctx, region, days)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // DeleteOldDiagnosisKeys provides a mock function with given fields:
 func (_m *Conn) DeleteOldDiagnosisKeys() (int64, error) {
 	ret := _m.Called()
@@ -382,6 +496,29 @@ func (_m *Conn) FetchKeysForHours(_a0 string, _a1 uint32, _a2 uint32, _a3 int32)
 	return r0, r1
 }
 
+// FetchKeysForHoursInRange provides a mock function with given fields: region, startHour, endHour, currentRSIN, startRSIN, endRSIN
+func (_m *Conn) FetchKeysForHoursInRange(region string, startHour uint32, endHour uint32, currentRSIN int32, startRSIN int32, endRSIN int32) ([]*covidshield.TemporaryExposureKey, error) {
+	ret := _m.Called(region, startHour, endHour, currentRSIN, startRSIN, endRSIN)
+
+	var r0 []*covidshield.TemporaryExposureKey
+	if rf, ok := ret.Get(0).(func(string, uint32, uint32, int32, int32, int32) []*covidshield.TemporaryExposureKey); ok {
+		r0 = rf(region, startHour, endHour, currentRSIN, startRSIN, endRSIN)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*covidshield.TemporaryExposureKey)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, uint32, uint32, int32, int32, int32) error); ok {
+		r1 = rf(region, startHour, endHour, currentRSIN, startRSIN, endRSIN)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // FetchKeysForHoursV1 provides a mock function with given fields: _a0, _a1, _a2, _a3
 func (_m *Conn) FetchKeysForHoursV1(_a0 string, _a1 uint32, _a2 uint32, _a3 int32) ([]*covidshieldv1.TemporaryExposureKey, error) {
 	ret := _m.Called(_a0, _a1, _a2, _a3)
@@ -405,6 +542,20 @@ func (_m *Conn) FetchKeysForHoursV1(_a0 string, _a1 uint32, _a2 uint32, _a3 int3
 	return r0, r1
 }
 
+// FinishEventsExport provides a mock function with given fields: ctx, date, exported
+func (_m *Conn) FinishEventsExport(ctx context.Context, date string, exported bool) error {
+	ret := _m.Called(ctx, date, exported)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, bool) error); ok {
+		r0 = rf(ctx, date, exported)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // GetAggregateOtkDurationsByDate provides a mock function with given fields: startDate
 func (_m *Conn) GetAggregateOtkDurationsByDate(startDate string) ([]persistence.AggregateOtkDuration, error) {
 	ret := _m.Called(startDate)
@@ -428,6 +579,52 @@ func (_m *Conn) GetAggregateOtkDurationsByDate(startDate string) ([]persistence.
 	return r0, r1
 }
 
+// GetEvents provides a mock function with given fields: date, deviceType
+func (_m *Conn) GetEvents(date string, deviceType persistence.DeviceType) ([]persistence.Events, error) {
+	ret := _m.Called(date, deviceType)
+
+	var r0 []persistence.Events
+	if rf, ok := ret.Get(0).(func(string, persistence.DeviceType) []persistence.Events); ok {
+		r0 = rf(date, deviceType)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]persistence.Events)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, persistence.DeviceType) error); ok {
+		r1 = rf(date, deviceType)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetOtkFunnel provides a mock function with given fields: startDate, endDate
+func (_m *Conn) GetOtkFunnel(startDate string, endDate string) ([]persistence.OtkFunnel, error) {
+	ret := _m.Called(startDate, endDate)
+
+	var r0 []persistence.OtkFunnel
+	if rf, ok := ret.Get(0).(func(string, string) []persistence.OtkFunnel); ok {
+		r0 = rf(startDate, endDate)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]persistence.OtkFunnel)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, string) error); ok {
+		r1 = rf(startDate, endDate)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetServerEvents provides a mock function with given fields: startDate
 func (_m *Conn) GetServerEvents(startDate string) ([]persistence.Events, error) {
 	ret := _m.Called(startDate)
@@ -474,6 +671,76 @@ func (_m *Conn) GetTEKUploads(startDate string) ([]persistence.Uploads, error) {
 	return r0, r1
 }
 
+// IsDenylisted provides a mock function with given fields: ctx, key
+func (_m *Conn) IsDenylisted(ctx context.Context, key []byte) (bool, error) {
+	ret := _m.Called(ctx, key)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(context.Context, []byte) bool); ok {
+		r0 = rf(ctx, key)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, []byte) error); ok {
+		r1 = rf(ctx, key)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// KeypairQuota provides a mock function with given fields: ctx, appPubKey
+func (_m *Conn) KeypairQuota(ctx context.Context, appPubKey *[32]byte) (int64, time.Time, error) {
+	ret := _m.Called(ctx, appPubKey)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, *[32]byte) int64); ok {
+		r0 = rf(ctx, appPubKey)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 time.Time
+	if rf, ok := ret.Get(1).(func(context.Context, *[32]byte) time.Time); ok {
+		r1 = rf(ctx, appPubKey)
+	} else {
+		r1 = ret.Get(1).(time.Time)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(context.Context, *[32]byte) error); ok {
+		r2 = rf(ctx, appPubKey)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// MaintenanceMode provides a mock function with given fields: ctx
+func (_m *Conn) MaintenanceMode(ctx context.Context) (bool, error) {
+	ret := _m.Called(ctx)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(context.Context) bool); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // NewKeyClaim provides a mock function with given fields: _a0, _a1, _a2, _a3
 func (_m *Conn) NewKeyClaim(_a0 context.Context, _a1 string, _a2 string, _a3 string) (string, error) {
 	ret := _m.Called(_a0, _a1, _a2, _a3)
@@ -495,6 +762,27 @@ func (_m *Conn) NewKeyClaim(_a0 context.Context, _a1 string, _a2 string, _a3 str
 	return r0, r1
 }
 
+// OriginatorRegion provides a mock function with given fields: ctx, appPubKey
+func (_m *Conn) OriginatorRegion(ctx context.Context, appPubKey *[32]byte) (string, error) {
+	ret := _m.Called(ctx, appPubKey)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(context.Context, *[32]byte) string); ok {
+		r0 = rf(ctx, appPubKey)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, *[32]byte) error); ok {
+		r1 = rf(ctx, appPubKey)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // PrivForPub provides a mock function with given fields: _a0
 func (_m *Conn) PrivForPub(_a0 []byte) ([]byte, error) {
 	ret := _m.Called(_a0)
@@ -518,6 +806,99 @@ func (_m *Conn) PrivForPub(_a0 []byte) ([]byte, error) {
 	return r0, r1
 }
 
+// PromoteKeys provides a mock function with given fields: ctx, originator, appPubKey
+func (_m *Conn) PromoteKeys(ctx context.Context, originator string, appPubKey *[32]byte) (int64, error) {
+	ret := _m.Called(ctx, originator, appPubKey)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, string, *[32]byte) int64); ok {
+		r0 = rf(ctx, originator, appPubKey)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, *[32]byte) error); ok {
+		r1 = rf(ctx, originator, appPubKey)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ReconcileUploadCounts provides a mock function with given fields: ctx, date
+func (_m *Conn) ReconcileUploadCounts(ctx context.Context, date time.Time) ([]persistence.UploadCountDrift, error) {
+	ret := _m.Called(ctx, date)
+
+	var r0 []persistence.UploadCountDrift
+	if rf, ok := ret.Get(0).(func(context.Context, time.Time) []persistence.UploadCountDrift); ok {
+		r0 = rf(ctx, date)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]persistence.UploadCountDrift)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, time.Time) error); ok {
+		r1 = rf(ctx, date)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// RecordUploadRejections provides a mock function with given fields: ctx, reason, date, count
+func (_m *Conn) RecordUploadRejections(ctx context.Context, reason string, date time.Time, count int64) error {
+	ret := _m.Called(ctx, reason, date, count)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, time.Time, int64) error); ok {
+		r0 = rf(ctx, reason, date, count)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RegionLastUpdated provides a mock function with given fields: ctx, region
+func (_m *Conn) RegionLastUpdated(ctx context.Context, region string) (time.Time, error) {
+	ret := _m.Called(ctx, region)
+
+	var r0 time.Time
+	if rf, ok := ret.Get(0).(func(context.Context, string) time.Time); ok {
+		r0 = rf(ctx, region)
+	} else {
+		r0 = ret.Get(0).(time.Time)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, region)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// RemoveFromDenylist provides a mock function with given fields: ctx, key
+func (_m *Conn) RemoveFromDenylist(ctx context.Context, key []byte) error {
+	ret := _m.Called(ctx, key)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, []byte) error); ok {
+		r0 = rf(ctx, key)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // SaveEvent provides a mock function with given fields: event
 func (_m *Conn) SaveEvent(event persistence.Event) error {
 	ret := _m.Called(event)
@@ -532,13 +913,90 @@ func (_m *Conn) SaveEvent(event persistence.Event) error {
 	return r0
 }
 
+// SeedServerKeypair provides a mock function with given fields: ctx, seed
+func (_m *Conn) SeedServerKeypair(ctx context.Context, seed persistence.KeypairSeed) (bool, error) {
+	ret := _m.Called(ctx, seed)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(context.Context, persistence.KeypairSeed) bool); ok {
+		r0 = rf(ctx, seed)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, persistence.KeypairSeed) error); ok {
+		r1 = rf(ctx, seed)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SetMaintenanceMode provides a mock function with given fields: ctx, enabled
+func (_m *Conn) SetMaintenanceMode(ctx context.Context, enabled bool) error {
+	ret := _m.Called(ctx, enabled)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, bool) error); ok {
+		r0 = rf(ctx, enabled)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // StoreKeys provides a mock function with given fields: _a0, _a1, _a2
-func (_m *Conn) StoreKeys(_a0 *[32]byte, _a1 []*covidshield.TemporaryExposureKey, _a2 context.Context) error {
+func (_m *Conn) StoreKeys(_a0 *[32]byte, _a1 []*covidshield.TemporaryExposureKey, _a2 context.Context) (int64, int64, error) {
 	ret := _m.Called(_a0, _a1, _a2)
 
-	var r0 error
-	if rf, ok := ret.Get(0).(func(*[32]byte, []*covidshield.TemporaryExposureKey, context.Context) error); ok {
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(*[32]byte, []*covidshield.TemporaryExposureKey, context.Context) int64); ok {
 		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 int64
+	if rf, ok := ret.Get(1).(func(*[32]byte, []*covidshield.TemporaryExposureKey, context.Context) int64); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Get(1).(int64)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(*[32]byte, []*covidshield.TemporaryExposureKey, context.Context) error); ok {
+		r2 = rf(_a0, _a1, _a2)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// StreamKeysForHours provides a mock function with given fields: _a0, _a1, _a2, _a3, _a4
+func (_m *Conn) StreamKeysForHours(_a0 string, _a1 uint32, _a2 uint32, _a3 int32, _a4 func(*covidshield.TemporaryExposureKey) error) error {
+	ret := _m.Called(_a0, _a1, _a2, _a3, _a4)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, uint32, uint32, int32, func(*covidshield.TemporaryExposureKey) error) error); ok {
+		r0 = rf(_a0, _a1, _a2, _a3, _a4)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Warmup provides a mock function with given fields: ctx
+func (_m *Conn) Warmup(ctx context.Context) error {
+	ret := _m.Called(ctx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -1,13 +1,17 @@
 package app
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/Shopify/goose/genmain"
 	"github.com/Shopify/goose/logger"
 	"github.com/Shopify/goose/srvutil"
+	"github.com/sirupsen/logrus"
 
 	"github.com/cds-snc/covid-alert-server/pkg/config"
 	"github.com/cds-snc/covid-alert-server/pkg/keyclaim"
@@ -35,15 +39,23 @@ type AppBuilder struct {
 
 func NewBuilder() *AppBuilder {
 	config.InitConfig() // read configuration into a structure
+	configureLogFormat(config.AppConstants.LogFormat)
+	logrus.AddHook(redactKeyMaterialHook{})
 
 	lookup = keyclaim.NewAuthenticator()
-	persistence.SetupLookup(lookup)
+	if legacy := keyclaim.NewLegacyAuthenticator(); legacy != nil {
+		persistence.SetupLookups(lookup, legacy)
+	} else {
+		persistence.SetupLookup(lookup)
+	}
 
 	builder := &AppBuilder{
 		defaultServerPort: config.AppConstants.DefaultServerPort,
 		database:          newDatabase(DatabaseURL()),
 	}
 	builder.servlets = append(builder.servlets, server.NewServicesServlet())
+	builder.servlets = append(builder.servlets, server.NewMaintenanceServlet(builder.database, lookup))
+	builder.servlets = append(builder.servlets, server.NewConfigServlet(lookup))
 	return builder
 }
 
@@ -61,28 +73,72 @@ func checkEnvironmentVariable(key string) {
 }
 
 func (a *AppBuilder) WithSubmission() *AppBuilder {
+	if config.AppConstants.AutoMigrate {
+		migrateDB(DatabaseURL())
+	}
+
+	if path := config.AppConstants.SeedServerKeypairsFile; path != "" {
+		log(nil, nil).Warn("seeding server keypairs, which should not be enabled in production")
+		fatalIfErr(seedServerKeypairs(context.Background(), a.database, path), "could not seed server keypairs")
+	}
 
 	a.defaultServerPort = config.AppConstants.DefaultSubmissionServerPort
 
-	a.servlets = append(a.servlets, server.NewUploadServlet(a.database))
+	a.servlets = append(a.servlets, server.NewUploadServlet(a.database, newKeyResolver(a.database)))
 	a.servlets = append(a.servlets, server.NewKeyClaimServlet(a.database, lookup))
+	if config.AppConstants.RequireKeyPromotion {
+		a.servlets = append(a.servlets, server.NewKeyPromotionServlet(a.database, lookup))
+	}
+	reloadUploadRegionsOnHangup()
+
+	if config.AppConstants.EnableValidateEndpoint {
+		log(nil, nil).Warn("registering /validate, which should not be enabled in production")
+		a.servlets = append(a.servlets, server.NewValidateServlet())
+	}
 
 	return a
 }
 
+// reloadUploadRegionsOnHangup re-reads uploadEnabledRegions from config.yaml
+// each time the process is sent a SIGHUP
+func reloadUploadRegionsOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			regions, err := config.ReloadStringSlice("uploadEnabledRegions")
+			if err != nil {
+				log(nil, err).Warn("unable to reload uploadEnabledRegions")
+				continue
+			}
+			server.SetUploadEnabledRegions(context.Background(), regions)
+		}
+	}()
+}
+
 func (a *AppBuilder) WithRetrieval() *AppBuilder {
 	migrateDB(DatabaseURL()) // This is a bit of a weird place for this but it works for now.
 
 	a.defaultServerPort = config.AppConstants.DefaultRetrievalServerPort
 
 	a.components = append(a.components, newExpirationWorker(a.database))
+	a.components = append(a.components, newTableRowCountsWorker(a.database))
+	if config.AppConstants.WorkerReconcileUploadsInterval > 0 {
+		a.components = append(a.components, newUploadReconciliationWorker(a.database))
+	}
+	if url := os.Getenv("EVENTS_EXPORT_URL"); url != "" {
+		a.components = append(a.components, newEventsExportWorker(a.database, url, os.Getenv("EVENTS_EXPORT_TOKEN")))
+	}
 
-	a.servlets = append(a.servlets, server.NewRetrieveServlet(a.database, retrieval.NewAuthenticator(), retrieval.NewSigner()))
+	retrieveAuth := retrieval.NewAuthenticator()
+	a.servlets = append(a.servlets, server.NewRetrieveServlet(a.database, retrieveAuth, retrieval.NewSigner()))
+	a.servlets = append(a.servlets, server.NewNotificationEventServlet(a.database, retrieveAuth))
 
 	//Check Metric existence ENV Variables
 	checkEnvironmentVariable("METRICS_USERNAME")
 	checkEnvironmentVariable("METRICS_PASSWORD")
 	a.servlets = append(a.servlets, server.NewMetricsServlet(a.database, lookup))
+	a.servlets = append(a.servlets, server.NewKeyCleanupServlet(a.database, lookup))
 
 	return a
 }
@@ -95,6 +151,9 @@ func (a *AppBuilder) WithDefaultPort() *AppBuilder {
 func (a *AppBuilder) Build() (*App, persistence.Conn) {
 	a.components = append(a.components, server.New(bindAddr(a.defaultServerPort), a.servlets))
 
+	warmupTimeout := time.Duration(config.AppConstants.WarmupTimeoutSeconds) * time.Second
+	go warmUp(a.database, warmupTimeout, server.MarkReady)
+
 	main := genmain.New(a.components...)
 	main.SetShutdownDeadline(time.Duration(1) * time.Second)
 	return &App{&main}, a.database
@@ -115,6 +174,17 @@ func newDatabase(dbURL string) persistence.Conn {
 	return db
 }
 
+// newKeyResolver reads server private keys straight from the database unless
+// KMS_DECRYPT_URL is set, in which case the stored keys are KMS-wrapped and
+// are decrypted through that endpoint.
+func newKeyResolver(db persistence.Conn) persistence.KeyResolver {
+	url := os.Getenv("KMS_DECRYPT_URL")
+	if url == "" {
+		return db
+	}
+	return persistence.NewKMSKeyResolver(db, persistence.NewHTTPDecrypter(url))
+}
+
 func bindAddr(defaultPort uint32) string {
 	if bindAddr := os.Getenv("BIND_ADDR"); bindAddr != "" {
 		return bindAddr
@@ -131,6 +201,24 @@ func newExpirationWorker(db persistence.Conn) workers.Worker {
 	return worker
 }
 
+func newTableRowCountsWorker(db persistence.Conn) workers.Worker {
+	worker, err := workers.StartTableRowCountsWorker(db)
+	fatalIfErr(err, "failed to do initial run of table row counts worker")
+	return worker
+}
+
+func newUploadReconciliationWorker(db persistence.Conn) workers.Worker {
+	worker, err := workers.StartUploadReconciliationWorker(db)
+	fatalIfErr(err, "failed to create upload reconciliation worker")
+	return worker
+}
+
+func newEventsExportWorker(db persistence.Conn, url, token string) workers.Worker {
+	worker, err := workers.StartEventsExportWorker(db, url, token)
+	fatalIfErr(err, "failed to create events export worker")
+	return worker
+}
+
 func fatalIfErr(err error, msg string) {
 	if err != nil {
 		log(nil, err).Fatal(msg)
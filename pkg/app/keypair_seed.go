@@ -0,0 +1,89 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/persistence"
+	"golang.org/x/crypto/curve25519"
+)
+
+// keypairSeedFile is the JSON format of seedServerKeypairsFile: a list of
+// hex-encoded NaCl box keypairs
+type keypairSeedFile []struct {
+	ServerPublicKey  string `json:"serverPublicKey"`
+	ServerPrivateKey string `json:"serverPrivateKey"`
+	AppPublicKey     string `json:"appPublicKey"`
+	Region           string `json:"region"`
+}
+
+// loadKeypairSeeds reads and checks the keypairs in path. Every server
+// private key must match its public key, so a typo can't seed a keypair that
+// no upload could ever be decrypted with.
+func loadKeypairSeeds(path string) ([]persistence.KeypairSeed, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file keypairSeedFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	seeds := make([]persistence.KeypairSeed, 0, len(file))
+	for i, entry := range file {
+		seed := persistence.KeypairSeed{Region: entry.Region}
+		if seed.Region == "" {
+			seed.Region = config.AppConstants.RegionCode
+		}
+		if seed.ServerPublicKey, err = hex.DecodeString(entry.ServerPublicKey); err != nil {
+			return nil, fmt.Errorf("keypair %d: invalid serverPublicKey: %v", i, err)
+		}
+		if seed.ServerPrivateKey, err = hex.DecodeString(entry.ServerPrivateKey); err != nil {
+			return nil, fmt.Errorf("keypair %d: invalid serverPrivateKey: %v", i, err)
+		}
+		if entry.AppPublicKey != "" {
+			if seed.AppPublicKey, err = hex.DecodeString(entry.AppPublicKey); err != nil {
+				return nil, fmt.Errorf("keypair %d: invalid appPublicKey: %v", i, err)
+			}
+		}
+		if len(seed.ServerPrivateKey) != 32 || len(seed.ServerPublicKey) != 32 {
+			return nil, fmt.Errorf("keypair %d: keys must be 32 bytes", i)
+		}
+
+		var priv, pub [32]byte
+		copy(priv[:], seed.ServerPrivateKey)
+		curve25519.ScalarBaseMult(&pub, &priv)
+		if !bytes.Equal(pub[:], seed.ServerPublicKey) {
+			return nil, fmt.Errorf("keypair %d: serverPrivateKey does not match serverPublicKey", i)
+		}
+		seeds = append(seeds, seed)
+	}
+	return seeds, nil
+}
+
+// seedServerKeypairs creates any of the keypairs in path that don't exist
+// yet, so dev and test environments start with known keys
+func seedServerKeypairs(ctx context.Context, db persistence.Conn, path string) error {
+	seeds, err := loadKeypairSeeds(path)
+	if err != nil {
+		return err
+	}
+	created := 0
+	for _, seed := range seeds {
+		ok, err := db.SeedServerKeypair(ctx, seed)
+		if err != nil {
+			return err
+		}
+		if ok {
+			created++
+		}
+	}
+	log(ctx, nil).WithField("keypairs", len(seeds)).WithField("created", created).Info("seeded server keypairs")
+	return nil
+}
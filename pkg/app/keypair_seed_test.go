@@ -0,0 +1,77 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	persistence "github.com/cds-snc/covid-alert-server/mocks/pkg/persistence"
+	persist "github.com/cds-snc/covid-alert-server/pkg/persistence"
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func writeSeedFile(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "keypair-seed")
+	assert.Nil(t, err)
+	path := filepath.Join(dir, "keypairs.json")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(contents), 0600))
+	return path
+}
+
+func TestSeedServerKeypairs(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	appPub, _, _ := box.GenerateKey(rand.Reader)
+	path := writeSeedFile(t, fmt.Sprintf(`[{"serverPublicKey": %q, "serverPrivateKey": %q, "appPublicKey": %q, "region": "ON"}]`,
+		hex.EncodeToString(pub[:]), hex.EncodeToString(priv[:]), hex.EncodeToString(appPub[:])))
+	defer os.RemoveAll(filepath.Dir(path))
+
+	expected := persist.KeypairSeed{ServerPublicKey: pub[:], ServerPrivateKey: priv[:], AppPublicKey: appPub[:], Region: "ON"}
+	db := &persistence.Conn{}
+	db.On("SeedServerKeypair", mock.Anything, expected).Return(true, nil).Once()
+	db.On("SeedServerKeypair", mock.Anything, expected).Return(false, nil).Once()
+
+	assert.Nil(t, seedServerKeypairs(context.Background(), db, path))
+	entry := hook.LastEntry()
+	assert.Equal(t, logrus.InfoLevel, entry.Level)
+	assert.Equal(t, "seeded server keypairs", entry.Message)
+	assert.Equal(t, 1, entry.Data["created"])
+
+	// Idempotent: the second startup finds the keypair already there
+	assert.Nil(t, seedServerKeypairs(context.Background(), db, path))
+	assert.Equal(t, 0, hook.LastEntry().Data["created"])
+	db.AssertNumberOfCalls(t, "SeedServerKeypair", 2)
+}
+
+func TestLoadKeypairSeeds_Invalid(t *testing.T) {
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	otherPub, _, _ := box.GenerateKey(rand.Reader)
+
+	for contents, expected := range map[string]string{
+		`not json`: "invalid character",
+		fmt.Sprintf(`[{"serverPublicKey": %q, "serverPrivateKey": "zz"}]`, hex.EncodeToString(pub[:])):                                 "keypair 0: invalid serverPrivateKey",
+		fmt.Sprintf(`[{"serverPublicKey": %q, "serverPrivateKey": "abcd"}]`, hex.EncodeToString(pub[:])):                               "keypair 0: keys must be 32 bytes",
+		fmt.Sprintf(`[{"serverPublicKey": %q, "serverPrivateKey": %q}]`, hex.EncodeToString(otherPub[:]), hex.EncodeToString(priv[:])): "keypair 0: serverPrivateKey does not match serverPublicKey",
+	} {
+		path := writeSeedFile(t, contents)
+		_, err := loadKeypairSeeds(path)
+		os.RemoveAll(filepath.Dir(path))
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), expected)
+		}
+	}
+
+	_, err := loadKeypairSeeds("/nonexistent/keypairs.json")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// configureLogFormat sets the formatter used by every goose logger, which all
+// write through the logrus standard logger. JSON is what log ingestion
+// expects; text is easier to read when running locally.
+func configureLogFormat(format string) {
+	switch strings.ToLower(format) {
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case "json", "":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+		log(nil, nil).WithField("logFormat", format).Warn("unknown log format, using json")
+	}
+}
+
+// redactKeyMaterialHook replaces log fields that look like raw key material
+// (16 byte TEKs, 24 byte nonces, 32 byte NaCl keys) before they are
+// formatted, so a stray WithField of key bytes can't end up in the logs.
+// Only the field's type and length are checked, which keeps ordinary fields
+// cheap.
+type redactKeyMaterialHook struct{}
+
+const redacted = "[REDACTED]"
+
+func (redactKeyMaterialHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (redactKeyMaterialHook) Fire(entry *logrus.Entry) error {
+	var data logrus.Fields
+	for k, v := range entry.Data {
+		if !looksLikeKeyMaterial(v) {
+			continue
+		}
+		// entry.Data may be shared with the entry the caller holds, so only
+		// the copy being logged is changed
+		if data == nil {
+			data = make(logrus.Fields, len(entry.Data))
+			for k, v := range entry.Data {
+				data[k] = v
+			}
+		}
+		data[k] = redacted
+	}
+	if data != nil {
+		entry.Data = data
+	}
+	return nil
+}
+
+func looksLikeKeyMaterial(v interface{}) bool {
+	switch b := v.(type) {
+	case []byte:
+		return len(b) == 16 || len(b) == 24 || len(b) == 32
+	case [16]byte, [24]byte, [32]byte, *[16]byte, *[24]byte, *[32]byte:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package app
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigureLogFormat(t *testing.T) {
+
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	oldFormatter := logrus.StandardLogger().Formatter
+	defer logrus.SetFormatter(oldFormatter)
+
+	configureLogFormat("text")
+	assert.IsType(t, &logrus.TextFormatter{}, logrus.StandardLogger().Formatter)
+
+	configureLogFormat("json")
+	assert.IsType(t, &logrus.JSONFormatter{}, logrus.StandardLogger().Formatter)
+
+	configureLogFormat("TEXT")
+	assert.IsType(t, &logrus.TextFormatter{}, logrus.StandardLogger().Formatter)
+
+	configureLogFormat("")
+	assert.IsType(t, &logrus.JSONFormatter{}, logrus.StandardLogger().Formatter)
+
+	configureLogFormat("xml")
+	assert.IsType(t, &logrus.JSONFormatter{}, logrus.StandardLogger().Formatter)
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "unknown log format, using json")
+}
+
+func TestRedactKeyMaterialHook(t *testing.T) {
+
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.AddHook(redactKeyMaterialHook{})
+
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = 0xab
+	}
+	entry := logger.WithField("key", key).WithField("region", "302").WithField("short", []byte{1, 2})
+	entry.Info("test")
+
+	assert.Contains(t, out.String(), `"key":"[REDACTED]"`)
+	assert.Contains(t, out.String(), `"region":"302"`)
+	assert.Contains(t, out.String(), `"short":"AQI="`)
+	assert.Equal(t, key, entry.Data["key"], "the caller's entry should not be modified")
+}
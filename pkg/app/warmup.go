@@ -0,0 +1,33 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/persistence"
+)
+
+// warmUp opens the idle database connections up front so that the first
+// requests after a deploy don't each pay for a fresh connection, then calls
+// markReady. Warmup is best effort: if it fails or runs past timeout we log
+// and report ready anyway rather than keep the instance out of rotation.
+func warmUp(db persistence.Conn, timeout time.Duration, markReady func()) {
+	defer markReady()
+
+	if timeout <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := db.Warmup(ctx); err != nil {
+		log(ctx, err).Warn("database warmup did not complete")
+		return
+	}
+
+	// The originator lookup is built from KEY_CLAIM_TOKEN when the servlets
+	// are constructed, so it is already primed by the time we get here.
+	log(ctx, nil).WithField("duration", time.Since(start)).Info("warmup complete")
+}
@@ -0,0 +1,83 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	persistence "github.com/cds-snc/covid-alert-server/mocks/pkg/persistence"
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestWarmUp_NotReadyUntilComplete(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	release := make(chan struct{})
+	db := &persistence.Conn{}
+	db.On("Warmup", mock.Anything).Run(func(mock.Arguments) { <-release }).Return(nil)
+
+	ready := make(chan struct{})
+	go warmUp(db, time.Minute, func() { close(ready) })
+
+	select {
+	case <-ready:
+		t.Fatal("reported ready before warmup completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("not ready after warmup completed")
+	}
+
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "warmup complete")
+}
+
+func TestWarmUp_Failure(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db := &persistence.Conn{}
+	db.On("Warmup", mock.Anything).Return(fmt.Errorf("connection refused"))
+
+	ready := false
+	warmUp(db, time.Minute, func() { ready = true })
+
+	assert.True(t, ready, "failed warmup still reports ready")
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "database warmup did not complete")
+}
+
+func TestWarmUp_Timeout(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db := &persistence.Conn{}
+	db.On("Warmup", mock.Anything).Return(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	ready := false
+	warmUp(db, 10*time.Millisecond, func() { ready = true })
+
+	assert.True(t, ready, "timed out warmup still reports ready")
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "database warmup did not complete")
+}
+
+func TestWarmUp_Disabled(t *testing.T) {
+	db := &persistence.Conn{}
+
+	ready := false
+	warmUp(db, 0, func() { ready = true })
+
+	assert.True(t, ready)
+	db.AssertNotCalled(t, "Warmup", mock.Anything)
+}
@@ -27,6 +27,85 @@ type Constants struct {
 	EnableEntirePeriodBundle           bool
 	RegionCode                         string
 	EventQueryRangeDates               int
+	KeyDataLength                      int
+	RecordServerEvents                 bool
+	MinimumAppVersion                  string
+	RejectMissingAppVersion            bool
+	AllowMissingTransmissionRisk       bool
+	MaxRetrieveRegions                 int
+	WorkerTableRowCountsInterval       uint32
+	MaxUploadPayloadBytes              int
+	ConsumedKeypairGraceSeconds        uint32
+	AllowedReportTypes                 []string
+	MaxConcurrentStoreKeys             int
+	StoreKeysWaitMilliseconds          uint32
+	AllowedCohorts                     []string
+	DBCircuitBreakerFailures           int
+	DBCircuitBreakerCooldownSeconds    uint32
+	DBConnRetryAttempts                int
+	DBConnRetryBackoffMilliseconds     uint32
+	DBStatementTimeoutMilliseconds     uint32
+	LogFormat                          string
+	UploadMaxPastSkew                  uint32
+	UploadMaxFutureSkew                uint32
+	WarmupTimeoutSeconds               uint32
+	UploadErrorStatuses                []string
+	MaxDistinctOriginatorsPerDay       int
+	DiagnosisKeyRetentionDaysByRegion  []string
+	UploadMaxKeyTimestampSkew          uint32
+	MinKeysInUpload                    int
+	StreamRetrieveExport               bool
+	MaxAppKeysPerOriginatorPerDay      int
+	RejectAppKeysOverCap               bool
+	MaintenanceMode                    bool
+	MaintenanceRetryAfterSeconds       uint32
+	MaintenanceBlocksRetrieve          bool
+	MinKeysInUploadByDeviceType        []string
+	MaxKeysInUploadByDeviceType        []string
+	UploadMaxPastSkewByDeviceType      []string
+	UploadMaxFutureSkewByDeviceType    []string
+	RecordRawOriginator                bool
+	UploadCooldownSeconds              uint32
+	AllowedServerPublicKeys            []string
+	AutoMigrate                        bool
+	EventAggregationBucket             string
+	RequestLogLevel                    string
+	RequestLogLevels                   []string
+	EnableValidateEndpoint             bool
+	LocalTimeSkewToleranceSeconds      uint32
+	MaxConnections                     int
+	DebugUploadOriginatorRegion        bool
+	RequireKeyPromotion                bool
+	UploadSkewLogThresholdSeconds      uint32
+	AcceptEmptyUploads                 bool
+	UploadFutureKeyGraceIntervals      uint32
+	UploadEnabledRegions               []string
+	StrictUploadUnmarshal              bool
+	RecordUploadRejections             bool
+	MaxKeyAgeDays                      uint32
+	NegotiateExportFormat              bool
+	EnableRetrieveDateRange            bool
+	SeedServerKeypairsFile             string
+	MaskOriginatorInLogs               bool
+	WorkerReconcileUploadsInterval     uint32
+	UploadCountDriftThreshold          int64
+	AutoDenylistReasons                []string
+	AutoDenylistThreshold              int
+	AutoDenylistWindowSeconds          uint32
+	AutoDenylistCooldownSeconds        uint32
+	AnswerUploadOptions                bool
+	DefaultTransmissionRiskLevel       int32
+	TLSMinVersion                      string
+	TLSCipherSuites                    []string
+	MaxKeysPerKeypair                  uint32
+	DeniedRollingPeriods               []int32
+	WorkerExportEventsInterval         uint32
+	EventsExportAttempts               int
+	EventsExportRetryBackoffSeconds    uint32
+	RequireSingleReportType            bool
+	DualWriteEventsTable               string
+	MaxNotificationShownCount          int
+	RetrieveRegions                    []string
 }
 
 var AppConstants Constants
@@ -39,6 +118,23 @@ func InitConfig() {
 	viper.AddConfigPath(*configFilePath)
 	viper.SetConfigType("yaml")
 	setDefaults()
+	// allow deployments to restrict report types without shipping a config.yaml
+	_ = viper.BindEnv("allowedReportTypes", "ALLOWED_REPORT_TYPES")
+	_ = viper.BindEnv("maintenanceMode", "MAINTENANCE_MODE")
+	_ = viper.BindEnv("allowedCohorts", "ALLOWED_COHORTS")
+	_ = viper.BindEnv("allowedServerPublicKeys", "ALLOWED_SERVER_PUBLIC_KEYS")
+	_ = viper.BindEnv("autoMigrate", "AUTO_MIGRATE")
+	_ = viper.BindEnv("enableValidateEndpoint", "ENABLE_VALIDATE_ENDPOINT")
+	_ = viper.BindEnv("maxConnections", "MAX_CONNECTIONS")
+	_ = viper.BindEnv("requireKeyPromotion", "REQUIRE_KEY_PROMOTION")
+	_ = viper.BindEnv("logFormat", "LOG_FORMAT")
+	_ = viper.BindEnv("uploadMaxPastSkew", "UPLOAD_MAX_PAST_SKEW")
+	_ = viper.BindEnv("uploadMaxFutureSkew", "UPLOAD_MAX_FUTURE_SKEW")
+	_ = viper.BindEnv("uploadErrorStatuses", "UPLOAD_ERROR_STATUSES")
+	_ = viper.BindEnv("maxKeyAgeDays", "MAX_KEY_AGE_DAYS")
+	_ = viper.BindEnv("seedServerKeypairsFile", "SEED_SERVER_KEYPAIRS_FILE")
+	_ = viper.BindEnv("dbStatementTimeoutMilliseconds", "DB_STATEMENT_TIMEOUT")
+	_ = viper.BindEnv("maxKeysPerKeypair", "MAX_KEYS_PER_KEYPAIR")
 	if err := viper.ReadInConfig(); err != nil {
 		log(nil, err).Fatal("Error reading application configuration file")
 	}
@@ -48,6 +144,16 @@ func InitConfig() {
 	}
 }
 
+// ReloadStringSlice re-reads the config file and returns the current value
+// of key, for the few settings that can be changed without a restart.
+// AppConstants keeps the values read at startup.
+func ReloadStringSlice(key string) ([]string, error) {
+	if err := viper.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	return viper.GetStringSlice(key), nil
+}
+
 func setDefaults() {
 	viper.SetDefault("defaultSubmissionServerPort", 8000)
 	viper.SetDefault("defaultRetrievalServerPort", 8001)
@@ -67,4 +173,84 @@ func setDefaults() {
 	/// The MCC Region Code for Canada
 	viper.SetDefault("regionCode", "302")
 	viper.SetDefault("eventQueryRangeDates", 10)
+	/// The Exposure Notification standard TEK length
+	viper.SetDefault("keyDataLength", 16)
+	viper.SetDefault("recordServerEvents", true)
+	viper.SetDefault("minimumAppVersion", "")
+	viper.SetDefault("rejectMissingAppVersion", false)
+	viper.SetDefault("allowMissingTransmissionRisk", false)
+	viper.SetDefault("maxRetrieveRegions", 5)
+	viper.SetDefault("workerTableRowCountsInterval", 300)
+	viper.SetDefault("maxUploadPayloadBytes", 1024)
+	viper.SetDefault("consumedKeypairGraceSeconds", 300)
+	viper.SetDefault("allowedReportTypes", []string{})
+	viper.SetDefault("maxConcurrentStoreKeys", 0)
+	viper.SetDefault("storeKeysWaitMilliseconds", 2000)
+	viper.SetDefault("allowedCohorts", []string{})
+	viper.SetDefault("dbCircuitBreakerFailures", 5)
+	viper.SetDefault("dbCircuitBreakerCooldownSeconds", 30)
+	viper.SetDefault("dbConnRetryAttempts", 2)
+	viper.SetDefault("dbConnRetryBackoffMilliseconds", 100)
+	viper.SetDefault("dbStatementTimeoutMilliseconds", 0)
+	viper.SetDefault("logFormat", "json")
+	viper.SetDefault("uploadMaxPastSkew", 3600)
+	viper.SetDefault("uploadMaxFutureSkew", 3600)
+	viper.SetDefault("warmupTimeoutSeconds", 10)
+	viper.SetDefault("uploadErrorStatuses", []string{})
+	viper.SetDefault("maxDistinctOriginatorsPerDay", 0)
+	viper.SetDefault("diagnosisKeyRetentionDaysByRegion", []string{})
+	viper.SetDefault("uploadMaxKeyTimestampSkew", 0)
+	viper.SetDefault("minKeysInUpload", 1)
+	viper.SetDefault("streamRetrieveExport", false)
+	viper.SetDefault("maxAppKeysPerOriginatorPerDay", 0)
+	viper.SetDefault("rejectAppKeysOverCap", false)
+	viper.SetDefault("maintenanceMode", false)
+	viper.SetDefault("maintenanceRetryAfterSeconds", 300)
+	viper.SetDefault("maintenanceBlocksRetrieve", false)
+	viper.SetDefault("minKeysInUploadByDeviceType", []string{})
+	viper.SetDefault("maxKeysInUploadByDeviceType", []string{})
+	viper.SetDefault("uploadMaxPastSkewByDeviceType", []string{})
+	viper.SetDefault("uploadMaxFutureSkewByDeviceType", []string{})
+	viper.SetDefault("recordRawOriginator", false)
+	viper.SetDefault("uploadCooldownSeconds", 0)
+	viper.SetDefault("allowedServerPublicKeys", []string{})
+	viper.SetDefault("autoMigrate", false)
+	viper.SetDefault("eventAggregationBucket", "day")
+	viper.SetDefault("requestLogLevel", "info")
+	viper.SetDefault("requestLogLevels", []string{})
+	viper.SetDefault("enableValidateEndpoint", false)
+	viper.SetDefault("localTimeSkewToleranceSeconds", 0)
+	viper.SetDefault("uploadSkewLogThresholdSeconds", 0)
+	viper.SetDefault("maxConnections", 0)
+	viper.SetDefault("debugUploadOriginatorRegion", false)
+	viper.SetDefault("requireKeyPromotion", false)
+	viper.SetDefault("acceptEmptyUploads", false)
+	viper.SetDefault("uploadFutureKeyGraceIntervals", 0)
+	viper.SetDefault("maxKeyAgeDays", 0)
+	viper.SetDefault("negotiateExportFormat", false)
+	viper.SetDefault("enableRetrieveDateRange", false)
+	viper.SetDefault("seedServerKeypairsFile", "")
+	viper.SetDefault("maskOriginatorInLogs", false)
+	viper.SetDefault("workerReconcileUploadsInterval", 0)
+	viper.SetDefault("uploadCountDriftThreshold", 0)
+	viper.SetDefault("autoDenylistReasons", []string{})
+	viper.SetDefault("autoDenylistThreshold", 10)
+	viper.SetDefault("autoDenylistWindowSeconds", 300)
+	viper.SetDefault("autoDenylistCooldownSeconds", 3600)
+	viper.SetDefault("answerUploadOptions", false)
+	viper.SetDefault("defaultTransmissionRiskLevel", 0)
+	viper.SetDefault("tlsMinVersion", "1.2")
+	viper.SetDefault("tlsCipherSuites", []string{})
+	viper.SetDefault("maxKeysPerKeypair", 0)
+	viper.SetDefault("deniedRollingPeriods", []int32{})
+	viper.SetDefault("workerExportEventsInterval", 86400)
+	viper.SetDefault("eventsExportAttempts", 3)
+	viper.SetDefault("eventsExportRetryBackoffSeconds", 30)
+	viper.SetDefault("requireSingleReportType", false)
+	viper.SetDefault("dualWriteEventsTable", "")
+	viper.SetDefault("maxNotificationShownCount", 20)
+	viper.SetDefault("retrieveRegions", []string{})
+	viper.SetDefault("uploadEnabledRegions", []string{})
+	viper.SetDefault("strictUploadUnmarshal", false)
+	viper.SetDefault("recordUploadRejections", false)
 }
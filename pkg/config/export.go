@@ -0,0 +1,89 @@
+package config
+
+import (
+	"os"
+	"reflect"
+)
+
+// Redacted replaces the value of secret settings in Export
+const Redacted = "[REDACTED]"
+
+// exportedEnv lists the environment variables read outside of viper, and
+// whether their value can be shown. Variables not listed here are left out
+// of Export entirely, so a new secret is never shown until someone decides
+// it's safe to.
+var exportedEnv = map[string]bool{
+	"ADMIN_CLIENT_CA_FILE":        true,
+	"ADMIN_TOKEN":                 false,
+	"BIND_ADDR":                   true,
+	"DATABASE_URL":                false,
+	"DB_MAX_IDLE_CONNS":           true,
+	"DB_READ_URL":                 false,
+	"ECDSA_ACTIVE_KEY_VERSION":    true,
+	"ECDSA_KEY":                   false,
+	"ECDSA_KEYS":                  false,
+	"ENABLE_TEST_TOOLS":           true,
+	"ENV":                         true,
+	"EVENTS_DUAL_WRITE_URL":       false,
+	"EVENTS_EXPORT_TOKEN":         false,
+	"EVENTS_EXPORT_URL":           false,
+	"KEY_CLAIM_TOKEN":             false,
+	"KMS_DECRYPT_URL":             false,
+	"LEGACY_KEY_CLAIM_TOKEN":      false,
+	"METRIC_PROVIDER":             true,
+	"METRICS_BEARER_TOKEN":        false,
+	"METRICS_LISTEN_ADDR":         true,
+	"METRICS_PASSWORD":            false,
+	"METRICS_USERNAME":            false,
+	"OTEL_EXPORTER_OTLP_ENDPOINT": true,
+	"OTEL_EXPORTER_OTLP_INSECURE": true,
+	"PORT":                        true,
+	"RETRIEVE_HMAC_KEY":           false,
+	"ROUTE_PREFIX":                true,
+	"TLS_CERT_FILE":               true,
+	"TLS_KEY_FILE":                true,
+	"TRACER_PROVIDER":             true,
+}
+
+// Export returns the resolved configuration for display: every field of
+// AppConstants, and the environment variables in exportedEnv. Fields tagged
+// `secret:"true"` and secret variables are replaced with Redacted when set.
+func Export() map[string]interface{} {
+	env := make(map[string]string, len(exportedEnv))
+	for name, public := range exportedEnv {
+		env[name] = redact(os.Getenv(name), !public)
+	}
+	return map[string]interface{}{
+		"constants":   exportFields(AppConstants),
+		"environment": env,
+	}
+}
+
+func exportFields(v interface{}) map[string]interface{} {
+	rv := reflect.ValueOf(v)
+	rt := rv.Type()
+	fields := make(map[string]interface{}, rt.NumField())
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		if f.Tag.Get("secret") == "true" {
+			fields[f.Name] = ""
+			if !rv.Field(i).IsZero() {
+				fields[f.Name] = Redacted
+			}
+			continue
+		}
+		fields[f.Name] = rv.Field(i).Interface()
+	}
+	return fields
+}
+
+// redact hides a secret value, but still shows whether it was set at all
+func redact(value string, secret bool) string {
+	if secret && value != "" {
+		return Redacted
+	}
+	return value
+}
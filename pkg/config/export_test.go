@@ -0,0 +1,58 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExport(t *testing.T) {
+	for name, value := range map[string]string{
+		"DATABASE_URL":      "user:hunter2@tcp(db:3306)/covidshield",
+		"RETRIEVE_HMAC_KEY": "abcdef0123456789",
+		"BIND_ADDR":         "127.0.0.1",
+		"NOT_EXPORTED":      "hunter2",
+	} {
+		old, set := os.LookupEnv(name)
+		os.Setenv(name, value)
+		defer func(name string) {
+			if set {
+				os.Setenv(name, old)
+			} else {
+				os.Unsetenv(name)
+			}
+		}(name)
+	}
+	os.Unsetenv("KEY_CLAIM_TOKEN")
+
+	oldConstants := AppConstants
+	defer func() { AppConstants = oldConstants }()
+	AppConstants.RegionCode = "302"
+
+	exported := Export()
+	env := exported["environment"].(map[string]string)
+	assert.Equal(t, Redacted, env["DATABASE_URL"])
+	assert.Equal(t, Redacted, env["RETRIEVE_HMAC_KEY"])
+	assert.Equal(t, "", env["KEY_CLAIM_TOKEN"], "unset secrets show as unset")
+	assert.Equal(t, "127.0.0.1", env["BIND_ADDR"])
+	assert.NotContains(t, env, "NOT_EXPORTED")
+
+	constants := exported["constants"].(map[string]interface{})
+	assert.Equal(t, "302", constants["RegionCode"])
+}
+
+func TestExportFieldsRedactsSecretTag(t *testing.T) {
+	fields := exportFields(struct {
+		Name     string
+		Password string `secret:"true"`
+		Token    string `secret:"true"`
+		limit    int
+	}{Name: "covidshield", Password: "hunter2"})
+
+	assert.Equal(t, map[string]interface{}{
+		"Name":     "covidshield",
+		"Password": Redacted,
+		"Token":    "",
+	}, fields)
+}
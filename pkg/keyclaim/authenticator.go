@@ -2,6 +2,7 @@ package keyclaim
 
 import (
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/cds-snc/covid-alert-server/pkg/config"
@@ -10,6 +11,7 @@ import (
 type Authenticator interface {
 	Authenticate(string) (string, bool)
 	RegionFromAuthHeader(string) (string, string, bool)
+	Regions() []string
 }
 
 type authenticator struct {
@@ -20,16 +22,32 @@ type authenticator struct {
 // These are two keys with region IDs 1 and 2 respectively. Keys should be much
 // longer than this but still hexadecimal.
 func NewAuthenticator() Authenticator {
+	return newAuthenticator("KEY_CLAIM_TOKEN")
+}
+
+// NewLegacyAuthenticator returns an Authenticator for the tokens in
+// LEGACY_KEY_CLAIM_TOKEN, in the same format as KEY_CLAIM_TOKEN, or nil if it
+// isn't set. While token schemes are migrated, it is the fallback originator
+// lookup for tokens KEY_CLAIM_TOKEN no longer maps. It doesn't authenticate
+// requests.
+func NewLegacyAuthenticator() Authenticator {
+	if os.Getenv("LEGACY_KEY_CLAIM_TOKEN") == "" {
+		return nil
+	}
+	return newAuthenticator("LEGACY_KEY_CLAIM_TOKEN")
+}
+
+func newAuthenticator(env string) Authenticator {
 	authTokens := make(map[string]string)
-	tokens := os.Getenv("KEY_CLAIM_TOKEN")
+	tokens := os.Getenv(env)
 	if tokens == "" {
-		panic("no KEY_CLAIM_TOKEN")
+		panic("no " + env)
 	}
 	for _, tokenWithRegion := range strings.Split(tokens, ":") {
 		assignmentParts := config.AppConstants.AssignmentParts
 		parts := strings.SplitN(tokenWithRegion, "=", assignmentParts)
 		if len(parts) != assignmentParts {
-			panic("invalid KEY_CLAIM_TOKEN")
+			panic("invalid " + env)
 		}
 		if len(parts[0]) > 63 {
 			panic("token too long")
@@ -51,6 +69,20 @@ func (a *authenticator) Authenticate(token string) (string, bool) {
 	return region, ok
 }
 
+// Regions returns every region a token is mapped to, sorted
+func (a *authenticator) Regions() []string {
+	seen := make(map[string]bool)
+	var regions []string
+	for _, region := range a.tokens {
+		if !seen[region] {
+			seen[region] = true
+			regions = append(regions, region)
+		}
+	}
+	sort.Strings(regions)
+	return regions
+}
+
 // RegionFromAuthHeader authenticate using the Auth Header
 func (a *authenticator) RegionFromAuthHeader(header string) (string, string, bool) {
 	parts := strings.SplitN(header, " ", 2)
@@ -39,6 +39,20 @@ func TestNewAuthenticator(t *testing.T) {
 	assert.Equal(t, expected, NewAuthenticator(), "Returns an authenticator struct with a map of valid tokens and regions")
 }
 
+func TestNewLegacyAuthenticator(t *testing.T) {
+
+	os.Setenv("LEGACY_KEY_CLAIM_TOKEN", "")
+	defer os.Unsetenv("LEGACY_KEY_CLAIM_TOKEN")
+	assert.Nil(t, NewLegacyAuthenticator(), "No fallback lookup without LEGACY_KEY_CLAIM_TOKEN")
+
+	os.Setenv("LEGACY_KEY_CLAIM_TOKEN", "foobaz")
+	assert.PanicsWithValue(t, "invalid LEGACY_KEY_CLAIM_TOKEN", func() { NewLegacyAuthenticator() })
+
+	os.Setenv("LEGACY_KEY_CLAIM_TOKEN", strings.Repeat("d", 20)+"=QCApi")
+	expected := &authenticator{tokens: map[string]string{strings.Repeat("d", 20): "QCApi"}}
+	assert.Equal(t, expected, NewLegacyAuthenticator())
+}
+
 func TestAuthenticate(t *testing.T) {
 
 	// Initialise Authenticator object
@@ -59,3 +73,11 @@ func TestAuthenticate(t *testing.T) {
 	assert.Equal(t, expectedRegion, receivedRegion, "Expected region is nil on invalid token")
 	assert.Equal(t, expectedBool, receivedBool, "Expected bool is false on invalid token")
 }
+
+func TestRegions(t *testing.T) {
+
+	os.Setenv("KEY_CLAIM_TOKEN", strings.Repeat("a", 20)+"=ONApi:"+strings.Repeat("b", 20)+"=302:"+strings.Repeat("c", 20)+"=ONApi")
+	authenticator := NewAuthenticator()
+
+	assert.Equal(t, []string{"302", "ONApi"}, authenticator.Regions(), "Returns each region once, sorted")
+}
@@ -0,0 +1,68 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+)
+
+// ErrTooManyAppKeys is returned when claiming a key would take its originator
+// past maxAppKeysPerOriginatorPerDay and rejectAppKeysOverCap is set
+var ErrTooManyAppKeys = errors.New("originator exceeded daily app public key cap")
+
+// countAppKey records that originator registered an app public key on date
+// and returns how many it has registered that day. Claims reject app keys
+// that are already registered, so this is a count of distinct keys.
+func countAppKey(tx *sql.Tx, originator, date string) (int64, error) {
+	if _, err := tx.Exec(`
+		INSERT INTO originator_app_keys
+		(originator, date, count)
+		VALUES (?, ?, 1) ON DUPLICATE KEY UPDATE count = count + 1`,
+		originator, date); err != nil {
+		return 0, err
+	}
+
+	var count int64
+	if err := tx.QueryRow(
+		`SELECT count FROM originator_app_keys WHERE originator = ? AND date = ?`,
+		originator, date,
+	).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// checkAppKeyCap counts a newly claimed app public key against originator's
+// daily cap and logs an error for every claim past it, since one originator
+// minting far more keypairs than usual may be abusing its token. The claim
+// is only refused when rejectAppKeysOverCap is set.
+func checkAppKeyCap(ctx context.Context, tx *sql.Tx, originator string) error {
+	max := config.AppConstants.MaxAppKeysPerOriginatorPerDay
+	if max <= 0 {
+		return nil
+	}
+
+	count, err := countAppKey(tx, translateToken(originator), time.Now().UTC().Format("2006-01-02"))
+	if err != nil {
+		return err
+	}
+	if count <= int64(max) {
+		return nil
+	}
+
+	reject := config.AppConstants.RejectAppKeysOverCap
+	log(ctx, nil).WithFields(map[string]interface{}{
+		"originator": translateTokenForLogs(originator),
+		"count":      count,
+		"max":        max,
+		"rejected":   reject,
+	}).Error("originator exceeded daily app public key cap")
+
+	if reject {
+		return ErrTooManyAppKeys
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package persistence
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const countAppKeyInsert = `
+		INSERT INTO originator_app_keys
+		(originator, date, count)
+		VALUES (?, ?, 1) ON DUPLICATE KEY UPDATE count = count + 1`
+
+const countAppKeySelect = `SELECT count FROM originator_app_keys WHERE originator = ? AND date = ?`
+
+func expectCountAppKey(mock sqlmock.Sqlmock, count int64) {
+	date := time.Now().UTC().Format("2006-01-02")
+	mock.ExpectExec(countAppKeyInsert).WithArgs(onApi, date).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(countAppKeySelect).WithArgs(onApi, date).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+}
+
+func TestCheckAppKeyCap(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	oldMax := config.AppConstants.MaxAppKeysPerOriginatorPerDay
+	oldReject := config.AppConstants.RejectAppKeysOverCap
+	defer func() {
+		config.AppConstants.MaxAppKeysPerOriginatorPerDay = oldMax
+		config.AppConstants.RejectAppKeysOverCap = oldReject
+	}()
+	config.AppConstants.MaxAppKeysPerOriginatorPerDay = 2
+
+	ctx := context.Background()
+	mock.ExpectBegin()
+	tx, _ := db.Begin()
+
+	// At the cap: allowed silently
+	expectCountAppKey(mock, 2)
+	assert.Nil(t, checkAppKeyCap(ctx, tx, token1))
+	assert.Equal(t, 0, len(hook.Entries))
+
+	// Past the cap without rejection: allowed but alerted
+	expectCountAppKey(mock, 3)
+	assert.Nil(t, checkAppKeyCap(ctx, tx, token1))
+	assert.Equal(t, int64(3), hook.LastEntry().Data["count"])
+	assert.Equal(t, false, hook.LastEntry().Data["rejected"])
+	testhelpers.AssertLog(t, hook, 1, logrus.ErrorLevel, "originator exceeded daily app public key cap")
+
+	// Past the cap with rejection: refused
+	config.AppConstants.RejectAppKeysOverCap = true
+	expectCountAppKey(mock, 4)
+	assert.Equal(t, ErrTooManyAppKeys, checkAppKeyCap(ctx, tx, token1))
+	assert.Equal(t, true, hook.LastEntry().Data["rejected"])
+	testhelpers.AssertLog(t, hook, 1, logrus.ErrorLevel, "originator exceeded daily app public key cap")
+
+	// Disabled: nothing is counted
+	config.AppConstants.MaxAppKeysPerOriginatorPerDay = 0
+	assert.Nil(t, checkAppKeyCap(ctx, tx, token1))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,104 @@
+package persistence
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without touching the database while the circuit
+// breaker is open after repeated database failures
+var ErrCircuitOpen = errors.New("database circuit breaker is open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker fast-fails database calls once threshold consecutive calls
+// have failed, so that during an outage requests don't each wait out the
+// driver timeout. After cooldown a single probe call is let through; if it
+// succeeds the breaker closes again, otherwise it stays open for another
+// cooldown. A nil *circuitBreaker never trips.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow returns ErrCircuitOpen if the call should not be attempted. Every call
+// it lets through must be followed by a call to record.
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return nil
+	case breakerHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// record reports the outcome of a call let through by allow. Pass nil for
+// calls that reached the database, even if they returned a domain error.
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if err == nil {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		log(nil, err).WithField("failures", b.failures).Warn("database circuit breaker opened")
+		b.state = breakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+// dbFailure filters out the errors that mean the database answered but
+// refused the operation, leaving only those that should count against the
+// breaker
+func dbFailure(err error) error {
+	switch err {
+	case ErrKeyConsumed, ErrTooManyKeys, ErrDuplicateKey, ErrInvalidKeyFormat, ErrTooManyAppKeys, ErrUploadTooSoon:
+		return nil
+	}
+	return err
+}
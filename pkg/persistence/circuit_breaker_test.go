@@ -0,0 +1,89 @@
+package persistence
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	b := newCircuitBreaker(3, 30*time.Second)
+	b.now = func() time.Time { return now }
+
+	failure := fmt.Errorf("connection refused")
+
+	// Failures below the threshold leave it closed
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, b.allow())
+		b.record(failure)
+	}
+	assert.Nil(t, b.allow())
+
+	// A success resets the count
+	b.record(nil)
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, b.allow())
+		b.record(failure)
+	}
+	assert.Nil(t, b.allow())
+
+	// The third consecutive failure trips it
+	b.record(failure)
+	assert.Equal(t, ErrCircuitOpen, b.allow())
+
+	// After the cooldown a single probe is let through
+	now = now.Add(30 * time.Second)
+	assert.Nil(t, b.allow())
+	assert.Equal(t, ErrCircuitOpen, b.allow(), "only one probe at a time")
+
+	// A failed probe reopens it for another cooldown
+	b.record(failure)
+	assert.Equal(t, ErrCircuitOpen, b.allow())
+
+	// A successful probe closes it
+	now = now.Add(30 * time.Second)
+	assert.Nil(t, b.allow())
+	b.record(nil)
+	assert.Nil(t, b.allow())
+	assert.Nil(t, b.allow())
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker(0, time.Second)
+	assert.Nil(t, b)
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, b.allow())
+		b.record(fmt.Errorf("error"))
+	}
+}
+
+func TestDBFetchKeysForHoursCircuitBreaker(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
+	defer db.Close()
+
+	conn := conn{
+		db:      db,
+		breaker: newCircuitBreaker(2, time.Minute),
+	}
+
+	mock.ExpectQuery("").WillReturnError(fmt.Errorf("connection refused"))
+	mock.ExpectQuery("").WillReturnError(fmt.Errorf("connection refused"))
+
+	for i := 0; i < 2; i++ {
+		_, err := conn.FetchKeysForHours("302", 100, 200, 2651450)
+		assert.EqualError(t, err, "connection refused")
+	}
+
+	// Open: fails fast without querying the database
+	_, err := conn.FetchKeysForHours("302", 100, 200, 2651450)
+	assert.Equal(t, ErrCircuitOpen, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
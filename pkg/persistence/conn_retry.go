@@ -0,0 +1,90 @@
+package persistence
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// connRetrier retries calls that failed because the connection to the
+// database broke rather than because the database refused the operation, so
+// that a failover doesn't surface as a burst of client errors while the pool
+// reconnects. A nil *connRetrier never retries.
+type connRetrier struct {
+	attempts int
+	backoff  time.Duration
+	sleep    func(context.Context, time.Duration) error
+}
+
+func newConnRetrier(attempts int, backoff time.Duration) *connRetrier {
+	if attempts <= 0 {
+		return nil
+	}
+	return &connRetrier{attempts: attempts, backoff: backoff, sleep: sleepContext}
+}
+
+// read calls fn, retrying it after any connection error
+func (r *connRetrier) read(ctx context.Context, fn func() error) error {
+	return r.do(ctx, connectionError, fn)
+}
+
+// write calls fn, retrying it only if the connection was refused. A
+// connection dropped mid-flight may have committed, so retrying the write
+// could apply it twice.
+func (r *connRetrier) write(ctx context.Context, fn func() error) error {
+	return r.do(ctx, connectionRefused, fn)
+}
+
+// do stops retrying and returns ctx.Err() if ctx is done while it backs off
+func (r *connRetrier) do(ctx context.Context, retryable func(error) bool, fn func() error) error {
+	err := fn()
+	if r == nil {
+		return err
+	}
+	backoff := r.backoff
+	for i := 0; i < r.attempts && err != nil && retryable(err); i++ {
+		log(nil, err).WithField("attempt", i+1).Warn("retrying after database connection error")
+		if err := r.sleep(ctx, backoff); err != nil {
+			return err
+		}
+		backoff *= 2
+		err = fn()
+	}
+	return err
+}
+
+// sleepContext waits for d, or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// connectionRefused reports whether err means the database could not be
+// reached at all, so nothing was sent
+func connectionRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// connectionError reports whether err means the connection to the database
+// failed, as opposed to the database answering with an error
+func connectionError(err error) bool {
+	switch {
+	case connectionRefused(err),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, mysql.ErrInvalidConn),
+		errors.Is(err, driver.ErrBadConn):
+		return true
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+)
+
+var errRefused = &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+var errBrokenPipe = &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}
+
+func testRetrier(attempts int) (*connRetrier, *[]time.Duration) {
+	var slept []time.Duration
+	r := newConnRetrier(attempts, 100*time.Millisecond)
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+	return r, &slept
+}
+
+func TestConnectionError(t *testing.T) {
+	assert.True(t, connectionError(errRefused))
+	assert.True(t, connectionError(errBrokenPipe))
+	assert.True(t, connectionError(fmt.Errorf("query: %w", mysql.ErrInvalidConn)))
+	assert.False(t, connectionError(fmt.Errorf("connection refused")), "only the error, not its text, counts")
+	assert.False(t, connectionError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}))
+	assert.False(t, connectionError(ErrTooManyKeys))
+
+	assert.True(t, connectionRefused(errRefused))
+	assert.False(t, connectionRefused(errBrokenPipe))
+}
+
+func TestConnRetrier(t *testing.T) {
+	r, slept := testRetrier(3)
+
+	calls := 0
+	err := r.read(context.Background(), func() error {
+		calls++
+		return errBrokenPipe
+	})
+	assert.Equal(t, errBrokenPipe, err)
+	assert.Equal(t, 4, calls)
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond}, *slept)
+
+	// Logical errors are never retried
+	calls = 0
+	assert.Equal(t, ErrTooManyKeys, r.read(context.Background(), func() error {
+		calls++
+		return ErrTooManyKeys
+	}))
+	assert.Equal(t, 1, calls)
+
+	// Writes are only retried if nothing reached the database
+	calls = 0
+	assert.Equal(t, errBrokenPipe, r.write(context.Background(), func() error {
+		calls++
+		return errBrokenPipe
+	}))
+	assert.Equal(t, 1, calls)
+
+	calls = 0
+	assert.Nil(t, r.write(context.Background(), func() error {
+		calls++
+		if calls == 1 {
+			return errRefused
+		}
+		return nil
+	}))
+	assert.Equal(t, 2, calls)
+}
+
+func TestConnRetrierCancelled(t *testing.T) {
+	r := newConnRetrier(3, time.Hour)
+
+	// A cancelled request doesn't wait out the backoff
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := r.read(ctx, func() error {
+		calls++
+		cancel()
+		return errBrokenPipe
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestConnRetrierDisabled(t *testing.T) {
+	r := newConnRetrier(0, time.Second)
+	assert.Nil(t, r)
+
+	calls := 0
+	assert.Equal(t, errRefused, r.read(context.Background(), func() error {
+		calls++
+		return errRefused
+	}))
+	assert.Equal(t, 1, calls)
+}
+
+func TestDBFetchKeysForHoursConnectionRestored(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
+	defer db.Close()
+
+	retrier, slept := testRetrier(2)
+	conn := conn{
+		db:      db,
+		breaker: newCircuitBreaker(1, time.Minute),
+		retrier: retrier,
+	}
+
+	// The connection drops mid-flight, then the pool reconnects to the new
+	// primary
+	mock.ExpectQuery("").WillReturnError(errBrokenPipe)
+	row := sqlmock.NewRows([]string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level"}).AddRow("302", []byte{}, 2651450, 144, 4)
+	mock.ExpectQuery("").WillReturnRows(row)
+
+	keys, err := conn.FetchKeysForHours("302", 100, 200, 2651450)
+	assert.Nil(t, err)
+	assert.Len(t, keys, 1)
+	assert.Len(t, *slept, 1)
+
+	// The breaker only saw the call succeed
+	assert.Nil(t, conn.breaker.allow())
+	conn.breaker.record(nil)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDBStoreKeysNotRetriedAfterDroppedConnection(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
+	defer db.Close()
+
+	retrier, _ := testRetrier(2)
+	conn := conn{db: db, retrier: retrier}
+
+	mock.ExpectBegin().WillReturnError(errBrokenPipe)
+
+	key := [32]byte{}
+	_, _, err := conn.StoreKeys(&key, []*pb.TemporaryExposureKey{}, context.Background())
+	assert.True(t, errors.Is(err, errBrokenPipe))
+	// nor reported as unavailable, which would have the client retry it
+	assert.False(t, errors.Is(err, ErrDBUnavailable))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
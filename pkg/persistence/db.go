@@ -7,12 +7,16 @@ import (
 	"crypto/x509"
 	"database/sql"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"math/big"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/cds-snc/covid-alert-server/pkg/config"
 	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
 
 	"github.com/Shopify/goose/logger"
@@ -24,6 +28,10 @@ import (
 // past their limit, assigned on keypair creation. The entire batch is rejected.
 var ErrTooManyKeys = errors.New("key limit for keypair exceeded")
 
+// tableNamePattern is what a configured table name, interpolated into queries,
+// must match
+var tableNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
 // Conn mediates all access to a MySQL/CloudSQL connection. It exposes a
 // method for each query we support. The one exception is database
 // creation/migrations, which are handled separately.
@@ -34,8 +42,12 @@ type Conn interface {
 	// Only returns keys that correspond to a Key for a date
 	// less than 14 days ago.
 	FetchKeysForHours(string, uint32, uint32, int32) ([]*pb.TemporaryExposureKey, error)
+	StreamKeysForHours(string, uint32, uint32, int32, func(*pb.TemporaryExposureKey) error) error
+	// FetchKeysForHoursInRange is FetchKeysForHours for only the keys whose
+	// rolling start interval number is in [start, end).
+	FetchKeysForHoursInRange(region string, startHour uint32, endHour uint32, currentRSIN int32, startRSIN int32, endRSIN int32) ([]*pb.TemporaryExposureKey, error)
 
-	StoreKeys(*[32]byte, []*pb.TemporaryExposureKey, context.Context) error
+	StoreKeys(*[32]byte, []*pb.TemporaryExposureKey, context.Context) (stored int64, skipped int64, err error)
 	NewKeyClaim(context.Context, string, string, string) (string, error)
 	ClaimKey(string, []byte, context.Context) ([]byte, error)
 	PrivForPub([]byte) ([]byte, error)
@@ -45,12 +57,14 @@ type Conn interface {
 	ClaimKeyFailure(string) (triesRemaining int, banDuration time.Duration, err error)
 
 	DeleteOldDiagnosisKeys() (int64, error)
+	DeleteDiagnosisKeysOlderThan(ctx context.Context, region string, days uint32) (int64, error)
 	DeleteOldEncryptionKeys() (int64, error)
 	DeleteOldFailedClaimKeyAttempts() (int64, error)
 
 	CountClaimedOneTimeCodes() (int64, error)
 	CountDiagnosisKeys() (int64, error)
 	CountUnclaimedOneTimeCodes() (int64, error)
+	ApproximateTableRowCounts(ctx context.Context, tables []string) ([]TableRowCount, error)
 
 	CountUnclaimedEncryptionKeysByOriginator() ([]CountByOriginator, error)
 	CountExhaustedEncryptionKeysByOriginator() ([]CountByOriginator, error)
@@ -59,16 +73,56 @@ type Conn interface {
 
 	SaveEvent(event Event) error
 	GetServerEvents(startDate string) ([]Events, error)
+	GetEvents(date string, deviceType DeviceType) ([]Events, error)
 	GetTEKUploads(startDate string) ([]Uploads, error)
+	GetOtkFunnel(startDate, endDate string) ([]OtkFunnel, error)
 	GetAggregateOtkDurationsByDate(startDate string) ([]AggregateOtkDuration, error)
 
 	ClearDiagnosisKeys(context.Context) error
 
+	AddToDenylist(ctx context.Context, key []byte) error
+	AddToDenylistUntil(ctx context.Context, key []byte, until time.Time) error
+	RemoveFromDenylist(ctx context.Context, key []byte) error
+	IsDenylisted(ctx context.Context, key []byte) (bool, error)
+
+	KeypairQuota(ctx context.Context, appPubKey *[32]byte) (remainingKeys int64, expiresAt time.Time, err error)
+	OriginatorRegion(ctx context.Context, appPubKey *[32]byte) (string, error)
+	PromoteKeys(ctx context.Context, originator string, appPubKey *[32]byte) (int64, error)
+	RegionLastUpdated(ctx context.Context, region string) (time.Time, error)
+	MaintenanceMode(ctx context.Context) (bool, error)
+	SetMaintenanceMode(ctx context.Context, enabled bool) error
+	ClaimEventsExport(ctx context.Context, date string, staleAfter time.Duration) (bool, error)
+	FinishEventsExport(ctx context.Context, date string, exported bool) error
+
+	RecordUploadRejections(ctx context.Context, reason string, date time.Time, count int64) error
+	CountRejections(ctx context.Context, reason string, since time.Time) (int64, error)
+	ReconcileUploadCounts(ctx context.Context, date time.Time) ([]UploadCountDrift, error)
+
+	SeedServerKeypair(ctx context.Context, seed KeypairSeed) (bool, error)
+
+	Warmup(ctx context.Context) error
 	Close() error
 }
 
 type conn struct {
 	db *sql.DB
+	// read is a read-only replica for queries that can tolerate replication
+	// lag; nil means they go to db too
+	read *sql.DB
+	// eventsDualWrite is where dualWriteEventsTable is written, if not db
+	eventsDualWrite *sql.DB
+	breaker         *circuitBreaker
+	retrier         *connRetrier
+	// statementTimeout bounds each call, see statementContext; 0 means none
+	statementTimeout time.Duration
+}
+
+// reader returns the replica if there is one, or the primary
+func (c *conn) reader() *sql.DB {
+	if c.read != nil {
+		return c.read
+	}
+	return c.db
 }
 
 var log = logger.New("db")
@@ -79,9 +133,91 @@ const (
 	maxIdleConns    = 10
 )
 
+// idleConns is the number of connections the pool keeps open between
+// requests, DB_MAX_IDLE_CONNS if set
+func idleConns() int {
+	if n, err := strconv.Atoi(os.Getenv("DB_MAX_IDLE_CONNS")); err == nil && n > 0 {
+		return n
+	}
+	return maxIdleConns
+}
+
+// Warmup opens and pings as many connections as the pool keeps idle, on the
+// replica too if there is one, so the first requests after a cold start don't
+// each pay for a new connection
+func (c *conn) Warmup(ctx context.Context) error {
+	if err := warmup(ctx, c.db); err != nil {
+		return err
+	}
+	if c.read != nil {
+		return warmup(ctx, c.read)
+	}
+	return nil
+}
+
+func warmup(ctx context.Context, db *sql.DB) error {
+	n := idleConns()
+	conns := make([]*sql.Conn, 0, n)
+	// Closing a *sql.Conn hands it back to the pool, where it stays idle
+	defer func() {
+		for _, sc := range conns {
+			_ = sc.Close()
+		}
+	}()
+
+	// Hold each connection until all are open so the pool can't hand the same
+	// one out twice
+	for i := 0; i < n; i++ {
+		sc, err := db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, sc)
+		if err := sc.PingContext(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Dial establishes a MySQL/CloudSQL connection and returns a Conn object,
-// wrapping each available query.
+// wrapping each available query. If DB_READ_URL is set, a second connection
+// is made to that read replica, and the events export, counts and key
+// retrieval read from it instead. Everything on the upload path stays on the
+// primary so it never sees stale keypairs. EVENTS_DUAL_WRITE_URL likewise
+// opens the connection for dualWriteEventsTable.
 func Dial(url string) (Conn, error) {
+	if table := config.AppConstants.DualWriteEventsTable; table != "" && !tableNamePattern.MatchString(table) {
+		return nil, fmt.Errorf("invalid dualWriteEventsTable %q", table)
+	}
+	db := openDB(url)
+	var read *sql.DB
+	if readURL := os.Getenv("DB_READ_URL"); readURL != "" {
+		read = openDB(readURL)
+	}
+	var eventsDualWrite *sql.DB
+	if dualWriteURL := os.Getenv("EVENTS_DUAL_WRITE_URL"); dualWriteURL != "" {
+		eventsDualWrite = openDB(dualWriteURL)
+	}
+	breaker := newCircuitBreaker(
+		config.AppConstants.DBCircuitBreakerFailures,
+		time.Duration(config.AppConstants.DBCircuitBreakerCooldownSeconds)*time.Second,
+	)
+	retrier := newConnRetrier(
+		config.AppConstants.DBConnRetryAttempts,
+		time.Duration(config.AppConstants.DBConnRetryBackoffMilliseconds)*time.Millisecond,
+	)
+	return &conn{
+		db:               db,
+		read:             read,
+		eventsDualWrite:  eventsDualWrite,
+		breaker:          breaker,
+		retrier:          retrier,
+		statementTimeout: time.Duration(config.AppConstants.DBStatementTimeoutMilliseconds) * time.Millisecond,
+	}, nil
+}
+
+func openDB(url string) *sql.DB {
 	if strings.Contains(url, "?") {
 		url += "&parseTime=true"
 	} else {
@@ -120,32 +256,36 @@ func Dial(url string) (Conn, error) {
 	}
 	db.SetConnMaxLifetime(maxConnLifetime)
 	db.SetMaxOpenConns(maxOpenConns)
-	db.SetMaxIdleConns(maxIdleConns)
-	return &conn{db: db}, nil
+	db.SetMaxIdleConns(idleConns())
+	return db
 }
 
 func (c *conn) DeleteOldDiagnosisKeys() (int64, error) {
-	return deleteOldDiagnosisKeys(c.db)
+	ctx, cancel := c.statementContext(context.Background())
+	defer cancel()
+	return deleteOldDiagnosisKeys(ctx, c.db)
 }
 
 func (c *conn) CountUnclaimedEncryptionKeysByOriginator() ([]CountByOriginator, error) {
-	return countUnclaimedEncryptionKeysByOriginator(c.db)
+	return countUnclaimedEncryptionKeysByOriginator(c.reader())
 }
 
 func (c *conn) CountExhaustedEncryptionKeysByOriginator() ([]CountByOriginator, error) {
-	return countExhaustedEncryptionKeysByOriginator(c.db)
+	return countExhaustedEncryptionKeysByOriginator(c.reader())
 }
 
 func (c *conn) CountExpiredClaimedEncryptionKeysByOriginator() ([]CountByOriginator, error) {
-	return countExpiredClaimedEncryptionKeysByOriginator(c.db)
+	return countExpiredClaimedEncryptionKeysByOriginator(c.reader())
 }
 
 func (c *conn) CountExpiredClaimedEncryptionKeysWithNoUploadsByOriginator() ([]CountByOriginator, error) {
-	return countExpiredClaimedEncryptionKeysWithNoUploadsByOriginator(c.db)
+	return countExpiredClaimedEncryptionKeysWithNoUploadsByOriginator(c.reader())
 }
 
 func (c *conn) DeleteOldEncryptionKeys() (int64, error) {
-	return deleteOldEncryptionKeys(c.db)
+	ctx, cancel := c.statementContext(context.Background())
+	defer cancel()
+	return deleteOldEncryptionKeys(ctx, c.db)
 }
 
 // ErrNoRecordWritten indicates that, though we should have been able to write
@@ -155,6 +295,10 @@ var ErrNoRecordWritten = errors.New("we tried to write a transaction but no reco
 
 var ErrKeyConsumed = errors.New("keypair has uploaded maximum number of diagnosis keys")
 
+// ErrUploadTooSoon is returned when a keypair uploads again before
+// uploadCooldownSeconds have passed since its last upload
+var ErrUploadTooSoon = errors.New("keypair uploaded too recently")
+
 var ErrInvalidKeyFormat = errors.New("argument had wrong size")
 
 var ErrDuplicateKey = errors.New("key is already registered")
@@ -165,6 +309,8 @@ func (c *conn) ClaimKey(oneTimeCode string, appPublicKey []byte, ctx context.Con
 	if len(appPublicKey) != pb.KeyLength {
 		return nil, ErrInvalidKeyFormat
 	}
+	ctx, cancel := c.statementContext(ctx)
+	defer cancel()
 	return claimKey(c.db, oneTimeCode, appPublicKey, ctx)
 }
 
@@ -190,11 +336,13 @@ func (c *conn) NewKeyClaim(ctx context.Context, region, originator, hashID strin
 			return "", err
 		}
 
+		stmtCtx, cancel := c.statementContext(ctx)
 		if len(hashID) == 128 {
-			err = persistEncryptionKeyWithHashID(c.db, region, originator, hashID, pub, priv, oneTimeCode)
+			err = persistEncryptionKeyWithHashID(stmtCtx, c.db, region, originator, hashID, pub, priv, oneTimeCode)
 		} else {
-			err = persistEncryptionKey(c.db, region, originator, pub, priv, oneTimeCode)
+			err = persistEncryptionKey(stmtCtx, c.db, region, originator, pub, priv, oneTimeCode)
 		}
+		cancel()
 
 		if err == nil {
 			c.saveNewKeyClaimEvent(ctx, originator, regenerated)
@@ -231,7 +379,9 @@ func (c *conn) saveNewKeyClaimEvent(ctx context.Context, originator string, rege
 		Date:       time.Now(),
 		Count:      1,
 	}
-	if err := saveEvent(c.db, event); err != nil {
+	stmtCtx, cancel := c.statementContext(ctx)
+	defer cancel()
+	if err := saveEvent(stmtCtx, c.db, event); err != nil {
 		LogEvent(ctx, err, event)
 	}
 }
@@ -277,33 +427,116 @@ func (c *conn) PrivForPub(pub []byte) ([]byte, error) {
 	if len(pub) != pb.KeyLength {
 		return nil, ErrInvalidKeyFormat
 	}
-	row := privForPub(c.db, pub)
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := c.statementContext(context.Background())
+	defer cancel()
 	var priv []byte
-	switch err := row.Scan(&priv); err {
+	err := c.retrier.read(ctx, func() error {
+		return privForPub(ctx, c.db, pub).Scan(&priv)
+	})
+	switch err {
 	case sql.ErrNoRows:
+		c.breaker.record(nil)
 		return nil, errors.New("no record")
 	case nil:
+		c.breaker.record(nil)
 		return priv, nil
 	default:
+		c.breaker.record(err)
+		if classified := classifyDBError(err); classified != err {
+			return nil, classified
+		}
 		return nil, errors.New("no record")
 	}
 }
 
-func (c *conn) StoreKeys(appPubKey *[32]byte, keys []*pb.TemporaryExposureKey, ctx context.Context) error {
-	return registerDiagnosisKeys(c.db, appPubKey, keys, ctx)
+// StoreKeys stores keys uploaded by the keypair with app public key
+// appPubKey, and returns how many were stored and how many were skipped
+// because their data was already stored
+func (c *conn) StoreKeys(appPubKey *[32]byte, keys []*pb.TemporaryExposureKey, ctx context.Context) (int64, int64, error) {
+	if err := c.breaker.allow(); err != nil {
+		return 0, 0, err
+	}
+	ctx, cancel := c.statementContext(ctx)
+	defer cancel()
+	var stored, skipped int64
+	err := c.retrier.write(ctx, func() error {
+		var err error
+		stored, skipped, err = registerDiagnosisKeys(c.db, appPubKey, keys, ctx)
+		return err
+	})
+	c.breaker.record(dbFailure(err))
+	if err != nil {
+		return 0, 0, classifyDBWriteError(err)
+	}
+	return stored, skipped, nil
 }
 
 func (c *conn) FetchKeysForHours(region string, startHour uint32, endHour uint32, currentRSIN int32) ([]*pb.TemporaryExposureKey, error) {
-	rows, err := diagnosisKeysForHours(c.db, region, startHour, endHour, currentRSIN)
-	if err != nil {
+	if err := c.breaker.allow(); err != nil {
 		return nil, err
 	}
-	return handleKeysRows(rows)
+	ctx, cancel := c.statementContext(context.Background())
+	defer cancel()
+	rows, err := c.diagnosisKeysForHours(ctx, region, startHour, endHour, currentRSIN)
+	c.breaker.record(err)
+	if err != nil {
+		return nil, classifyDBError(err)
+	}
+	keys, err := handleKeysRows(rows)
+	return keys, classifyDBError(err)
+}
+
+// StreamKeysForHours is FetchKeysForHours without collecting the keys: fn is
+// called with each key as its row is read, and an error from fn stops the
+// query and is returned.
+func (c *conn) StreamKeysForHours(region string, startHour uint32, endHour uint32, currentRSIN int32, fn func(*pb.TemporaryExposureKey) error) error {
+	if err := c.breaker.allow(); err != nil {
+		return err
+	}
+	ctx, timer, cancel := c.streamContext(context.Background())
+	defer cancel()
+	rows, err := c.diagnosisKeysForHours(ctx, region, startHour, endHour, currentRSIN)
+	c.breaker.record(err)
+	if err != nil {
+		return classifyDBError(timer.wrap(err))
+	}
+	// The timeout doesn't run while fn writes a key to the client. Errors from
+	// here on may come from fn, so they are left unclassified
+	return timer.wrap(streamKeysRows(rows, func(key *pb.TemporaryExposureKey) error {
+		timer.pause()
+		defer timer.resume()
+		return fn(key)
+	}))
+}
+
+func (c *conn) diagnosisKeysForHours(ctx context.Context, region string, startHour uint32, endHour uint32, currentRSIN int32) (*sql.Rows, error) {
+	var rows *sql.Rows
+	err := c.retrier.read(ctx, func() (err error) {
+		rows, err = diagnosisKeysForHours(ctx, c.reader(), region, startHour, endHour, currentRSIN)
+		return err
+	})
+	return rows, err
 }
 
 func handleKeysRows(rows *sql.Rows) ([]*pb.TemporaryExposureKey, error) {
 	var keys []*pb.TemporaryExposureKey
 
+	err := streamKeysRows(rows, func(key *pb.TemporaryExposureKey) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func streamKeysRows(rows *sql.Rows, fn func(*pb.TemporaryExposureKey) error) error {
+	defer rows.Close()
+
 	for rows.Next() {
 		var key []byte
 		var rollingStartIntervalNumber int32
@@ -312,11 +545,11 @@ func handleKeysRows(rows *sql.Rows) ([]*pb.TemporaryExposureKey, error) {
 		var region string
 		err := rows.Scan(&region, &key, &rollingStartIntervalNumber, &rollingPeriod, &transmissionRiskLevel)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		onsetDays := int32(0)
-		keys = append(keys, &pb.TemporaryExposureKey{
+		err = fn(&pb.TemporaryExposureKey{
 			KeyData:                    key,
 			TransmissionRiskLevel:      &transmissionRiskLevel,
 			RollingStartIntervalNumber: &rollingStartIntervalNumber,
@@ -324,9 +557,12 @@ func handleKeysRows(rows *sql.Rows) ([]*pb.TemporaryExposureKey, error) {
 			ReportType:                 pb.TemporaryExposureKey_CONFIRMED_TEST.Enum(),
 			DaysSinceOnsetOfSymptoms:   &onsetDays,
 		})
+		if err != nil {
+			return err
+		}
 
 	}
-	return keys, nil
+	return rows.Err()
 }
 
 func (c *conn) CheckClaimKeyBan(identifier string) (triesRemaining int, banDuration time.Duration, err error) {
@@ -334,29 +570,52 @@ func (c *conn) CheckClaimKeyBan(identifier string) (triesRemaining int, banDurat
 }
 
 func (c *conn) ClaimKeySuccess(identifier string) error {
-	return registerClaimKeySuccess(c.db, identifier)
+	ctx, cancel := c.statementContext(context.Background())
+	defer cancel()
+	return registerClaimKeySuccess(ctx, c.db, identifier)
 }
 
 func (c *conn) ClaimKeyFailure(identifier string) (int, time.Duration, error) {
-	return registerClaimKeyFailure(c.db, identifier)
+	ctx, cancel := c.statementContext(context.Background())
+	defer cancel()
+	return registerClaimKeyFailure(ctx, c.db, identifier)
 }
 
 func (c *conn) DeleteOldFailedClaimKeyAttempts() (int64, error) {
-	return deleteOldFailedClaimKeyAttempts(c.db)
+	ctx, cancel := c.statementContext(context.Background())
+	defer cancel()
+	return deleteOldFailedClaimKeyAttempts(ctx, c.db)
 }
 
 func (c *conn) CountClaimedOneTimeCodes() (int64, error) {
-	return countClaimedOneTimeCodes(c.db)
+	return countClaimedOneTimeCodes(c.reader())
 }
 
 func (c *conn) CountDiagnosisKeys() (int64, error) {
-	return countDiagnosisKeys(c.db)
+	return countDiagnosisKeys(c.reader())
 }
 
 func (c *conn) CountUnclaimedOneTimeCodes() (int64, error) {
-	return countUnclaimedOneTimeCodes(c.db)
+	return countUnclaimedOneTimeCodes(c.reader())
+}
+
+func (c *conn) ApproximateTableRowCounts(ctx context.Context, tables []string) ([]TableRowCount, error) {
+	ctx, cancel := c.statementContext(ctx)
+	defer cancel()
+	return approximateTableRowCounts(ctx, c.reader(), tables)
 }
 
+// Close closes every pool, even if an earlier one fails, and returns the
+// first error
 func (c *conn) Close() error {
-	return c.db.Close()
+	var first error
+	for _, db := range []*sql.DB{c.read, c.eventsDualWrite, c.db} {
+		if db == nil {
+			continue
+		}
+		if err := db.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
 }
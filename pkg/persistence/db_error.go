@@ -0,0 +1,87 @@
+package persistence
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Kinds of database failure a DBError can be. Callers test for them with
+// errors.Is, and all of them are worth retrying later.
+var (
+	// ErrDBUnavailable means the connection to the database failed
+	ErrDBUnavailable = errors.New("database unavailable")
+	// ErrDBTimeout means the call ran past its deadline, such as
+	// dbStatementTimeoutMilliseconds
+	ErrDBTimeout = errors.New("database call timed out")
+	// ErrDBConflict means the database gave up on the call because of a
+	// deadlock or lock wait timeout
+	ErrDBConflict = errors.New("database conflict")
+)
+
+// MySQL error numbers for lock conflicts
+const (
+	mysqlLockWaitTimeout = 1205
+	mysqlDeadlock        = 1213
+)
+
+// DBError is a database failure of a known Kind, wrapping the driver's error.
+// errors.Is matches both the Kind and the wrapped error, and errors.As gives
+// access to the DBError itself.
+type DBError struct {
+	Kind error
+	Err  error
+}
+
+func (e *DBError) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *DBError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is e's Kind, so that errors.Is can tell the kinds
+// apart without unwrapping
+func (e *DBError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// classifyDBError wraps err in a DBError if it is one of the known kinds of
+// failure, and returns it as is otherwise
+func classifyDBError(err error) error {
+	if kind := dbErrorKind(err); kind != nil {
+		return &DBError{Kind: kind, Err: err}
+	}
+	return err
+}
+
+// classifyDBWriteError is classifyDBError for a write. A connection that broke
+// after the write was sent may still have committed it, so that isn't
+// reported as ErrDBUnavailable, which tells clients to retry: only failures
+// before anything was sent are.
+func classifyDBWriteError(err error) error {
+	if connectionError(err) && !connectionRefused(err) && !errors.Is(err, driver.ErrBadConn) {
+		return err
+	}
+	return classifyDBError(err)
+}
+
+func dbErrorKind(err error) error {
+	var mysqlErr *mysql.MySQLError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, new(*DBError)):
+		return nil
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrDBTimeout
+	case connectionError(err):
+		return ErrDBUnavailable
+	case errors.As(err, &mysqlErr) && (mysqlErr.Number == mysqlLockWaitTimeout || mysqlErr.Number == mysqlDeadlock):
+		return ErrDBConflict
+	}
+	return nil
+}
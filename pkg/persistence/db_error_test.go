@@ -0,0 +1,91 @@
+package persistence
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyDBError(t *testing.T) {
+	deadlock := &mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}
+
+	for err, kind := range map[error]error{
+		syscall.ECONNREFUSED:                   ErrDBUnavailable,
+		fmt.Errorf("write: %w", syscall.EPIPE): ErrDBUnavailable,
+		mysql.ErrInvalidConn:                   ErrDBUnavailable,
+		context.DeadlineExceeded:               ErrDBTimeout,
+		deadlock:                               ErrDBConflict,
+		&mysql.MySQLError{Number: 1205, Message: "timeout"}: ErrDBConflict,
+	} {
+		classified := classifyDBError(err)
+		assert.True(t, errors.Is(classified, kind), "%v is %v", err, kind)
+		assert.True(t, errors.Is(classified, err), "%v still matches the wrapped error", err)
+
+		var dbErr *DBError
+		assert.True(t, errors.As(classified, &dbErr))
+		assert.Equal(t, kind, dbErr.Kind)
+		assert.Equal(t, err, dbErr.Err)
+
+		for _, other := range []error{ErrDBUnavailable, ErrDBTimeout, ErrDBConflict} {
+			if other != kind {
+				assert.False(t, errors.Is(classified, other), "%v is not %v", err, other)
+			}
+		}
+
+		// Classifying again doesn't wrap twice
+		assert.Equal(t, classified, classifyDBError(classified))
+	}
+
+	assert.Equal(t, "database conflict: Error 1213: Deadlock found when trying to get lock", classifyDBError(deadlock).Error())
+
+	// Anything else is left alone
+	for _, err := range []error{nil, ErrTooManyKeys, ErrKeyConsumed, &mysql.MySQLError{Number: 1062}, errors.New("generic DB error")} {
+		assert.Equal(t, err, classifyDBError(err))
+	}
+}
+
+func TestClassifyDBWriteError(t *testing.T) {
+	// Nothing was sent, so the client can retry
+	for _, err := range []error{syscall.ECONNREFUSED, driver.ErrBadConn} {
+		assert.True(t, errors.Is(classifyDBWriteError(err), ErrDBUnavailable), "%v is ErrDBUnavailable", err)
+	}
+
+	// The write may have committed
+	for _, err := range []error{fmt.Errorf("write: %w", syscall.EPIPE), fmt.Errorf("read: %w", syscall.ECONNRESET), mysql.ErrInvalidConn} {
+		assert.Equal(t, err, classifyDBWriteError(err))
+	}
+
+	assert.True(t, errors.Is(classifyDBWriteError(context.DeadlineExceeded), ErrDBTimeout))
+}
+
+func TestStoreKeys_ClassifiesErrors(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
+	defer db.Close()
+
+	c := conn{db: db}
+	mock.ExpectBegin().WillReturnError(&mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"})
+
+	_, _, err := c.StoreKeys(&[32]byte{}, nil, context.Background())
+	assert.True(t, errors.Is(err, ErrDBConflict))
+
+	// A connection dropped once the upload was sent isn't reported as
+	// unavailable, since the upload may have been stored
+	mock.ExpectBegin()
+	mock.ExpectQuery("").WillReturnError(fmt.Errorf("read: %w", syscall.ECONNRESET))
+	mock.ExpectRollback()
+
+	_, _, err = c.StoreKeys(&[32]byte{}, nil, context.Background())
+	assert.True(t, errors.Is(err, syscall.ECONNRESET))
+	assert.False(t, errors.Is(err, ErrDBUnavailable))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"os"
 	"testing"
 	"time"
 
@@ -78,7 +79,7 @@ func TestDBClaimKey(t *testing.T) {
 	oneTimeCode := "80311300"
 
 	// App key to short
-	receivedResult, receivedError := conn.ClaimKey(oneTimeCode, make([]byte, 8), nil)
+	receivedResult, receivedError := conn.ClaimKey(oneTimeCode, make([]byte, 8), context.Background())
 	assert.Equal(t, receivedError, ErrInvalidKeyFormat)
 	assert.Nil(t, receivedResult)
 
@@ -112,7 +113,7 @@ func TestDBClaimKey(t *testing.T) {
 	mock.ExpectCommit()
 
 	expectedResult := pub[:]
-	receivedResult, receivedError = conn.ClaimKey(oneTimeCode, pub[:], nil)
+	receivedResult, receivedError = conn.ClaimKey(oneTimeCode, pub[:], context.Background())
 
 	assert.Equal(t, expectedResult, receivedResult)
 	assert.Nil(t, receivedError)
@@ -542,23 +543,27 @@ func TestDBStoreKeys(t *testing.T) {
 
 	mock.ExpectExec(
 		`UPDATE encryption_keys
-	SET remaining_keys = remaining_keys - ?
+	SET remaining_keys = remaining_keys - ?, stored_keys = stored_keys + ?
 	WHERE remaining_keys >= ?
 	AND app_public_key = ?`,
 	).WithArgs(
+		len(keys),
 		len(keys),
 		len(keys),
 		pub[:],
 	).WillReturnResult(sqlmock.NewResult(1, 1))
 
 	mock.ExpectCommit()
-	receivedResult := conn.StoreKeys(pub, keys, nil)
+	expectRegionUpdated(mock, "302")
+	stored, skipped, receivedResult := conn.StoreKeys(pub, keys, context.Background())
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
 	assert.Nil(t, receivedResult, "Expected nil when keys are commited")
+	assert.Equal(t, int64(2), stored)
+	assert.Equal(t, int64(0), skipped)
 }
 
 func TestDBFetchKeysForHours(t *testing.T) {
@@ -608,6 +613,59 @@ func TestDBFetchKeysForHours(t *testing.T) {
 	assert.Equal(t, fmt.Errorf("Generic error"), receivedError, "Expected rows for the query")
 }
 
+func TestDBStreamKeysForHours(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
+	defer db.Close()
+
+	conn := conn{
+		db: db,
+	}
+
+	region := "302"
+	startHour := uint32(100)
+	endHour := uint32(200)
+	currentRollingStartIntervalNumber := int32(2651450)
+
+	columns := []string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level"}
+
+	// Each row is handed over as it is read
+	rows := sqlmock.NewRows(columns).AddRow("302", []byte{1}, 2651450, 144, 4).AddRow("302", []byte{2}, 2651450, 144, 4)
+	mock.ExpectQuery("").WillReturnRows(rows)
+
+	var received [][]byte
+	err := conn.StreamKeysForHours(region, startHour, endHour, currentRollingStartIntervalNumber, func(key *pb.TemporaryExposureKey) error {
+		received = append(received, key.GetKeyData())
+		assert.Equal(t, pb.TemporaryExposureKey_CONFIRMED_TEST, key.GetReportType())
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{{1}, {2}}, received)
+
+	// An error from the callback stops the stream
+	rows = sqlmock.NewRows(columns).AddRow("302", []byte{1}, 2651450, 144, 4).AddRow("302", []byte{2}, 2651450, 144, 4)
+	mock.ExpectQuery("").WillReturnRows(rows)
+
+	calls := 0
+	err = conn.StreamKeysForHours(region, startHour, endHour, currentRollingStartIntervalNumber, func(key *pb.TemporaryExposureKey) error {
+		calls++
+		return fmt.Errorf("write failed")
+	})
+
+	assert.EqualError(t, err, "write failed")
+	assert.Equal(t, 1, calls)
+
+	// Query errors
+	mock.ExpectQuery("").WillReturnError(fmt.Errorf("Generic error"))
+
+	err = conn.StreamKeysForHours(region, startHour, endHour, currentRollingStartIntervalNumber, func(*pb.TemporaryExposureKey) error { return nil })
+	assert.EqualError(t, err, "Generic error")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func TestDBCheckClaimKeyBan(t *testing.T) {
 	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
 	defer db.Close()
@@ -760,6 +818,24 @@ func TestDBCountUnclaimedOneTimeCodes(t *testing.T) {
 	assert.Nil(t, receivedError)
 }
 
+func TestDBApproximateTableRowCounts(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
+	defer db.Close()
+
+	conn := conn{
+		db: db,
+	}
+
+	rows := sqlmock.NewRows([]string{"table_name", "table_rows"}).AddRow("events", 20)
+	mock.ExpectQuery("").WillReturnRows(rows)
+
+	expectedResult := []TableRowCount{{Table: "events", Rows: 20}}
+	receivedResult, receivedError := conn.ApproximateTableRowCounts(context.Background(), []string{"events"})
+
+	assert.Equal(t, expectedResult, receivedResult)
+	assert.Nil(t, receivedError)
+}
+
 func assertLog(t *testing.T, hook *test.Hook, length int, level logrus.Level, msg string) {
 	assert.Equal(t, length, len(hook.Entries))
 	assert.Equal(t, level, hook.LastEntry().Level)
@@ -772,3 +848,59 @@ func SHA512(message []byte) []byte {
 	c.Write(message)
 	return c.Sum(nil)
 }
+
+func TestDBWarmup(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	defer db.Close()
+
+	os.Setenv("DB_MAX_IDLE_CONNS", "3")
+	defer os.Unsetenv("DB_MAX_IDLE_CONNS")
+
+	for i := 0; i < 3; i++ {
+		mock.ExpectPing()
+	}
+
+	conn := conn{db: db}
+	assert.Nil(t, conn.Warmup(context.Background()))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDBWarmupPingFailure(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	defer db.Close()
+
+	os.Setenv("DB_MAX_IDLE_CONNS", "3")
+	defer os.Unsetenv("DB_MAX_IDLE_CONNS")
+
+	mock.ExpectPing().WillReturnError(fmt.Errorf("connection refused"))
+
+	conn := conn{db: db}
+	assert.EqualError(t, conn.Warmup(context.Background()), "connection refused")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDBClose(t *testing.T) {
+	primary, primaryMock, _ := sqlmock.New()
+	replica, replicaMock, _ := sqlmock.New()
+	dualWrite, dualWriteMock, _ := sqlmock.New()
+
+	// A failing pool doesn't stop the others closing
+	replicaMock.ExpectClose().WillReturnError(fmt.Errorf("replica gone"))
+	dualWriteMock.ExpectClose().WillReturnError(fmt.Errorf("dual write gone"))
+	primaryMock.ExpectClose()
+
+	c := conn{db: primary, read: replica, eventsDualWrite: dualWrite}
+	assert.EqualError(t, c.Close(), "replica gone")
+
+	for _, mock := range []sqlmock.Sqlmock{primaryMock, replicaMock, dualWriteMock} {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+)
+
+// ErrNotDenylisted is returned when removing a keypair that has no active
+// denylist entry
+var ErrNotDenylisted = errors.New("keypair is not denylisted")
+
+// Denylist entries are never deleted. Unblocking a keypair sets removed_at on
+// its active entry and blocking it again adds a new one, so the table keeps
+// the full history of both. Entries with an expires_at stop being active once
+// it has passed.
+
+// AddToDenylist blocks uploads from the keypair with app public key key. It
+// is a no-op if the keypair is already blocked permanently.
+func (c *conn) AddToDenylist(ctx context.Context, key []byte) error {
+	ctx, cancel := c.statementContext(ctx)
+	defer cancel()
+	return addToDenylist(ctx, c.db, key)
+}
+
+// RemoveFromDenylist unblocks the keypair with app public key key
+func (c *conn) RemoveFromDenylist(ctx context.Context, key []byte) error {
+	ctx, cancel := c.statementContext(ctx)
+	defer cancel()
+	return removeFromDenylist(ctx, c.db, key)
+}
+
+// AddToDenylistUntil blocks uploads from the keypair with app public key key
+// until until. It is a no-op if the keypair is already blocked.
+func (c *conn) AddToDenylistUntil(ctx context.Context, key []byte, until time.Time) error {
+	ctx, cancel := c.statementContext(ctx)
+	defer cancel()
+	return addToDenylistUntil(ctx, c.db, key, until)
+}
+
+// IsDenylisted reports whether the keypair with app public key key has an
+// active denylist entry
+func (c *conn) IsDenylisted(ctx context.Context, key []byte) (bool, error) {
+	ctx, cancel := c.statementContext(ctx)
+	defer cancel()
+	return isDenylisted(ctx, c.db, key)
+}
+
+// activeDenylistEntry matches the entries that currently block a keypair
+const activeDenylistEntry = `removed_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())`
+
+func addToDenylist(ctx context.Context, db *sql.DB, key []byte) error {
+	if len(key) != pb.KeyLength {
+		return ErrInvalidKeyFormat
+	}
+
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO keypair_denylist (app_public_key)
+		SELECT ? FROM DUAL
+		WHERE NOT EXISTS (SELECT 1 FROM keypair_denylist WHERE app_public_key = ? AND removed_at IS NULL AND expires_at IS NULL)`,
+		key, key)
+	return err
+}
+
+func addToDenylistUntil(ctx context.Context, db *sql.DB, key []byte, until time.Time) error {
+	if len(key) != pb.KeyLength {
+		return ErrInvalidKeyFormat
+	}
+
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO keypair_denylist (app_public_key, expires_at)
+		SELECT ?, ? FROM DUAL
+		WHERE NOT EXISTS (SELECT 1 FROM keypair_denylist WHERE app_public_key = ? AND `+activeDenylistEntry+`)`,
+		key, until.UTC(), key)
+	return err
+}
+
+func removeFromDenylist(ctx context.Context, db *sql.DB, key []byte) error {
+	if len(key) != pb.KeyLength {
+		return ErrInvalidKeyFormat
+	}
+
+	res, err := db.ExecContext(ctx,
+		`UPDATE keypair_denylist SET removed_at = NOW() WHERE app_public_key = ? AND `+activeDenylistEntry,
+		key)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotDenylisted
+	}
+	return nil
+}
+
+func isDenylisted(ctx context.Context, db *sql.DB, key []byte) (bool, error) {
+	if len(key) != pb.KeyLength {
+		return false, ErrInvalidKeyFormat
+	}
+
+	var denylisted bool
+	err := db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM keypair_denylist WHERE app_public_key = ? AND `+activeDenylistEntry+`)`,
+		key).Scan(&denylisted)
+	return denylisted, err
+}
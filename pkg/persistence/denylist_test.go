@@ -0,0 +1,114 @@
+package persistence
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+const addToDenylistQuery = `
+		INSERT INTO keypair_denylist (app_public_key)
+		SELECT ? FROM DUAL
+		WHERE NOT EXISTS (SELECT 1 FROM keypair_denylist WHERE app_public_key = ? AND removed_at IS NULL AND expires_at IS NULL)`
+
+const addToDenylistUntilQuery = `
+		INSERT INTO keypair_denylist (app_public_key, expires_at)
+		SELECT ?, ? FROM DUAL
+		WHERE NOT EXISTS (SELECT 1 FROM keypair_denylist WHERE app_public_key = ? AND removed_at IS NULL AND (expires_at IS NULL OR expires_at > NOW()))`
+
+const removeFromDenylistQuery = `UPDATE keypair_denylist SET removed_at = NOW() WHERE app_public_key = ? AND removed_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())`
+
+const isDenylistedQuery = `SELECT EXISTS (SELECT 1 FROM keypair_denylist WHERE app_public_key = ? AND removed_at IS NULL AND (expires_at IS NULL OR expires_at > NOW()))`
+
+func expectIsDenylisted(mock sqlmock.Sqlmock, key []byte, denylisted bool) {
+	rows := sqlmock.NewRows([]string{"denylisted"}).AddRow(denylisted)
+	mock.ExpectQuery(isDenylistedQuery).WithArgs(key).WillReturnRows(rows)
+}
+
+func TestDenylist_BlockUnblockReblock(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	ctx := context.Background()
+	key := make([]byte, 32)
+
+	// Block
+	mock.ExpectExec(addToDenylistQuery).WithArgs(key, key).WillReturnResult(sqlmock.NewResult(1, 1))
+	expectIsDenylisted(mock, key, true)
+
+	assert.Nil(t, addToDenylist(ctx, db, key))
+	denylisted, err := isDenylisted(ctx, db, key)
+	assert.Nil(t, err)
+	assert.True(t, denylisted)
+
+	// Unblock soft-deletes the active entry
+	mock.ExpectExec(removeFromDenylistQuery).WithArgs(key).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectIsDenylisted(mock, key, false)
+
+	assert.Nil(t, removeFromDenylist(ctx, db, key))
+	denylisted, err = isDenylisted(ctx, db, key)
+	assert.Nil(t, err)
+	assert.False(t, denylisted)
+
+	// Re-block adds a new entry alongside the removed one
+	mock.ExpectExec(addToDenylistQuery).WithArgs(key, key).WillReturnResult(sqlmock.NewResult(2, 1))
+	expectIsDenylisted(mock, key, true)
+
+	assert.Nil(t, addToDenylist(ctx, db, key))
+	denylisted, err = isDenylisted(ctx, db, key)
+	assert.Nil(t, err)
+	assert.True(t, denylisted)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDenylist_UnblockNotDenylisted(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	key := make([]byte, 32)
+	mock.ExpectExec(removeFromDenylistQuery).WithArgs(key).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.Equal(t, ErrNotDenylisted, removeFromDenylist(context.Background(), db, key))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDenylist_Until(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	ctx := context.Background()
+	key := make([]byte, 32)
+	until := time.Date(2020, 9, 13, 13, 26, 40, 0, time.FixedZone("EDT", -4*60*60))
+
+	mock.ExpectExec(addToDenylistUntilQuery).WithArgs(key, until.UTC(), key).WillReturnResult(sqlmock.NewResult(1, 1))
+	assert.Nil(t, addToDenylistUntil(ctx, db, key, until))
+
+	// A permanent entry is still added while a temporary one is active, so
+	// the keypair stays blocked once the temporary one expires
+	mock.ExpectExec(addToDenylistQuery).WithArgs(key, key).WillReturnResult(sqlmock.NewResult(2, 1))
+	assert.Nil(t, addToDenylist(ctx, db, key))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDenylist_InvalidKey(t *testing.T) {
+	ctx := context.Background()
+	key := make([]byte, 8)
+
+	assert.Equal(t, ErrInvalidKeyFormat, addToDenylist(ctx, nil, key))
+	assert.Equal(t, ErrInvalidKeyFormat, addToDenylistUntil(ctx, nil, key, time.Now()))
+	assert.Equal(t, ErrInvalidKeyFormat, removeFromDenylist(ctx, nil, key))
+	_, err := isDenylisted(ctx, nil, key)
+	assert.Equal(t, ErrInvalidKeyFormat, err)
+}
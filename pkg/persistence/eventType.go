@@ -11,6 +11,8 @@ type EventType string
 // OTKExpired One Time Key Expired
 // OTKExpiredNoUploads One Time Key Expired with no TEK uploads (not exclusive but subset)
 // OTKExhausted One Time Key exhausted all it's TEKs
+// UploadCohort TEK upload tagged with an allowlisted cohort, the cohort is recorded as the source
+// NotificationShown Exposure notifications reported as shown to users, as an aggregate count
 const (
 	OTKClaimed          EventType = "OTKClaimed"
 	OTKUnclaimed        EventType = "OTKUnclaimed"
@@ -19,12 +21,14 @@ const (
 	OTKExhausted        EventType = "OTKExhausted"
 	OTKExpiredNoUploads EventType = "OTKExpiredNoUploads"
 	OTKRegenerated      EventType = "OTKRegenerated"
+	UploadCohort        EventType = "UploadCohort"
+	NotificationShown   EventType = "NotificationShown"
 )
 
 // IsValid validates the Event Type against a list of allowed strings
 func (et EventType) IsValid() error {
 	switch et {
-	case OTKGenerated, OTKClaimed, OTKExpired, OTKRegenerated, OTKExhausted, OTKExpiredNoUploads, OTKUnclaimed:
+	case OTKGenerated, OTKClaimed, OTKExpired, OTKRegenerated, OTKExhausted, OTKExpiredNoUploads, OTKUnclaimed, UploadCohort, NotificationShown:
 		return nil
 	}
 	return fmt.Errorf("invalid EventType: (%s)", et)
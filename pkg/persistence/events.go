@@ -2,12 +2,20 @@ package persistence
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/metric"
 
+	"github.com/cds-snc/covid-alert-server/pkg/config"
 	"github.com/cds-snc/covid-alert-server/pkg/keyclaim"
 )
 
@@ -25,23 +33,80 @@ type Event struct {
 	Originator string
 }
 
-var originatorLookup keyclaim.Authenticator
+// ErrEmptyOriginator is returned when saving an Event with no Originator; it
+// could only be recorded as an empty source that no one can attribute
+var ErrEmptyOriginator = errors.New("event originator is empty")
+
+var originatorLookups []keyclaim.Authenticator
 
 // SetupLookup Setup the originator lookup used to map events to bearerTokens
 func SetupLookup(lookup keyclaim.Authenticator) {
-	originatorLookup = lookup
+	originatorLookups = []keyclaim.Authenticator{lookup}
 }
 
-func translateToken(token string) string {
-	region, ok := originatorLookup.Authenticate(token)
+// SetupLookups Setup an ordered chain of originator lookups, consulted until one
+// maps the token to a region. Used while migrating token schemes so tokens
+// from the legacy scheme still resolve through fallback.
+func SetupLookups(primary, fallback keyclaim.Authenticator) {
+	originatorLookups = []keyclaim.Authenticator{primary, fallback}
+}
 
-	// If we forgot to map a token to a PT just return the token
-	if region == "302" {
-		return token
+// Reasons translateToken can fail to map a token to a region, recorded as the
+// miss_type label of covidshield.originator.translation_misses
+const (
+	translationMissSentinel = "sentinel" // known, but mapped to the "302" placeholder
+	translationMissUnknown  = "unknown"  // not known to any lookup
+)
+
+var translationMisses = metric.Must(global.Meter("covidshield")).NewInt64Counter("covidshield.originator.translation_misses",
+	metric.WithDescription("Number of originator tokens that couldn't be translated to a region, by miss type"),
+)
+
+// lookupRegion returns the region of the first lookup in the chain that maps
+// token to one. A "302" region means the token is known but was never mapped
+// to a PT, so it doesn't count and the next lookup is tried.
+func lookupRegion(token string) (string, bool) {
+	region, miss := resolveRegion(token)
+	return region, miss == ""
+}
+
+// missingLookupWarning makes sure an unset lookup is only warned about once
+var missingLookupWarning sync.Once
+
+// resolveRegion is lookupRegion, but says why token wasn't mapped when it
+// isn't: translationMissSentinel if any lookup knew it as "302". Nil lookups
+// are skipped, so before SetupLookup every token is passed through unmapped.
+func resolveRegion(token string) (string, string) {
+	miss := translationMissUnknown
+	found := false
+	for _, lookup := range originatorLookups {
+		if lookup == nil {
+			continue
+		}
+		found = true
+		region, ok := lookup.Authenticate(token)
+		if !ok {
+			continue
+		}
+		if region != "302" {
+			return region, ""
+		}
+		miss = translationMissSentinel
+	}
+	if !found {
+		missingLookupWarning.Do(func() {
+			log(nil, nil).Warn("originator lookup not set up, passing tokens through untranslated")
+		})
 	}
+	return "", miss
+}
 
-	// If it's an old token or unknown just return the token
-	if ok == false {
+func translateToken(token string) string {
+	// If it's an old token, unknown, or we forgot to map it to a PT just
+	// return the token
+	region, miss := resolveRegion(token)
+	if miss != "" {
+		translationMisses.Add(context.Background(), 1, kv.String("miss_type", miss))
 		return token
 	}
 
@@ -50,15 +115,63 @@ func translateToken(token string) string {
 
 // translateTokenForLogs Since we don't want to log bearer tokens to the log file we only use the first and last character
 func translateTokenForLogs(token string) string {
-	region, ok := originatorLookup.Authenticate(token)
+	if token == "" {
+		return ""
+	}
+
+	region, ok := lookupRegion(token)
 
-	if region == "302" || ok == false {
-		return fmt.Sprintf("%s...%s", token[0:1], token[len(token)-1:])
+	if !ok {
+		return RedactToken(token)
 	}
 
 	return region
 }
 
+// MaskedToken stands in for tokens in logs when maskOriginatorInLogs is set
+const MaskedToken = "[masked]"
+
+// RedactToken returns the form of a bearer token that may be logged: its
+// first and last characters, or MaskedToken if maskOriginatorInLogs is set
+func RedactToken(token string) string {
+	if config.AppConstants.MaskOriginatorInLogs {
+		return MaskedToken
+	}
+	return partialToken(token)
+}
+
+// partialToken is a token's first and last characters
+func partialToken(token string) string {
+	return fmt.Sprintf("%s...%s", token[0:1], token[len(token)-1:])
+}
+
+// TokenForLogs returns the region a bearer token is mapped to, or a redacted
+// form of the token, for logging by other packages
+func TokenForLogs(token string) string {
+	return translateTokenForLogs(token)
+}
+
+// ExportableSource returns an events source as it may be sent off the server.
+// translateToken records the raw bearer token as the source of events from an
+// originator it couldn't map to a region, so any source that isn't a region
+// one of the lookups maps to is redacted with RedactToken.
+func ExportableSource(source string) string {
+	if source == "" {
+		return ""
+	}
+	for _, lookup := range originatorLookups {
+		if lookup == nil {
+			continue
+		}
+		for _, region := range lookup.Regions() {
+			if region == source && region != config.AppConstants.RegionCode {
+				return source
+			}
+		}
+	}
+	return RedactToken(source)
+}
+
 // LogEvent Log a failed Event
 func LogEvent(ctx context.Context, err error, event Event) {
 
@@ -71,48 +184,168 @@ func LogEvent(ctx context.Context, err error, event Event) {
 	}).Warn("Unable to log event")
 }
 
-// SaveEvent log an Event in the database
+// SaveEvent log an Event in the database. With dualWriteEventsTable set it is
+// also added to that table, on EVENTS_DUAL_WRITE_URL if given, which only
+// ever logs a failure: the events table stays the source of truth.
 func (c *conn) SaveEvent(event Event) error {
+	ctx, cancel := c.statementContext(context.Background())
+	defer cancel()
 
-	if err := saveEvent(c.db, event); err != nil {
+	originator, err := storeEvent(ctx, c.db, event)
+	if err != nil {
 		return err
 	}
+
+	if table := config.AppConstants.DualWriteEventsTable; table != "" && originator != "" {
+		db := c.db
+		if c.eventsDualWrite != nil {
+			db = c.eventsDualWrite
+		}
+		if err := insertEvent(ctx, db, table, originator, event); err != nil {
+			log(nil, err).WithField("table", table).Warn("unable to dual-write event")
+		}
+	}
 	return nil
 }
 
-func saveEvent(db *sql.DB, e Event) error {
+// eventExecer is the part of *sql.DB and *sql.Tx insertEvent needs
+type eventExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertEvent adds e's count to its bucket in table, which has the columns
+// of events
+func insertEvent(ctx context.Context, db eventExecer, table, originator string, e Event) error {
+	columns, placeholders, bucket := eventBucket(e.Date)
+	args := append(append([]interface{}{originator, e.Identifier, e.DeviceType}, bucket...), e.Count, e.Count)
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`
+		INSERT INTO %s
+		(source, identifier, device_type, %s, count)
+		VALUES (?, ?, ?, %s, ?) ON DUPLICATE KEY UPDATE count = count + ?`, table, columns, placeholders),
+		args...)
+	return err
+}
+
+func saveEvent(ctx context.Context, db *sql.DB, e Event) error {
+	_, err := storeEvent(ctx, db, e)
+	return err
+}
+
+// storeEvent is saveEvent, also returning the originator e was stored under,
+// translated once so it can be reused, or "" if e wasn't stored
+func storeEvent(ctx context.Context, db *sql.DB, e Event) (string, error) {
+	if e.Originator == "" {
+		return "", ErrEmptyOriginator
+	}
+
 	if err := e.DeviceType.IsValid(); err != nil {
-		return err
+		return "", err
 	}
 
 	if err := e.Identifier.IsValid(); err != nil {
-		return err
+		return "", err
+	}
+
+	if e.DeviceType == Server && !config.AppConstants.RecordServerEvents {
+		return "", nil
 	}
 
 	originator := translateToken(e.Originator)
 
-	tx, err := db.Begin()
+	date := e.Date.Format("2006-01-02")
+	columns, placeholders, bucket := eventBucket(e.Date)
+
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	if _, err := tx.Exec(`
-		INSERT INTO events
-		(source, identifier, device_type, date, count)
-		VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE count = count + ?`,
-		originator, e.Identifier, e.DeviceType, e.Date.Format("2006-01-02"), e.Count, e.Count); err != nil {
-
+	if err := insertEvent(ctx, tx, "events", originator, e); err != nil {
 		if err := tx.Rollback(); err != nil {
-			return err
+			return "", err
+		}
+		return "", err
+	}
+
+	if config.AppConstants.RecordRawOriginator {
+		args := append(append([]interface{}{originator, hashOriginator(e.Originator), e.Identifier, e.DeviceType}, bucket...), e.Count, e.Count)
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`
+			INSERT INTO events_by_originator
+			(source, originator_hash, identifier, device_type, %s, count)
+			VALUES (?, ?, ?, ?, %s, ?) ON DUPLICATE KEY UPDATE count = count + ?`, columns, placeholders),
+			args...); err != nil {
+
+			if err := tx.Rollback(); err != nil {
+				return "", err
+			}
+			return "", err
 		}
-		return err
 	}
 
 	if err := tx.Commit(); err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	checkDistinctOriginators(db, date)
+
+	return originator, nil
+}
+
+// eventBucket returns the columns, placeholders and values that identify the
+// aggregation bucket t falls in. Daily buckets leave hour at its default of 0,
+// so rows written before hourly buckets existed keep aggregating with them.
+func eventBucket(t time.Time) (string, string, []interface{}) {
+	if config.AppConstants.EventAggregationBucket == "hour" {
+		return "date, hour", "?, ?", []interface{}{t.Format("2006-01-02"), t.Hour()}
+	}
+	return "date", "?", []interface{}{t.Format("2006-01-02")}
+}
+
+// hashOriginator identifies the raw bearer token an event came from without
+// storing the token itself
+func hashOriginator(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// originatorAlertDate is the last date checkDistinctOriginators alerted for,
+// so the alert is logged once per day rather than on every event after
+var (
+	originatorAlertMu   sync.Mutex
+	originatorAlertDate string
+)
+
+// checkDistinctOriginators logs an error when more distinct sources have
+// written events on date than maxDistinctOriginatorsPerDay. Unmapped tokens
+// are recorded as their own source, so a jump in distinct sources usually
+// means the token mapping is broken.
+func checkDistinctOriginators(db *sql.DB, date string) {
+	max := config.AppConstants.MaxDistinctOriginatorsPerDay
+	if max <= 0 {
+		return
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(DISTINCT source) FROM events WHERE date = ?`, date).Scan(&count); err != nil {
+		log(nil, err).Warn("unable to count distinct originators")
+		return
+	}
+	if count <= max {
+		return
+	}
+
+	originatorAlertMu.Lock()
+	defer originatorAlertMu.Unlock()
+	if originatorAlertDate == date {
+		return
+	}
+	originatorAlertDate = date
+
+	log(nil, nil).WithFields(logrus.Fields{
+		"date":      date,
+		"count":     count,
+		"threshold": max,
+	}).Error("too many distinct originators, token mapping may be broken")
 }
 
 // Events the aggregate of events identified in Identifier by Source
@@ -129,20 +362,34 @@ type Events struct {
 
 // GetServerEvents get all the events that occurred in a day
 func (c *conn) GetServerEvents(date string) ([]Events, error) {
-	return getServerEventsByType(c.db, date)
+	return getServerEventsByType(c.reader(), date)
+}
+
+// GetEvents get all the events generated by deviceType in a day
+func (c *conn) GetEvents(date string, deviceType DeviceType) ([]Events, error) {
+	return getEventsByType(c.reader(), date, deviceType)
 }
 
 func getServerEventsByType(db *sql.DB, date string) ([]Events, error) {
+	return getEventsByType(db, date, Server)
+}
+
+func getEventsByType(db *sql.DB, date string, deviceType DeviceType) ([]Events, error) {
 
 	if date == "" {
 		return nil, fmt.Errorf("a date is required for querying events")
 	}
 
+	if err := deviceType.IsValid(); err != nil {
+		return nil, err
+	}
+
 	rows, err := db.Query(`
-	SELECT identifier, source, date, count 
-	FROM events 
-	WHERE events.device_type = ? AND events.date = ?`,
-		Server, date)
+	SELECT identifier, source, date, SUM(count)
+	FROM events
+	WHERE events.device_type = ? AND events.date = ?
+	GROUP BY identifier, source, date`,
+		deviceType, date)
 
 	if err != nil {
 		return nil, err
@@ -170,6 +417,77 @@ func getServerEventsByType(db *sql.DB, date string) ([]Events, error) {
 	return events, nil
 }
 
+// OtkFunnel the number of OTKs generated, claimed and expired on a date
+// Date the date the events occurred
+// Generated the number of OTKGenerated events
+// Claimed the number of OTKClaimed events
+// Expired the number of OTKExpired events
+type OtkFunnel struct {
+	Date      string `json:"date"`
+	Generated int64  `json:"generated"`
+	Claimed   int64  `json:"claimed"`
+	Expired   int64  `json:"expired"`
+}
+
+// GetOtkFunnel get the OTK funnel for each day between startDate and endDate inclusive
+func (c *conn) GetOtkFunnel(startDate, endDate string) ([]OtkFunnel, error) {
+	return getOtkFunnelByDateRange(c.reader(), startDate, endDate)
+}
+
+func getOtkFunnelByDateRange(db *sql.DB, startDate, endDate string) ([]OtkFunnel, error) {
+
+	if startDate == "" || endDate == "" {
+		return nil, fmt.Errorf("a start and end date are required for querying events")
+	}
+
+	rows, err := db.Query(`
+	SELECT identifier, date, SUM(count)
+	FROM events
+	WHERE events.device_type = ?
+	AND events.identifier IN (?, ?, ?)
+	AND events.date >= ? AND events.date <= ?
+	GROUP BY date, identifier
+	ORDER BY date`,
+		Server, OTKGenerated, OTKClaimed, OTKExpired, startDate, endDate)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var funnel []OtkFunnel
+
+	for rows.Next() {
+		var identifier EventType
+		var t time.Time
+		var count int64
+
+		err := rows.Scan(&identifier, &t, &count)
+
+		if err != nil {
+			return nil, err
+		}
+
+		date := t.Format("2006-01-02")
+		if len(funnel) == 0 || funnel[len(funnel)-1].Date != date {
+			funnel = append(funnel, OtkFunnel{Date: date})
+		}
+
+		switch identifier {
+		case OTKGenerated:
+			funnel[len(funnel)-1].Generated += count
+		case OTKClaimed:
+			funnel[len(funnel)-1].Claimed += count
+		case OTKExpired:
+			funnel[len(funnel)-1].Expired += count
+		}
+	}
+
+	if funnel == nil {
+		funnel = make([]OtkFunnel, 0)
+	}
+	return funnel, nil
+}
+
 // Uploads the aggregate of uploads identified in orignator by Source
 // Source the bearer token that generated these uploads
 // Date the date the upload occurs
@@ -184,7 +502,7 @@ type Uploads struct {
 
 // GetTEKUploads get all the events that occurred in a day
 func (c *conn) GetTEKUploads(date string) ([]Uploads, error) {
-	return getTEKUploadsByDay(c.db, date)
+	return getTEKUploadsByDay(c.reader(), date)
 }
 
 func getTEKUploadsByDay(db *sql.DB, date string) ([]Uploads, error) {
@@ -0,0 +1,52 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// ClaimEventsExport claims the export of date's events for this instance, so
+// only one replica sends each day. It reports false if the day was already
+// exported, or claimed less than staleAfter ago by an instance that may still
+// be sending it.
+func (c *conn) ClaimEventsExport(ctx context.Context, date string, staleAfter time.Duration) (bool, error) {
+	ctx, cancel := c.statementContext(ctx)
+	defer cancel()
+	return claimEventsExport(ctx, c.db, date, time.Now().UTC(), staleAfter)
+}
+
+func claimEventsExport(ctx context.Context, db *sql.DB, date string, now time.Time, staleAfter time.Duration) (bool, error) {
+	// Affects 1 row for a new claim, 2 for a taken over stale one and 0
+	// otherwise
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO events_exports (date, claimed_at) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE claimed_at = IF(exported_at IS NULL AND claimed_at < ?, VALUES(claimed_at), claimed_at)`,
+		date, now, now.Add(-staleAfter),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// FinishEventsExport records that date's events were exported, or if not
+// gives up the claim so another run can try again
+func (c *conn) FinishEventsExport(ctx context.Context, date string, exported bool) error {
+	ctx, cancel := c.statementContext(ctx)
+	defer cancel()
+	return finishEventsExport(ctx, c.db, date, exported, time.Now().UTC())
+}
+
+func finishEventsExport(ctx context.Context, db *sql.DB, date string, exported bool, now time.Time) error {
+	if !exported {
+		_, err := db.ExecContext(ctx, `DELETE FROM events_exports WHERE date = ? AND exported_at IS NULL`, date)
+		return err
+	}
+	_, err := db.ExecContext(ctx, `UPDATE events_exports SET exported_at = ? WHERE date = ?`, now, date)
+	return err
+}
@@ -0,0 +1,61 @@
+package persistence
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimEventsExport(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	query := `
+		INSERT INTO events_exports (date, claimed_at) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE claimed_at = IF(exported_at IS NULL AND claimed_at < ?, VALUES(claimed_at), claimed_at)`
+	now := time.Date(2020, 9, 14, 2, 0, 0, 0, time.UTC)
+	stale := now.Add(-time.Hour)
+
+	// A new claim
+	mock.ExpectExec(query).WithArgs("2020-09-13", now, stale).WillReturnResult(sqlmock.NewResult(1, 1))
+	claimed, err := claimEventsExport(context.Background(), db, "2020-09-13", now, time.Hour)
+	assert.Nil(t, err)
+	assert.True(t, claimed)
+
+	// A stale claim taken over
+	mock.ExpectExec(query).WithArgs("2020-09-13", now, stale).WillReturnResult(sqlmock.NewResult(1, 2))
+	claimed, err = claimEventsExport(context.Background(), db, "2020-09-13", now, time.Hour)
+	assert.Nil(t, err)
+	assert.True(t, claimed)
+
+	// Exported, or claimed by another instance that may still be sending it
+	mock.ExpectExec(query).WithArgs("2020-09-13", now, stale).WillReturnResult(sqlmock.NewResult(1, 0))
+	claimed, err = claimEventsExport(context.Background(), db, "2020-09-13", now, time.Hour)
+	assert.Nil(t, err)
+	assert.False(t, claimed)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestFinishEventsExport(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	now := time.Date(2020, 9, 14, 2, 0, 0, 0, time.UTC)
+
+	mock.ExpectExec(`UPDATE events_exports SET exported_at = ? WHERE date = ?`).WithArgs(now, "2020-09-13").WillReturnResult(sqlmock.NewResult(1, 1))
+	assert.Nil(t, finishEventsExport(context.Background(), db, "2020-09-13", true, now))
+
+	// A failed export gives up its claim
+	mock.ExpectExec(`DELETE FROM events_exports WHERE date = ? AND exported_at IS NULL`).WithArgs("2020-09-13").WillReturnResult(sqlmock.NewResult(1, 1))
+	assert.Nil(t, finishEventsExport(context.Background(), db, "2020-09-13", false, now))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
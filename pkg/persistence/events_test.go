@@ -1,17 +1,56 @@
 package persistence
 
 import (
+	"context"
 	"fmt"
+	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	keyclaim "github.com/cds-snc/covid-alert-server/mocks/pkg/keyclaim"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
 	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/exporters/metric/prometheus"
+	"go.opentelemetry.io/otel/sdk/metric/controller/pull"
 )
 
+var (
+	testMeterOnce     sync.Once
+	testMeterExporter *prometheus.Exporter
+)
+
+// translationMissCount installs a prometheus pipeline as the global meter
+// provider (once per test run) and returns the current count of translation
+// misses of missType
+func translationMissCount(missType string) float64 {
+	testMeterOnce.Do(func() {
+		exporter, err := prometheus.InstallNewPipeline(prometheus.Config{}, pull.WithCachePeriod(0))
+		if err != nil {
+			panic(err)
+		}
+		testMeterExporter = exporter
+	})
+
+	resp := httptest.NewRecorder()
+	testMeterExporter.ServeHTTP(resp, httptest.NewRequest("GET", "/metrics", nil))
+
+	prefix := fmt.Sprintf(`covidshield_originator_translation_misses{miss_type="%s"}`, missType)
+	for _, line := range strings.Split(resp.Body.String(), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			fields := strings.Fields(line)
+			value, _ := strconv.ParseFloat(fields[len(fields)-1], 64)
+			return value
+		}
+	}
+	return 0
+}
+
 func Test_translateToken(t *testing.T) {
 
 	token3 := strings.Repeat("c", 20)
@@ -42,6 +81,137 @@ func Test_translateTokenForLogs(t *testing.T) {
 
 }
 
+func Test_translateTokenForLogsMasked(t *testing.T) {
+	oldMask := config.AppConstants.MaskOriginatorInLogs
+	defer func() { config.AppConstants.MaskOriginatorInLogs = oldMask }()
+	config.AppConstants.MaskOriginatorInLogs = true
+
+	token3 := strings.Repeat("c", 20)
+
+	// Regions aren't tokens, so they are still logged
+	assert.Equal(t, onApi, translateTokenForLogs(token1))
+
+	// Nothing of an unmapped token is
+	assert.Equal(t, MaskedToken, translateTokenForLogs(token2))
+	assert.Equal(t, MaskedToken, translateTokenForLogs(token3))
+	assert.Equal(t, MaskedToken, TokenForLogs(token3))
+	assert.NotContains(t, translateTokenForLogs(token3), "c")
+
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+	LogEvent(context.Background(), nil, Event{Originator: token3, DeviceType: Android, Identifier: OTKClaimed, Count: 1})
+	assert.Equal(t, MaskedToken, hook.LastEntry().Data["Originator"])
+}
+
+func Test_translateTokenFallback(t *testing.T) {
+
+	oldLookups := originatorLookups
+	defer func() { originatorLookups = oldLookups }()
+
+	legacyToken := strings.Repeat("d", 20)
+	unmappedToken := strings.Repeat("e", 20)
+	unknownToken := strings.Repeat("f", 20)
+
+	primary := &keyclaim.Authenticator{}
+	primary.On("Authenticate", token1).Return(onApi, true)
+	primary.On("Authenticate", legacyToken).Return("", false)
+	primary.On("Authenticate", unmappedToken).Return("302", true)
+	primary.On("Authenticate", unknownToken).Return("", false)
+
+	fallback := &keyclaim.Authenticator{}
+	fallback.On("Authenticate", legacyToken).Return("QCApi", true)
+	fallback.On("Authenticate", unmappedToken).Return("302", true)
+	fallback.On("Authenticate", unknownToken).Return("", false)
+
+	SetupLookups(primary, fallback)
+
+	// Primary resolves without consulting the fallback
+	assert.Equal(t, onApi, translateToken(token1))
+	fallback.AssertNotCalled(t, "Authenticate", token1)
+
+	// Only the fallback resolves the token
+	assert.Equal(t, "QCApi", translateToken(legacyToken))
+	assert.Equal(t, "QCApi", translateTokenForLogs(legacyToken))
+
+	// A 302 anywhere in the chain is never used as the region
+	assert.Equal(t, unmappedToken, translateToken(unmappedToken))
+	assert.Equal(t, "e...e", translateTokenForLogs(unmappedToken))
+
+	// Unknown to both
+	assert.Equal(t, unknownToken, translateToken(unknownToken))
+	assert.Equal(t, "f...f", translateTokenForLogs(unknownToken))
+}
+
+func TestExportableSource(t *testing.T) {
+
+	oldLookups := originatorLookups
+	defer func() { originatorLookups = oldLookups }()
+
+	primary := &keyclaim.Authenticator{}
+	primary.On("Regions").Return([]string{onApi, "302"})
+	fallback := &keyclaim.Authenticator{}
+	fallback.On("Regions").Return([]string{"QCApi"})
+	SetupLookups(primary, fallback)
+
+	// Regions from any lookup are sent as they are
+	assert.Equal(t, onApi, ExportableSource(onApi))
+	assert.Equal(t, "QCApi", ExportableSource("QCApi"))
+
+	// Raw tokens recorded for unmapped originators aren't, nor is 302
+	assert.Equal(t, "e...e", ExportableSource(strings.Repeat("e", 20)))
+	assert.Equal(t, "3...2", ExportableSource("302"))
+	assert.Equal(t, "", ExportableSource(""))
+}
+
+func Test_translateToken302FallsBack(t *testing.T) {
+
+	oldLookups := originatorLookups
+	defer func() { originatorLookups = oldLookups }()
+
+	primary := &keyclaim.Authenticator{}
+	primary.On("Authenticate", token2).Return("302", true)
+
+	fallback := &keyclaim.Authenticator{}
+	fallback.On("Authenticate", token2).Return(onApi, true)
+
+	SetupLookups(primary, fallback)
+
+	assert.Equal(t, onApi, translateToken(token2))
+}
+
+func Test_translateTokenCountsMisses(t *testing.T) {
+
+	oldLookups := originatorLookups
+	defer func() { originatorLookups = oldLookups }()
+
+	unmappedToken := strings.Repeat("e", 20)
+	unknownToken := strings.Repeat("f", 20)
+
+	lookup := &keyclaim.Authenticator{}
+	lookup.On("Authenticate", token1).Return(onApi, true)
+	lookup.On("Authenticate", unmappedToken).Return("302", true)
+	lookup.On("Authenticate", unknownToken).Return("", false)
+	SetupLookup(lookup)
+
+	sentinel := translationMissCount(translationMissSentinel)
+	unknown := translationMissCount(translationMissUnknown)
+
+	translateToken(unmappedToken)
+	assert.Equal(t, sentinel+1, translationMissCount(translationMissSentinel))
+	assert.Equal(t, unknown, translationMissCount(translationMissUnknown))
+
+	translateToken(unknownToken)
+	translateToken(unknownToken)
+	assert.Equal(t, sentinel+1, translationMissCount(translationMissSentinel))
+	assert.Equal(t, unknown+2, translationMissCount(translationMissUnknown))
+
+	// Mapped tokens, and translating for logs, don't count
+	translateToken(token1)
+	translateTokenForLogs(unknownToken)
+	assert.Equal(t, sentinel+1, translationMissCount(translationMissSentinel))
+	assert.Equal(t, unknown+2, translationMissCount(translationMissUnknown))
+}
+
 func setupSaveEventMock(mock sqlmock.Sqlmock, event Event) {
 	mock.ExpectBegin()
 	mock.ExpectExec(
@@ -73,8 +243,409 @@ func Test_SaveEvent(t *testing.T) {
 
 	setupSaveEventMock(mock, event)
 
-	saveEvent(db, event)
+	saveEvent(context.Background(), db, event)
+
+}
+
+func Test_SaveEvent_BeforeSetupLookup(t *testing.T) {
+
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	// As when the app calls SetupLookup before its authenticator is built
+	oldLookups := originatorLookups
+	defer func() { originatorLookups = oldLookups }()
+	SetupLookup(nil)
+	assert.Len(t, originatorLookups, 1)
+	assert.Nil(t, originatorLookups[0])
+	missingLookupWarning = sync.Once{}
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	event := Event{
+		Identifier: OTKClaimed,
+		Originator: token1,
+		Count:      1,
+		DeviceType: IOS,
+		Date:       time.Now(),
+	}
+
+	// The raw token is recorded rather than panicking
+	setupSaveEventMock(mock, event)
+	setupSaveEventMock(mock, event)
+
+	c := &conn{db: db}
+	assert.Nil(t, c.SaveEvent(event))
+	assert.Nil(t, c.SaveEvent(event))
+	assert.Equal(t, "a...a", translateTokenForLogs(token1))
+
+	// Warned about only the once
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "originator lookup not set up, passing tokens through untranslated")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func Test_SaveEvent_RecordRawOriginator(t *testing.T) {
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	config.AppConstants.RecordRawOriginator = true
+	defer func() { config.AppConstants.RecordRawOriginator = false }()
+
+	date := time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)
+	event := Event{
+		Identifier: OTKClaimed,
+		Originator: token1,
+		Count:      2,
+		DeviceType: IOS,
+		Date:       date,
+	}
+
+	// The aggregate row stays keyed by region, the raw token only appears hashed
+	mock.ExpectBegin()
+	mock.ExpectExec(`
+		INSERT INTO events
+		(source, identifier, device_type, date, count)
+		VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE count = count + ?`).
+		WithArgs(onApi, OTKClaimed, IOS, "2020-09-01", 2, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`
+			INSERT INTO events_by_originator
+			(source, originator_hash, identifier, device_type, date, count)
+			VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE count = count + ?`).
+		WithArgs(onApi, "42492da06234ad0ac76f5d5debdb6d1ae027cffbe746a1c13b89bb8bc0139137", OTKClaimed, IOS, "2020-09-01", 2, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	assert.Nil(t, saveEvent(context.Background(), db, event))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func Test_SaveEvent_HourlyBuckets(t *testing.T) {
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	config.AppConstants.EventAggregationBucket = "hour"
+	defer func() { config.AppConstants.EventAggregationBucket = "day" }()
+
+	hourlyInsert := `
+		INSERT INTO events
+		(source, identifier, device_type, date, hour, count)
+		VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE count = count + ?`
+
+	// Events in the same hour land in the same bucket, the next hour gets its own
+	times := []time.Time{
+		time.Date(2020, 9, 1, 14, 5, 0, 0, time.UTC),
+		time.Date(2020, 9, 1, 14, 55, 0, 0, time.UTC),
+		time.Date(2020, 9, 1, 15, 0, 0, 0, time.UTC),
+	}
+	hours := []int{14, 14, 15}
+
+	for i, date := range times {
+		mock.ExpectBegin()
+		mock.ExpectExec(hourlyInsert).
+			WithArgs(onApi, OTKClaimed, IOS, "2020-09-01", hours[i], 1, 1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		assert.Nil(t, saveEvent(context.Background(), db, Event{
+			Identifier: OTKClaimed,
+			Originator: token1,
+			Count:      1,
+			DeviceType: IOS,
+			Date:       date,
+		}))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func Test_SaveEvent_HourlyBucketsRecordRawOriginator(t *testing.T) {
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	config.AppConstants.EventAggregationBucket = "hour"
+	config.AppConstants.RecordRawOriginator = true
+	defer func() {
+		config.AppConstants.EventAggregationBucket = "day"
+		config.AppConstants.RecordRawOriginator = false
+	}()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`
+		INSERT INTO events
+		(source, identifier, device_type, date, hour, count)
+		VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE count = count + ?`).
+		WithArgs(onApi, OTKClaimed, IOS, "2020-09-01", 9, 2, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`
+			INSERT INTO events_by_originator
+			(source, originator_hash, identifier, device_type, date, hour, count)
+			VALUES (?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE count = count + ?`).
+		WithArgs(onApi, "42492da06234ad0ac76f5d5debdb6d1ae027cffbe746a1c13b89bb8bc0139137", OTKClaimed, IOS, "2020-09-01", 9, 2, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	assert.Nil(t, saveEvent(context.Background(), db, Event{
+		Identifier: OTKClaimed,
+		Originator: token1,
+		Count:      2,
+		DeviceType: IOS,
+		Date:       time.Date(2020, 9, 1, 9, 30, 0, 0, time.UTC),
+	}))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func Test_SaveEvent_ServerEventsSuppressed(t *testing.T) {
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	config.AppConstants.RecordServerEvents = false
+	defer func() { config.AppConstants.RecordServerEvents = true }()
+
+	serverEvent := Event{
+		Identifier: OTKExpired,
+		Originator: token1,
+		Count:      1,
+		DeviceType: Server,
+		Date:       time.Now(),
+	}
+
+	// No DB expectations, any write would fail the test
+	err := saveEvent(context.Background(), db, serverEvent)
+	assert.Nil(t, err, "Expected no error when skipping a Server event")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	iosEvent := Event{
+		Identifier: OTKClaimed,
+		Originator: token1,
+		Count:      1,
+		DeviceType: IOS,
+		Date:       time.Now(),
+	}
+
+	setupSaveEventMock(mock, Event{
+		Identifier: iosEvent.Identifier,
+		Originator: onApi,
+		Count:      iosEvent.Count,
+		DeviceType: iosEvent.DeviceType,
+	})
+
+	err = saveEvent(context.Background(), db, iosEvent)
+	assert.Nil(t, err, "Expected iOS events to still be written")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func Test_SaveEvent_EmptyOriginator(t *testing.T) {
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	event := Event{
+		Identifier: OTKClaimed,
+		Originator: "",
+		Count:      1,
+		DeviceType: IOS,
+		Date:       time.Now(),
+	}
+
+	// No DB expectations, any write would fail the test
+	assert.Equal(t, ErrEmptyOriginator, saveEvent(context.Background(), db, event))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	// Logging the failed event must not panic on the empty token
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	assert.NotPanics(t, func() { LogEvent(nil, ErrEmptyOriginator, event) })
+	assert.Equal(t, "", hook.LastEntry().Data["Originator"])
+}
+
+func Test_SaveEvent_TooManyDistinctOriginators(t *testing.T) {
+
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	oldMax := config.AppConstants.MaxDistinctOriginatorsPerDay
+	config.AppConstants.MaxDistinctOriginatorsPerDay = 2
+	defer func() { config.AppConstants.MaxDistinctOriginatorsPerDay = oldMax }()
+
+	defer func() { originatorAlertDate = "" }()
+
+	date := time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)
+	event := Event{
+		Identifier: OTKClaimed,
+		Originator: token1,
+		Count:      1,
+		DeviceType: IOS,
+		Date:       date,
+	}
+	expected := Event{
+		Identifier: event.Identifier,
+		Originator: onApi,
+		Count:      event.Count,
+		DeviceType: event.DeviceType,
+	}
+	countQuery := `SELECT COUNT(DISTINCT source) FROM events WHERE date = ?`
+
+	// At the threshold: no alert
+	setupSaveEventMock(mock, expected)
+	mock.ExpectQuery(countQuery).WithArgs("2020-09-01").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+
+	assert.Nil(t, saveEvent(context.Background(), db, event))
+	assert.Equal(t, 0, len(hook.Entries))
+
+	// Over the threshold: alert once
+	setupSaveEventMock(mock, expected)
+	mock.ExpectQuery(countQuery).WithArgs("2020-09-01").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+
+	assert.Nil(t, saveEvent(context.Background(), db, event))
+	assert.Equal(t, 3, hook.LastEntry().Data["count"])
+	assert.Equal(t, 2, hook.LastEntry().Data["threshold"])
+	testhelpers.AssertLog(t, hook, 1, logrus.ErrorLevel, "too many distinct originators, token mapping may be broken")
+
+	// Still over on the same day: not repeated
+	setupSaveEventMock(mock, expected)
+	mock.ExpectQuery(countQuery).WithArgs("2020-09-01").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(4))
+
+	assert.Nil(t, saveEvent(context.Background(), db, event))
+	assert.Equal(t, 0, len(hook.Entries))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func Test_SaveEvent_DualWrite(t *testing.T) {
+
+	oldLookups := originatorLookups
+	defer func() { originatorLookups = oldLookups }()
+	lookup := &keyclaim.Authenticator{}
+	lookup.On("Authenticate", token1).Return(onApi, true)
+	SetupLookup(lookup)
+
+	primary, primaryMock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer primary.Close()
+	secondary, secondaryMock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer secondary.Close()
+
+	config.AppConstants.DualWriteEventsTable = "events_v2"
+	defer func() { config.AppConstants.DualWriteEventsTable = "" }()
+
+	event := Event{
+		Identifier: OTKClaimed,
+		Originator: token1,
+		Count:      3,
+		DeviceType: IOS,
+		Date:       time.Now(),
+	}
+
+	setupSaveEventMock(primaryMock, Event{
+		Identifier: event.Identifier,
+		Originator: onApi,
+		Count:      event.Count,
+		DeviceType: event.DeviceType,
+	})
+	secondaryMock.ExpectExec(
+		`INSERT INTO events_v2
+		(source, identifier, device_type, date, count)
+		VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE count = count + ?`).WithArgs(
+		onApi,
+		event.Identifier,
+		event.DeviceType,
+		AnyType{},
+		event.Count,
+		event.Count,
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	c := &conn{db: primary, eventsDualWrite: secondary}
+	assert.Nil(t, c.SaveEvent(event))
+
+	// The originator is translated once for both writes, so a miss would only
+	// be counted once
+	lookup.AssertNumberOfCalls(t, "Authenticate", 1)
+
+	if err := primaryMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled primary expectations: %s", err)
+	}
+	if err := secondaryMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled secondary expectations: %s", err)
+	}
+}
+
+func Test_SaveEvent_DualWriteFails(t *testing.T) {
+
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	config.AppConstants.DualWriteEventsTable = "events_v2"
+	defer func() { config.AppConstants.DualWriteEventsTable = "" }()
+
+	event := Event{
+		Identifier: OTKClaimed,
+		Originator: token1,
+		Count:      1,
+		DeviceType: IOS,
+		Date:       time.Now(),
+	}
+
+	// Without EVENTS_DUAL_WRITE_URL the table is on the main connection
+	setupSaveEventMock(mock, Event{
+		Identifier: event.Identifier,
+		Originator: onApi,
+		Count:      event.Count,
+		DeviceType: event.DeviceType,
+	})
+	mock.ExpectExec(
+		`INSERT INTO events_v2
+		(source, identifier, device_type, date, count)
+		VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE count = count + ?`).WithArgs(
+		onApi,
+		event.Identifier,
+		event.DeviceType,
+		AnyType{},
+		event.Count,
+		event.Count,
+	).WillReturnError(fmt.Errorf("no such table"))
 
+	c := &conn{db: db}
+	assert.Nil(t, c.SaveEvent(event), "a failed dual-write must not fail the event")
+	assert.Equal(t, "events_v2", hook.LastEntry().Data["table"])
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "unable to dual-write event")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
 }
 
 func Test_LogEvent(t *testing.T) {
@@ -129,10 +700,11 @@ func TestConn_GetServerEventsByTypeStartDateOnly(t *testing.T) {
 	d, _ := time.Parse("2006-01-02", "2020-01-01")
 	rows := sqlmock.NewRows([]string{"identifier", "source", "date", "count"}).AddRow("event", "foo", d, 1)
 	mock.ExpectQuery(`
-		SELECT identifier, source, date, count 
-		FROM events 
-		WHERE events.device_type = ? 
-		  AND events.date = ?`).
+		SELECT identifier, source, date, SUM(count)
+		FROM events
+		WHERE events.device_type = ?
+		  AND events.date = ?
+		GROUP BY identifier, source, date`).
 		WithArgs(Server, "2020-01-01").
 		WillReturnRows(rows)
 
@@ -149,6 +721,95 @@ func TestConn_GetServerEventsByTypeStartDateOnly(t *testing.T) {
 	assert.Equal(t, []Events{{"foo", "2020-01-01", 1, "event"}}, events)
 }
 
+func TestConn_GetEventsByTypeInvalidDeviceType(t *testing.T) {
+
+	db, _, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	_, err := getEventsByType(db, "2020-01-01", "Windows")
+
+	assert.Equal(t, fmt.Errorf("invalid Device Type: (Windows)"), err)
+}
+
+func TestConn_GetEventsByTypeDevice(t *testing.T) {
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	d, _ := time.Parse("2006-01-02", "2020-01-01")
+	rows := sqlmock.NewRows([]string{"identifier", "source", "date", "count"}).AddRow("event", "foo", d, 3)
+	mock.ExpectQuery(`
+		SELECT identifier, source, date, SUM(count)
+		FROM events
+		WHERE events.device_type = ?
+		  AND events.date = ?
+		GROUP BY identifier, source, date`).
+		WithArgs(Android, "2020-01-01").
+		WillReturnRows(rows)
+
+	events, err := getEventsByType(db, "2020-01-01", Android)
+
+	if err != nil {
+		t.Errorf("%s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, []Events{{"foo", "2020-01-01", 3, "event"}}, events)
+}
+
+func TestConn_GetOtkFunnelNoDates(t *testing.T) {
+
+	db, _, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	_, err := getOtkFunnelByDateRange(db, "2020-01-01", "")
+
+	assert.Equal(t, fmt.Errorf("a start and end date are required for querying events"), err)
+}
+
+func TestConn_GetOtkFunnel(t *testing.T) {
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	d1, _ := time.Parse("2006-01-02", "2020-01-01")
+	d2, _ := time.Parse("2006-01-02", "2020-01-02")
+	rows := sqlmock.NewRows([]string{"identifier", "date", "count"}).
+		AddRow(OTKClaimed, d1, 3).
+		AddRow(OTKGenerated, d1, 5).
+		AddRow(OTKClaimed, d2, 4).
+		AddRow(OTKExpired, d2, 1).
+		AddRow(OTKGenerated, d2, 6)
+	mock.ExpectQuery(`
+	SELECT identifier, date, SUM(count)
+	FROM events
+	WHERE events.device_type = ?
+	AND events.identifier IN (?, ?, ?)
+	AND events.date >= ? AND events.date <= ?
+	GROUP BY date, identifier
+	ORDER BY date`).
+		WithArgs(Server, OTKGenerated, OTKClaimed, OTKExpired, "2020-01-01", "2020-01-02").
+		WillReturnRows(rows)
+
+	funnel, err := getOtkFunnelByDateRange(db, "2020-01-01", "2020-01-02")
+
+	if err != nil {
+		t.Errorf("%s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, []OtkFunnel{
+		{Date: "2020-01-01", Generated: 5, Claimed: 3, Expired: 0},
+		{Date: "2020-01-02", Generated: 6, Claimed: 4, Expired: 1},
+	}, funnel)
+}
+
 func TestConn_GetTEKUploadsByDayNoStartDate(t *testing.T) {
 
 	db, _, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
@@ -0,0 +1,68 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/timemath"
+)
+
+// PromoteKeys makes the pending keys uploaded by the keypair with app public
+// key appPubKey retrievable, returning how many were promoted. Only keys from
+// a one time code issued with the bearer token originator are promoted, so a
+// health authority can only release its own uploads. They're moved to the
+// current hour of submission so they're served in a batch clients haven't
+// already fetched.
+func (c *conn) PromoteKeys(ctx context.Context, originator string, appPubKey *[32]byte) (int64, error) {
+	ctx, cancel := c.statementContext(ctx)
+	defer cancel()
+	return promoteKeys(ctx, c.db, originator, appPubKey)
+}
+
+func promoteKeys(ctx context.Context, db *sql.DB, originator string, appPubKey *[32]byte) (int64, error) {
+	now := time.Now()
+
+	// The regions the keys are in can only be found while they're still
+	// pending, so they're looked up first
+	rows, err := db.QueryContext(ctx,
+		"SELECT DISTINCT region FROM diagnosis_keys WHERE pending_app_public_key = ? AND originator = ?",
+		appPubKey[:], originator,
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var regions []string
+	for rows.Next() {
+		var region string
+		if err := rows.Scan(&region); err != nil {
+			return 0, err
+		}
+		regions = append(regions, region)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	result, err := db.ExecContext(ctx,
+		"UPDATE diagnosis_keys SET pending_app_public_key = NULL, hour_of_submission = ? WHERE pending_app_public_key = ? AND originator = ?",
+		timemath.HourNumber(now), appPubKey[:], originator,
+	)
+	if err != nil {
+		return 0, err
+	}
+	promoted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	// As with uploads, regions are marked as updated once their keys are stored
+	if promoted > 0 {
+		for _, region := range regions {
+			bumpRegionUpdated(ctx, db, region, now)
+		}
+	}
+	return promoted, nil
+}
@@ -0,0 +1,117 @@
+package persistence
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const promoteKeysQuery = `UPDATE diagnosis_keys SET pending_app_public_key = NULL, hour_of_submission = ? WHERE pending_app_public_key = ? AND originator = ?`
+
+const promotedRegionsQuery = `SELECT DISTINCT region FROM diagnosis_keys WHERE pending_app_public_key = ? AND originator = ?`
+
+const retrievableKeysQuery = `
+	SELECT region, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level FROM diagnosis_keys
+		WHERE hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND rolling_start_interval_number > ?
+		AND region = ?
+		AND pending_app_public_key IS NULL
+		ORDER BY key_data`
+
+func TestPromoteKeys_PendingThenPromoted(t *testing.T) {
+	oldRequireKeyPromotion := config.AppConstants.RequireKeyPromotion
+	config.AppConstants.RequireKeyPromotion = true
+	defer func() { config.AppConstants.RequireKeyPromotion = oldRequireKeyPromotion }()
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	ctx := context.Background()
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	key := randomTestKey()
+	keyColumns := []string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level"}
+
+	// Keys are stored against the keypair that uploaded them
+	mock.ExpectBegin()
+	row := sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow("302", "randomOrigin", 10)
+	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WillReturnRows(row)
+	mock.ExpectPrepare(
+		`INSERT IGNORE INTO diagnosis_keys
+		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, hour_of_submission, pending_app_public_key)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+	).ExpectExec().WithArgs("302", "randomOrigin", key.GetKeyData(), AnyType{}, AnyType{}, AnyType{}, AnyType{}, pub[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(
+		`INSERT INTO tek_upload_count
+		(originator, date, count, first_upload)
+		VALUES (?, ?, ?, ?)`,
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(
+		`UPDATE encryption_keys
+		SET remaining_keys = remaining_keys - ?, stored_keys = stored_keys + ?
+		WHERE remaining_keys >= ?
+		AND app_public_key = ?`,
+	).WithArgs(int64(1), int64(1), int64(1), pub[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	_, _, err := registerDiagnosisKeys(db, pub, []*pb.TemporaryExposureKey{key}, ctx)
+	assert.Nil(t, err)
+
+	// While pending they aren't retrievable
+	mock.ExpectQuery(retrievableKeysQuery).WillReturnRows(sqlmock.NewRows(keyColumns))
+
+	rows, err := diagnosisKeysForHours(context.Background(), db, "302", 100, 200, 2651450)
+	assert.Nil(t, err)
+	assert.False(t, rows.Next())
+	rows.Close()
+
+	// Promotion by the originator makes them retrievable, and marks their
+	// region as updated
+	mock.ExpectQuery(promotedRegionsQuery).WithArgs(pub[:], "randomOrigin").WillReturnRows(sqlmock.NewRows([]string{"region"}).AddRow("302"))
+	mock.ExpectExec(promoteKeysQuery).WithArgs(AnyType{}, pub[:], "randomOrigin").WillReturnResult(sqlmock.NewResult(0, 1))
+	expectRegionUpdated(mock, "302")
+	mock.ExpectQuery(retrievableKeysQuery).WillReturnRows(
+		sqlmock.NewRows(keyColumns).AddRow("302", key.GetKeyData(), key.GetRollingStartIntervalNumber(), key.GetRollingPeriod(), key.GetTransmissionRiskLevel()),
+	)
+
+	promoted, err := promoteKeys(ctx, db, "randomOrigin", pub)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), promoted)
+
+	rows, err = diagnosisKeysForHours(context.Background(), db, "302", 100, 200, 2651450)
+	assert.Nil(t, err)
+	assert.True(t, rows.Next())
+	var region string
+	var keyData []byte
+	assert.Nil(t, rows.Scan(&region, &keyData, new(int32), new(int32), new(int32)))
+	assert.Equal(t, key.GetKeyData(), keyData)
+	rows.Close()
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPromoteKeys_NothingPending(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	// Including keys another originator uploaded
+	mock.ExpectQuery(promotedRegionsQuery).WithArgs(pub[:], "otherOrigin").WillReturnRows(sqlmock.NewRows([]string{"region"}))
+	mock.ExpectExec(promoteKeysQuery).WithArgs(AnyType{}, pub[:], "otherOrigin").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	promoted, err := promoteKeys(context.Background(), db, "otherOrigin", pub)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), promoted)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
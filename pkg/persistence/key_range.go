@@ -0,0 +1,48 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+	"github.com/cds-snc/covid-alert-server/pkg/timemath"
+)
+
+// FetchKeysForHoursInRange is FetchKeysForHours restricted to the keys whose
+// rolling start interval number is at least startRSIN and before endRSIN
+func (c *conn) FetchKeysForHoursInRange(region string, startHour uint32, endHour uint32, currentRSIN int32, startRSIN int32, endRSIN int32) ([]*pb.TemporaryExposureKey, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := c.statementContext(context.Background())
+	defer cancel()
+	var rows *sql.Rows
+	err := c.retrier.read(ctx, func() (err error) {
+		rows, err = diagnosisKeysForHoursInRange(ctx, c.reader(), region, startHour, endHour, currentRSIN, startRSIN, endRSIN)
+		return err
+	})
+	c.breaker.record(err)
+	if err != nil {
+		return nil, classifyDBError(err)
+	}
+	keys, err := handleKeysRows(rows)
+	return keys, classifyDBError(err)
+}
+
+func diagnosisKeysForHoursInRange(ctx context.Context, db *sql.DB, region string, startHour uint32, endHour uint32, currentRSIN int32, startRSIN int32, endRSIN int32) (*sql.Rows, error) {
+	minRSIN := timemath.RollingStartIntervalNumberPlusDays(currentRSIN, -14)
+
+	return db.QueryContext(ctx,
+		`SELECT region, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level FROM diagnosis_keys
+		WHERE hour_of_submission >= ?
+		AND hour_of_submission < ?
+		AND rolling_start_interval_number > ?
+		AND rolling_start_interval_number >= ?
+		AND rolling_start_interval_number < ?
+		AND region = ?
+		AND pending_app_public_key IS NULL
+		ORDER BY key_data
+		`, // don't implicitly order by insertion date: for privacy
+		startHour, endHour, minRSIN, startRSIN, endRSIN, region,
+	)
+}
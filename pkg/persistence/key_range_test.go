@@ -0,0 +1,35 @@
+package persistence
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cds-snc/covid-alert-server/pkg/timemath"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDBFetchKeysForHoursInRange(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
+	defer db.Close()
+
+	conn := conn{db: db}
+
+	currentRSIN := int32(2651450)
+	minRSIN := timemath.RollingStartIntervalNumberPlusDays(currentRSIN, -14)
+	startRSIN, endRSIN := int32(2651040), int32(2651328)
+
+	rows := sqlmock.NewRows([]string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level"}).
+		AddRow("302", []byte{1}, 2651040, 144, 4).
+		AddRow("302", []byte{2}, 2651184, 144, 4)
+	mock.ExpectQuery("").WithArgs(uint32(100), uint32(200), minRSIN, startRSIN, endRSIN, "302").WillReturnRows(rows)
+
+	keys, err := conn.FetchKeysForHoursInRange("302", 100, 200, currentRSIN, startRSIN, endRSIN)
+	assert.Nil(t, err)
+	assert.Len(t, keys, 2)
+	assert.Equal(t, int32(2651040), keys[0].GetRollingStartIntervalNumber())
+	assert.Equal(t, int32(2651184), keys[1].GetRollingStartIntervalNumber())
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,75 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+)
+
+// KeyResolver looks up the server private key for the public key an upload
+// was encrypted to. Conn satisfies it directly by reading the key from the
+// database.
+type KeyResolver interface {
+	PrivForPub([]byte) ([]byte, error)
+}
+
+// Decrypter unwraps key material that was encrypted under an external KMS key
+type Decrypter interface {
+	Decrypt([]byte) ([]byte, error)
+}
+
+type kmsKeyResolver struct {
+	db  Conn
+	kms Decrypter
+}
+
+// NewKMSKeyResolver returns a KeyResolver for deployments that store the
+// server private key wrapped by a KMS; the stored value is read from the
+// database and handed to kms to decrypt on every lookup.
+func NewKMSKeyResolver(db Conn, kms Decrypter) KeyResolver {
+	return &kmsKeyResolver{db: db, kms: kms}
+}
+
+func (k *kmsKeyResolver) PrivForPub(pub []byte) ([]byte, error) {
+	wrapped, err := k.db.PrivForPub(pub)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := k.kms.Decrypt(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if len(priv) != pb.KeyLength {
+		return nil, ErrInvalidKeyFormat
+	}
+	return priv, nil
+}
+
+type httpDecrypter struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPDecrypter returns a Decrypter that POSTs the ciphertext to url and
+// expects the plaintext back as the body of a 200 response.
+func NewHTTPDecrypter(url string) Decrypter {
+	return &httpDecrypter{url: url, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (d *httpDecrypter) Decrypt(ciphertext []byte) ([]byte, error) {
+	resp, err := d.client.Post(d.url, "application/octet-stream", bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("decrypt request failed with status %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+}
@@ -0,0 +1,165 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/timemath"
+)
+
+// oldestRetainedHour is the first hour_of_submission kept under a retention
+// of days
+func oldestRetainedHour(days uint32) uint32 {
+	oldestDateNumber := timemath.DateNumber(time.Now()) - days
+	return timemath.HourNumberAtStartOfDate(oldestDateNumber)
+}
+
+// DeleteDiagnosisKeysOlderThan deletes the keys from region submitted more
+// than days ago. Keys only record the originator token, so they are matched to
+// region the same way events are, and keys with no originator are left alone.
+func (c *conn) DeleteDiagnosisKeysOlderThan(ctx context.Context, region string, days uint32) (int64, error) {
+	ctx, cancel := c.statementContext(ctx)
+	defer cancel()
+	return deleteDiagnosisKeysOlderThan(ctx, c.db, region, days)
+}
+
+func deleteDiagnosisKeysOlderThan(ctx context.Context, db *sql.DB, region string, days uint32) (int64, error) {
+	rows, err := db.QueryContext(ctx, `SELECT DISTINCT originator FROM diagnosis_keys WHERE originator IS NOT NULL`)
+	if err != nil {
+		return 0, err
+	}
+
+	var originators []string
+	for rows.Next() {
+		var originator string
+		if err := rows.Scan(&originator); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if translateToken(originator) == region {
+			originators = append(originators, originator)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(originators) == 0 {
+		return 0, nil
+	}
+	sort.Strings(originators)
+
+	args := []interface{}{oldestRetainedHour(days)}
+	for _, originator := range originators {
+		args = append(args, originator)
+	}
+	res, err := db.ExecContext(ctx,
+		`DELETE FROM diagnosis_keys WHERE hour_of_submission < ? AND originator IN (?`+strings.Repeat(`, ?`, len(originators)-1)+`)`,
+		args...,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// RegionRetentionDays is how many days keys from region are kept: its
+// diagnosisKeyRetentionDaysByRegion entry, or maxDiagnosisKeyRetentionDays
+func RegionRetentionDays(region string) uint32 {
+	if days, ok := regionRetentionDays()[region]; ok {
+		return days
+	}
+	return config.AppConstants.MaxDiagnosisKeyRetentionDays
+}
+
+// regionRetentionDays parses the REGION=DAYS entries of
+// diagnosisKeyRetentionDaysByRegion, skipping any that are malformed
+func regionRetentionDays() map[string]uint32 {
+	retention := make(map[string]uint32)
+	for _, entry := range config.AppConstants.DiagnosisKeyRetentionDaysByRegion {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 {
+			log(nil, nil).WithField("entry", entry).Warn("ignoring invalid diagnosisKeyRetentionDaysByRegion entry")
+			continue
+		}
+		days, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+		if err != nil {
+			log(nil, err).WithField("entry", entry).Warn("ignoring invalid diagnosisKeyRetentionDaysByRegion entry")
+			continue
+		}
+		retention[strings.TrimSpace(parts[0])] = uint32(days)
+	}
+	return retention
+}
+
+// deleteOldDiagnosisKeysByRegion deletes keys past their region's retention.
+// Keys only record the originator token, so each distinct originator is
+// translated to its region the same way events are. Keys from originators
+// without a configured region fall back to maxDiagnosisKeyRetentionDays.
+func deleteOldDiagnosisKeysByRegion(ctx context.Context, db *sql.DB, retention map[string]uint32) (int64, error) {
+	rows, err := db.QueryContext(ctx, `SELECT DISTINCT originator FROM diagnosis_keys WHERE originator IS NOT NULL`)
+	if err != nil {
+		return 0, err
+	}
+
+	days := make(map[string]uint32)
+	for rows.Next() {
+		var originator string
+		if err := rows.Scan(&originator); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if d, ok := retention[translateToken(originator)]; ok {
+			days[originator] = d
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// sorted so the deletes run in a stable order
+	originators := make([]string, 0, len(days))
+	for originator := range days {
+		originators = append(originators, originator)
+	}
+	sort.Strings(originators)
+
+	var deleted int64
+	for _, originator := range originators {
+		res, err := db.ExecContext(ctx,
+			`DELETE FROM diagnosis_keys WHERE originator = ? AND hour_of_submission < ?`,
+			originator, oldestRetainedHour(days[originator]),
+		)
+		if err != nil {
+			return deleted, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+
+	query := `DELETE FROM diagnosis_keys WHERE hour_of_submission < ?`
+	args := []interface{}{oldestRetainedHour(config.AppConstants.MaxDiagnosisKeyRetentionDays)}
+	if len(originators) > 0 {
+		query += ` AND (originator IS NULL OR originator NOT IN (?` + strings.Repeat(`, ?`, len(originators)-1) + `))`
+		for _, originator := range originators {
+			args = append(args, originator)
+		}
+	}
+
+	res, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return deleted, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return deleted, err
+	}
+	return deleted + n, nil
+}
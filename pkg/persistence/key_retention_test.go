@@ -0,0 +1,104 @@
+package persistence
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	keyclaim "github.com/cds-snc/covid-alert-server/mocks/pkg/keyclaim"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeleteOldDiagnosisKeysByRegion(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	oldLookups := originatorLookups
+	defer func() { originatorLookups = oldLookups }()
+
+	onToken := strings.Repeat("o", 20)
+	qcToken := strings.Repeat("q", 20)
+	otherToken := strings.Repeat("x", 20)
+
+	lookup := &keyclaim.Authenticator{}
+	lookup.On("Authenticate", onToken).Return("ONApi", true)
+	lookup.On("Authenticate", qcToken).Return("QCApi", true)
+	lookup.On("Authenticate", otherToken).Return("", false)
+	SetupLookup(lookup)
+
+	oldRetention := config.AppConstants.DiagnosisKeyRetentionDaysByRegion
+	config.AppConstants.DiagnosisKeyRetentionDaysByRegion = []string{"ONApi=10", "QCApi = 20", "bogus"}
+	defer func() { config.AppConstants.DiagnosisKeyRetentionDaysByRegion = oldRetention }()
+
+	rows := sqlmock.NewRows([]string{"originator"}).AddRow(qcToken).AddRow(onToken).AddRow(otherToken)
+	mock.ExpectQuery(`SELECT DISTINCT originator FROM diagnosis_keys WHERE originator IS NOT NULL`).WillReturnRows(rows)
+
+	mock.ExpectExec(`DELETE FROM diagnosis_keys WHERE originator = ? AND hour_of_submission < ?`).
+		WithArgs(onToken, oldestRetainedHour(10)).WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(`DELETE FROM diagnosis_keys WHERE originator = ? AND hour_of_submission < ?`).
+		WithArgs(qcToken, oldestRetainedHour(20)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM diagnosis_keys WHERE hour_of_submission < ? AND (originator IS NULL OR originator NOT IN (?, ?))`).
+		WithArgs(oldestRetainedHour(config.AppConstants.MaxDiagnosisKeyRetentionDays), onToken, qcToken).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	deleted, err := deleteOldDiagnosisKeys(context.Background(), db)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), deleted)
+	assert.NotEqual(t, oldestRetainedHour(10), oldestRetainedHour(20))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeleteDiagnosisKeysOlderThan(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	oldLookups := originatorLookups
+	defer func() { originatorLookups = oldLookups }()
+
+	onToken := strings.Repeat("o", 20)
+	onToken2 := strings.Repeat("p", 20)
+	qcToken := strings.Repeat("q", 20)
+
+	lookup := &keyclaim.Authenticator{}
+	lookup.On("Authenticate", onToken).Return("ONApi", true)
+	lookup.On("Authenticate", onToken2).Return("ONApi", true)
+	lookup.On("Authenticate", qcToken).Return("QCApi", true)
+	SetupLookup(lookup)
+
+	rows := sqlmock.NewRows([]string{"originator"}).AddRow(qcToken).AddRow(onToken2).AddRow(onToken)
+	mock.ExpectQuery(`SELECT DISTINCT originator FROM diagnosis_keys WHERE originator IS NOT NULL`).WillReturnRows(rows)
+
+	// Only the region's keys
+	mock.ExpectExec(`DELETE FROM diagnosis_keys WHERE hour_of_submission < ? AND originator IN (?, ?)`).
+		WithArgs(oldestRetainedHour(30), onToken, onToken2).WillReturnResult(sqlmock.NewResult(0, 4))
+
+	deleted, err := deleteDiagnosisKeysOlderThan(context.Background(), db, "ONApi", 30)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), deleted)
+
+	// A region with no keys deletes nothing
+	mock.ExpectQuery(`SELECT DISTINCT originator FROM diagnosis_keys WHERE originator IS NOT NULL`).
+		WillReturnRows(sqlmock.NewRows([]string{"originator"}).AddRow(qcToken))
+
+	deleted, err = deleteDiagnosisKeysOlderThan(context.Background(), db, "ONApi", 30)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), deleted)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRegionRetentionDays(t *testing.T) {
+	oldRetention := config.AppConstants.DiagnosisKeyRetentionDaysByRegion
+	config.AppConstants.DiagnosisKeyRetentionDaysByRegion = []string{"ONApi=10"}
+	defer func() { config.AppConstants.DiagnosisKeyRetentionDaysByRegion = oldRetention }()
+
+	assert.Equal(t, uint32(10), RegionRetentionDays("ONApi"))
+	assert.Equal(t, config.AppConstants.MaxDiagnosisKeyRetentionDays, RegionRetentionDays("QCApi"))
+}
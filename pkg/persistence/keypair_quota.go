@@ -0,0 +1,32 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+)
+
+// KeypairQuota returns how many keys the keypair with app public key
+// appPubKey may still upload, and when it expires and is deleted by the
+// expiration worker
+func (c *conn) KeypairQuota(ctx context.Context, appPubKey *[32]byte) (int64, time.Time, error) {
+	ctx, cancel := c.statementContext(ctx)
+	defer cancel()
+	return keypairQuota(ctx, c.db, appPubKey)
+}
+
+func keypairQuota(ctx context.Context, db *sql.DB, appPubKey *[32]byte) (int64, time.Time, error) {
+	var remainingKeys int64
+	var created time.Time
+	if err := db.QueryRowContext(ctx,
+		"SELECT remaining_keys, created FROM encryption_keys WHERE app_public_key = ?",
+		appPubKey[:],
+	).Scan(&remainingKeys, &created); err != nil {
+		return 0, time.Time{}, err
+	}
+
+	validity := time.Duration(config.AppConstants.EncryptionKeyValidityDays) * 24 * time.Hour
+	return remainingKeys, created.Add(validity), nil
+}
@@ -0,0 +1,37 @@
+package persistence
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestKeypairQuota(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	oldValidity := config.AppConstants.EncryptionKeyValidityDays
+	config.AppConstants.EncryptionKeyValidityDays = 15
+	defer func() { config.AppConstants.EncryptionKeyValidityDays = oldValidity }()
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	created := time.Date(2020, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	rows := sqlmock.NewRows([]string{"remaining_keys", "created"}).AddRow(23, created)
+	mock.ExpectQuery(`SELECT remaining_keys, created FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(rows)
+
+	remaining, expiresAt, err := keypairQuota(context.Background(), db, pub)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(23), remaining)
+	assert.Equal(t, time.Date(2020, 9, 16, 12, 0, 0, 0, time.UTC), expiresAt)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
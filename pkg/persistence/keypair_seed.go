@@ -0,0 +1,53 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+)
+
+// KeypairSeed is a server keypair to create at startup, and optionally the
+// app public key it has been claimed by
+type KeypairSeed struct {
+	ServerPublicKey  []byte
+	ServerPrivateKey []byte
+	AppPublicKey     []byte
+	Region           string
+}
+
+// SeedServerKeypair creates the keypair described by seed unless one with the
+// same server public key already exists, reporting whether it did. Seeded
+// keypairs expire and are deleted like any other.
+func (c *conn) SeedServerKeypair(ctx context.Context, seed KeypairSeed) (bool, error) {
+	ctx, cancel := c.statementContext(ctx)
+	defer cancel()
+	return seedServerKeypair(ctx, c.db, seed)
+}
+
+func seedServerKeypair(ctx context.Context, db *sql.DB, seed KeypairSeed) (bool, error) {
+	if len(seed.ServerPublicKey) != pb.KeyLength || len(seed.ServerPrivateKey) != pb.KeyLength {
+		return false, ErrInvalidKeyFormat
+	}
+	var appPublicKey interface{}
+	if seed.AppPublicKey != nil {
+		if len(seed.AppPublicKey) != pb.KeyLength {
+			return false, ErrInvalidKeyFormat
+		}
+		appPublicKey = seed.AppPublicKey
+	}
+
+	result, err := db.ExecContext(ctx, `
+		INSERT INTO encryption_keys (server_private_key, server_public_key, app_public_key, remaining_keys, region)
+		SELECT ?, ?, ?, ?, ? FROM DUAL
+		WHERE NOT EXISTS (SELECT 1 FROM encryption_keys WHERE server_public_key = ?)`,
+		seed.ServerPrivateKey, seed.ServerPublicKey, appPublicKey,
+		config.AppConstants.InitialRemainingKeys, seed.Region, seed.ServerPublicKey,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
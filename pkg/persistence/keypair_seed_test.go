@@ -0,0 +1,71 @@
+package persistence
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const seedServerKeypairQuery = `
+		INSERT INTO encryption_keys (server_private_key, server_public_key, app_public_key, remaining_keys, region)
+		SELECT ?, ?, ?, ?, ? FROM DUAL
+		WHERE NOT EXISTS (SELECT 1 FROM encryption_keys WHERE server_public_key = ?)`
+
+func TestSeedServerKeypair_Resolvable(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	conn := conn{db: db}
+	ctx := context.Background()
+	pub, priv, _ := box.GenerateKey(rand.Reader)
+	seed := KeypairSeed{ServerPublicKey: pub[:], ServerPrivateKey: priv[:], Region: "302"}
+	remaining := config.AppConstants.InitialRemainingKeys
+
+	mock.ExpectExec(seedServerKeypairQuery).
+		WithArgs(priv[:], pub[:], nil, remaining, "302", pub[:]).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(fmt.Sprintf(`
+		SELECT server_private_key FROM encryption_keys
+			WHERE server_public_key = ?
+			AND created > (NOW() - INTERVAL %d DAY)
+			LIMIT 1`, config.AppConstants.EncryptionKeyValidityDays)).
+		WithArgs(pub[:]).
+		WillReturnRows(sqlmock.NewRows([]string{"server_private_key"}).AddRow(priv[:]))
+
+	created, err := conn.SeedServerKeypair(ctx, seed)
+	assert.Nil(t, err)
+	assert.True(t, created)
+
+	resolved, err := conn.PrivForPub(pub[:])
+	assert.Nil(t, err)
+	assert.Equal(t, priv[:], resolved)
+
+	// Seeding again leaves the existing keypair alone
+	mock.ExpectExec(seedServerKeypairQuery).
+		WithArgs(priv[:], pub[:], nil, remaining, "302", pub[:]).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	created, err = conn.SeedServerKeypair(ctx, seed)
+	assert.Nil(t, err)
+	assert.False(t, created)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSeedServerKeypair_InvalidKey(t *testing.T) {
+	ctx := context.Background()
+	key := make([]byte, 32)
+
+	_, err := seedServerKeypair(ctx, nil, KeypairSeed{ServerPublicKey: key[:8], ServerPrivateKey: key})
+	assert.Equal(t, ErrInvalidKeyFormat, err)
+	_, err = seedServerKeypair(ctx, nil, KeypairSeed{ServerPublicKey: key, ServerPrivateKey: key, AppPublicKey: key[:8]})
+	assert.Equal(t, ErrInvalidKeyFormat, err)
+}
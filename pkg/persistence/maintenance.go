@@ -0,0 +1,43 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+)
+
+// MaintenanceMode reports whether maintenance mode is on. It is kept in the
+// database so every replica agrees and it survives restarts. maintenanceMode
+// in the config turns it on as well, whatever is stored, so a deployment can
+// always force it without the admin route.
+func (c *conn) MaintenanceMode(ctx context.Context) (bool, error) {
+	ctx, cancel := c.statementContext(ctx)
+	defer cancel()
+	return maintenanceMode(ctx, c.db)
+}
+
+func maintenanceMode(ctx context.Context, db *sql.DB) (bool, error) {
+	var enabled bool
+	err := db.QueryRowContext(ctx, `SELECT enabled FROM maintenance_mode WHERE id = 1`).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return config.AppConstants.MaintenanceMode, nil
+	}
+	return enabled || config.AppConstants.MaintenanceMode, err
+}
+
+// SetMaintenanceMode turns maintenance mode on or off for every replica
+func (c *conn) SetMaintenanceMode(ctx context.Context, enabled bool) error {
+	ctx, cancel := c.statementContext(ctx)
+	defer cancel()
+	return setMaintenanceMode(ctx, c.db, enabled)
+}
+
+func setMaintenanceMode(ctx context.Context, db *sql.DB, enabled bool) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO maintenance_mode (id, enabled) VALUES (1, ?)
+		ON DUPLICATE KEY UPDATE enabled = VALUES(enabled)`,
+		enabled,
+	)
+	return err
+}
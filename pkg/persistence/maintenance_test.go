@@ -0,0 +1,61 @@
+package persistence
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	query := `SELECT enabled FROM maintenance_mode WHERE id = 1`
+
+	// Never set, so the config applies
+	config.AppConstants.MaintenanceMode = true
+	defer func() { config.AppConstants.MaintenanceMode = false }()
+	mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"enabled"}))
+	enabled, err := maintenanceMode(context.Background(), db)
+	assert.Nil(t, err)
+	assert.True(t, enabled)
+
+	mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"enabled"}).AddRow(false))
+	enabled, err = maintenanceMode(context.Background(), db)
+	assert.Nil(t, err)
+	assert.True(t, enabled, "the config still applies once a state is stored")
+
+	// Without the config, the stored state decides
+	config.AppConstants.MaintenanceMode = false
+	mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"enabled"}).AddRow(false))
+	enabled, err = maintenanceMode(context.Background(), db)
+	assert.Nil(t, err)
+	assert.False(t, enabled)
+
+	mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows([]string{"enabled"}).AddRow(true))
+	enabled, err = maintenanceMode(context.Background(), db)
+	assert.Nil(t, err)
+	assert.True(t, enabled)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSetMaintenanceMode(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	mock.ExpectExec(`
+		INSERT INTO maintenance_mode (id, enabled) VALUES (1, ?)
+		ON DUPLICATE KEY UPDATE enabled = VALUES(enabled)`).WithArgs(true).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	assert.Nil(t, setMaintenanceMode(context.Background(), db, true))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -2,7 +2,6 @@ package persistence
 
 import (
 	"database/sql"
-	"fmt"
 	"strings"
 
 	// inject mysql support for database/sql
@@ -132,9 +131,138 @@ CREATE TABLE IF NOT EXISTS otk_life_duration (
 	INDEX (originator),
 	INDEX (date),
 	UNIQUE KEY originator_date(originator, date)
+)`,
+		},
+	}, {
+		id: "10",
+		statements: []string{
+			`ALTER TABLE encryption_keys
+	ADD COLUMN consumed_at TIMESTAMP NULL DEFAULT NULL,
+	ADD COLUMN last_upload_digest BINARY(32) NULL DEFAULT NULL`,
+		},
+	}, {
+		id: "11",
+		statements: []string{
+			`
+CREATE TABLE IF NOT EXISTS keypair_denylist (
+	id				INT UNSIGNED	NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	app_public_key	BINARY(32)		NOT NULL,
+	created			TIMESTAMP		NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	removed_at		TIMESTAMP		NULL DEFAULT NULL,
+	INDEX (app_public_key, removed_at)
+)`,
+		},
+	}, {
+		id: "12",
+		statements: []string{
+			`
+CREATE TABLE IF NOT EXISTS originator_app_keys (
+	originator	VARCHAR(64)	NOT NULL,
+	date		DATE		NOT NULL,
+	count		INT			UNSIGNED NOT NULL DEFAULT 0,
+	UNIQUE KEY originator_date(originator, date)
+)`,
+		},
+	}, {
+		id: "13",
+		statements: []string{
+			`
+CREATE TABLE IF NOT EXISTS events_by_originator (
+	source			VARCHAR(32)		NOT NULL,
+	originator_hash	CHAR(64)		NOT NULL,
+	identifier		VARCHAR(255)	NOT NULL,
+	device_type		VARCHAR(32)		NOT NULL,
+	date			DATE			NOT NULL,
+	count			INT				UNSIGNED NOT NULL DEFAULT 0,
+	INDEX (source),
+	INDEX (date),
+	UNIQUE KEY originator_identifier_type_date (originator_hash, identifier, device_type, date)
+)`,
+		},
+	}, {
+		id: "14",
+		statements: []string{
+			`ALTER TABLE encryption_keys ADD COLUMN last_upload_at TIMESTAMP NULL DEFAULT NULL`,
+		},
+	}, {
+		id: "15",
+		statements: []string{
+			`ALTER TABLE events
+	ADD COLUMN hour TINYINT UNSIGNED NOT NULL DEFAULT 0,
+	DROP INDEX identifier_type_date,
+	ADD UNIQUE KEY identifier_type_date_hour (source, identifier, device_type, date, hour)`,
+			`ALTER TABLE events_by_originator
+	ADD COLUMN hour TINYINT UNSIGNED NOT NULL DEFAULT 0,
+	DROP INDEX originator_identifier_type_date,
+	ADD UNIQUE KEY originator_identifier_type_date_hour (originator_hash, identifier, device_type, date, hour)`,
+		},
+	},
+	{
+		id: "16",
+		statements: []string{
+			`ALTER TABLE diagnosis_keys
+	ADD COLUMN pending_app_public_key BINARY(32) NULL DEFAULT NULL,
+	ADD INDEX (pending_app_public_key)`,
+		},
+	},
+	{
+		id: "17",
+		statements: []string{
+			`
+CREATE TABLE IF NOT EXISTS upload_rejections (
+	reason	VARCHAR(64)		NOT NULL,
+	date	DATE			NOT NULL,
+	count	INT UNSIGNED	NOT NULL DEFAULT 0,
+	PRIMARY KEY (reason, date)
 )`,
 		},
 	},
+	{
+		id: "18",
+		statements: []string{
+			`ALTER TABLE keypair_denylist ADD COLUMN expires_at TIMESTAMP NULL DEFAULT NULL`,
+		},
+	},
+	{
+		id: "19",
+		statements: []string{
+			`
+CREATE TABLE IF NOT EXISTS region_updates (
+	region		VARCHAR(32)	NOT NULL,
+	updated_at	TIMESTAMP	NOT NULL,
+	PRIMARY KEY (region)
+)`,
+		},
+	},
+	{
+		id: "20",
+		statements: []string{
+			`
+CREATE TABLE IF NOT EXISTS maintenance_mode (
+	id		TINYINT UNSIGNED	NOT NULL,
+	enabled	BOOLEAN				NOT NULL,
+	PRIMARY KEY (id)
+)`,
+		},
+	},
+	{
+		id: "21",
+		statements: []string{
+			`
+CREATE TABLE IF NOT EXISTS events_exports (
+	date		DATE		NOT NULL,
+	claimed_at	TIMESTAMP	NOT NULL,
+	exported_at	TIMESTAMP	NULL DEFAULT NULL,
+	PRIMARY KEY (date)
+)`,
+		},
+	},
+	{
+		id: "22",
+		statements: []string{
+			`ALTER TABLE encryption_keys ADD COLUMN stored_keys SMALLINT UNSIGNED NOT NULL DEFAULT 0`,
+		},
+	},
 }
 
 // MigrateDatabase creates the database and migrates it into the correct state.
@@ -208,9 +336,9 @@ func runMigration(db *sql.DB, migration migration) error {
 		return tx.Rollback()
 	}
 
-	fmt.Printf("===== running migration id=%s ===============================\n", migration.id)
+	log(nil, nil).WithField("version", migration.id).Info("running migration")
 	for _, statement := range migration.statements {
-		fmt.Println(statement)
+		log(nil, nil).WithField("version", migration.id).Debug(statement)
 		if _, err := db.Exec(statement); err != nil {
 			if err := tx.Rollback(); err != nil {
 				return err
@@ -226,5 +354,9 @@ func runMigration(db *sql.DB, migration migration) error {
 		return err
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log(nil, nil).WithField("version", migration.id).Info("applied migration")
+	return nil
 }
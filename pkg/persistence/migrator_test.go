@@ -1,9 +1,15 @@
 package persistence
 
 import (
+	"database/sql"
+	"fmt"
+	"os"
 	"testing"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestRunMigration(t *testing.T) {
@@ -28,3 +34,61 @@ func TestRunMigration(t *testing.T) {
 	}
 
 }
+
+func TestRunMigration_SkipsApplied(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	applied := migration{id: "1", statements: []string{"CREATE TABLE a (id INT)"}}
+	pending := migration{id: "2", statements: []string{"CREATE TABLE b (id INT)"}}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`).WithArgs(applied.id).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectRollback()
+
+	assert.Nil(t, runMigration(db, applied))
+	assert.Equal(t, 0, len(hook.Entries))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`).WithArgs(pending.id).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec(pending.statements[0]).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_migrations (version) VALUES (?)").WithArgs(pending.id).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	assert.Nil(t, runMigration(db, pending))
+	assert.Equal(t, "2", hook.LastEntry().Data["version"])
+	testhelpers.AssertLog(t, hook, 2, logrus.InfoLevel, "applied migration")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// Runs against the same MySQL database as the ruby integration suite, and is
+// skipped unless DB_HOST, DB_USER and DB_PASS are set
+func TestMigrateDatabase_Integration(t *testing.T) {
+	host, user, pass := os.Getenv("DB_HOST"), os.Getenv("DB_USER"), os.Getenv("DB_PASS")
+	if host == "" || user == "" || pass == "" {
+		t.Skip("DB_HOST, DB_USER and DB_PASS are required for the integration database")
+	}
+	name := os.Getenv("DB_NAME")
+	if name == "" {
+		name = "test"
+	}
+	url := fmt.Sprintf("%s:%s@tcp(%s)/%s", user, pass, host, name)
+
+	// Running twice checks that already applied migrations are skipped
+	assert.Nil(t, MigrateDatabase(url))
+	assert.Nil(t, MigrateDatabase(url))
+
+	db, err := sql.Open("mysql", url)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	var count int
+	assert.Nil(t, db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&count))
+	assert.Equal(t, len(migrations), count)
+}
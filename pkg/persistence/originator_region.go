@@ -0,0 +1,35 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+)
+
+// OriginatorRegion returns the region the bearer token that created the
+// keypair with app public key appPubKey maps to, as uploads from it are
+// attributed. An unmapped token is attributed to itself, but what's returned
+// is only its first and last character so it can be shown to clients. Unlike
+// TokenForLogs, it doesn't depend on maskOriginatorInLogs, so whatever is
+// keyed by it stays the same; logging it is up to the caller.
+func (c *conn) OriginatorRegion(ctx context.Context, appPubKey *[32]byte) (string, error) {
+	ctx, cancel := c.statementContext(ctx)
+	defer cancel()
+	return originatorRegion(ctx, c.db, appPubKey)
+}
+
+func originatorRegion(ctx context.Context, db *sql.DB, appPubKey *[32]byte) (string, error) {
+	var originator string
+	if err := db.QueryRowContext(ctx,
+		"SELECT originator FROM encryption_keys WHERE app_public_key = ?",
+		appPubKey[:],
+	).Scan(&originator); err != nil {
+		return "", err
+	}
+	if originator == "" {
+		return "", nil
+	}
+	if region, ok := lookupRegion(originator); ok {
+		return region, nil
+	}
+	return partialToken(originator), nil
+}
@@ -0,0 +1,43 @@
+package persistence
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestOriginatorRegion(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	query := `SELECT originator FROM encryption_keys WHERE app_public_key = ?`
+
+	mock.ExpectQuery(query).WithArgs(pub[:]).WillReturnRows(sqlmock.NewRows([]string{"originator"}).AddRow(token1))
+	region, err := originatorRegion(context.Background(), db, pub)
+	assert.Nil(t, err)
+	assert.Equal(t, onApi, region)
+
+	// token2 is only mapped to 302, so it stays attributed to the token, redacted
+	mock.ExpectQuery(query).WithArgs(pub[:]).WillReturnRows(sqlmock.NewRows([]string{"originator"}).AddRow(token2))
+	region, err = originatorRegion(context.Background(), db, pub)
+	assert.Nil(t, err)
+	assert.Equal(t, "b...b", region)
+
+	// Masking tokens in logs doesn't change it
+	config.AppConstants.MaskOriginatorInLogs = true
+	defer func() { config.AppConstants.MaskOriginatorInLogs = false }()
+	mock.ExpectQuery(query).WithArgs(pub[:]).WillReturnRows(sqlmock.NewRows([]string{"originator"}).AddRow(token2))
+	region, err = originatorRegion(context.Background(), db, pub)
+	assert.Nil(t, err)
+	assert.Equal(t, "b...b", region)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -51,7 +51,7 @@ type AggregateOtkDuration struct {
 }
 
 func (c *conn) GetAggregateOtkDurationsByDate(date string) ([]AggregateOtkDuration, error) {
-	return getAggregateOtkDurationsByDate(c.db, date)
+	return getAggregateOtkDurationsByDate(c.reader(), date)
 }
 
 func  getAggregateOtkDurationsByDate(db *sql.DB, date string) ([]AggregateOtkDuration, error) {
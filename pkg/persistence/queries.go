@@ -1,10 +1,13 @@
 package persistence
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"database/sql"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -13,11 +16,14 @@ import (
 	"github.com/cds-snc/covid-alert-server/pkg/timemath"
 )
 
-func deleteOldDiagnosisKeys(db *sql.DB) (int64, error) {
-	oldestDateNumber := timemath.DateNumber(time.Now()) - config.AppConstants.MaxDiagnosisKeyRetentionDays
-	oldestHour := timemath.HourNumberAtStartOfDate(oldestDateNumber)
+func deleteOldDiagnosisKeys(ctx context.Context, db *sql.DB) (int64, error) {
+	if retention := regionRetentionDays(); len(retention) > 0 {
+		return deleteOldDiagnosisKeysByRegion(ctx, db, retention)
+	}
+
+	oldestHour := oldestRetainedHour(config.AppConstants.MaxDiagnosisKeyRetentionDays)
 
-	res, err := db.Exec(`DELETE FROM diagnosis_keys WHERE hour_of_submission < ?`, oldestHour)
+	res, err := db.ExecContext(ctx, `DELETE FROM diagnosis_keys WHERE hour_of_submission < ?`, oldestHour)
 	if err != nil {
 		return 0, err
 	}
@@ -25,14 +31,17 @@ func deleteOldDiagnosisKeys(db *sql.DB) (int64, error) {
 }
 
 // Delete anything past our data retention threshold, AND any timed-out KeyClaims.
-func deleteOldEncryptionKeys(db *sql.DB) (int64, error) {
-	res, err := db.Exec(
+//
+// Consumed keypairs are kept until consumedKeypairGraceSeconds have passed, so
+// a client retrying the upload that consumed one still finds it.
+func deleteOldEncryptionKeys(ctx context.Context, db *sql.DB) (int64, error) {
+	res, err := db.ExecContext(ctx,
 		fmt.Sprintf(`
 			DELETE FROM encryption_keys
 			WHERE  (created < (NOW() - INTERVAL %d DAY))
 			OR    ((created < (NOW() - INTERVAL %d MINUTE)) AND app_public_key IS NULL)
-			OR    remaining_keys = 0
-		`, config.AppConstants.EncryptionKeyValidityDays, config.AppConstants.OneTimeCodeExpiryInMinutes),
+			OR    (remaining_keys = 0 AND (consumed_at IS NULL OR consumed_at < (NOW() - INTERVAL %d SECOND)))
+		`, config.AppConstants.EncryptionKeyValidityDays, config.AppConstants.OneTimeCodeExpiryInMinutes, config.AppConstants.ConsumedKeypairGraceSeconds),
 	)
 	if err != nil {
 		return 0, err
@@ -125,6 +134,13 @@ func claimKey(db *sql.DB, oneTimeCode string, appPublicKey []byte, ctx context.C
 		return nil, ErrInvalidOneTimeCode
 	}
 
+	if err := checkAppKeyCap(ctx, tx, originator); err != nil {
+		if err := tx.Rollback(); err != nil {
+			return nil, err
+		}
+		return nil, err
+	}
+
 	s, err = tx.Prepare(
 		`SELECT server_public_key FROM encryption_keys WHERE app_public_key = ?`,
 	)
@@ -144,7 +160,7 @@ func claimKey(db *sql.DB, oneTimeCode string, appPublicKey []byte, ctx context.C
 	}
 
 	event := Event{Originator: originator, DeviceType: Server, Identifier: OTKClaimed, Count: 1, Date: time.Now()}
-	if err := saveEvent(db, event); err != nil {
+	if err := saveEvent(ctx, db, event); err != nil {
 		LogEvent(ctx, err, event)
 	}
 
@@ -162,8 +178,8 @@ func claimKey(db *sql.DB, oneTimeCode string, appPublicKey []byte, ctx context.C
 	return serverPub, nil
 }
 
-func persistEncryptionKey(db *sql.DB, region, originator string, pub *[32]byte, priv *[32]byte, oneTimeCode string) error {
-	_, err := db.Exec(
+func persistEncryptionKey(ctx context.Context, db *sql.DB, region, originator string, pub *[32]byte, priv *[32]byte, oneTimeCode string) error {
+	_, err := db.ExecContext(ctx,
 		`INSERT INTO encryption_keys
 			(region, originator, server_private_key, server_public_key, one_time_code, remaining_keys)
 			VALUES (?, ?, ?, ?, ?, ?)`,
@@ -172,8 +188,8 @@ func persistEncryptionKey(db *sql.DB, region, originator string, pub *[32]byte,
 	return err
 }
 
-func persistEncryptionKeyWithHashID(db *sql.DB, region, originator, hashID string, pub *[32]byte, priv *[32]byte, oneTimeCode string) error {
-	_, err := db.Exec(
+func persistEncryptionKeyWithHashID(ctx context.Context, db *sql.DB, region, originator, hashID string, pub *[32]byte, priv *[32]byte, oneTimeCode string) error {
+	_, err := db.ExecContext(ctx,
 		`INSERT INTO encryption_keys
 			(region, originator, hash_id, server_private_key, server_public_key, one_time_code, remaining_keys)
 			VALUES (?, ?, ?, ?, ?, ?, ?)`,
@@ -185,11 +201,11 @@ func persistEncryptionKeyWithHashID(db *sql.DB, region, originator, hashID strin
 		return err
 	} else if strings.Contains(err.Error(), "for key 'hash_id") { // HashID duplicate
 		var oneTimeCode sql.NullString
-		row := db.QueryRow("SELECT one_time_code FROM encryption_keys WHERE hash_id = ?", hashID)
+		row := db.QueryRowContext(ctx, "SELECT one_time_code FROM encryption_keys WHERE hash_id = ?", hashID)
 		row.Scan(&oneTimeCode)
 
 		if oneTimeCode.Valid { // unused hashID found
-			_, err = db.Exec(`DELETE FROM encryption_keys WHERE hash_id = ? AND one_time_code IS NOT NULL`, hashID)
+			_, err = db.ExecContext(ctx, `DELETE FROM encryption_keys WHERE hash_id = ? AND one_time_code IS NOT NULL`, hashID)
 			if err != nil {
 				return err
 			}
@@ -200,8 +216,8 @@ func persistEncryptionKeyWithHashID(db *sql.DB, region, originator, hashID strin
 	return err
 }
 
-func privForPub(db *sql.DB, pub []byte) *sql.Row {
-	return db.QueryRow(fmt.Sprintf(`
+func privForPub(ctx context.Context, db *sql.DB, pub []byte) *sql.Row {
+	return db.QueryRowContext(ctx, fmt.Sprintf(`
 		SELECT server_private_key FROM encryption_keys
 			WHERE server_public_key = ?
 			AND created > (NOW() - INTERVAL %d DAY)
@@ -216,54 +232,106 @@ func privForPub(db *sql.DB, pub []byte) *sql.Row {
 // UTC date.
 //
 // Only return keys that correspond to a Key valid for a date less than 14 days ago.
-func diagnosisKeysForHours(db *sql.DB, region string, startHour uint32, endHour uint32, currentRollingStartIntervalNumber int32) (*sql.Rows, error) {
+func diagnosisKeysForHours(ctx context.Context, db *sql.DB, region string, startHour uint32, endHour uint32, currentRollingStartIntervalNumber int32) (*sql.Rows, error) {
 	minRollingStartIntervalNumber := timemath.RollingStartIntervalNumberPlusDays(currentRollingStartIntervalNumber, -14)
 
-	return db.Query(
+	return db.QueryContext(ctx,
 		`SELECT region, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level FROM diagnosis_keys
 		WHERE hour_of_submission >= ?
 		AND hour_of_submission < ?
 		AND rolling_start_interval_number > ?
 		AND region = ?
+		AND pending_app_public_key IS NULL
 		ORDER BY key_data
 		`, // don't implicitly order by insertion date: for privacy
 		startHour, endHour, minRollingStartIntervalNumber, region,
 	)
 }
 
-func registerDiagnosisKeys(db *sql.DB, appPubKey *[32]byte, keys []*pb.TemporaryExposureKey, ctx context.Context) error {
-	tx, err := db.Begin()
+// exceedsKeypairBudget reports whether inserting keysInserted more keys takes
+// the keypair past maxKeysPerKeypair in total. Each keypair counts the keys it
+// has stored, so the cap holds whatever remaining_keys it was issued with.
+func exceedsKeypairBudget(ctx context.Context, tx *sql.Tx, appPubKey *[32]byte, keysInserted int64) (bool, error) {
+	budget := int64(config.AppConstants.MaxKeysPerKeypair)
+	if budget == 0 {
+		return false, nil
+	}
+
+	var stored int64
+	if err := tx.QueryRowContext(ctx, "SELECT stored_keys FROM encryption_keys WHERE app_public_key = ?", appPubKey[:]).Scan(&stored); err != nil {
+		return false, err
+	}
+	return stored+keysInserted > budget, nil
+}
+
+// registerDiagnosisKeys stores keys against the keypair with app public key
+// appPubKey, and returns how many were stored and how many were skipped
+// because their data was already stored
+func registerDiagnosisKeys(db *sql.DB, appPubKey *[32]byte, keys []*pb.TemporaryExposureKey, ctx context.Context) (int64, int64, error) {
+	// If ctx is cancelled database/sql rolls back the transaction itself, so a
+	// later Rollback returning ErrTxDone must not mask the original error.
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 
 	var region string
 	var originator string
 	var remainingKeys int64
-	if err := tx.QueryRow("SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE", appPubKey[:]).Scan(&region, &originator, &remainingKeys); err != nil {
-		if err := tx.Rollback(); err != nil {
-			return err
+	if err := tx.QueryRowContext(ctx, "SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE", appPubKey[:]).Scan(&region, &originator, &remainingKeys); err != nil {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			return 0, 0, err
 		}
-		return err
+		return 0, 0, err
 	}
 
+	digest := uploadDigest(keys)
+
 	if remainingKeys == 0 {
-		if err := tx.Rollback(); err != nil {
-			return err
+		retry, err := isRetryWithinGrace(ctx, tx, appPubKey, digest)
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			return 0, 0, err
+		}
+		if err != nil {
+			return 0, 0, err
 		}
-		return ErrKeyConsumed
+		// A client retrying the upload that consumed its keypair (e.g. after a
+		// timeout) gets the same success it would have seen the first time
+		if retry {
+			return 0, int64(len(keys)), nil
+		}
+		return 0, 0, ErrKeyConsumed
+	}
+
+	tooSoon, err := uploadedWithinCooldown(ctx, tx, appPubKey)
+	if err != nil || tooSoon {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			return 0, 0, err
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		return 0, 0, ErrUploadTooSoon
 	}
 
-	s, err := tx.Prepare(`
+	// Keys held back until the health authority promotes them record the
+	// keypair they came from, which keeps them out of retrieval until then
+	insertKeys := `
 		INSERT IGNORE INTO diagnosis_keys
 		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, hour_of_submission)
-		VALUES (?, ?, ?, ?, ?, ?, ?)`,
-	)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
+	if config.AppConstants.RequireKeyPromotion {
+		insertKeys = `
+		INSERT IGNORE INTO diagnosis_keys
+		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, hour_of_submission, pending_app_public_key)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	}
+	s, err := tx.PrepareContext(ctx, insertKeys)
 	if err != nil {
-		if err := tx.Rollback(); err != nil {
-			return err
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			return 0, 0, err
 		}
-		return err
+		return 0, 0, err
 	}
 
 	hourOfSubmission := timemath.HourNumber(time.Now())
@@ -271,32 +339,44 @@ func registerDiagnosisKeys(db *sql.DB, appPubKey *[32]byte, keys []*pb.Temporary
 	var keysInserted int64
 
 	for _, key := range keys {
-		result, err := s.Exec(region, originator, key.GetKeyData(), key.GetRollingStartIntervalNumber(), key.GetRollingPeriod(), key.GetTransmissionRiskLevel(), hourOfSubmission)
+		args := []interface{}{region, originator, key.GetKeyData(), key.GetRollingStartIntervalNumber(), key.GetRollingPeriod(), key.GetTransmissionRiskLevel(), hourOfSubmission}
+		if config.AppConstants.RequireKeyPromotion {
+			args = append(args, appPubKey[:])
+		}
+		result, err := s.ExecContext(ctx, args...)
 		if err != nil {
-			if err := tx.Rollback(); err != nil {
-				return err
+			if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+				return 0, 0, err
 			}
-			return err
+			return 0, 0, err
 		}
 		n, err := result.RowsAffected()
 		if err != nil {
-			if err := tx.Rollback(); err != nil {
-				return err
+			if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+				return 0, 0, err
 			}
-			return err
+			return 0, 0, err
 		}
 
 		keysInserted += n
 	}
 
-	if remainingKeys < keysInserted {
-		if err := tx.Rollback(); err != nil {
-			return err
+	overBudget, err := exceedsKeypairBudget(ctx, tx, appPubKey, keysInserted)
+	if err != nil {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			return 0, 0, err
 		}
-		return ErrTooManyKeys
+		return 0, 0, err
 	}
 
-	_, err = tx.Exec(`
+	if remainingKeys < keysInserted || overBudget {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			return 0, 0, err
+		}
+		return 0, 0, ErrTooManyKeys
+	}
+
+	_, err = tx.ExecContext(ctx, `
 		INSERT INTO tek_upload_count
 		(originator, date, count, first_upload)
 		VALUES (?, ?, ?, ?)`,
@@ -307,34 +387,127 @@ func registerDiagnosisKeys(db *sql.DB, appPubKey *[32]byte, keys []*pb.Temporary
 	)
 
 	if err != nil {
-		if err := tx.Rollback(); err != nil {
-			return err
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			return 0, 0, err
 		}
-		return err
+		return 0, 0, err
 	}
 
-	_, err = tx.Exec(`
+	_, err = tx.ExecContext(ctx, `
 		UPDATE encryption_keys
-		SET remaining_keys = remaining_keys - ?
+		SET remaining_keys = remaining_keys - ?, stored_keys = stored_keys + ?
 		WHERE remaining_keys >= ?
 		AND app_public_key = ?`,
 		keysInserted,
 		keysInserted,
+		keysInserted,
 		appPubKey[:],
 	)
 
 	if err != nil {
-		if err := tx.Rollback(); err != nil {
-			return err
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			return 0, 0, err
+		}
+		return 0, 0, ErrTooManyKeys
+	}
+
+	if remainingKeys == keysInserted {
+		if _, err := tx.ExecContext(ctx, `
+		UPDATE encryption_keys
+		SET consumed_at = ?, last_upload_digest = ?
+		WHERE app_public_key = ?`,
+			time.Now(),
+			digest,
+			appPubKey[:],
+		); err != nil {
+			if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+				return 0, 0, err
+			}
+			return 0, 0, err
+		}
+	}
+
+	if config.AppConstants.UploadCooldownSeconds > 0 {
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE encryption_keys SET last_upload_at = ? WHERE app_public_key = ?`,
+			time.Now(),
+			appPubKey[:],
+		); err != nil {
+			if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+				return 0, 0, err
+			}
+			return 0, 0, err
 		}
-		return ErrTooManyKeys
 	}
 
 	if err = tx.Commit(); err != nil {
-		return err
+		return 0, 0, err
 	}
 
-	return nil
+	// Keys held back for promotion don't change what's served until then, so
+	// promoteKeys records the update instead
+	if keysInserted > 0 && !config.AppConstants.RequireKeyPromotion {
+		bumpRegionUpdated(ctx, db, region, time.Now())
+	}
+
+	// Keys whose data is already stored, from this or another keypair, are
+	// ignored by the unique key_data index rather than erroring, so a client
+	// resubmitting keys it already uploaded isn't charged for them twice
+	return keysInserted, int64(len(keys)) - keysInserted, nil
+}
+
+// uploadedWithinCooldown reports whether the keypair last uploaded less than
+// the configured cooldown ago. Uploads made while the cooldown was disabled
+// aren't recorded, so they never count.
+func uploadedWithinCooldown(ctx context.Context, tx *sql.Tx, appPubKey *[32]byte) (bool, error) {
+	cooldown := time.Duration(config.AppConstants.UploadCooldownSeconds) * time.Second
+	if cooldown == 0 {
+		return false, nil
+	}
+
+	var lastUpload sql.NullTime
+	if err := tx.QueryRowContext(ctx, "SELECT last_upload_at FROM encryption_keys WHERE app_public_key = ?", appPubKey[:]).Scan(&lastUpload); err != nil {
+		return false, err
+	}
+	return lastUpload.Valid && time.Since(lastUpload.Time) < cooldown, nil
+}
+
+// isRetryWithinGrace reports whether an upload of keys with digest to a
+// consumed keypair repeats the upload that consumed it, within the configured
+// grace period.
+func isRetryWithinGrace(ctx context.Context, tx *sql.Tx, appPubKey *[32]byte, digest []byte) (bool, error) {
+	grace := time.Duration(config.AppConstants.ConsumedKeypairGraceSeconds) * time.Second
+	if grace == 0 {
+		return false, nil
+	}
+
+	var consumedAt sql.NullTime
+	var lastDigest []byte
+	if err := tx.QueryRowContext(ctx, "SELECT consumed_at, last_upload_digest FROM encryption_keys WHERE app_public_key = ?", appPubKey[:]).Scan(&consumedAt, &lastDigest); err != nil {
+		return false, err
+	}
+
+	if !consumedAt.Valid || time.Since(consumedAt.Time) > grace {
+		return false, nil
+	}
+	return bytes.Equal(digest, lastDigest), nil
+}
+
+// uploadDigest is a hash of the keys in an upload, independent of their order
+func uploadDigest(keys []*pb.TemporaryExposureKey) []byte {
+	encoded := make([][]byte, len(keys))
+	for i, key := range keys {
+		encoded[i] = []byte(fmt.Sprintf("%x:%d:%d:%d",
+			key.GetKeyData(),
+			key.GetRollingStartIntervalNumber(),
+			key.GetRollingPeriod(),
+			key.GetTransmissionRiskLevel(),
+		))
+	}
+	sort.Slice(encoded, func(i, j int) bool { return bytes.Compare(encoded[i], encoded[j]) < 0 })
+
+	sum := sha256.Sum256(bytes.Join(encoded, []byte(",")))
+	return sum[:]
 }
 
 type queryRower interface {
@@ -370,18 +543,18 @@ func checkClaimKeyBan(db queryRower, identifier string) (triesRemaining int, ban
 	return triesRemaining, banDuration, nil
 }
 
-func registerClaimKeySuccess(db *sql.DB, identifier string) error {
-	_, err := db.Exec(`DELETE FROM failed_key_claim_attempts WHERE identifier = ?`, identifier)
+func registerClaimKeySuccess(ctx context.Context, db *sql.DB, identifier string) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM failed_key_claim_attempts WHERE identifier = ?`, identifier)
 	return err
 }
 
-func registerClaimKeyFailure(db *sql.DB, identifier string) (triesRemaining int, banDuration time.Duration, err error) {
-	tx, err := db.Begin()
+func registerClaimKeyFailure(ctx context.Context, db *sql.DB, identifier string) (triesRemaining int, banDuration time.Duration, err error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	if _, err := tx.Exec(`
+	if _, err := tx.ExecContext(ctx, `
 		INSERT INTO failed_key_claim_attempts (identifier) VALUES (?)
 		ON DUPLICATE KEY UPDATE
       failures = failures + 1,
@@ -407,10 +580,10 @@ func registerClaimKeyFailure(db *sql.DB, identifier string) (triesRemaining int,
 	return triesRemaining, banDuration, nil
 }
 
-func deleteOldFailedClaimKeyAttempts(db *sql.DB) (int64, error) {
+func deleteOldFailedClaimKeyAttempts(ctx context.Context, db *sql.DB) (int64, error) {
 	threshold := time.Now().Add(-(time.Duration(config.AppConstants.ClaimKeyBanDuration) * time.Hour))
 
-	res, err := db.Exec(`DELETE FROM failed_key_claim_attempts WHERE last_failure < ?`, threshold)
+	res, err := db.ExecContext(ctx, `DELETE FROM failed_key_claim_attempts WHERE last_failure < ?`, threshold)
 	if err != nil {
 		return 0, err
 	}
@@ -455,3 +628,40 @@ func countUnclaimedOneTimeCodes(db *sql.DB) (int64, error) {
 
 	return count, err
 }
+
+// TableRowCount is the approximate number of rows in a table
+type TableRowCount struct {
+	Table string
+	Rows  int64
+}
+
+// Approximate row counts from information_schema, which avoids the full scan
+// (and locking) of a COUNT(*) on large tables.
+func approximateTableRowCounts(ctx context.Context, db *sql.DB, tables []string) ([]TableRowCount, error) {
+	if len(tables) == 0 {
+		return nil, nil
+	}
+
+	args := make([]interface{}, len(tables))
+	for i, table := range tables {
+		args[i] = table
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(tables)), ", ")
+
+	rows, err := db.QueryContext(ctx, `SELECT table_name, COALESCE(table_rows, 0) FROM information_schema.tables
+		WHERE table_schema = DATABASE() AND table_name IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []TableRowCount
+	for rows.Next() {
+		var count TableRowCount
+		if err := rows.Scan(&count.Table, &count.Rows); err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
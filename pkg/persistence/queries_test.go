@@ -1,7 +1,9 @@
 package persistence
 
 import (
+	"context"
 	"crypto/rand"
+	"database/sql"
 	"database/sql/driver"
 	"fmt"
 	"testing"
@@ -23,7 +25,7 @@ func TestDeleteOldDiagnosisKeys(t *testing.T) {
 	oldestHour := timemath.HourNumberAtStartOfDate(oldestDateNumber)
 
 	mock.ExpectExec(`DELETE FROM diagnosis_keys WHERE hour_of_submission < ?`).WithArgs(oldestHour).WillReturnResult(sqlmock.NewResult(1, 1))
-	deleteOldDiagnosisKeys(db)
+	deleteOldDiagnosisKeys(context.Background(), db)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -40,11 +42,11 @@ func TestDeleteOldEncryptionKeys(t *testing.T) {
 		DELETE FROM encryption_keys
 		WHERE  (created < (NOW() - INTERVAL %d DAY))
 		OR    ((created < (NOW() - INTERVAL %d MINUTE)) AND app_public_key IS NULL)
-		OR    remaining_keys = 0
-	`, config.AppConstants.EncryptionKeyValidityDays, config.AppConstants.OneTimeCodeExpiryInMinutes)
+		OR    (remaining_keys = 0 AND (consumed_at IS NULL OR consumed_at < (NOW() - INTERVAL %d SECOND)))
+	`, config.AppConstants.EncryptionKeyValidityDays, config.AppConstants.OneTimeCodeExpiryInMinutes, config.AppConstants.ConsumedKeypairGraceSeconds)
 
 	mock.ExpectExec(query).WillReturnResult(sqlmock.NewResult(1, 1))
-	deleteOldEncryptionKeys(db)
+	deleteOldEncryptionKeys(context.Background(), db)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -64,7 +66,7 @@ func TestClaimKey(t *testing.T) {
 	mock.ExpectBegin()
 	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnError(fmt.Errorf("error"))
 	mock.ExpectRollback()
-	_, receivedErr := claimKey(db, oneTimeCode, pub[:], nil)
+	_, receivedErr := claimKey(db, oneTimeCode, pub[:], context.Background())
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -78,7 +80,7 @@ func TestClaimKey(t *testing.T) {
 	rows := sqlmock.NewRows([]string{"count"}).AddRow(1)
 	mock.ExpectQuery(`SELECT COUNT(*) FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(rows)
 	mock.ExpectRollback()
-	_, receivedErr = claimKey(db, oneTimeCode, pub[:], nil)
+	_, receivedErr = claimKey(db, oneTimeCode, pub[:], context.Background())
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -95,7 +97,7 @@ func TestClaimKey(t *testing.T) {
 	setupSelectOneTimeCode(mock, oneTimeCode, "1950-01-01 00:00:00")
 
 	mock.ExpectRollback()
-	_, receivedErr = claimKey(db, oneTimeCode, pub[:], nil)
+	_, receivedErr = claimKey(db, oneTimeCode, pub[:], context.Background())
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -124,7 +126,7 @@ func TestClaimKey(t *testing.T) {
 	mock.ExpectPrepare(query).WillReturnError(fmt.Errorf("error"))
 
 	mock.ExpectRollback()
-	_, receivedErr = claimKey(db, oneTimeCode, pub[:], nil)
+	_, receivedErr = claimKey(db, oneTimeCode, pub[:], context.Background())
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -147,7 +149,7 @@ func TestClaimKey(t *testing.T) {
 	mock.ExpectPrepare(query).ExpectExec().WithArgs(pub[:], created, oneTimeCode).WillReturnError(fmt.Errorf("error"))
 
 	mock.ExpectRollback()
-	_, receivedErr = claimKey(db, oneTimeCode, pub[:], nil)
+	_, receivedErr = claimKey(db, oneTimeCode, pub[:], context.Background())
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -170,7 +172,7 @@ func TestClaimKey(t *testing.T) {
 	mock.ExpectPrepare(query).ExpectExec().WithArgs(pub[:], created, oneTimeCode).WillReturnResult(sqlmock.NewResult(1, 2))
 
 	mock.ExpectRollback()
-	_, receivedErr = claimKey(db, oneTimeCode, pub[:], nil)
+	_, receivedErr = claimKey(db, oneTimeCode, pub[:], context.Background())
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -195,7 +197,7 @@ func TestClaimKey(t *testing.T) {
 	mock.ExpectPrepare(`SELECT server_public_key FROM encryption_keys WHERE app_public_key = ?`).ExpectQuery().WithArgs(pub[:]).WillReturnError(fmt.Errorf("error"))
 
 	mock.ExpectRollback()
-	_, receivedErr = claimKey(db, oneTimeCode, pub[:], nil)
+	_, receivedErr = claimKey(db, oneTimeCode, pub[:], context.Background())
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -222,7 +224,7 @@ func TestClaimKey(t *testing.T) {
 
 	mock.ExpectCommit()
 
-	serverKey, _ := claimKey(db, oneTimeCode, pub[:], nil)
+	serverKey, _ := claimKey(db, oneTimeCode, pub[:], context.Background())
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -259,7 +261,7 @@ func TestPersistEncryptionKey(t *testing.T) {
 		config.AppConstants.InitialRemainingKeys,
 	).WillReturnError(fmt.Errorf("error"))
 
-	receivedErr := persistEncryptionKey(db, region, originator, pub, priv, oneTimeCode)
+	receivedErr := persistEncryptionKey(context.Background(), db, region, originator, pub, priv, oneTimeCode)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -281,7 +283,7 @@ func TestPersistEncryptionKey(t *testing.T) {
 		config.AppConstants.InitialRemainingKeys,
 	).WillReturnResult(sqlmock.NewResult(1, 1))
 
-	receivedResult := persistEncryptionKey(db, region, originator, pub, priv, oneTimeCode)
+	receivedResult := persistEncryptionKey(context.Background(), db, region, originator, pub, priv, oneTimeCode)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -315,7 +317,7 @@ func testPersistEncryptionKeyWithHashID(t *testing.T) {
 		config.AppConstants.InitialRemainingKeys,
 	).WillReturnError(fmt.Errorf("error"))
 
-	receivedErr := persistEncryptionKeyWithHashID(db, region, originator, hashID, pub, priv, oneTimeCode)
+	receivedErr := persistEncryptionKeyWithHashID(context.Background(), db, region, originator, hashID, pub, priv, oneTimeCode)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -338,7 +340,7 @@ func testPersistEncryptionKeyWithHashID(t *testing.T) {
 		config.AppConstants.InitialRemainingKeys,
 	).WillReturnError(fmt.Errorf("for key 'one_time_code"))
 
-	receivedErr = persistEncryptionKeyWithHashID(db, region, originator, hashID, pub, priv, oneTimeCode)
+	receivedErr = persistEncryptionKeyWithHashID(context.Background(), db, region, originator, hashID, pub, priv, oneTimeCode)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -365,7 +367,7 @@ func testPersistEncryptionKeyWithHashID(t *testing.T) {
 	mock.ExpectQuery(
 		`SELECT one_time_code FROM encryption_keys WHERE hash_id = ? FOR UPDATE`).WithArgs(hashID).WillReturnRows(rows)
 
-	receivedErr = persistEncryptionKeyWithHashID(db, region, originator, hashID, pub, priv, oneTimeCode)
+	receivedErr = persistEncryptionKeyWithHashID(context.Background(), db, region, originator, hashID, pub, priv, oneTimeCode)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -393,7 +395,7 @@ func testPersistEncryptionKeyWithHashID(t *testing.T) {
 		`SELECT one_time_code FROM encryption_keys WHERE hash_id = ? FOR UPDATE`).WithArgs(hashID).WillReturnRows(rows)
 	mock.ExpectExec(`DELETE FROM encryption_keys WHERE hash_id = ? AND one_time_code IS NOT NULL`).WithArgs(hashID).WillReturnError(fmt.Errorf("error"))
 
-	receivedErr = persistEncryptionKeyWithHashID(db, region, originator, hashID, pub, priv, oneTimeCode)
+	receivedErr = persistEncryptionKeyWithHashID(context.Background(), db, region, originator, hashID, pub, priv, oneTimeCode)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -421,7 +423,7 @@ func testPersistEncryptionKeyWithHashID(t *testing.T) {
 		`SELECT one_time_code FROM encryption_keys WHERE hash_id = ? FOR UPDATE`).WithArgs(hashID).WillReturnRows(rows)
 	mock.ExpectExec(`DELETE FROM encryption_keys WHERE hash_id = ? AND one_time_code IS NOT NULL`).WithArgs(hashID).WillReturnResult(sqlmock.NewResult(1, 1))
 
-	receivedErr = persistEncryptionKeyWithHashID(db, region, originator, hashID, pub, priv, oneTimeCode)
+	receivedErr = persistEncryptionKeyWithHashID(context.Background(), db, region, originator, hashID, pub, priv, oneTimeCode)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -444,7 +446,7 @@ func testPersistEncryptionKeyWithHashID(t *testing.T) {
 		config.AppConstants.InitialRemainingKeys,
 	).WillReturnResult(sqlmock.NewResult(1, 1))
 
-	receivedResult := persistEncryptionKeyWithHashID(db, region, originator, hashID, pub, priv, oneTimeCode)
+	receivedResult := persistEncryptionKeyWithHashID(context.Background(), db, region, originator, hashID, pub, priv, oneTimeCode)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -473,7 +475,7 @@ func TestPrivForPub(t *testing.T) {
 
 	expectedResult := priv[:]
 	var receivedResult []byte
-	privForPub(db, pub[:]).Scan(&receivedResult)
+	privForPub(context.Background(), db, pub[:]).Scan(&receivedResult)
 
 	assert.Equal(t, expectedResult, receivedResult, "Expected private key for public key")
 
@@ -498,6 +500,7 @@ func TestDiagnosisKeysForHours(t *testing.T) {
 		AND hour_of_submission < ?
 		AND rolling_start_interval_number > ?
 		AND region = ?
+		AND pending_app_public_key IS NULL
 		ORDER BY key_data`
 
 	row := sqlmock.NewRows([]string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level"}).AddRow("302", []byte{}, 2651450, 144, 4)
@@ -508,7 +511,7 @@ func TestDiagnosisKeysForHours(t *testing.T) {
 		region).WillReturnRows(row)
 
 	expectedResult := []byte("302")
-	rows, _ := diagnosisKeysForHours(db, region, startHour, endHour, currentRollingStartIntervalNumber)
+	rows, _ := diagnosisKeysForHours(context.Background(), db, region, startHour, endHour, currentRollingStartIntervalNumber)
 	var receivedResult []byte
 	for rows.Next() {
 		rows.Scan(&receivedResult, nil, nil, nil, nil)
@@ -534,7 +537,7 @@ func TestRegisterDiagnosisKeys(t *testing.T) {
 	mock.ExpectBegin()
 	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WithArgs(pub[:]).WillReturnError(fmt.Errorf("error"))
 	mock.ExpectRollback()
-	receivedErr := registerDiagnosisKeys(db, pub, keys, nil)
+	_, _, receivedErr := registerDiagnosisKeys(db, pub, keys, context.Background())
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -547,8 +550,10 @@ func TestRegisterDiagnosisKeys(t *testing.T) {
 	mock.ExpectBegin()
 	row := sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow(region, originator, 0)
 	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WillReturnRows(row)
+	graceRow := sqlmock.NewRows([]string{"consumed_at", "last_upload_digest"}).AddRow(nil, nil)
+	mock.ExpectQuery(`SELECT consumed_at, last_upload_digest FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(graceRow)
 	mock.ExpectRollback()
-	receivedErr = registerDiagnosisKeys(db, pub, keys, nil)
+	_, _, receivedErr = registerDiagnosisKeys(db, pub, keys, context.Background())
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -568,7 +573,7 @@ func TestRegisterDiagnosisKeys(t *testing.T) {
 	).WillReturnError(fmt.Errorf("error"))
 
 	mock.ExpectRollback()
-	receivedErr = registerDiagnosisKeys(db, pub, keys, nil)
+	_, _, receivedErr = registerDiagnosisKeys(db, pub, keys, context.Background())
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -601,7 +606,7 @@ func TestRegisterDiagnosisKeys(t *testing.T) {
 	).WillReturnError(fmt.Errorf("error"))
 
 	mock.ExpectRollback()
-	receivedErr = registerDiagnosisKeys(db, pub, keys, nil)
+	_, _, receivedErr = registerDiagnosisKeys(db, pub, keys, context.Background())
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -642,7 +647,7 @@ func TestRegisterDiagnosisKeys(t *testing.T) {
 	}
 
 	mock.ExpectRollback()
-	receivedErr = registerDiagnosisKeys(db, pub, keys, nil)
+	_, _, receivedErr = registerDiagnosisKeys(db, pub, keys, context.Background())
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -695,17 +700,18 @@ func TestRegisterDiagnosisKeys(t *testing.T) {
 
 	mock.ExpectExec(
 		`UPDATE encryption_keys
-	SET remaining_keys = remaining_keys - ?
+	SET remaining_keys = remaining_keys - ?, stored_keys = stored_keys + ?
 	WHERE remaining_keys >= ?
 	AND app_public_key = ?`,
 	).WithArgs(
+		len(keys),
 		len(keys),
 		len(keys),
 		pub[:],
 	).WillReturnError(fmt.Errorf("error"))
 
 	mock.ExpectRollback()
-	receivedErr = registerDiagnosisKeys(db, pub, keys, nil)
+	_, _, receivedErr = registerDiagnosisKeys(db, pub, keys, context.Background())
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -758,17 +764,19 @@ func TestRegisterDiagnosisKeys(t *testing.T) {
 
 	mock.ExpectExec(
 		`UPDATE encryption_keys
-	SET remaining_keys = remaining_keys - ?
+	SET remaining_keys = remaining_keys - ?, stored_keys = stored_keys + ?
 	WHERE remaining_keys >= ?
 	AND app_public_key = ?`,
 	).WithArgs(
+		len(keys),
 		len(keys),
 		len(keys),
 		pub[:],
 	).WillReturnResult(sqlmock.NewResult(1, 1))
 
 	mock.ExpectCommit()
-	receivedResult := registerDiagnosisKeys(db, pub, keys, nil)
+	expectRegionUpdated(mock, "302")
+	_, _, receivedResult := registerDiagnosisKeys(db, pub, keys, context.Background())
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -777,6 +785,313 @@ func TestRegisterDiagnosisKeys(t *testing.T) {
 	assert.Nil(t, receivedResult, "Expected nil when keys are commited")
 }
 
+func TestRegisterDiagnosisKeys_ConsumedGracePeriod(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	keys := []*pb.TemporaryExposureKey{randomTestKey(), randomTestKey()}
+
+	// Identical retry within the grace period succeeds without writing
+	mock.ExpectBegin()
+	row := sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow("302", "randomOrigin", 0)
+	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WillReturnRows(row)
+	graceRow := sqlmock.NewRows([]string{"consumed_at", "last_upload_digest"}).AddRow(time.Now().Add(-time.Minute), uploadDigest(keys))
+	mock.ExpectQuery(`SELECT consumed_at, last_upload_digest FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(graceRow)
+	mock.ExpectRollback()
+
+	// Keys in a different order are the same upload
+	_, _, receivedErr := registerDiagnosisKeys(db, pub, []*pb.TemporaryExposureKey{keys[1], keys[0]}, context.Background())
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	assert.Nil(t, receivedErr, "Expected nil for an identical retry within the grace period")
+
+	// Different keys within the grace period are still rejected
+	mock.ExpectBegin()
+	row = sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow("302", "randomOrigin", 0)
+	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WillReturnRows(row)
+	graceRow = sqlmock.NewRows([]string{"consumed_at", "last_upload_digest"}).AddRow(time.Now().Add(-time.Minute), uploadDigest(keys))
+	mock.ExpectQuery(`SELECT consumed_at, last_upload_digest FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(graceRow)
+	mock.ExpectRollback()
+
+	_, _, receivedErr = registerDiagnosisKeys(db, pub, []*pb.TemporaryExposureKey{randomTestKey()}, context.Background())
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	assert.Equal(t, ErrKeyConsumed, receivedErr, "Expected ErrKeyConsumed for different keys")
+
+	// Identical retry after the grace period is rejected
+	mock.ExpectBegin()
+	row = sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow("302", "randomOrigin", 0)
+	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WillReturnRows(row)
+	graceRow = sqlmock.NewRows([]string{"consumed_at", "last_upload_digest"}).AddRow(time.Now().Add(-time.Hour), uploadDigest(keys))
+	mock.ExpectQuery(`SELECT consumed_at, last_upload_digest FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(graceRow)
+	mock.ExpectRollback()
+
+	_, _, receivedErr = registerDiagnosisKeys(db, pub, keys, context.Background())
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	assert.Equal(t, ErrKeyConsumed, receivedErr, "Expected ErrKeyConsumed after the grace period")
+}
+
+func TestRegisterDiagnosisKeys_UploadCooldown(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	config.AppConstants.UploadCooldownSeconds = 60
+	defer func() { config.AppConstants.UploadCooldownSeconds = 0 }()
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	keys := []*pb.TemporaryExposureKey{randomTestKey()}
+
+	// First upload: nothing recorded yet, so it goes through and is timestamped
+	mock.ExpectBegin()
+	row := sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow("302", "randomOrigin", 2)
+	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WillReturnRows(row)
+	lastUpload := sqlmock.NewRows([]string{"last_upload_at"}).AddRow(nil)
+	mock.ExpectQuery(`SELECT last_upload_at FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(lastUpload)
+	mock.ExpectPrepare(
+		`INSERT IGNORE INTO diagnosis_keys
+		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, hour_of_submission)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+	).ExpectExec().WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(
+		`INSERT INTO tek_upload_count
+		(originator, date, count, first_upload)
+		VALUES (?, ?, ?, ?)`,
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(
+		`UPDATE encryption_keys
+		SET remaining_keys = remaining_keys - ?, stored_keys = stored_keys + ?
+		WHERE remaining_keys >= ?
+		AND app_public_key = ?`,
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`UPDATE encryption_keys SET last_upload_at = ? WHERE app_public_key = ?`).WithArgs(AnyType{}, pub[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	expectRegionUpdated(mock, "302")
+
+	_, _, err := registerDiagnosisKeys(db, pub, keys, context.Background())
+	assert.Nil(t, err)
+
+	// Second upload straight after is throttled without writing
+	mock.ExpectBegin()
+	row = sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow("302", "randomOrigin", 1)
+	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WillReturnRows(row)
+	lastUpload = sqlmock.NewRows([]string{"last_upload_at"}).AddRow(time.Now())
+	mock.ExpectQuery(`SELECT last_upload_at FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(lastUpload)
+	mock.ExpectRollback()
+
+	_, _, err = registerDiagnosisKeys(db, pub, []*pb.TemporaryExposureKey{randomTestKey()}, context.Background())
+	assert.Equal(t, ErrUploadTooSoon, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRegisterDiagnosisKeys_CrossUploadDuplicates(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	stored, fresh := randomTestKey(), randomTestKey()
+
+	// The first key was stored by an earlier upload, so the unique key_data
+	// index ignores it and only the fresh key is counted and charged
+	mock.ExpectBegin()
+	row := sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow("302", "randomOrigin", 10)
+	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WillReturnRows(row)
+	insert := `INSERT IGNORE INTO diagnosis_keys
+		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, hour_of_submission)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
+	mock.ExpectPrepare(insert)
+	mock.ExpectExec(insert).WithArgs("302", "randomOrigin", stored.GetKeyData(), AnyType{}, AnyType{}, AnyType{}, AnyType{}).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(insert).WithArgs("302", "randomOrigin", fresh.GetKeyData(), AnyType{}, AnyType{}, AnyType{}, AnyType{}).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(
+		`INSERT INTO tek_upload_count
+		(originator, date, count, first_upload)
+		VALUES (?, ?, ?, ?)`,
+	).WithArgs(AnyType{}, AnyType{}, int64(1), AnyType{}).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(
+		`UPDATE encryption_keys
+		SET remaining_keys = remaining_keys - ?, stored_keys = stored_keys + ?
+		WHERE remaining_keys >= ?
+		AND app_public_key = ?`,
+	).WithArgs(int64(1), int64(1), int64(1), pub[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	expectRegionUpdated(mock, "302")
+
+	storedCount, skippedCount, err := registerDiagnosisKeys(db, pub, []*pb.TemporaryExposureKey{stored, fresh}, context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), storedCount)
+	assert.Equal(t, int64(1), skippedCount)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRegisterDiagnosisKeys_RecordsConsumption(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	key := randomTestKey()
+	keys := []*pb.TemporaryExposureKey{key}
+
+	mock.ExpectBegin()
+	row := sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow("302", "randomOrigin", 1)
+	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WillReturnRows(row)
+	mock.ExpectPrepare(
+		`INSERT IGNORE INTO diagnosis_keys
+		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, hour_of_submission)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+	).ExpectExec().WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(
+		`INSERT INTO tek_upload_count
+		(originator, date, count, first_upload)
+		VALUES (?, ?, ?, ?)`,
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(
+		`UPDATE encryption_keys
+	SET remaining_keys = remaining_keys - ?, stored_keys = stored_keys + ?
+	WHERE remaining_keys >= ?
+	AND app_public_key = ?`,
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(
+		`UPDATE encryption_keys
+		SET consumed_at = ?, last_upload_digest = ?
+		WHERE app_public_key = ?`,
+	).WithArgs(AnyType{}, uploadDigest(keys), pub[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	expectRegionUpdated(mock, "302")
+
+	_, _, receivedErr := registerDiagnosisKeys(db, pub, keys, context.Background())
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	assert.Nil(t, receivedErr, "Expected nil when the last keys are commited")
+}
+
+func TestRegisterDiagnosisKeys_MaxKeysPerKeypair(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	oldInitial := config.AppConstants.InitialRemainingKeys
+	config.AppConstants.InitialRemainingKeys = 28
+	config.AppConstants.MaxKeysPerKeypair = 3
+	defer func() {
+		config.AppConstants.InitialRemainingKeys = oldInitial
+		config.AppConstants.MaxKeysPerKeypair = 0
+	}()
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+
+	// The keypair was issued 40 keys, more than initialRemainingKeys now
+	// allows, and has already stored 2 of them
+	expectUpload := func(keys []*pb.TemporaryExposureKey) {
+		mock.ExpectBegin()
+		row := sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow("302", "randomOrigin", 38)
+		mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WillReturnRows(row)
+		prepare := mock.ExpectPrepare(
+			`INSERT IGNORE INTO diagnosis_keys
+		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, hour_of_submission)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		)
+		for range keys {
+			prepare.ExpectExec().WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		stored := sqlmock.NewRows([]string{"stored_keys"}).AddRow(2)
+		mock.ExpectQuery(`SELECT stored_keys FROM encryption_keys WHERE app_public_key = ?`).WithArgs(pub[:]).WillReturnRows(stored)
+	}
+
+	// Above the budget
+	keys := []*pb.TemporaryExposureKey{randomTestKey(), randomTestKey()}
+	expectUpload(keys)
+	mock.ExpectRollback()
+
+	_, _, receivedErr := registerDiagnosisKeys(db, pub, keys, context.Background())
+	assert.Equal(t, ErrTooManyKeys, receivedErr, "Expected error when the keypair's budget is exceeded")
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	// At the budget
+	keys = []*pb.TemporaryExposureKey{randomTestKey()}
+	expectUpload(keys)
+	mock.ExpectExec(
+		`INSERT INTO tek_upload_count
+		(originator, date, count, first_upload)
+		VALUES (?, ?, ?, ?)`,
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(
+		`UPDATE encryption_keys
+	SET remaining_keys = remaining_keys - ?, stored_keys = stored_keys + ?
+	WHERE remaining_keys >= ?
+	AND app_public_key = ?`,
+	).WithArgs(1, 1, 1, pub[:]).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	expectRegionUpdated(mock, "302")
+
+	_, _, receivedErr = registerDiagnosisKeys(db, pub, keys, context.Background())
+	assert.Nil(t, receivedErr, "Expected nil when the keypair reaches its budget")
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRegisterDiagnosisKeys_ContextCancelled(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	key := randomTestKey()
+	keys := []*pb.TemporaryExposureKey{key}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	mock.ExpectBegin()
+	row := sqlmock.NewRows([]string{"region", "originator", "remaining_keys"}).AddRow("302", "randomOrigin", 1)
+	mock.ExpectQuery(`SELECT region, originator, remaining_keys FROM encryption_keys WHERE app_public_key = ? FOR UPDATE`).WillReturnRows(row)
+	mock.ExpectPrepare(
+		`INSERT IGNORE INTO diagnosis_keys
+		(region, originator, key_data, rolling_start_interval_number, rolling_period, transmission_risk_level, hour_of_submission)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+	).ExpectExec().WillDelayFor(time.Second).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectRollback()
+
+	// Cancel the request while the insert is in flight
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, _, receivedErr := registerDiagnosisKeys(db, pub, keys, ctx)
+
+	assert.NotNil(t, receivedErr, "Expected error if the context is cancelled")
+	assert.NotEqual(t, sql.ErrTxDone, receivedErr, "Expected the cancellation error, not the rollback error")
+	assert.True(t, time.Since(start) < time.Second, "Expected the insert to abort before completing")
+
+	// database/sql rolls back the cancelled transaction asynchronously
+	var expectationsErr error
+	for i := 0; i < 100; i++ {
+		if expectationsErr = mock.ExpectationsWereMet(); expectationsErr == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if expectationsErr != nil {
+		t.Errorf("there were unfulfilled expectations: %s", expectationsErr)
+	}
+}
+
 func TestCheckClaimKeyBan(t *testing.T) {
 	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
 	defer db.Close()
@@ -877,7 +1192,7 @@ func TestRegisterClaimKeySuccess(t *testing.T) {
 	identifier := "127.0.0.1"
 
 	mock.ExpectExec(`DELETE FROM failed_key_claim_attempts WHERE identifier = ?`).WithArgs(identifier).WillReturnResult(sqlmock.NewResult(1, 1))
-	receivedResult := registerClaimKeySuccess(db, identifier)
+	receivedResult := registerClaimKeySuccess(context.Background(), db, identifier)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -908,7 +1223,7 @@ func TestRegisterClaimKeyFailure(t *testing.T) {
 	expectedBanDuration := time.Duration(0)
 	expectedErr := fmt.Errorf("error")
 
-	receivedTriesRemaining, receivedBanDuration, receivedErr := registerClaimKeyFailure(db, identifier)
+	receivedTriesRemaining, receivedBanDuration, receivedErr := registerClaimKeyFailure(context.Background(), db, identifier)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -937,7 +1252,7 @@ func TestRegisterClaimKeyFailure(t *testing.T) {
 	expectedBanDuration = time.Duration(0)
 	expectedErr = fmt.Errorf("error")
 
-	receivedTriesRemaining, receivedBanDuration, receivedErr = registerClaimKeyFailure(db, identifier)
+	receivedTriesRemaining, receivedBanDuration, receivedErr = registerClaimKeyFailure(context.Background(), db, identifier)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -967,7 +1282,7 @@ func TestRegisterClaimKeyFailure(t *testing.T) {
 	expectedTriesRemaining = maxConsecutiveClaimKeyFailures - 1
 	expectedBanDuration = time.Duration(0)
 
-	receivedTriesRemaining, receivedBanDuration, receivedErr = registerClaimKeyFailure(db, identifier)
+	receivedTriesRemaining, receivedBanDuration, receivedErr = registerClaimKeyFailure(context.Background(), db, identifier)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -985,7 +1300,7 @@ func TestDeleteOldFailedClaimKeyAttempts(t *testing.T) {
 	mock.ExpectExec(`DELETE FROM failed_key_claim_attempts WHERE last_failure < ?`).WillReturnResult(sqlmock.NewResult(1, 1))
 
 	expectedResult := int64(1)
-	receivedResult, receivedError := deleteOldFailedClaimKeyAttempts(db)
+	receivedResult, receivedError := deleteOldFailedClaimKeyAttempts(context.Background(), db)
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
@@ -1052,6 +1367,39 @@ func TestCountUnclaimedOneTimeCodes(t *testing.T) {
 	assert.Nil(t, receivedErr, "Expected nil if query ran")
 }
 
+func TestApproximateTableRowCounts(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{"table_name", "table_rows"}).
+		AddRow("diagnosis_keys", 1000).
+		AddRow("events", 20)
+	mock.ExpectQuery(`SELECT table_name, COALESCE(table_rows, 0) FROM information_schema.tables
+		WHERE table_schema = DATABASE() AND table_name IN (?, ?)`).
+		WithArgs("diagnosis_keys", "events").
+		WillReturnRows(rows)
+
+	expectedResult := []TableRowCount{
+		{Table: "diagnosis_keys", Rows: 1000},
+		{Table: "events", Rows: 20},
+	}
+
+	receivedResult, receivedErr := approximateTableRowCounts(context.Background(), db, []string{"diagnosis_keys", "events"})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, expectedResult, receivedResult, "Expected to receive a row count per table")
+	assert.Nil(t, receivedErr, "Expected nil if query ran")
+
+	// No tables doesn't query
+	receivedResult, receivedErr = approximateTableRowCounts(context.Background(), db, nil)
+
+	assert.Nil(t, receivedResult, "Expected no counts without tables")
+	assert.Nil(t, receivedErr, "Expected nil without tables")
+}
+
 func randomTestKey() *pb.TemporaryExposureKey {
 	token := make([]byte, 16)
 	rand.Read(token)
@@ -0,0 +1,43 @@
+package persistence
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConn_ReadReplica(t *testing.T) {
+	primary, primaryMock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
+	defer primary.Close()
+	replica, replicaMock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
+	defer replica.Close()
+
+	c := conn{db: primary, read: replica}
+
+	// Reads go to the replica
+	replicaMock.ExpectQuery("").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(5))
+	count, err := c.CountDiagnosisKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), count)
+
+	// Writes stay on the primary
+	primaryMock.ExpectExec("").WillReturnResult(sqlmock.NewResult(0, 3))
+	deleted, err := c.DeleteOldDiagnosisKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), deleted)
+
+	// Without a replica reads go to the primary
+	c = conn{db: primary}
+	primaryMock.ExpectQuery("").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(7))
+	count, err = c.CountDiagnosisKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), count)
+
+	if err := primaryMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if err := replicaMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
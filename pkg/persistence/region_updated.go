@@ -0,0 +1,40 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// RegionLastUpdated returns when keys were last stored for region, or
+// sql.ErrNoRows if none have been since the time was first tracked
+func (c *conn) RegionLastUpdated(ctx context.Context, region string) (time.Time, error) {
+	ctx, cancel := c.statementContext(ctx)
+	defer cancel()
+	return regionLastUpdated(ctx, c.reader(), region)
+}
+
+func regionLastUpdated(ctx context.Context, db *sql.DB, region string) (time.Time, error) {
+	var updatedAt time.Time
+	if err := db.QueryRowContext(ctx,
+		"SELECT updated_at FROM region_updates WHERE region = ?",
+		region,
+	).Scan(&updatedAt); err != nil {
+		return time.Time{}, err
+	}
+	return updatedAt, nil
+}
+
+// bumpRegionUpdated records now as the time keys were last stored for region.
+// It runs once the keys are stored rather than in the same transaction, so
+// uploads to a region don't all wait on its region_updates row. The keys are
+// already stored by then, so a failure is logged instead of returned.
+func bumpRegionUpdated(ctx context.Context, db *sql.DB, region string, now time.Time) {
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO region_updates (region, updated_at) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE updated_at = VALUES(updated_at)`,
+		region, now,
+	); err != nil {
+		log(ctx, err).WithField("region", region).Warn("unable to record region update")
+	}
+}
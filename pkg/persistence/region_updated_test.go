@@ -0,0 +1,61 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const regionUpdatedQuery = `
+		INSERT INTO region_updates (region, updated_at) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE updated_at = VALUES(updated_at)`
+
+// expectRegionUpdated expects a successful upload to mark region as updated
+func expectRegionUpdated(mock sqlmock.Sqlmock, region string) {
+	mock.ExpectExec(regionUpdatedQuery).WithArgs(region, AnyType{}).WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+func TestRegionLastUpdated(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	updatedAt := time.Date(2020, 9, 14, 12, 30, 0, 0, time.UTC)
+	query := `SELECT updated_at FROM region_updates WHERE region = ?`
+	mock.ExpectQuery(query).WithArgs("302").WillReturnRows(sqlmock.NewRows([]string{"updated_at"}).AddRow(updatedAt))
+	mock.ExpectQuery(query).WithArgs("999").WillReturnRows(sqlmock.NewRows([]string{"updated_at"}))
+
+	received, err := regionLastUpdated(context.Background(), db, "302")
+	assert.Nil(t, err)
+	assert.Equal(t, updatedAt, received)
+
+	_, err = regionLastUpdated(context.Background(), db, "999")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestBumpRegionUpdated_LogsFailure(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	mock.ExpectExec(regionUpdatedQuery).WithArgs("302", AnyType{}).WillReturnError(fmt.Errorf("error"))
+
+	bumpRegionUpdated(context.Background(), db, "302", time.Now())
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "unable to record region update")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
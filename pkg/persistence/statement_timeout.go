@@ -0,0 +1,83 @@
+package persistence
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// statementContext bounds ctx by dbStatementTimeoutMilliseconds, so the
+// queries run under it are cancelled if they take longer. The returned
+// cancel func must be called once the call, including reading its rows, is
+// done.
+func (c *conn) statementContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.statementTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.statementTimeout)
+}
+
+// streamContext is statementContext for a query whose rows are handed on as
+// they are read. The timeout only runs while the database is being waited
+// on: the returned streamTimer is paused while a row is handled, e.g. written
+// to a slow client, so that time doesn't count against it.
+func (c *conn) streamContext(ctx context.Context) (context.Context, *streamTimer, context.CancelFunc) {
+	if c.statementTimeout <= 0 {
+		return ctx, nil, func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	t := &streamTimer{remaining: c.statementTimeout, started: time.Now()}
+	t.timer = time.AfterFunc(c.statementTimeout, func() {
+		t.mu.Lock()
+		t.expired = true
+		t.mu.Unlock()
+		cancel()
+	})
+	return ctx, t, func() {
+		t.timer.Stop()
+		cancel()
+	}
+}
+
+// streamTimer cancels a streamContext once it has run for the statement
+// timeout, not counting the time it spent paused. A nil streamTimer, for no
+// timeout, does nothing.
+type streamTimer struct {
+	timer     *time.Timer
+	remaining time.Duration
+	started   time.Time
+
+	mu      sync.Mutex
+	expired bool
+}
+
+func (t *streamTimer) pause() {
+	if t == nil {
+		return
+	}
+	if t.timer.Stop() {
+		t.remaining -= time.Since(t.started)
+	}
+}
+
+func (t *streamTimer) resume() {
+	if t == nil {
+		return
+	}
+	t.started = time.Now()
+	t.timer.Reset(t.remaining)
+}
+
+// wrap returns err as an ErrDBTimeout if the timer ran out, since the query
+// is then cancelled rather than past a deadline
+func (t *streamTimer) wrap(err error) error {
+	if t == nil || err == nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.expired {
+		return &DBError{Kind: ErrDBTimeout, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,103 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatementTimeout(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
+	defer db.Close()
+
+	c := conn{db: db, statementTimeout: 10 * time.Millisecond}
+	key := make([]byte, 32)
+
+	// A slow query is cancelled once the timeout passes
+	mock.ExpectQuery("").WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"denylisted"}).AddRow(true))
+
+	start := time.Now()
+	_, err := c.IsDenylisted(context.Background(), key)
+	assert.Equal(t, sqlmock.ErrCancelled, err)
+	assert.True(t, time.Since(start) < time.Second, "query should be cancelled early")
+
+	// So is a slow key retrieval
+	mock.ExpectQuery("").WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level"}))
+
+	_, err = c.FetchKeysForHours("302", 100, 200, 2651450)
+	assert.Equal(t, sqlmock.ErrCancelled, err)
+
+	// A fast one is unaffected
+	mock.ExpectQuery("").WillReturnRows(sqlmock.NewRows([]string{"denylisted"}).AddRow(true))
+
+	denylisted, err := c.IsDenylisted(context.Background(), key)
+	assert.Nil(t, err)
+	assert.True(t, denylisted)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestStatementTimeout_PrivForPub(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
+	defer db.Close()
+
+	c := conn{db: db, statementTimeout: 10 * time.Millisecond}
+
+	mock.ExpectQuery("").WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"server_private_key"}).AddRow(make([]byte, 32)))
+
+	start := time.Now()
+	_, err := c.PrivForPub(make([]byte, 32))
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < time.Second, "query should be cancelled early")
+}
+
+func TestStatementTimeout_Stream(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(allQueryMatcher))
+	defer db.Close()
+
+	c := conn{db: db, statementTimeout: 10 * time.Millisecond}
+	columns := []string{"region", "key_data", "rolling_start_interval_number", "rolling_period", "transmission_risk_level"}
+
+	// A slow query times out
+	mock.ExpectQuery("").WillDelayFor(time.Second).WillReturnRows(sqlmock.NewRows(columns))
+
+	err := c.StreamKeysForHours("302", 100, 200, 2651450, func(*pb.TemporaryExposureKey) error { return nil })
+	assert.True(t, errors.Is(err, ErrDBTimeout))
+
+	// Time spent handing keys to a slow client doesn't count
+	mock.ExpectQuery("").WillReturnRows(sqlmock.NewRows(columns).
+		AddRow("302", make([]byte, 16), 2651450, 144, 4).
+		AddRow("302", make([]byte, 16), 2651450, 144, 4))
+
+	streamed := 0
+	err = c.StreamKeysForHours("302", 100, 200, 2651450, func(*pb.TemporaryExposureKey) error {
+		time.Sleep(20 * time.Millisecond)
+		streamed++
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, streamed)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestStatementTimeout_Disabled(t *testing.T) {
+	c := conn{}
+	ctx, cancel := c.statementContext(context.Background())
+	defer cancel()
+
+	_, ok := ctx.Deadline()
+	assert.False(t, ok)
+}
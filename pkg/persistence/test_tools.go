@@ -8,6 +8,8 @@ import (
 
 // ClearDiagnosisKeys Truncates the diagnosis_keys table to support testing
 func (c *conn) ClearDiagnosisKeys(ctx context.Context) error {
+	ctx, cancel := c.statementContext(ctx)
+	defer cancel()
 	return clearDiagnosisKeys(ctx, c.db)
 }
 
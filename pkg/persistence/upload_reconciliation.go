@@ -0,0 +1,104 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/timemath"
+)
+
+// UploadCountDrift compares, for one originator and day, the keys stored in
+// diagnosis_keys with the keys tek_upload_count says were uploaded
+type UploadCountDrift struct {
+	Originator   string
+	Date         string
+	StoredKeys   int64
+	RecordedKeys int64
+}
+
+// Difference is how many more keys were stored than recorded, negative if
+// fewer were
+func (d UploadCountDrift) Difference() int64 {
+	return d.StoredKeys - d.RecordedKeys
+}
+
+// ReconcileUploadCounts returns the stored and recorded key counts of each
+// originator with either on the UTC day of date, ordered by originator. The
+// counts only agree for days whose keys haven't yet been deleted by retention
+// or moved by promotion.
+func (c *conn) ReconcileUploadCounts(ctx context.Context, date time.Time) ([]UploadCountDrift, error) {
+	ctx, cancel := c.statementContext(ctx)
+	defer cancel()
+	return reconcileUploadCounts(ctx, c.reader(), date)
+}
+
+func reconcileUploadCounts(ctx context.Context, db *sql.DB, date time.Time) ([]UploadCountDrift, error) {
+	day := timemath.MostRecentUTCMidnight(date)
+	startHour := timemath.HourNumber(day)
+	dateString := day.Format("2006-01-02")
+
+	drift := map[string]*UploadCountDrift{}
+	entry := func(originator string) *UploadCountDrift {
+		d, ok := drift[originator]
+		if !ok {
+			d = &UploadCountDrift{Originator: originator, Date: dateString}
+			drift[originator] = d
+		}
+		return d
+	}
+
+	// diagnosis_keys holds the raw originator, tek_upload_count the region it
+	// translates to
+	rows, err := db.QueryContext(ctx, `
+		SELECT originator, COUNT(*) FROM diagnosis_keys
+		WHERE hour_of_submission >= ? AND hour_of_submission < ?
+		GROUP BY originator`,
+		startHour, startHour+24,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var originator sql.NullString
+		var count int64
+		if err := rows.Scan(&originator, &count); err != nil {
+			return nil, err
+		}
+		entry(translateToken(originator.String)).StoredKeys += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT originator, SUM(count) FROM tek_upload_count
+		WHERE date = ?
+		GROUP BY originator`,
+		dateString,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var originator string
+		var count int64
+		if err := rows.Scan(&originator, &count); err != nil {
+			return nil, err
+		}
+		entry(originator).RecordedKeys += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]UploadCountDrift, 0, len(drift))
+	for _, d := range drift {
+		result = append(result, *d)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Originator < result[j].Originator })
+	return result, nil
+}
@@ -0,0 +1,59 @@
+package persistence
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+const storedKeysByOriginatorQuery = `
+		SELECT originator, COUNT(*) FROM diagnosis_keys
+		WHERE hour_of_submission >= ? AND hour_of_submission < ?
+		GROUP BY originator`
+
+const recordedKeysByOriginatorQuery = `
+		SELECT originator, SUM(count) FROM tek_upload_count
+		WHERE date = ?
+		GROUP BY originator`
+
+func TestReconcileUploadCounts(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	date := time.Date(2020, 9, 13, 15, 30, 0, 0, time.UTC)
+	startHour := uint32(date.Truncate(24*time.Hour).Unix() / 3600)
+
+	// token1 translates to ONApi. One of its uploads stored 10 keys but the
+	// count of it was lost, and token2 isn't mapped so is reported by itself.
+	mock.ExpectQuery(storedKeysByOriginatorQuery).WithArgs(startHour, startHour+24).WillReturnRows(
+		sqlmock.NewRows([]string{"originator", "count"}).
+			AddRow(token1, 24).
+			AddRow(token2, 3).
+			AddRow(nil, 2),
+	)
+	mock.ExpectQuery(recordedKeysByOriginatorQuery).WithArgs("2020-09-13").WillReturnRows(
+		sqlmock.NewRows([]string{"originator", "count"}).
+			AddRow(onApi, 14).
+			AddRow(token2, 3).
+			AddRow("QCApi", 5),
+	)
+
+	drift, err := reconcileUploadCounts(context.Background(), db, date)
+	assert.Nil(t, err)
+	assert.Equal(t, []UploadCountDrift{
+		{Originator: "", Date: "2020-09-13", StoredKeys: 2, RecordedKeys: 0},
+		{Originator: onApi, Date: "2020-09-13", StoredKeys: 24, RecordedKeys: 14},
+		{Originator: "QCApi", Date: "2020-09-13", StoredKeys: 0, RecordedKeys: 5},
+		{Originator: token2, Date: "2020-09-13", StoredKeys: 3, RecordedKeys: 3},
+	}, drift)
+	assert.Equal(t, int64(10), drift[1].Difference())
+	assert.Equal(t, int64(-5), drift[2].Difference())
+	assert.Equal(t, int64(0), drift[3].Difference())
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
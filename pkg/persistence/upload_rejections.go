@@ -0,0 +1,43 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// RecordUploadRejections adds count uploads rejected with reason, an
+// EncryptedUploadResponse error code, to the daily count for date
+func (c *conn) RecordUploadRejections(ctx context.Context, reason string, date time.Time, count int64) error {
+	ctx, cancel := c.statementContext(ctx)
+	defer cancel()
+	return recordUploadRejections(ctx, c.db, reason, date, count)
+}
+
+// CountRejections returns how many uploads were rejected with reason from the
+// start of since's day onwards
+func (c *conn) CountRejections(ctx context.Context, reason string, since time.Time) (int64, error) {
+	ctx, cancel := c.statementContext(ctx)
+	defer cancel()
+	return countRejections(ctx, c.reader(), reason, since)
+}
+
+func recordUploadRejections(ctx context.Context, db *sql.DB, reason string, date time.Time, count int64) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO upload_rejections (reason, date, count)
+		VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE count = count + VALUES(count)`,
+		reason, date.UTC().Format("2006-01-02"), count,
+	)
+	return err
+}
+
+func countRejections(ctx context.Context, db *sql.DB, reason string, since time.Time) (int64, error) {
+	var count int64
+	if err := db.QueryRowContext(ctx,
+		"SELECT COALESCE(SUM(count), 0) FROM upload_rejections WHERE reason = ? AND date >= ?",
+		reason, since.UTC().Format("2006-01-02"),
+	).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
@@ -0,0 +1,54 @@
+package persistence
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+const recordUploadRejectionsQuery = `
+		INSERT INTO upload_rejections (reason, date, count)
+		VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE count = count + VALUES(count)`
+
+const countRejectionsQuery = `SELECT COALESCE(SUM(count), 0) FROM upload_rejections WHERE reason = ? AND date >= ?`
+
+func TestUploadRejections_RecordAndCount(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	ctx := context.Background()
+	day1 := time.Date(2020, 9, 13, 23, 0, 0, 0, time.UTC)
+	day2 := day1.Add(2 * time.Hour)
+
+	// Two rejections on the first day, one on the next, bucketed by UTC date
+	mock.ExpectExec(recordUploadRejectionsQuery).WithArgs("INVALID_TIMESTAMP", "2020-09-13", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(recordUploadRejectionsQuery).WithArgs("INVALID_TIMESTAMP", "2020-09-13", 1).WillReturnResult(sqlmock.NewResult(1, 2))
+	mock.ExpectExec(recordUploadRejectionsQuery).WithArgs("INVALID_TIMESTAMP", "2020-09-14", 1).WillReturnResult(sqlmock.NewResult(2, 1))
+
+	assert.Nil(t, recordUploadRejections(ctx, db, "INVALID_TIMESTAMP", day1, 1))
+	assert.Nil(t, recordUploadRejections(ctx, db, "INVALID_TIMESTAMP", day1.In(time.FixedZone("EDT", -4*3600)), 1))
+	assert.Nil(t, recordUploadRejections(ctx, db, "INVALID_TIMESTAMP", day2, 1))
+
+	mock.ExpectQuery(countRejectionsQuery).WithArgs("INVALID_TIMESTAMP", "2020-09-13").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(countRejectionsQuery).WithArgs("INVALID_TIMESTAMP", "2020-09-14").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(countRejectionsQuery).WithArgs("TOO_MANY_KEYS", "2020-09-13").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	count, err := countRejections(ctx, db, "INVALID_TIMESTAMP", day1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), count)
+
+	count, err = countRejections(ctx, db, "INVALID_TIMESTAMP", day2)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+
+	count, err = countRejections(ctx, db, "TOO_MANY_KEYS", day1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), count)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
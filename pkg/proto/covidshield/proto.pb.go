@@ -115,6 +115,23 @@ const (
 	EncryptedUploadResponse_INVALID_ROLLING_START_INTERVAL_NUMBER EncryptedUploadResponse_ErrorCode = 12
 	EncryptedUploadResponse_INVALID_TRANSMISSION_RISK_LEVEL       EncryptedUploadResponse_ErrorCode = 13
 	EncryptedUploadResponse_NO_KEYS_IN_PAYLOAD                    EncryptedUploadResponse_ErrorCode = 14
+	// The X-App-Version header is missing or older than the minimum version
+	// accepted by the server. The user should update the app and try again.
+	EncryptedUploadResponse_APP_VERSION_TOO_OLD EncryptedUploadResponse_ErrorCode = 15
+	// A key's report_type is not one this deployment accepts.
+	EncryptedUploadResponse_INVALID_REPORT_TYPE EncryptedUploadResponse_ErrorCode = 16
+	// The Upload has fewer keys than the minimum this deployment accepts.
+	EncryptedUploadResponse_TOO_FEW_KEYS EncryptedUploadResponse_ErrorCode = 17
+	// Uploads are paused for maintenance. The app should retry after the
+	// number of seconds in the Retry-After header.
+	EncryptedUploadResponse_MAINTENANCE EncryptedUploadResponse_ErrorCode = 18
+	// The keypair uploaded too recently. The app should wait before retrying.
+	EncryptedUploadResponse_UPLOAD_TOO_SOON EncryptedUploadResponse_ErrorCode = 19
+	// Uploads aren't enabled yet for the region the keypair was issued in.
+	EncryptedUploadResponse_REGION_NOT_ENABLED EncryptedUploadResponse_ErrorCode = 20
+	// The upload's keys don't all have the same report type, and the server
+	// requires them to.
+	EncryptedUploadResponse_MIXED_REPORT_TYPES EncryptedUploadResponse_ErrorCode = 21
 )
 
 // Enum value maps for EncryptedUploadResponse_ErrorCode.
@@ -134,6 +151,13 @@ var (
 		12: "INVALID_ROLLING_START_INTERVAL_NUMBER",
 		13: "INVALID_TRANSMISSION_RISK_LEVEL",
 		14: "NO_KEYS_IN_PAYLOAD",
+		15: "APP_VERSION_TOO_OLD",
+		16: "INVALID_REPORT_TYPE",
+		17: "TOO_FEW_KEYS",
+		18: "MAINTENANCE",
+		19: "UPLOAD_TOO_SOON",
+		20: "REGION_NOT_ENABLED",
+		21: "MIXED_REPORT_TYPES",
 	}
 	EncryptedUploadResponse_ErrorCode_value = map[string]int32{
 		"NONE":                                  0,
@@ -150,6 +174,13 @@ var (
 		"INVALID_ROLLING_START_INTERVAL_NUMBER": 12,
 		"INVALID_TRANSMISSION_RISK_LEVEL":       13,
 		"NO_KEYS_IN_PAYLOAD":                    14,
+		"APP_VERSION_TOO_OLD":                   15,
+		"INVALID_REPORT_TYPE":                   16,
+		"TOO_FEW_KEYS":                          17,
+		"MAINTENANCE":                           18,
+		"UPLOAD_TOO_SOON":                       19,
+		"REGION_NOT_ENABLED":                    20,
+		"MIXED_REPORT_TYPES":                    21,
 	}
 )
 
@@ -256,7 +287,7 @@ func (x *TemporaryExposureKey_ReportType) UnmarshalJSON(b []byte) error {
 
 // Deprecated: Use TemporaryExposureKey_ReportType.Descriptor instead.
 func (TemporaryExposureKey_ReportType) EnumDescriptor() ([]byte, []int) {
-	return file_proto_covidshield_proto_rawDescGZIP(), []int{7, 0}
+	return file_proto_covidshield_proto_rawDescGZIP(), []int{8, 0}
 }
 
 // Clients will receive a One Time Code via some external channel (i.e. SMS or
@@ -502,6 +533,13 @@ type EncryptedUploadResponse struct {
 	unknownFields protoimpl.UnknownFields
 
 	Error *EncryptedUploadResponse_ErrorCode `protobuf:"varint,1,opt,name=error,enum=covidshield.EncryptedUploadResponse_ErrorCode" json:"error,omitempty"`
+	// Only set on success, and only when the request carried an
+	// `X-Upload-Quota: true` header, so older clients see the same response.
+	Quota *UploadQuota `protobuf:"bytes,2,opt,name=quota" json:"quota,omitempty"`
+	// The region the upload was attributed to, from the bearer token that
+	// created the keypair. Only set on success on servers with
+	// debugUploadOriginatorRegion enabled, which production never does.
+	OriginatorRegion *string `protobuf:"bytes,3,opt,name=originator_region,json=originatorRegion" json:"originator_region,omitempty"`
 }
 
 func (x *EncryptedUploadResponse) Reset() {
@@ -543,6 +581,87 @@ func (x *EncryptedUploadResponse) GetError() EncryptedUploadResponse_ErrorCode {
 	return EncryptedUploadResponse_NONE
 }
 
+func (x *EncryptedUploadResponse) GetQuota() *UploadQuota {
+	if x != nil {
+		return x.Quota
+	}
+	return nil
+}
+
+func (x *EncryptedUploadResponse) GetOriginatorRegion() string {
+	if x != nil && x.OriginatorRegion != nil {
+		return *x.OriginatorRegion
+	}
+	return ""
+}
+
+// UploadQuota describes what is left of the keypair after a successful upload.
+type UploadQuota struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// The number of keys in the upload that were accepted.
+	AcceptedKeys *uint32 `protobuf:"varint,1,opt,name=accepted_keys,json=acceptedKeys" json:"accepted_keys,omitempty"`
+	// The number of keys the keypair may still upload.
+	RemainingKeys *uint32 `protobuf:"varint,2,opt,name=remaining_keys,json=remainingKeys" json:"remaining_keys,omitempty"`
+	// After this time the keypair is deleted and can no longer upload.
+	ExpiresAt *timestamp.Timestamp `protobuf:"bytes,3,opt,name=expires_at,json=expiresAt" json:"expires_at,omitempty"`
+}
+
+func (x *UploadQuota) Reset() {
+	*x = UploadQuota{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_proto_covidshield_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *UploadQuota) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UploadQuota) ProtoMessage() {}
+
+func (x *UploadQuota) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_covidshield_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UploadQuota.ProtoReflect.Descriptor instead.
+func (*UploadQuota) Descriptor() ([]byte, []int) {
+	return file_proto_covidshield_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *UploadQuota) GetAcceptedKeys() uint32 {
+	if x != nil && x.AcceptedKeys != nil {
+		return *x.AcceptedKeys
+	}
+	return 0
+}
+
+func (x *UploadQuota) GetRemainingKeys() uint32 {
+	if x != nil && x.RemainingKeys != nil {
+		return *x.RemainingKeys
+	}
+	return 0
+}
+
+func (x *UploadQuota) GetExpiresAt() *timestamp.Timestamp {
+	if x != nil {
+		return x.ExpiresAt
+	}
+	return nil
+}
+
 // Upload is the decrypted type of the `payload` field in EncryptedUploadRequest.
 type Upload struct {
 	state         protoimpl.MessageState
@@ -558,7 +677,7 @@ type Upload struct {
 func (x *Upload) Reset() {
 	*x = Upload{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_proto_covidshield_proto_msgTypes[4]
+		mi := &file_proto_covidshield_proto_msgTypes[5]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -571,7 +690,7 @@ func (x *Upload) String() string {
 func (*Upload) ProtoMessage() {}
 
 func (x *Upload) ProtoReflect() protoreflect.Message {
-	mi := &file_proto_covidshield_proto_msgTypes[4]
+	mi := &file_proto_covidshield_proto_msgTypes[5]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -584,7 +703,7 @@ func (x *Upload) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Upload.ProtoReflect.Descriptor instead.
 func (*Upload) Descriptor() ([]byte, []int) {
-	return file_proto_covidshield_proto_rawDescGZIP(), []int{4}
+	return file_proto_covidshield_proto_rawDescGZIP(), []int{5}
 }
 
 func (x *Upload) GetTimestamp() *timestamp.Timestamp {
@@ -630,7 +749,7 @@ type TemporaryExposureKeyExport struct {
 func (x *TemporaryExposureKeyExport) Reset() {
 	*x = TemporaryExposureKeyExport{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_proto_covidshield_proto_msgTypes[5]
+		mi := &file_proto_covidshield_proto_msgTypes[6]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -643,7 +762,7 @@ func (x *TemporaryExposureKeyExport) String() string {
 func (*TemporaryExposureKeyExport) ProtoMessage() {}
 
 func (x *TemporaryExposureKeyExport) ProtoReflect() protoreflect.Message {
-	mi := &file_proto_covidshield_proto_msgTypes[5]
+	mi := &file_proto_covidshield_proto_msgTypes[6]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -656,7 +775,7 @@ func (x *TemporaryExposureKeyExport) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use TemporaryExposureKeyExport.ProtoReflect.Descriptor instead.
 func (*TemporaryExposureKeyExport) Descriptor() ([]byte, []int) {
-	return file_proto_covidshield_proto_rawDescGZIP(), []int{5}
+	return file_proto_covidshield_proto_rawDescGZIP(), []int{6}
 }
 
 func (x *TemporaryExposureKeyExport) GetStartTimestamp() uint64 {
@@ -739,7 +858,7 @@ type SignatureInfo struct {
 func (x *SignatureInfo) Reset() {
 	*x = SignatureInfo{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_proto_covidshield_proto_msgTypes[6]
+		mi := &file_proto_covidshield_proto_msgTypes[7]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -752,7 +871,7 @@ func (x *SignatureInfo) String() string {
 func (*SignatureInfo) ProtoMessage() {}
 
 func (x *SignatureInfo) ProtoReflect() protoreflect.Message {
-	mi := &file_proto_covidshield_proto_msgTypes[6]
+	mi := &file_proto_covidshield_proto_msgTypes[7]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -765,7 +884,7 @@ func (x *SignatureInfo) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use SignatureInfo.ProtoReflect.Descriptor instead.
 func (*SignatureInfo) Descriptor() ([]byte, []int) {
-	return file_proto_covidshield_proto_rawDescGZIP(), []int{6}
+	return file_proto_covidshield_proto_rawDescGZIP(), []int{7}
 }
 
 func (x *SignatureInfo) GetVerificationKeyVersion() string {
@@ -819,7 +938,7 @@ const (
 func (x *TemporaryExposureKey) Reset() {
 	*x = TemporaryExposureKey{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_proto_covidshield_proto_msgTypes[7]
+		mi := &file_proto_covidshield_proto_msgTypes[8]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -832,7 +951,7 @@ func (x *TemporaryExposureKey) String() string {
 func (*TemporaryExposureKey) ProtoMessage() {}
 
 func (x *TemporaryExposureKey) ProtoReflect() protoreflect.Message {
-	mi := &file_proto_covidshield_proto_msgTypes[7]
+	mi := &file_proto_covidshield_proto_msgTypes[8]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -845,7 +964,7 @@ func (x *TemporaryExposureKey) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use TemporaryExposureKey.ProtoReflect.Descriptor instead.
 func (*TemporaryExposureKey) Descriptor() ([]byte, []int) {
-	return file_proto_covidshield_proto_rawDescGZIP(), []int{7}
+	return file_proto_covidshield_proto_rawDescGZIP(), []int{8}
 }
 
 func (x *TemporaryExposureKey) GetKeyData() []byte {
@@ -902,7 +1021,7 @@ type TEKSignatureList struct {
 func (x *TEKSignatureList) Reset() {
 	*x = TEKSignatureList{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_proto_covidshield_proto_msgTypes[8]
+		mi := &file_proto_covidshield_proto_msgTypes[9]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -915,7 +1034,7 @@ func (x *TEKSignatureList) String() string {
 func (*TEKSignatureList) ProtoMessage() {}
 
 func (x *TEKSignatureList) ProtoReflect() protoreflect.Message {
-	mi := &file_proto_covidshield_proto_msgTypes[8]
+	mi := &file_proto_covidshield_proto_msgTypes[9]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -928,7 +1047,7 @@ func (x *TEKSignatureList) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use TEKSignatureList.ProtoReflect.Descriptor instead.
 func (*TEKSignatureList) Descriptor() ([]byte, []int) {
-	return file_proto_covidshield_proto_rawDescGZIP(), []int{8}
+	return file_proto_covidshield_proto_rawDescGZIP(), []int{9}
 }
 
 func (x *TEKSignatureList) GetSignatures() []*TEKSignature {
@@ -957,7 +1076,7 @@ type TEKSignature struct {
 func (x *TEKSignature) Reset() {
 	*x = TEKSignature{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_proto_covidshield_proto_msgTypes[9]
+		mi := &file_proto_covidshield_proto_msgTypes[10]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -970,7 +1089,7 @@ func (x *TEKSignature) String() string {
 func (*TEKSignature) ProtoMessage() {}
 
 func (x *TEKSignature) ProtoReflect() protoreflect.Message {
-	mi := &file_proto_covidshield_proto_msgTypes[9]
+	mi := &file_proto_covidshield_proto_msgTypes[10]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -983,7 +1102,7 @@ func (x *TEKSignature) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use TEKSignature.ProtoReflect.Descriptor instead.
 func (*TEKSignature) Descriptor() ([]byte, []int) {
-	return file_proto_covidshield_proto_rawDescGZIP(), []int{9}
+	return file_proto_covidshield_proto_rawDescGZIP(), []int{10}
 }
 
 func (x *TEKSignature) GetSignatureInfo() *SignatureInfo {
@@ -1062,128 +1181,152 @@ var file_proto_covidshield_proto_rawDesc = []byte{
 	0x12, 0x14, 0x0a, 0x05, 0x6e, 0x6f, 0x6e, 0x63, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52,
 	0x05, 0x6e, 0x6f, 0x6e, 0x63, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61,
 	0x64, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x07, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64,
-	0x22, 0xba, 0x03, 0x0a, 0x17, 0x45, 0x6e, 0x63, 0x72, 0x79, 0x70, 0x74, 0x65, 0x64, 0x55, 0x70,
+	0x22, 0xb1, 0x05, 0x0a, 0x17, 0x45, 0x6e, 0x63, 0x72, 0x79, 0x70, 0x74, 0x65, 0x64, 0x55, 0x70,
 	0x6c, 0x6f, 0x61, 0x64, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x44, 0x0a, 0x05,
 	0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x2e, 0x2e, 0x63, 0x6f,
 	0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65, 0x6c, 0x64, 0x2e, 0x45, 0x6e, 0x63, 0x72, 0x79, 0x70,
 	0x74, 0x65, 0x64, 0x55, 0x70, 0x6c, 0x6f, 0x61, 0x64, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
 	0x65, 0x2e, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x43, 0x6f, 0x64, 0x65, 0x52, 0x05, 0x65, 0x72, 0x72,
-	0x6f, 0x72, 0x22, 0xd8, 0x02, 0x0a, 0x09, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x43, 0x6f, 0x64, 0x65,
-	0x12, 0x08, 0x0a, 0x04, 0x4e, 0x4f, 0x4e, 0x45, 0x10, 0x00, 0x12, 0x0b, 0x0a, 0x07, 0x55, 0x4e,
-	0x4b, 0x4e, 0x4f, 0x57, 0x4e, 0x10, 0x01, 0x12, 0x13, 0x0a, 0x0f, 0x49, 0x4e, 0x56, 0x41, 0x4c,
-	0x49, 0x44, 0x5f, 0x4b, 0x45, 0x59, 0x50, 0x41, 0x49, 0x52, 0x10, 0x02, 0x12, 0x15, 0x0a, 0x11,
-	0x44, 0x45, 0x43, 0x52, 0x59, 0x50, 0x54, 0x49, 0x4f, 0x4e, 0x5f, 0x46, 0x41, 0x49, 0x4c, 0x45,
-	0x44, 0x10, 0x03, 0x12, 0x13, 0x0a, 0x0f, 0x49, 0x4e, 0x56, 0x41, 0x4c, 0x49, 0x44, 0x5f, 0x50,
-	0x41, 0x59, 0x4c, 0x4f, 0x41, 0x44, 0x10, 0x04, 0x12, 0x10, 0x0a, 0x0c, 0x53, 0x45, 0x52, 0x56,
-	0x45, 0x52, 0x5f, 0x45, 0x52, 0x52, 0x4f, 0x52, 0x10, 0x05, 0x12, 0x1d, 0x0a, 0x19, 0x49, 0x4e,
-	0x56, 0x41, 0x4c, 0x49, 0x44, 0x5f, 0x43, 0x52, 0x59, 0x50, 0x54, 0x4f, 0x5f, 0x50, 0x41, 0x52,
-	0x41, 0x4d, 0x45, 0x54, 0x45, 0x52, 0x53, 0x10, 0x06, 0x12, 0x11, 0x0a, 0x0d, 0x54, 0x4f, 0x4f,
-	0x5f, 0x4d, 0x41, 0x4e, 0x59, 0x5f, 0x4b, 0x45, 0x59, 0x53, 0x10, 0x07, 0x12, 0x15, 0x0a, 0x11,
-	0x49, 0x4e, 0x56, 0x41, 0x4c, 0x49, 0x44, 0x5f, 0x54, 0x49, 0x4d, 0x45, 0x53, 0x54, 0x41, 0x4d,
-	0x50, 0x10, 0x08, 0x12, 0x1a, 0x0a, 0x16, 0x49, 0x4e, 0x56, 0x41, 0x4c, 0x49, 0x44, 0x5f, 0x52,
-	0x4f, 0x4c, 0x4c, 0x49, 0x4e, 0x47, 0x5f, 0x50, 0x45, 0x52, 0x49, 0x4f, 0x44, 0x10, 0x0a, 0x12,
-	0x14, 0x0a, 0x10, 0x49, 0x4e, 0x56, 0x41, 0x4c, 0x49, 0x44, 0x5f, 0x4b, 0x45, 0x59, 0x5f, 0x44,
-	0x41, 0x54, 0x41, 0x10, 0x0b, 0x12, 0x29, 0x0a, 0x25, 0x49, 0x4e, 0x56, 0x41, 0x4c, 0x49, 0x44,
-	0x5f, 0x52, 0x4f, 0x4c, 0x4c, 0x49, 0x4e, 0x47, 0x5f, 0x53, 0x54, 0x41, 0x52, 0x54, 0x5f, 0x49,
-	0x4e, 0x54, 0x45, 0x52, 0x56, 0x41, 0x4c, 0x5f, 0x4e, 0x55, 0x4d, 0x42, 0x45, 0x52, 0x10, 0x0c,
-	0x12, 0x23, 0x0a, 0x1f, 0x49, 0x4e, 0x56, 0x41, 0x4c, 0x49, 0x44, 0x5f, 0x54, 0x52, 0x41, 0x4e,
-	0x53, 0x4d, 0x49, 0x53, 0x53, 0x49, 0x4f, 0x4e, 0x5f, 0x52, 0x49, 0x53, 0x4b, 0x5f, 0x4c, 0x45,
-	0x56, 0x45, 0x4c, 0x10, 0x0d, 0x12, 0x16, 0x0a, 0x12, 0x4e, 0x4f, 0x5f, 0x4b, 0x45, 0x59, 0x53,
-	0x5f, 0x49, 0x4e, 0x5f, 0x50, 0x41, 0x59, 0x4c, 0x4f, 0x41, 0x44, 0x10, 0x0e, 0x22, 0x79, 0x0a,
-	0x06, 0x55, 0x70, 0x6c, 0x6f, 0x61, 0x64, 0x12, 0x38, 0x0a, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73,
-	0x74, 0x61, 0x6d, 0x70, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f,
-	0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d,
-	0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d,
-	0x70, 0x12, 0x35, 0x0a, 0x04, 0x6b, 0x65, 0x79, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32,
-	0x21, 0x2e, 0x63, 0x6f, 0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65, 0x6c, 0x64, 0x2e, 0x54, 0x65,
-	0x6d, 0x70, 0x6f, 0x72, 0x61, 0x72, 0x79, 0x45, 0x78, 0x70, 0x6f, 0x73, 0x75, 0x72, 0x65, 0x4b,
-	0x65, 0x79, 0x52, 0x04, 0x6b, 0x65, 0x79, 0x73, 0x22, 0x80, 0x03, 0x0a, 0x1a, 0x54, 0x65, 0x6d,
-	0x70, 0x6f, 0x72, 0x61, 0x72, 0x79, 0x45, 0x78, 0x70, 0x6f, 0x73, 0x75, 0x72, 0x65, 0x4b, 0x65,
-	0x79, 0x45, 0x78, 0x70, 0x6f, 0x72, 0x74, 0x12, 0x27, 0x0a, 0x0f, 0x73, 0x74, 0x61, 0x72, 0x74,
-	0x5f, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x18, 0x01, 0x20, 0x01, 0x28, 0x06,
-	0x52, 0x0e, 0x73, 0x74, 0x61, 0x72, 0x74, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70,
-	0x12, 0x23, 0x0a, 0x0d, 0x65, 0x6e, 0x64, 0x5f, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d,
-	0x70, 0x18, 0x02, 0x20, 0x01, 0x28, 0x06, 0x52, 0x0c, 0x65, 0x6e, 0x64, 0x54, 0x69, 0x6d, 0x65,
-	0x73, 0x74, 0x61, 0x6d, 0x70, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65, 0x67, 0x69, 0x6f, 0x6e, 0x18,
-	0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x72, 0x65, 0x67, 0x69, 0x6f, 0x6e, 0x12, 0x1b, 0x0a,
-	0x09, 0x62, 0x61, 0x74, 0x63, 0x68, 0x5f, 0x6e, 0x75, 0x6d, 0x18, 0x04, 0x20, 0x01, 0x28, 0x05,
-	0x52, 0x08, 0x62, 0x61, 0x74, 0x63, 0x68, 0x4e, 0x75, 0x6d, 0x12, 0x1d, 0x0a, 0x0a, 0x62, 0x61,
-	0x74, 0x63, 0x68, 0x5f, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x05, 0x52, 0x09,
-	0x62, 0x61, 0x74, 0x63, 0x68, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x43, 0x0a, 0x0f, 0x73, 0x69, 0x67,
-	0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x5f, 0x69, 0x6e, 0x66, 0x6f, 0x73, 0x18, 0x06, 0x20, 0x03,
+	0x6f, 0x72, 0x12, 0x2e, 0x0a, 0x05, 0x71, 0x75, 0x6f, 0x74, 0x61, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x18, 0x2e, 0x63, 0x6f, 0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65, 0x6c, 0x64, 0x2e,
+	0x55, 0x70, 0x6c, 0x6f, 0x61, 0x64, 0x51, 0x75, 0x6f, 0x74, 0x61, 0x52, 0x05, 0x71, 0x75, 0x6f,
+	0x74, 0x61, 0x12, 0x2b, 0x0a, 0x11, 0x6f, 0x72, 0x69, 0x67, 0x69, 0x6e, 0x61, 0x74, 0x6f, 0x72,
+	0x5f, 0x72, 0x65, 0x67, 0x69, 0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x10, 0x6f,
+	0x72, 0x69, 0x67, 0x69, 0x6e, 0x61, 0x74, 0x6f, 0x72, 0x52, 0x65, 0x67, 0x69, 0x6f, 0x6e, 0x22,
+	0xf2, 0x03, 0x0a, 0x09, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x43, 0x6f, 0x64, 0x65, 0x12, 0x08, 0x0a,
+	0x04, 0x4e, 0x4f, 0x4e, 0x45, 0x10, 0x00, 0x12, 0x0b, 0x0a, 0x07, 0x55, 0x4e, 0x4b, 0x4e, 0x4f,
+	0x57, 0x4e, 0x10, 0x01, 0x12, 0x13, 0x0a, 0x0f, 0x49, 0x4e, 0x56, 0x41, 0x4c, 0x49, 0x44, 0x5f,
+	0x4b, 0x45, 0x59, 0x50, 0x41, 0x49, 0x52, 0x10, 0x02, 0x12, 0x15, 0x0a, 0x11, 0x44, 0x45, 0x43,
+	0x52, 0x59, 0x50, 0x54, 0x49, 0x4f, 0x4e, 0x5f, 0x46, 0x41, 0x49, 0x4c, 0x45, 0x44, 0x10, 0x03,
+	0x12, 0x13, 0x0a, 0x0f, 0x49, 0x4e, 0x56, 0x41, 0x4c, 0x49, 0x44, 0x5f, 0x50, 0x41, 0x59, 0x4c,
+	0x4f, 0x41, 0x44, 0x10, 0x04, 0x12, 0x10, 0x0a, 0x0c, 0x53, 0x45, 0x52, 0x56, 0x45, 0x52, 0x5f,
+	0x45, 0x52, 0x52, 0x4f, 0x52, 0x10, 0x05, 0x12, 0x1d, 0x0a, 0x19, 0x49, 0x4e, 0x56, 0x41, 0x4c,
+	0x49, 0x44, 0x5f, 0x43, 0x52, 0x59, 0x50, 0x54, 0x4f, 0x5f, 0x50, 0x41, 0x52, 0x41, 0x4d, 0x45,
+	0x54, 0x45, 0x52, 0x53, 0x10, 0x06, 0x12, 0x11, 0x0a, 0x0d, 0x54, 0x4f, 0x4f, 0x5f, 0x4d, 0x41,
+	0x4e, 0x59, 0x5f, 0x4b, 0x45, 0x59, 0x53, 0x10, 0x07, 0x12, 0x15, 0x0a, 0x11, 0x49, 0x4e, 0x56,
+	0x41, 0x4c, 0x49, 0x44, 0x5f, 0x54, 0x49, 0x4d, 0x45, 0x53, 0x54, 0x41, 0x4d, 0x50, 0x10, 0x08,
+	0x12, 0x1a, 0x0a, 0x16, 0x49, 0x4e, 0x56, 0x41, 0x4c, 0x49, 0x44, 0x5f, 0x52, 0x4f, 0x4c, 0x4c,
+	0x49, 0x4e, 0x47, 0x5f, 0x50, 0x45, 0x52, 0x49, 0x4f, 0x44, 0x10, 0x0a, 0x12, 0x14, 0x0a, 0x10,
+	0x49, 0x4e, 0x56, 0x41, 0x4c, 0x49, 0x44, 0x5f, 0x4b, 0x45, 0x59, 0x5f, 0x44, 0x41, 0x54, 0x41,
+	0x10, 0x0b, 0x12, 0x29, 0x0a, 0x25, 0x49, 0x4e, 0x56, 0x41, 0x4c, 0x49, 0x44, 0x5f, 0x52, 0x4f,
+	0x4c, 0x4c, 0x49, 0x4e, 0x47, 0x5f, 0x53, 0x54, 0x41, 0x52, 0x54, 0x5f, 0x49, 0x4e, 0x54, 0x45,
+	0x52, 0x56, 0x41, 0x4c, 0x5f, 0x4e, 0x55, 0x4d, 0x42, 0x45, 0x52, 0x10, 0x0c, 0x12, 0x23, 0x0a,
+	0x1f, 0x49, 0x4e, 0x56, 0x41, 0x4c, 0x49, 0x44, 0x5f, 0x54, 0x52, 0x41, 0x4e, 0x53, 0x4d, 0x49,
+	0x53, 0x53, 0x49, 0x4f, 0x4e, 0x5f, 0x52, 0x49, 0x53, 0x4b, 0x5f, 0x4c, 0x45, 0x56, 0x45, 0x4c,
+	0x10, 0x0d, 0x12, 0x16, 0x0a, 0x12, 0x4e, 0x4f, 0x5f, 0x4b, 0x45, 0x59, 0x53, 0x5f, 0x49, 0x4e,
+	0x5f, 0x50, 0x41, 0x59, 0x4c, 0x4f, 0x41, 0x44, 0x10, 0x0e, 0x12, 0x17, 0x0a, 0x13, 0x41, 0x50,
+	0x50, 0x5f, 0x56, 0x45, 0x52, 0x53, 0x49, 0x4f, 0x4e, 0x5f, 0x54, 0x4f, 0x4f, 0x5f, 0x4f, 0x4c,
+	0x44, 0x10, 0x0f, 0x12, 0x17, 0x0a, 0x13, 0x49, 0x4e, 0x56, 0x41, 0x4c, 0x49, 0x44, 0x5f, 0x52,
+	0x45, 0x50, 0x4f, 0x52, 0x54, 0x5f, 0x54, 0x59, 0x50, 0x45, 0x10, 0x10, 0x12, 0x10, 0x0a, 0x0c,
+	0x54, 0x4f, 0x4f, 0x5f, 0x46, 0x45, 0x57, 0x5f, 0x4b, 0x45, 0x59, 0x53, 0x10, 0x11, 0x12, 0x0f,
+	0x0a, 0x0b, 0x4d, 0x41, 0x49, 0x4e, 0x54, 0x45, 0x4e, 0x41, 0x4e, 0x43, 0x45, 0x10, 0x12, 0x12,
+	0x13, 0x0a, 0x0f, 0x55, 0x50, 0x4c, 0x4f, 0x41, 0x44, 0x5f, 0x54, 0x4f, 0x4f, 0x5f, 0x53, 0x4f,
+	0x4f, 0x4e, 0x10, 0x13, 0x12, 0x16, 0x0a, 0x12, 0x52, 0x45, 0x47, 0x49, 0x4f, 0x4e, 0x5f, 0x4e,
+	0x4f, 0x54, 0x5f, 0x45, 0x4e, 0x41, 0x42, 0x4c, 0x45, 0x44, 0x10, 0x14, 0x12, 0x16, 0x0a, 0x12,
+	0x4d, 0x49, 0x58, 0x45, 0x44, 0x5f, 0x52, 0x45, 0x50, 0x4f, 0x52, 0x54, 0x5f, 0x54, 0x59, 0x50,
+	0x45, 0x53, 0x10, 0x15, 0x22, 0x94, 0x01, 0x0a, 0x0b, 0x55, 0x70, 0x6c, 0x6f, 0x61, 0x64, 0x51,
+	0x75, 0x6f, 0x74, 0x61, 0x12, 0x23, 0x0a, 0x0d, 0x61, 0x63, 0x63, 0x65, 0x70, 0x74, 0x65, 0x64,
+	0x5f, 0x6b, 0x65, 0x79, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0c, 0x61, 0x63, 0x63,
+	0x65, 0x70, 0x74, 0x65, 0x64, 0x4b, 0x65, 0x79, 0x73, 0x12, 0x25, 0x0a, 0x0e, 0x72, 0x65, 0x6d,
+	0x61, 0x69, 0x6e, 0x69, 0x6e, 0x67, 0x5f, 0x6b, 0x65, 0x79, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x0d, 0x52, 0x0d, 0x72, 0x65, 0x6d, 0x61, 0x69, 0x6e, 0x69, 0x6e, 0x67, 0x4b, 0x65, 0x79, 0x73,
+	0x12, 0x39, 0x0a, 0x0a, 0x65, 0x78, 0x70, 0x69, 0x72, 0x65, 0x73, 0x5f, 0x61, 0x74, 0x18, 0x03,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70,
+	0x52, 0x09, 0x65, 0x78, 0x70, 0x69, 0x72, 0x65, 0x73, 0x41, 0x74, 0x22, 0x79, 0x0a, 0x06, 0x55,
+	0x70, 0x6c, 0x6f, 0x61, 0x64, 0x12, 0x38, 0x0a, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61,
+	0x6d, 0x70, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c,
+	0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73,
+	0x74, 0x61, 0x6d, 0x70, 0x52, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x12,
+	0x35, 0x0a, 0x04, 0x6b, 0x65, 0x79, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x21, 0x2e,
+	0x63, 0x6f, 0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65, 0x6c, 0x64, 0x2e, 0x54, 0x65, 0x6d, 0x70,
+	0x6f, 0x72, 0x61, 0x72, 0x79, 0x45, 0x78, 0x70, 0x6f, 0x73, 0x75, 0x72, 0x65, 0x4b, 0x65, 0x79,
+	0x52, 0x04, 0x6b, 0x65, 0x79, 0x73, 0x22, 0x80, 0x03, 0x0a, 0x1a, 0x54, 0x65, 0x6d, 0x70, 0x6f,
+	0x72, 0x61, 0x72, 0x79, 0x45, 0x78, 0x70, 0x6f, 0x73, 0x75, 0x72, 0x65, 0x4b, 0x65, 0x79, 0x45,
+	0x78, 0x70, 0x6f, 0x72, 0x74, 0x12, 0x27, 0x0a, 0x0f, 0x73, 0x74, 0x61, 0x72, 0x74, 0x5f, 0x74,
+	0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x18, 0x01, 0x20, 0x01, 0x28, 0x06, 0x52, 0x0e,
+	0x73, 0x74, 0x61, 0x72, 0x74, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x12, 0x23,
+	0x0a, 0x0d, 0x65, 0x6e, 0x64, 0x5f, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x06, 0x52, 0x0c, 0x65, 0x6e, 0x64, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74,
+	0x61, 0x6d, 0x70, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65, 0x67, 0x69, 0x6f, 0x6e, 0x18, 0x03, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x06, 0x72, 0x65, 0x67, 0x69, 0x6f, 0x6e, 0x12, 0x1b, 0x0a, 0x09, 0x62,
+	0x61, 0x74, 0x63, 0x68, 0x5f, 0x6e, 0x75, 0x6d, 0x18, 0x04, 0x20, 0x01, 0x28, 0x05, 0x52, 0x08,
+	0x62, 0x61, 0x74, 0x63, 0x68, 0x4e, 0x75, 0x6d, 0x12, 0x1d, 0x0a, 0x0a, 0x62, 0x61, 0x74, 0x63,
+	0x68, 0x5f, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x05, 0x52, 0x09, 0x62, 0x61,
+	0x74, 0x63, 0x68, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x43, 0x0a, 0x0f, 0x73, 0x69, 0x67, 0x6e, 0x61,
+	0x74, 0x75, 0x72, 0x65, 0x5f, 0x69, 0x6e, 0x66, 0x6f, 0x73, 0x18, 0x06, 0x20, 0x03, 0x28, 0x0b,
+	0x32, 0x1a, 0x2e, 0x63, 0x6f, 0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65, 0x6c, 0x64, 0x2e, 0x53,
+	0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x52, 0x0e, 0x73, 0x69,
+	0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x73, 0x12, 0x35, 0x0a, 0x04,
+	0x6b, 0x65, 0x79, 0x73, 0x18, 0x07, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x21, 0x2e, 0x63, 0x6f, 0x76,
+	0x69, 0x64, 0x73, 0x68, 0x69, 0x65, 0x6c, 0x64, 0x2e, 0x54, 0x65, 0x6d, 0x70, 0x6f, 0x72, 0x61,
+	0x72, 0x79, 0x45, 0x78, 0x70, 0x6f, 0x73, 0x75, 0x72, 0x65, 0x4b, 0x65, 0x79, 0x52, 0x04, 0x6b,
+	0x65, 0x79, 0x73, 0x12, 0x44, 0x0a, 0x0c, 0x72, 0x65, 0x76, 0x69, 0x73, 0x65, 0x64, 0x5f, 0x6b,
+	0x65, 0x79, 0x73, 0x18, 0x08, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x21, 0x2e, 0x63, 0x6f, 0x76, 0x69,
+	0x64, 0x73, 0x68, 0x69, 0x65, 0x6c, 0x64, 0x2e, 0x54, 0x65, 0x6d, 0x70, 0x6f, 0x72, 0x61, 0x72,
+	0x79, 0x45, 0x78, 0x70, 0x6f, 0x73, 0x75, 0x72, 0x65, 0x4b, 0x65, 0x79, 0x52, 0x0b, 0x72, 0x65,
+	0x76, 0x69, 0x73, 0x65, 0x64, 0x4b, 0x65, 0x79, 0x73, 0x22, 0xd6, 0x01, 0x0a, 0x0d, 0x53, 0x69,
+	0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x38, 0x0a, 0x18, 0x76,
+	0x65, 0x72, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x6b, 0x65, 0x79, 0x5f,
+	0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x16, 0x76,
+	0x65, 0x72, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x4b, 0x65, 0x79, 0x56, 0x65,
+	0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x2e, 0x0a, 0x13, 0x76, 0x65, 0x72, 0x69, 0x66, 0x69, 0x63,
+	0x61, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x6b, 0x65, 0x79, 0x5f, 0x69, 0x64, 0x18, 0x04, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x11, 0x76, 0x65, 0x72, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e,
+	0x4b, 0x65, 0x79, 0x49, 0x64, 0x12, 0x2f, 0x0a, 0x13, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75,
+	0x72, 0x65, 0x5f, 0x61, 0x6c, 0x67, 0x6f, 0x72, 0x69, 0x74, 0x68, 0x6d, 0x18, 0x05, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x12, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x41, 0x6c, 0x67,
+	0x6f, 0x72, 0x69, 0x74, 0x68, 0x6d, 0x4a, 0x04, 0x08, 0x01, 0x10, 0x02, 0x4a, 0x04, 0x08, 0x02,
+	0x10, 0x03, 0x52, 0x0d, 0x61, 0x70, 0x70, 0x5f, 0x62, 0x75, 0x6e, 0x64, 0x6c, 0x65, 0x5f, 0x69,
+	0x64, 0x52, 0x0f, 0x61, 0x6e, 0x64, 0x72, 0x6f, 0x69, 0x64, 0x5f, 0x70, 0x61, 0x63, 0x6b, 0x61,
+	0x67, 0x65, 0x22, 0xe5, 0x03, 0x0a, 0x14, 0x54, 0x65, 0x6d, 0x70, 0x6f, 0x72, 0x61, 0x72, 0x79,
+	0x45, 0x78, 0x70, 0x6f, 0x73, 0x75, 0x72, 0x65, 0x4b, 0x65, 0x79, 0x12, 0x19, 0x0a, 0x08, 0x6b,
+	0x65, 0x79, 0x5f, 0x64, 0x61, 0x74, 0x61, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x07, 0x6b,
+	0x65, 0x79, 0x44, 0x61, 0x74, 0x61, 0x12, 0x36, 0x0a, 0x17, 0x74, 0x72, 0x61, 0x6e, 0x73, 0x6d,
+	0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x5f, 0x72, 0x69, 0x73, 0x6b, 0x5f, 0x6c, 0x65, 0x76, 0x65,
+	0x6c, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x15, 0x74, 0x72, 0x61, 0x6e, 0x73, 0x6d, 0x69,
+	0x73, 0x73, 0x69, 0x6f, 0x6e, 0x52, 0x69, 0x73, 0x6b, 0x4c, 0x65, 0x76, 0x65, 0x6c, 0x12, 0x41,
+	0x0a, 0x1d, 0x72, 0x6f, 0x6c, 0x6c, 0x69, 0x6e, 0x67, 0x5f, 0x73, 0x74, 0x61, 0x72, 0x74, 0x5f,
+	0x69, 0x6e, 0x74, 0x65, 0x72, 0x76, 0x61, 0x6c, 0x5f, 0x6e, 0x75, 0x6d, 0x62, 0x65, 0x72, 0x18,
+	0x03, 0x20, 0x01, 0x28, 0x05, 0x52, 0x1a, 0x72, 0x6f, 0x6c, 0x6c, 0x69, 0x6e, 0x67, 0x53, 0x74,
+	0x61, 0x72, 0x74, 0x49, 0x6e, 0x74, 0x65, 0x72, 0x76, 0x61, 0x6c, 0x4e, 0x75, 0x6d, 0x62, 0x65,
+	0x72, 0x12, 0x2a, 0x0a, 0x0e, 0x72, 0x6f, 0x6c, 0x6c, 0x69, 0x6e, 0x67, 0x5f, 0x70, 0x65, 0x72,
+	0x69, 0x6f, 0x64, 0x18, 0x04, 0x20, 0x01, 0x28, 0x05, 0x3a, 0x03, 0x31, 0x34, 0x34, 0x52, 0x0d,
+	0x72, 0x6f, 0x6c, 0x6c, 0x69, 0x6e, 0x67, 0x50, 0x65, 0x72, 0x69, 0x6f, 0x64, 0x12, 0x4d, 0x0a,
+	0x0b, 0x72, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x5f, 0x74, 0x79, 0x70, 0x65, 0x18, 0x05, 0x20, 0x01,
+	0x28, 0x0e, 0x32, 0x2c, 0x2e, 0x63, 0x6f, 0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65, 0x6c, 0x64,
+	0x2e, 0x54, 0x65, 0x6d, 0x70, 0x6f, 0x72, 0x61, 0x72, 0x79, 0x45, 0x78, 0x70, 0x6f, 0x73, 0x75,
+	0x72, 0x65, 0x4b, 0x65, 0x79, 0x2e, 0x52, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x54, 0x79, 0x70, 0x65,
+	0x52, 0x0a, 0x72, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x3e, 0x0a, 0x1c,
+	0x64, 0x61, 0x79, 0x73, 0x5f, 0x73, 0x69, 0x6e, 0x63, 0x65, 0x5f, 0x6f, 0x6e, 0x73, 0x65, 0x74,
+	0x5f, 0x6f, 0x66, 0x5f, 0x73, 0x79, 0x6d, 0x70, 0x74, 0x6f, 0x6d, 0x73, 0x18, 0x06, 0x20, 0x01,
+	0x28, 0x11, 0x52, 0x18, 0x64, 0x61, 0x79, 0x73, 0x53, 0x69, 0x6e, 0x63, 0x65, 0x4f, 0x6e, 0x73,
+	0x65, 0x74, 0x4f, 0x66, 0x53, 0x79, 0x6d, 0x70, 0x74, 0x6f, 0x6d, 0x73, 0x22, 0x7c, 0x0a, 0x0a,
+	0x52, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x0b, 0x0a, 0x07, 0x55, 0x4e,
+	0x4b, 0x4e, 0x4f, 0x57, 0x4e, 0x10, 0x00, 0x12, 0x12, 0x0a, 0x0e, 0x43, 0x4f, 0x4e, 0x46, 0x49,
+	0x52, 0x4d, 0x45, 0x44, 0x5f, 0x54, 0x45, 0x53, 0x54, 0x10, 0x01, 0x12, 0x20, 0x0a, 0x1c, 0x43,
+	0x4f, 0x4e, 0x46, 0x49, 0x52, 0x4d, 0x45, 0x44, 0x5f, 0x43, 0x4c, 0x49, 0x4e, 0x49, 0x43, 0x41,
+	0x4c, 0x5f, 0x44, 0x49, 0x41, 0x47, 0x4e, 0x4f, 0x53, 0x49, 0x53, 0x10, 0x02, 0x12, 0x0f, 0x0a,
+	0x0b, 0x53, 0x45, 0x4c, 0x46, 0x5f, 0x52, 0x45, 0x50, 0x4f, 0x52, 0x54, 0x10, 0x03, 0x12, 0x0d,
+	0x0a, 0x09, 0x52, 0x45, 0x43, 0x55, 0x52, 0x53, 0x49, 0x56, 0x45, 0x10, 0x04, 0x12, 0x0b, 0x0a,
+	0x07, 0x52, 0x45, 0x56, 0x4f, 0x4b, 0x45, 0x44, 0x10, 0x05, 0x22, 0x4d, 0x0a, 0x10, 0x54, 0x45,
+	0x4b, 0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x4c, 0x69, 0x73, 0x74, 0x12, 0x39,
+	0x0a, 0x0a, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03,
+	0x28, 0x0b, 0x32, 0x19, 0x2e, 0x63, 0x6f, 0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65, 0x6c, 0x64,
+	0x2e, 0x54, 0x45, 0x4b, 0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x52, 0x0a, 0x73,
+	0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x22, 0xab, 0x01, 0x0a, 0x0c, 0x54, 0x45,
+	0x4b, 0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x12, 0x41, 0x0a, 0x0e, 0x73, 0x69,
+	0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x5f, 0x69, 0x6e, 0x66, 0x6f, 0x18, 0x01, 0x20, 0x01,
 	0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x63, 0x6f, 0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65, 0x6c, 0x64,
-	0x2e, 0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x52, 0x0e,
-	0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x73, 0x12, 0x35,
-	0x0a, 0x04, 0x6b, 0x65, 0x79, 0x73, 0x18, 0x07, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x21, 0x2e, 0x63,
-	0x6f, 0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65, 0x6c, 0x64, 0x2e, 0x54, 0x65, 0x6d, 0x70, 0x6f,
-	0x72, 0x61, 0x72, 0x79, 0x45, 0x78, 0x70, 0x6f, 0x73, 0x75, 0x72, 0x65, 0x4b, 0x65, 0x79, 0x52,
-	0x04, 0x6b, 0x65, 0x79, 0x73, 0x12, 0x44, 0x0a, 0x0c, 0x72, 0x65, 0x76, 0x69, 0x73, 0x65, 0x64,
-	0x5f, 0x6b, 0x65, 0x79, 0x73, 0x18, 0x08, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x21, 0x2e, 0x63, 0x6f,
-	0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65, 0x6c, 0x64, 0x2e, 0x54, 0x65, 0x6d, 0x70, 0x6f, 0x72,
-	0x61, 0x72, 0x79, 0x45, 0x78, 0x70, 0x6f, 0x73, 0x75, 0x72, 0x65, 0x4b, 0x65, 0x79, 0x52, 0x0b,
-	0x72, 0x65, 0x76, 0x69, 0x73, 0x65, 0x64, 0x4b, 0x65, 0x79, 0x73, 0x22, 0xd6, 0x01, 0x0a, 0x0d,
-	0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x38, 0x0a,
-	0x18, 0x76, 0x65, 0x72, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x6b, 0x65,
-	0x79, 0x5f, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52,
-	0x16, 0x76, 0x65, 0x72, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x4b, 0x65, 0x79,
-	0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x2e, 0x0a, 0x13, 0x76, 0x65, 0x72, 0x69, 0x66,
-	0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x6b, 0x65, 0x79, 0x5f, 0x69, 0x64, 0x18, 0x04,
-	0x20, 0x01, 0x28, 0x09, 0x52, 0x11, 0x76, 0x65, 0x72, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x69,
-	0x6f, 0x6e, 0x4b, 0x65, 0x79, 0x49, 0x64, 0x12, 0x2f, 0x0a, 0x13, 0x73, 0x69, 0x67, 0x6e, 0x61,
-	0x74, 0x75, 0x72, 0x65, 0x5f, 0x61, 0x6c, 0x67, 0x6f, 0x72, 0x69, 0x74, 0x68, 0x6d, 0x18, 0x05,
-	0x20, 0x01, 0x28, 0x09, 0x52, 0x12, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x41,
-	0x6c, 0x67, 0x6f, 0x72, 0x69, 0x74, 0x68, 0x6d, 0x4a, 0x04, 0x08, 0x01, 0x10, 0x02, 0x4a, 0x04,
-	0x08, 0x02, 0x10, 0x03, 0x52, 0x0d, 0x61, 0x70, 0x70, 0x5f, 0x62, 0x75, 0x6e, 0x64, 0x6c, 0x65,
-	0x5f, 0x69, 0x64, 0x52, 0x0f, 0x61, 0x6e, 0x64, 0x72, 0x6f, 0x69, 0x64, 0x5f, 0x70, 0x61, 0x63,
-	0x6b, 0x61, 0x67, 0x65, 0x22, 0xe5, 0x03, 0x0a, 0x14, 0x54, 0x65, 0x6d, 0x70, 0x6f, 0x72, 0x61,
-	0x72, 0x79, 0x45, 0x78, 0x70, 0x6f, 0x73, 0x75, 0x72, 0x65, 0x4b, 0x65, 0x79, 0x12, 0x19, 0x0a,
-	0x08, 0x6b, 0x65, 0x79, 0x5f, 0x64, 0x61, 0x74, 0x61, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52,
-	0x07, 0x6b, 0x65, 0x79, 0x44, 0x61, 0x74, 0x61, 0x12, 0x36, 0x0a, 0x17, 0x74, 0x72, 0x61, 0x6e,
-	0x73, 0x6d, 0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x5f, 0x72, 0x69, 0x73, 0x6b, 0x5f, 0x6c, 0x65,
-	0x76, 0x65, 0x6c, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x15, 0x74, 0x72, 0x61, 0x6e, 0x73,
-	0x6d, 0x69, 0x73, 0x73, 0x69, 0x6f, 0x6e, 0x52, 0x69, 0x73, 0x6b, 0x4c, 0x65, 0x76, 0x65, 0x6c,
-	0x12, 0x41, 0x0a, 0x1d, 0x72, 0x6f, 0x6c, 0x6c, 0x69, 0x6e, 0x67, 0x5f, 0x73, 0x74, 0x61, 0x72,
-	0x74, 0x5f, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x76, 0x61, 0x6c, 0x5f, 0x6e, 0x75, 0x6d, 0x62, 0x65,
-	0x72, 0x18, 0x03, 0x20, 0x01, 0x28, 0x05, 0x52, 0x1a, 0x72, 0x6f, 0x6c, 0x6c, 0x69, 0x6e, 0x67,
-	0x53, 0x74, 0x61, 0x72, 0x74, 0x49, 0x6e, 0x74, 0x65, 0x72, 0x76, 0x61, 0x6c, 0x4e, 0x75, 0x6d,
-	0x62, 0x65, 0x72, 0x12, 0x2a, 0x0a, 0x0e, 0x72, 0x6f, 0x6c, 0x6c, 0x69, 0x6e, 0x67, 0x5f, 0x70,
-	0x65, 0x72, 0x69, 0x6f, 0x64, 0x18, 0x04, 0x20, 0x01, 0x28, 0x05, 0x3a, 0x03, 0x31, 0x34, 0x34,
-	0x52, 0x0d, 0x72, 0x6f, 0x6c, 0x6c, 0x69, 0x6e, 0x67, 0x50, 0x65, 0x72, 0x69, 0x6f, 0x64, 0x12,
-	0x4d, 0x0a, 0x0b, 0x72, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x5f, 0x74, 0x79, 0x70, 0x65, 0x18, 0x05,
-	0x20, 0x01, 0x28, 0x0e, 0x32, 0x2c, 0x2e, 0x63, 0x6f, 0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65,
-	0x6c, 0x64, 0x2e, 0x54, 0x65, 0x6d, 0x70, 0x6f, 0x72, 0x61, 0x72, 0x79, 0x45, 0x78, 0x70, 0x6f,
-	0x73, 0x75, 0x72, 0x65, 0x4b, 0x65, 0x79, 0x2e, 0x52, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x54, 0x79,
-	0x70, 0x65, 0x52, 0x0a, 0x72, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x3e,
-	0x0a, 0x1c, 0x64, 0x61, 0x79, 0x73, 0x5f, 0x73, 0x69, 0x6e, 0x63, 0x65, 0x5f, 0x6f, 0x6e, 0x73,
-	0x65, 0x74, 0x5f, 0x6f, 0x66, 0x5f, 0x73, 0x79, 0x6d, 0x70, 0x74, 0x6f, 0x6d, 0x73, 0x18, 0x06,
-	0x20, 0x01, 0x28, 0x11, 0x52, 0x18, 0x64, 0x61, 0x79, 0x73, 0x53, 0x69, 0x6e, 0x63, 0x65, 0x4f,
-	0x6e, 0x73, 0x65, 0x74, 0x4f, 0x66, 0x53, 0x79, 0x6d, 0x70, 0x74, 0x6f, 0x6d, 0x73, 0x22, 0x7c,
-	0x0a, 0x0a, 0x52, 0x65, 0x70, 0x6f, 0x72, 0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x0b, 0x0a, 0x07,
-	0x55, 0x4e, 0x4b, 0x4e, 0x4f, 0x57, 0x4e, 0x10, 0x00, 0x12, 0x12, 0x0a, 0x0e, 0x43, 0x4f, 0x4e,
-	0x46, 0x49, 0x52, 0x4d, 0x45, 0x44, 0x5f, 0x54, 0x45, 0x53, 0x54, 0x10, 0x01, 0x12, 0x20, 0x0a,
-	0x1c, 0x43, 0x4f, 0x4e, 0x46, 0x49, 0x52, 0x4d, 0x45, 0x44, 0x5f, 0x43, 0x4c, 0x49, 0x4e, 0x49,
-	0x43, 0x41, 0x4c, 0x5f, 0x44, 0x49, 0x41, 0x47, 0x4e, 0x4f, 0x53, 0x49, 0x53, 0x10, 0x02, 0x12,
-	0x0f, 0x0a, 0x0b, 0x53, 0x45, 0x4c, 0x46, 0x5f, 0x52, 0x45, 0x50, 0x4f, 0x52, 0x54, 0x10, 0x03,
-	0x12, 0x0d, 0x0a, 0x09, 0x52, 0x45, 0x43, 0x55, 0x52, 0x53, 0x49, 0x56, 0x45, 0x10, 0x04, 0x12,
-	0x0b, 0x0a, 0x07, 0x52, 0x45, 0x56, 0x4f, 0x4b, 0x45, 0x44, 0x10, 0x05, 0x22, 0x4d, 0x0a, 0x10,
-	0x54, 0x45, 0x4b, 0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x4c, 0x69, 0x73, 0x74,
-	0x12, 0x39, 0x0a, 0x0a, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x18, 0x01,
-	0x20, 0x03, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x63, 0x6f, 0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65,
-	0x6c, 0x64, 0x2e, 0x54, 0x45, 0x4b, 0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x52,
-	0x0a, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x22, 0xab, 0x01, 0x0a, 0x0c,
-	0x54, 0x45, 0x4b, 0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x12, 0x41, 0x0a, 0x0e,
-	0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x5f, 0x69, 0x6e, 0x66, 0x6f, 0x18, 0x01,
-	0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x63, 0x6f, 0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65,
-	0x6c, 0x64, 0x2e, 0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x49, 0x6e, 0x66, 0x6f,
-	0x52, 0x0d, 0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x12,
-	0x1b, 0x0a, 0x09, 0x62, 0x61, 0x74, 0x63, 0x68, 0x5f, 0x6e, 0x75, 0x6d, 0x18, 0x02, 0x20, 0x01,
-	0x28, 0x05, 0x52, 0x08, 0x62, 0x61, 0x74, 0x63, 0x68, 0x4e, 0x75, 0x6d, 0x12, 0x1d, 0x0a, 0x0a,
-	0x62, 0x61, 0x74, 0x63, 0x68, 0x5f, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x05,
-	0x52, 0x09, 0x62, 0x61, 0x74, 0x63, 0x68, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x1c, 0x0a, 0x09, 0x73,
-	0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x09,
-	0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x42, 0x17, 0x5a, 0x15, 0x70, 0x6b, 0x67,
-	0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x2f, 0x63, 0x6f, 0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65,
-	0x6c, 0x64,
+	0x2e, 0x53, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x52, 0x0d,
+	0x73, 0x69, 0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x1b, 0x0a,
+	0x09, 0x62, 0x61, 0x74, 0x63, 0x68, 0x5f, 0x6e, 0x75, 0x6d, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05,
+	0x52, 0x08, 0x62, 0x61, 0x74, 0x63, 0x68, 0x4e, 0x75, 0x6d, 0x12, 0x1d, 0x0a, 0x0a, 0x62, 0x61,
+	0x74, 0x63, 0x68, 0x5f, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x05, 0x52, 0x09,
+	0x62, 0x61, 0x74, 0x63, 0x68, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x1c, 0x0a, 0x09, 0x73, 0x69, 0x67,
+	0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x09, 0x73, 0x69,
+	0x67, 0x6e, 0x61, 0x74, 0x75, 0x72, 0x65, 0x42, 0x17, 0x5a, 0x15, 0x70, 0x6b, 0x67, 0x2f, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x2f, 0x63, 0x6f, 0x76, 0x69, 0x64, 0x73, 0x68, 0x69, 0x65, 0x6c, 0x64,
 }
 
 var (
@@ -1199,7 +1342,7 @@ func file_proto_covidshield_proto_rawDescGZIP() []byte {
 }
 
 var file_proto_covidshield_proto_enumTypes = make([]protoimpl.EnumInfo, 3)
-var file_proto_covidshield_proto_msgTypes = make([]protoimpl.MessageInfo, 10)
+var file_proto_covidshield_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
 var file_proto_covidshield_proto_goTypes = []interface{}{
 	(KeyClaimResponse_ErrorCode)(0),        // 0: covidshield.KeyClaimResponse.ErrorCode
 	(EncryptedUploadResponse_ErrorCode)(0), // 1: covidshield.EncryptedUploadResponse.ErrorCode
@@ -1208,32 +1351,35 @@ var file_proto_covidshield_proto_goTypes = []interface{}{
 	(*KeyClaimResponse)(nil),               // 4: covidshield.KeyClaimResponse
 	(*EncryptedUploadRequest)(nil),         // 5: covidshield.EncryptedUploadRequest
 	(*EncryptedUploadResponse)(nil),        // 6: covidshield.EncryptedUploadResponse
-	(*Upload)(nil),                         // 7: covidshield.Upload
-	(*TemporaryExposureKeyExport)(nil),     // 8: covidshield.TemporaryExposureKeyExport
-	(*SignatureInfo)(nil),                  // 9: covidshield.SignatureInfo
-	(*TemporaryExposureKey)(nil),           // 10: covidshield.TemporaryExposureKey
-	(*TEKSignatureList)(nil),               // 11: covidshield.TEKSignatureList
-	(*TEKSignature)(nil),                   // 12: covidshield.TEKSignature
-	(*duration.Duration)(nil),              // 13: google.protobuf.Duration
-	(*timestamp.Timestamp)(nil),            // 14: google.protobuf.Timestamp
+	(*UploadQuota)(nil),                    // 7: covidshield.UploadQuota
+	(*Upload)(nil),                         // 8: covidshield.Upload
+	(*TemporaryExposureKeyExport)(nil),     // 9: covidshield.TemporaryExposureKeyExport
+	(*SignatureInfo)(nil),                  // 10: covidshield.SignatureInfo
+	(*TemporaryExposureKey)(nil),           // 11: covidshield.TemporaryExposureKey
+	(*TEKSignatureList)(nil),               // 12: covidshield.TEKSignatureList
+	(*TEKSignature)(nil),                   // 13: covidshield.TEKSignature
+	(*duration.Duration)(nil),              // 14: google.protobuf.Duration
+	(*timestamp.Timestamp)(nil),            // 15: google.protobuf.Timestamp
 }
 var file_proto_covidshield_proto_depIdxs = []int32{
 	0,  // 0: covidshield.KeyClaimResponse.error:type_name -> covidshield.KeyClaimResponse.ErrorCode
-	13, // 1: covidshield.KeyClaimResponse.remaining_ban_duration:type_name -> google.protobuf.Duration
+	14, // 1: covidshield.KeyClaimResponse.remaining_ban_duration:type_name -> google.protobuf.Duration
 	1,  // 2: covidshield.EncryptedUploadResponse.error:type_name -> covidshield.EncryptedUploadResponse.ErrorCode
-	14, // 3: covidshield.Upload.timestamp:type_name -> google.protobuf.Timestamp
-	10, // 4: covidshield.Upload.keys:type_name -> covidshield.TemporaryExposureKey
-	9,  // 5: covidshield.TemporaryExposureKeyExport.signature_infos:type_name -> covidshield.SignatureInfo
-	10, // 6: covidshield.TemporaryExposureKeyExport.keys:type_name -> covidshield.TemporaryExposureKey
-	10, // 7: covidshield.TemporaryExposureKeyExport.revised_keys:type_name -> covidshield.TemporaryExposureKey
-	2,  // 8: covidshield.TemporaryExposureKey.report_type:type_name -> covidshield.TemporaryExposureKey.ReportType
-	12, // 9: covidshield.TEKSignatureList.signatures:type_name -> covidshield.TEKSignature
-	9,  // 10: covidshield.TEKSignature.signature_info:type_name -> covidshield.SignatureInfo
-	11, // [11:11] is the sub-list for method output_type
-	11, // [11:11] is the sub-list for method input_type
-	11, // [11:11] is the sub-list for extension type_name
-	11, // [11:11] is the sub-list for extension extendee
-	0,  // [0:11] is the sub-list for field type_name
+	7,  // 3: covidshield.EncryptedUploadResponse.quota:type_name -> covidshield.UploadQuota
+	15, // 4: covidshield.UploadQuota.expires_at:type_name -> google.protobuf.Timestamp
+	15, // 5: covidshield.Upload.timestamp:type_name -> google.protobuf.Timestamp
+	11, // 6: covidshield.Upload.keys:type_name -> covidshield.TemporaryExposureKey
+	10, // 7: covidshield.TemporaryExposureKeyExport.signature_infos:type_name -> covidshield.SignatureInfo
+	11, // 8: covidshield.TemporaryExposureKeyExport.keys:type_name -> covidshield.TemporaryExposureKey
+	11, // 9: covidshield.TemporaryExposureKeyExport.revised_keys:type_name -> covidshield.TemporaryExposureKey
+	2,  // 10: covidshield.TemporaryExposureKey.report_type:type_name -> covidshield.TemporaryExposureKey.ReportType
+	13, // 11: covidshield.TEKSignatureList.signatures:type_name -> covidshield.TEKSignature
+	10, // 12: covidshield.TEKSignature.signature_info:type_name -> covidshield.SignatureInfo
+	13, // [13:13] is the sub-list for method output_type
+	13, // [13:13] is the sub-list for method input_type
+	13, // [13:13] is the sub-list for extension type_name
+	13, // [13:13] is the sub-list for extension extendee
+	0,  // [0:13] is the sub-list for field type_name
 }
 
 func init() { file_proto_covidshield_proto_init() }
@@ -1291,7 +1437,7 @@ func file_proto_covidshield_proto_init() {
 			}
 		}
 		file_proto_covidshield_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*Upload); i {
+			switch v := v.(*UploadQuota); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1303,7 +1449,7 @@ func file_proto_covidshield_proto_init() {
 			}
 		}
 		file_proto_covidshield_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*TemporaryExposureKeyExport); i {
+			switch v := v.(*Upload); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1315,7 +1461,7 @@ func file_proto_covidshield_proto_init() {
 			}
 		}
 		file_proto_covidshield_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*SignatureInfo); i {
+			switch v := v.(*TemporaryExposureKeyExport); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1327,7 +1473,7 @@ func file_proto_covidshield_proto_init() {
 			}
 		}
 		file_proto_covidshield_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*TemporaryExposureKey); i {
+			switch v := v.(*SignatureInfo); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1339,7 +1485,7 @@ func file_proto_covidshield_proto_init() {
 			}
 		}
 		file_proto_covidshield_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*TEKSignatureList); i {
+			switch v := v.(*TemporaryExposureKey); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -1351,6 +1497,18 @@ func file_proto_covidshield_proto_init() {
 			}
 		}
 		file_proto_covidshield_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*TEKSignatureList); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_proto_covidshield_proto_msgTypes[10].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*TEKSignature); i {
 			case 0:
 				return &v.state
@@ -1369,7 +1527,7 @@ func file_proto_covidshield_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_proto_covidshield_proto_rawDesc,
 			NumEnums:      3,
-			NumMessages:   10,
+			NumMessages:   11,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cds-snc/covid-alert-server/pkg/config"
@@ -35,8 +36,11 @@ func NewAuthenticator() Authenticator {
 	return &authenticator{hmacKey: hmacKey}
 }
 
+// Authenticate reports whether auth is the HMAC of region, requestedDay and
+// an hour within one of now. region may be a comma separated list of
+// regions, which is then signed as a whole.
 func (a *authenticator) Authenticate(region, requestedDay, auth string) bool {
-	if len(region) != 3 || len(requestedDay) != 5 || len(auth) != 64 {
+	if !validRegionList(region) || len(requestedDay) != 5 || len(auth) != 64 {
 		return false
 	}
 
@@ -65,6 +69,17 @@ func (a *authenticator) Authenticate(region, requestedDay, auth string) bool {
 	return false
 }
 
+// validRegionList reports whether regions is one or more three character
+// region codes separated by commas
+func validRegionList(regions string) bool {
+	for _, region := range strings.Split(regions, ",") {
+		if len(region) != 3 {
+			return false
+		}
+	}
+	return true
+}
+
 func validMAC(message, messageMAC, key []byte) bool {
 	mac := hmac.New(sha256.New, key)
 	if _, err := mac.Write(message); err != nil {
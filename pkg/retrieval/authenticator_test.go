@@ -70,6 +70,8 @@ func TestAuthenticate(t *testing.T) {
 	validAuth := "448d9bfd238b34323b70175b4b385fb39d59186711049c6766fa7c890de33a12"
 
 	assert.False(t, authenticator.Authenticate("", validDay, validAuth), "region must be three characters long")
+	assert.False(t, authenticator.Authenticate("302,30", validDay, validAuth), "each listed region must be three characters long")
+	assert.False(t, authenticator.Authenticate("302,", validDay, validAuth), "listed regions can't be empty")
 	assert.False(t, authenticator.Authenticate(validRegion, "", validAuth), "day must be five characters long")
 	assert.False(t, authenticator.Authenticate(validRegion, validDay, ""), "auth must be 64 characters long")
 
@@ -87,6 +89,13 @@ func TestAuthenticate(t *testing.T) {
 
 	assert.True(t, authenticator.Authenticate(validRegion, validDay, validAuth), "should return true on valid signature for current hour")
 
+	mac = hmac.New(sha256.New, []byte(hmacKey))
+	mac.Write([]byte("302,303:" + validDay + ":" + strconv.Itoa(currentHour)))
+	listAuth := hex.EncodeToString(mac.Sum(nil))
+
+	assert.True(t, authenticator.Authenticate("302,303", validDay, listAuth), "should return true on a signature over the whole region list")
+	assert.False(t, authenticator.Authenticate("302", validDay, listAuth), "a list's signature doesn't cover one of its regions")
+
 	validMessage = validRegion + ":" + validDay + ":" + strconv.Itoa(currentHour-1)
 	mac = hmac.New(sha256.New, []byte(hmacKey))
 	mac.Write([]byte(validMessage))
@@ -0,0 +1,79 @@
+package retrieval
+
+import (
+	"strings"
+
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ExportFormat is the layout of the keys in an export, which differs between
+// versions of the Exposure Notification framework
+type ExportFormat int
+
+// Only EN v1 needs a layout of its own. report_type and
+// days_since_onset_of_symptoms aren't stored, so every key is served as
+// CONFIRMED_TEST with 0 days since onset, which is already what EN v1.5
+// clients are given by FormatCurrent.
+const (
+	// FormatCurrent serves keys as they are stored
+	FormatCurrent ExportFormat = iota
+	// FormatV1 serves keys as EN v1 expects them: risk is carried only by
+	// transmission_risk_level, so report_type and days_since_onset_of_symptoms
+	// are left out
+	FormatV1
+)
+
+func (f ExportFormat) String() string {
+	if f == FormatV1 {
+		return "v1"
+	}
+	return "current"
+}
+
+// ParseENVersion returns the export format for an EN framework version such
+// as "1" or "v1.0", or FormatCurrent for any other version, including an
+// empty one
+func ParseENVersion(version string) ExportFormat {
+	switch strings.TrimPrefix(strings.ToLower(strings.TrimSpace(version)), "v") {
+	case "1", "1.0":
+		return FormatV1
+	}
+	return FormatCurrent
+}
+
+// Keys returns keys in the shape f calls for. Keys that need changing are
+// copied, so those passed in are left as they were.
+func (f ExportFormat) Keys(keys []*pb.TemporaryExposureKey) []*pb.TemporaryExposureKey {
+	if f == FormatCurrent {
+		return keys
+	}
+	out := make([]*pb.TemporaryExposureKey, len(keys))
+	for i, key := range keys {
+		out[i] = f.key(key)
+	}
+	return out
+}
+
+// Stream is Keys over a KeyStream
+func (f ExportFormat) Stream(keys KeyStream) KeyStream {
+	if f == FormatCurrent {
+		return keys
+	}
+	return func(fn func(*pb.TemporaryExposureKey) error) error {
+		return keys(func(key *pb.TemporaryExposureKey) error {
+			return fn(f.key(key))
+		})
+	}
+}
+
+func (f ExportFormat) key(key *pb.TemporaryExposureKey) *pb.TemporaryExposureKey {
+	if f != FormatV1 || (key.ReportType == nil && key.DaysSinceOnsetOfSymptoms == nil) {
+		return key
+	}
+	key = proto.Clone(key).(*pb.TemporaryExposureKey)
+	key.ReportType = nil
+	key.DaysSinceOnsetOfSymptoms = nil
+	return key
+}
@@ -0,0 +1,68 @@
+package retrieval
+
+import (
+	"testing"
+
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParseENVersion(t *testing.T) {
+	for version, expected := range map[string]ExportFormat{
+		"":      FormatCurrent,
+		"2":     FormatCurrent,
+		"bogus": FormatCurrent,
+		"1":     FormatV1,
+		"1.0":   FormatV1,
+		"v1":    FormatV1,
+		"V1.0":  FormatV1,
+		"1.5":   FormatCurrent,
+		"v1.5":  FormatCurrent,
+	} {
+		assert.Equal(t, expected, ParseENVersion(version), "version %q", version)
+	}
+}
+
+func TestExportFormatKeys(t *testing.T) {
+	// Keys as storage returns them
+	onset := int32(0)
+	full := randomTestKey()
+	full.ReportType = pb.TemporaryExposureKey_CONFIRMED_TEST.Enum()
+	full.DaysSinceOnsetOfSymptoms = &onset
+	bare := randomTestKey()
+	keys := []*pb.TemporaryExposureKey{full, bare}
+	original := []*pb.TemporaryExposureKey{proto.Clone(full).(*pb.TemporaryExposureKey), proto.Clone(bare).(*pb.TemporaryExposureKey)}
+
+	// Current: keys as stored
+	assert.Equal(t, keys, FormatCurrent.Keys(keys))
+
+	// v1: risk only through transmission_risk_level
+	v1 := FormatV1.Keys(keys)
+	for i, key := range v1 {
+		assert.Nil(t, key.ReportType)
+		assert.Nil(t, key.DaysSinceOnsetOfSymptoms)
+		assert.Equal(t, keys[i].GetTransmissionRiskLevel(), key.GetTransmissionRiskLevel())
+		assert.Equal(t, keys[i].GetKeyData(), key.GetKeyData())
+	}
+
+	// The keys passed in are left alone
+	for i := range keys {
+		assert.True(t, proto.Equal(original[i], keys[i]))
+	}
+}
+
+func TestExportFormatStream(t *testing.T) {
+	onset := int32(3)
+	key := randomTestKey()
+	key.DaysSinceOnsetOfSymptoms = &onset
+
+	var streamed []*pb.TemporaryExposureKey
+	err := FormatV1.Stream(SliceKeyStream([]*pb.TemporaryExposureKey{key}))(func(k *pb.TemporaryExposureKey) error {
+		streamed = append(streamed, k)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Len(t, streamed, 1)
+	assert.Nil(t, streamed[0].DaysSinceOnsetOfSymptoms)
+}
@@ -52,28 +52,8 @@ func SerializeTo(
 ) (int, error) {
 	zipw := zip.NewWriter(w)
 
-	one := int32(1)
-
-	start := uint64(startTimestamp.Unix())
-	end := uint64(endTimestamp.Unix())
-
-	sigInfo := &pb.SignatureInfo{
-		VerificationKeyVersion: &verificationKeyVersion,
-		VerificationKeyId:      &verificationKeyID,
-		SignatureAlgorithm:     &signatureAlgorithm,
-	}
-
-	region = transformRegion(region)
-
-	tekExport := &pb.TemporaryExposureKeyExport{
-		StartTimestamp: &start,
-		EndTimestamp:   &end,
-		Region:         &region,
-		BatchNum:       &one,
-		BatchSize:      &one,
-		SignatureInfos: []*pb.SignatureInfo{sigInfo},
-		Keys:           keys,
-	}
+	tekExport, sigInfo := exportMetadata(region, startTimestamp, endTimestamp, signer)
+	tekExport.Keys = keys
 
 	exportBinData, err := proto.Marshal(tekExport)
 	if err != nil {
@@ -85,15 +65,7 @@ func SerializeTo(
 		return -1, err
 	}
 
-	sigList := &pb.TEKSignatureList{
-		Signatures: []*pb.TEKSignature{&pb.TEKSignature{
-			SignatureInfo: sigInfo,
-			BatchNum:      &one,
-			BatchSize:     &one,
-			Signature:     sig,
-		}},
-	}
-	exportSigData, err := proto.Marshal(sigList)
+	exportSigData, err := signatureList(sigInfo, sig)
 	if err != nil {
 		return -1, err
 	}
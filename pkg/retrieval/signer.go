@@ -8,21 +8,75 @@ import (
 	"crypto/x509"
 	"encoding/hex"
 	"os"
+	"strings"
 )
 
 type Signer interface {
 	Sign([]byte) ([]byte, error)
 }
 
+// DigestSigner is a Signer that can also sign a SHA-256 digest it is handed,
+// for data too large to pass to Sign whole
+type DigestSigner interface {
+	Signer
+	SignDigest([]byte) ([]byte, error)
+}
+
+// VersionedSigner is a Signer that knows which verification key version its
+// signatures are checked against, for the export's SignatureInfo
+type VersionedSigner interface {
+	Signer
+	KeyVersion() string
+}
+
 type signer struct {
 	privateKey *ecdsa.PrivateKey
+	version    string
 }
 
+// NewSigner loads the export signing key. For rotation, ECDSA_KEYS holds
+// every configured key as version=hexkey pairs separated by colons, e.g.
+// v1=3077...:v2=3077..., and ECDSA_ACTIVE_KEY_VERSION picks the one to sign
+// with; adding the new key as active while clients still carry the old
+// version's public key lets them move over. Without ECDSA_KEYS the single
+// ECDSA_KEY is used as version v1.
 func NewSigner() Signer {
-	ecdsaKeyHex := os.Getenv("ECDSA_KEY")
-	if ecdsaKeyHex == "" {
-		panic("no ECDSA_KEY")
+	keys := os.Getenv("ECDSA_KEYS")
+	if keys == "" {
+		ecdsaKeyHex := os.Getenv("ECDSA_KEY")
+		if ecdsaKeyHex == "" {
+			panic("no ECDSA_KEY")
+		}
+		return &signer{privateKey: parseSigningKey(ecdsaKeyHex), version: verificationKeyVersion}
+	}
+
+	privateKeys := make(map[string]*ecdsa.PrivateKey)
+	for _, versionWithKey := range strings.Split(keys, ":") {
+		parts := strings.SplitN(versionWithKey, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			panic("invalid ECDSA_KEYS")
+		}
+		if _, ok := privateKeys[parts[0]]; ok {
+			panic("duplicate ECDSA_KEYS version")
+		}
+		privateKeys[parts[0]] = parseSigningKey(parts[1])
+	}
+
+	active := os.Getenv("ECDSA_ACTIVE_KEY_VERSION")
+	if active == "" && len(privateKeys) == 1 {
+		for version := range privateKeys {
+			active = version
+		}
 	}
+	priv, ok := privateKeys[active]
+	if !ok {
+		panic("ECDSA_ACTIVE_KEY_VERSION is not one of ECDSA_KEYS")
+	}
+
+	return &signer{privateKey: priv, version: active}
+}
+
+func parseSigningKey(ecdsaKeyHex string) *ecdsa.PrivateKey {
 	ecdsaKey, err := hex.DecodeString(ecdsaKeyHex)
 	if err != nil {
 		panic(err)
@@ -32,13 +86,20 @@ func NewSigner() Signer {
 	if err != nil {
 		panic(err)
 	}
+	return priv
+}
 
-	return &signer{privateKey: priv}
+func (s *signer) KeyVersion() string {
+	return s.version
 }
 
 func (s *signer) Sign(data []byte) ([]byte, error) {
 	digest := sha256.Sum256(data)
-	sig, err := s.privateKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	return s.SignDigest(digest[:])
+}
+
+func (s *signer) SignDigest(digest []byte) ([]byte, error) {
+	sig, err := s.privateKey.Sign(rand.Reader, digest, crypto.SHA256)
 	if err != nil {
 		return nil, err
 	}
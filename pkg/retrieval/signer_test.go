@@ -1,6 +1,8 @@
 package retrieval
 
 import (
+	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -12,8 +14,11 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestNewSigner(t *testing.T) {
@@ -31,7 +36,7 @@ func TestNewSigner(t *testing.T) {
 	data, _ := x509.MarshalECPrivateKey(privateKey)
 	os.Setenv("ECDSA_KEY", hex.EncodeToString(data))
 
-	expected := &signer{privateKey: privateKey}
+	expected := &signer{privateKey: privateKey, version: "v1"}
 	assert.Equal(t, NewSigner(), expected, "should return a signer struct with a private key")
 
 }
@@ -60,3 +65,52 @@ func TestSign(t *testing.T) {
 	assert.Equal(t, receivedValidation, expectedValidation, "signer should return a valid signature")
 	assert.Equal(t, receivedError, nil, "signer should not return an error")
 }
+
+func TestNewSignerRotation(t *testing.T) {
+	defer os.Unsetenv("ECDSA_KEYS")
+	defer os.Unsetenv("ECDSA_ACTIVE_KEY_VERSION")
+
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	oldData, _ := x509.MarshalECPrivateKey(oldKey)
+	newData, _ := x509.MarshalECPrivateKey(newKey)
+	os.Setenv("ECDSA_KEYS", "v1="+hex.EncodeToString(oldData)+":v2="+hex.EncodeToString(newData))
+
+	os.Setenv("ECDSA_ACTIVE_KEY_VERSION", "v3")
+	assert.PanicsWithValue(t, "ECDSA_ACTIVE_KEY_VERSION is not one of ECDSA_KEYS", func() { NewSigner() })
+
+	os.Setenv("ECDSA_ACTIVE_KEY_VERSION", "v2")
+	s := NewSigner()
+	assert.Equal(t, &signer{privateKey: newKey, version: "v2"}, s, "should sign with the active key")
+
+	// The export is signed by the active key and says which version it is
+	var out bytes.Buffer
+	keys := []*pb.TemporaryExposureKey{randomTestKey()}
+	_, err := SerializeTo(context.Background(), &out, keys, "302", time.Now(), time.Now(), s)
+	assert.Nil(t, err)
+
+	var export pb.TemporaryExposureKeyExport
+	exportBin := readZipEntry(t, out.Bytes(), "export.bin")
+	assert.Nil(t, proto.Unmarshal(exportBin[binHeaderLength:], &export))
+	assert.Equal(t, "v2", export.SignatureInfos[0].GetVerificationKeyVersion())
+
+	var sigList pb.TEKSignatureList
+	assert.Nil(t, proto.Unmarshal(readZipEntry(t, out.Bytes(), "export.sig"), &sigList))
+	assert.Equal(t, "v2", sigList.Signatures[0].SignatureInfo.GetVerificationKeyVersion())
+
+	var esig struct {
+		R, S *big.Int
+	}
+	asn1.Unmarshal(sigList.Signatures[0].Signature, &esig)
+	digest := sha256.Sum256(exportBin)
+	assert.True(t, ecdsa.Verify(&newKey.PublicKey, digest[:], esig.R, esig.S), "should verify with the active key")
+	assert.False(t, ecdsa.Verify(&oldKey.PublicKey, digest[:], esig.R, esig.S), "should not verify with the old key")
+
+	// A single configured key is active without naming it
+	os.Unsetenv("ECDSA_ACTIVE_KEY_VERSION")
+	os.Setenv("ECDSA_KEYS", "2021="+hex.EncodeToString(newData))
+	assert.Equal(t, "2021", NewSigner().(VersionedSigner).KeyVersion())
+
+	os.Setenv("ECDSA_KEYS", hex.EncodeToString(newData))
+	assert.PanicsWithValue(t, "invalid ECDSA_KEYS", func() { NewSigner() })
+}
@@ -0,0 +1,180 @@
+package retrieval
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"time"
+
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// KeyStream calls fn with each key of a batch in order, stopping at and
+// returning the first error from fn
+type KeyStream func(fn func(*pb.TemporaryExposureKey) error) error
+
+// SliceKeyStream returns a KeyStream over keys that are already in memory
+func SliceKeyStream(keys []*pb.TemporaryExposureKey) KeyStream {
+	return func(fn func(*pb.TemporaryExposureKey) error) error {
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// keysField is the protobuf field number of TemporaryExposureKeyExport.keys
+var keysField = (&pb.TemporaryExposureKeyExport{}).ProtoReflect().Descriptor().Fields().ByName("keys").Number()
+
+// signingKeyVersion is the verification key version signer's signatures are
+// checked against
+func signingKeyVersion(signer Signer) string {
+	if vs, ok := signer.(VersionedSigner); ok {
+		return vs.KeyVersion()
+	}
+	return verificationKeyVersion
+}
+
+// exportMetadata returns everything in a batch's export.bin except the keys,
+// and the SignatureInfo it is signed under
+func exportMetadata(region string, startTimestamp, endTimestamp time.Time, signer Signer) (*pb.TemporaryExposureKeyExport, *pb.SignatureInfo) {
+	one := int32(1)
+
+	start := uint64(startTimestamp.Unix())
+	end := uint64(endTimestamp.Unix())
+
+	keyVersion := signingKeyVersion(signer)
+	sigInfo := &pb.SignatureInfo{
+		VerificationKeyVersion: &keyVersion,
+		VerificationKeyId:      &verificationKeyID,
+		SignatureAlgorithm:     &signatureAlgorithm,
+	}
+
+	region = transformRegion(region)
+
+	return &pb.TemporaryExposureKeyExport{
+		StartTimestamp: &start,
+		EndTimestamp:   &end,
+		Region:         &region,
+		BatchNum:       &one,
+		BatchSize:      &one,
+		SignatureInfos: []*pb.SignatureInfo{sigInfo},
+	}, sigInfo
+}
+
+// signatureList marshals the export.sig contents for sig
+func signatureList(sigInfo *pb.SignatureInfo, sig []byte) ([]byte, error) {
+	one := int32(1)
+	return proto.Marshal(&pb.TEKSignatureList{
+		Signatures: []*pb.TEKSignature{{
+			SignatureInfo: sigInfo,
+			BatchNum:      &one,
+			BatchSize:     &one,
+			Signature:     sig,
+		}},
+	})
+}
+
+// StreamTo writes the same export as SerializeTo, but takes the keys from
+// keys one at a time and writes each as it arrives, so the batch is never
+// held in memory. Keys are the last field of TemporaryExposureKeyExport and
+// protobuf encodes a repeated field as one record per element, so the
+// metadata followed by each key's record is byte for byte what marshalling the
+// whole export would produce.
+//
+// If signer is a DigestSigner export.bin is hashed as it is written; any other
+// Signer needs the whole of export.bin, which is then buffered.
+func StreamTo(
+	ctx context.Context, w io.Writer,
+	keys KeyStream,
+	region string,
+	startTimestamp, endTimestamp time.Time,
+	signer Signer,
+) (int, error) {
+	zipw := zip.NewWriter(w)
+
+	tekExport, sigInfo := exportMetadata(region, startTimestamp, endTimestamp, signer)
+	metadata, err := proto.Marshal(tekExport)
+	if err != nil {
+		return -1, err
+	}
+
+	f, err := zipw.Create("export.bin")
+	if err != nil {
+		return -1, err
+	}
+
+	digestSigner, canSignDigest := signer.(DigestSigner)
+	var digest hash.Hash
+	var signed bytes.Buffer
+	var out io.Writer
+	if canSignDigest {
+		digest = sha256.New()
+		out = io.MultiWriter(f, digest)
+	} else {
+		out = io.MultiWriter(f, &signed)
+	}
+
+	totalN := 0
+	write := func(data []byte) error {
+		n, err := out.Write(data)
+		totalN += n
+		return err
+	}
+
+	if err := write(binHeader); err != nil {
+		return -1, err
+	}
+	if err := write(metadata); err != nil {
+		return -1, err
+	}
+
+	var record []byte
+	err = keys(func(key *pb.TemporaryExposureKey) error {
+		data, err := proto.Marshal(key)
+		if err != nil {
+			return err
+		}
+		record = protowire.AppendTag(record[:0], keysField, protowire.BytesType)
+		record = protowire.AppendBytes(record, data)
+		return write(record)
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	var sig []byte
+	if canSignDigest {
+		sig, err = digestSigner.SignDigest(digest.Sum(nil))
+	} else {
+		sig, err = signer.Sign(signed.Bytes())
+	}
+	if err != nil {
+		return -1, err
+	}
+
+	exportSigData, err := signatureList(sigInfo, sig)
+	if err != nil {
+		return -1, err
+	}
+
+	f, err = zipw.Create("export.sig")
+	if err != nil {
+		return -1, err
+	}
+	n, err := f.Write(exportSigData)
+	if err != nil {
+		return -1, err
+	}
+	totalN += n
+
+	return totalN, zipw.Close()
+}
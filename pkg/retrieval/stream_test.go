@@ -0,0 +1,128 @@
+package retrieval
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"io/ioutil"
+	"math/big"
+	"testing"
+	"time"
+
+	mockSigner "github.com/cds-snc/covid-alert-server/mocks/pkg/retrieval"
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/protobuf/proto"
+)
+
+func readZipEntry(t *testing.T, data []byte, name string) []byte {
+	zipr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	assert.Nil(t, err)
+	for _, f := range zipr.File {
+		if f.Name == name {
+			rc, _ := f.Open()
+			defer rc.Close()
+			contents, _ := ioutil.ReadAll(rc)
+			return contents
+		}
+	}
+	t.Fatalf("no %s in zip", name)
+	return nil
+}
+
+func TestStreamToMatchesSerializeTo(t *testing.T) {
+	keys := []*pb.TemporaryExposureKey{randomTestKey(), randomTestKey(), randomTestKey()}
+	startTimestamp := time.Unix(1600000000, 0)
+	endTimestamp := startTimestamp.Add(24 * time.Hour)
+
+	sig := make([]byte, 64)
+	signer := &mockSigner.Signer{}
+	signer.On("Sign", mock.AnythingOfType("[]uint8")).Return(sig, nil)
+
+	var serialized, streamed bytes.Buffer
+	serializedN, err := SerializeTo(context.Background(), &serialized, keys, "302", startTimestamp, endTimestamp, signer)
+	assert.Nil(t, err)
+	streamedN, err := StreamTo(context.Background(), &streamed, SliceKeyStream(keys), "302", startTimestamp, endTimestamp, signer)
+	assert.Nil(t, err)
+
+	assert.Equal(t, serializedN, streamedN)
+	assert.Equal(t, readZipEntry(t, serialized.Bytes(), "export.bin"), readZipEntry(t, streamed.Bytes(), "export.bin"))
+	assert.Equal(t, readZipEntry(t, serialized.Bytes(), "export.sig"), readZipEntry(t, streamed.Bytes(), "export.sig"))
+
+	// Both signed the same export.bin
+	signed := signer.Calls[0].Arguments.Get(0).([]byte)
+	assert.Equal(t, signed, signer.Calls[1].Arguments.Get(0).([]byte))
+
+	var export pb.TemporaryExposureKeyExport
+	assert.Nil(t, proto.Unmarshal(readZipEntry(t, streamed.Bytes(), "export.bin")[binHeaderLength:], &export))
+	assert.Len(t, export.Keys, 3)
+	assert.Equal(t, "CA", export.GetRegion())
+}
+
+// firstWriteRecorder records how many keys had been produced when the export
+// first reached the underlying writer
+type firstWriteRecorder struct {
+	produced    *int
+	atFirst     int
+	wroteBefore bool
+	n           int
+}
+
+func (f *firstWriteRecorder) Write(p []byte) (int, error) {
+	if !f.wroteBefore {
+		f.wroteBefore = true
+		f.atFirst = *f.produced
+	}
+	f.n += len(p)
+	return len(p), nil
+}
+
+func TestStreamToDoesNotMaterializeKeys(t *testing.T) {
+	const total = 20000
+	produced := 0
+	source := func(fn func(*pb.TemporaryExposureKey) error) error {
+		for produced < total {
+			produced++
+			if err := fn(randomTestKey()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	privateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	out := &firstWriteRecorder{produced: &produced}
+
+	_, err := StreamTo(context.Background(), out, source, "302", time.Now(), time.Now(), &signer{privateKey: privateKey, version: "v1"})
+	assert.Nil(t, err)
+
+	assert.Equal(t, total, produced)
+	assert.True(t, out.wroteBefore)
+	assert.Less(t, out.atFirst, total, "output should start before the source is exhausted")
+}
+
+func TestStreamToSignsDigest(t *testing.T) {
+	privateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keys := []*pb.TemporaryExposureKey{randomTestKey(), randomTestKey()}
+
+	var streamed bytes.Buffer
+	_, err := StreamTo(context.Background(), &streamed, SliceKeyStream(keys), "302", time.Now(), time.Now(), &signer{privateKey: privateKey, version: "v1"})
+	assert.Nil(t, err)
+
+	var sigList pb.TEKSignatureList
+	assert.Nil(t, proto.Unmarshal(readZipEntry(t, streamed.Bytes(), "export.sig"), &sigList))
+
+	var esig struct {
+		R, S *big.Int
+	}
+	asn1.Unmarshal(sigList.Signatures[0].Signature, &esig)
+
+	digest := sha256.Sum256(readZipEntry(t, streamed.Bytes(), "export.bin"))
+	assert.True(t, ecdsa.Verify(&privateKey.PublicKey, digest[:], esig.R, esig.S), "should be signed over the streamed export.bin")
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+)
+
+// adminTokenHeader carries ADMIN_TOKEN on admin requests. It is separate from
+// Authorization, which still holds the health authority's bearer token so
+// handlers know the caller's region.
+const adminTokenHeader = "X-Admin-Token"
+
+// AdminTokenMiddleware rejects requests whose X-Admin-Token header doesn't
+// match token. An empty token rejects everything, so admin routes are closed
+// until ADMIN_TOKEN is set.
+func AdminTokenMiddleware(token string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			given := r.Header.Get(adminTokenHeader)
+			if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				log(r.Context(), nil).Info("bad admin token")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// adminRouter returns a subrouter for admin routes. They require ADMIN_TOKEN,
+// which health authority tokens alone don't carry, and also a client
+// certificate signed by the CA in ADMIN_CLIENT_CA_FILE if it is set.
+func adminRouter(r *mux.Router) *mux.Router {
+	r = r.NewRoute().Subrouter()
+	r.Use(AdminTokenMiddleware(os.Getenv("ADMIN_TOKEN")))
+	if pool := adminClientCAs(); pool != nil {
+		r.Use(ClientCertMiddleware(pool))
+	}
+	return r
+}
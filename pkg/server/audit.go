@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Shopify/goose/logger"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/persistence"
+	"github.com/sirupsen/logrus"
+)
+
+// Audit entries go to their own JSON logger so they can be shipped and
+// retained separately from operational logs.
+var auditLogger = &logrus.Logger{
+	Out:       os.Stdout,
+	Formatter: &logrus.JSONFormatter{},
+	Hooks:     make(logrus.LevelHooks),
+	Level:     logrus.InfoLevel,
+	ExitFunc:  os.Exit,
+}
+
+var auditLog logger.Logger = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+	if len(err) == 1 && err[0] == nil {
+		err = nil
+	}
+	return logger.ContextLog(ctx, err, logrus.NewEntry(auditLogger)).WithField("component", "audit")
+}
+
+// auditActor identifies who made an admin request: the subject of a verified
+// client certificate if there is one, otherwise the bearer token's region, or
+// the token redacted by persistence.RedactToken if it isn't mapped to one.
+func auditActor(r *http.Request, region, token string) string {
+	if subject, ok := clientCertSubject(r.Context()); ok {
+		return "cert:" + subject
+	}
+	if region != "" && region != config.AppConstants.RegionCode {
+		return "token:" + region
+	}
+	if len(token) < 2 {
+		return "token:unknown"
+	}
+	return "token:" + persistence.RedactToken(token)
+}
+
+// authHeaderForLogs is an Authorization header as it may be logged: only its
+// token, redacted by secretForLogs
+func authHeaderForLogs(hdr string) string {
+	return secretForLogs(strings.TrimPrefix(hdr, "Bearer "))
+}
+
+// secretForLogs is a credential as it may be logged: redacted by
+// persistence.RedactToken, or nothing if it's too short to redact
+func secretForLogs(secret string) string {
+	if len(secret) < 2 {
+		return ""
+	}
+	return persistence.RedactToken(secret)
+}
+
+// auditAction records an admin action on target by actor, and whether it
+// succeeded. Every admin handler should call this once it has authorized the
+// request.
+func auditAction(r *http.Request, actor, action, target string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	auditLog(r.Context(), err).WithFields(logrus.Fields{
+		"actor":     actor,
+		"action":    action,
+		"target":    target,
+		"result":    result,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	}).Info("admin action")
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditActor(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/clear-diagnosis-keys", nil)
+
+	assert.Equal(t, "token:ONApi", auditActor(req, "ONApi", "abcdefgh"), "should use the token's region")
+	assert.Equal(t, "token:a...h", auditActor(req, "302", "abcdefgh"), "should mask tokens without a region")
+	assert.Equal(t, "token:unknown", auditActor(req, "", ""), "should handle a missing token")
+
+	oldRegionCode := config.AppConstants.RegionCode
+	config.AppConstants.RegionCode = "999"
+	assert.Equal(t, "token:a...h", auditActor(req, "999", "abcdefgh"), "should treat the configured region code as no region")
+	assert.Equal(t, "token:302", auditActor(req, "302", "abcdefgh"))
+	config.AppConstants.RegionCode = oldRegionCode
+
+	req = req.WithContext(context.WithValue(req.Context(), clientCertSubjectKey{}, "CN=admin"))
+	assert.Equal(t, "cert:CN=admin", auditActor(req, "ONApi", "abcdefgh"), "should prefer the client certificate subject")
+}
+
+func TestAuditActorMasked(t *testing.T) {
+	oldMask := config.AppConstants.MaskOriginatorInLogs
+	defer func() { config.AppConstants.MaskOriginatorInLogs = oldMask }()
+	config.AppConstants.MaskOriginatorInLogs = true
+
+	req, _ := http.NewRequest("POST", "/clear-diagnosis-keys", nil)
+
+	assert.Equal(t, "token:ONApi", auditActor(req, "ONApi", "abcdefgh"))
+	assert.Equal(t, "token:[masked]", auditActor(req, "302", "abcdefgh"), "should leak no characters of tokens without a region")
+}
+
+func TestAuthHeaderForLogs(t *testing.T) {
+	assert.Equal(t, "a...h", authHeaderForLogs("Bearer abcdefgh"))
+	assert.Equal(t, "a...h", authHeaderForLogs("abcdefgh"))
+	assert.Equal(t, "", authHeaderForLogs("Bearer a"))
+	assert.Equal(t, "", authHeaderForLogs(""))
+
+	oldMask := config.AppConstants.MaskOriginatorInLogs
+	defer func() { config.AppConstants.MaskOriginatorInLogs = oldMask }()
+	config.AppConstants.MaskOriginatorInLogs = true
+	assert.Equal(t, "[masked]", authHeaderForLogs("Bearer abcdefgh"))
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+)
+
+type clientCertSubjectKey struct{}
+
+// clientCertSubject returns the subject of the client certificate verified by
+// ClientCertMiddleware for this request, if any
+func clientCertSubject(ctx context.Context) (string, bool) {
+	subject, ok := ctx.Value(clientCertSubjectKey{}).(string)
+	return subject, ok
+}
+
+// ClientCertMiddleware rejects requests that don't present a client
+// certificate chaining to one of the CAs in pool. The certificate is read from
+// the request's TLS connection state, so requests over plain HTTP are always
+// rejected.
+func ClientCertMiddleware(pool *x509.CertPool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+
+			if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+				log(ctx, nil).Info("missing client certificate")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			intermediates := x509.NewCertPool()
+			for _, cert := range r.TLS.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+
+			chains, err := r.TLS.PeerCertificates[0].Verify(x509.VerifyOptions{
+				Roots:         pool,
+				Intermediates: intermediates,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			})
+			if err != nil {
+				log(ctx, err).Info("untrusted client certificate")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			ctx = context.WithValue(ctx, clientCertSubjectKey{}, chains[0][0].Subject.String())
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// adminClientCAs returns the pool of CAs in ADMIN_CLIENT_CA_FILE, or nil if it
+// isn't set
+func adminClientCAs() *x509.CertPool {
+	caFile := os.Getenv("ADMIN_CLIENT_CA_FILE")
+	if caFile == "" {
+		return nil
+	}
+
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		log(nil, err).Fatal("unable to read ADMIN_CLIENT_CA_FILE")
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		log(nil, nil).Fatal("ADMIN_CLIENT_CA_FILE contains no certificates")
+	}
+	return pool
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shopify/goose/srvutil"
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func buildTestCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func buildTestClientCert(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey) *x509.Certificate {
+	cert, _ := buildTestClientKeyPair(t, ca, caKey)
+	return cert
+}
+
+func buildTestClientKeyPair(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "admin"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	assert.Nil(t, err)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func serveWithClientCert(handler http.Handler, cert *x509.Certificate) *httptest.ResponseRecorder {
+	req := adminRequest("POST", "/clear-diagnosis-keys")
+	if cert != nil {
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	}
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestClientCertMiddleware(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	ca, caKey := buildTestCA(t)
+	untrustedCA, untrustedCAKey := buildTestCA(t)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	var subject string
+	handler := ClientCertMiddleware(pool)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject, _ = clientCertSubject(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// Valid client certificate
+	resp := serveWithClientCert(handler, buildTestClientCert(t, ca, caKey))
+	assert.Equal(t, http.StatusOK, resp.Code, "trusted certificate should be accepted")
+	assert.Equal(t, "CN=admin", subject, "should expose the verified certificate subject")
+
+	// Certificate signed by another CA
+	resp = serveWithClientCert(handler, buildTestClientCert(t, untrustedCA, untrustedCAKey))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code, "untrusted certificate should be rejected")
+	assert.Equal(t, "unauthorized\n", resp.Body.String())
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "untrusted client certificate")
+
+	// No certificate
+	resp = serveWithClientCert(handler, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code, "missing certificate should be rejected")
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "missing client certificate")
+}
+
+func TestAdminRouter_ClientCA(t *testing.T) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	ca, caKey := buildTestCA(t)
+
+	caFile, _ := ioutil.TempFile("", "admin-ca-*.pem")
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	caFile.Close()
+
+	os.Setenv("ADMIN_CLIENT_CA_FILE", caFile.Name())
+	defer os.Unsetenv("ADMIN_CLIENT_CA_FILE")
+
+	router := Router()
+	adminRouter(router).HandleFunc("/clear-diagnosis-keys", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	resp := serveWithClientCert(router, buildTestClientCert(t, ca, caKey))
+	assert.Equal(t, http.StatusOK, resp.Code, "trusted certificate should be accepted")
+
+	resp = serveWithClientCert(router, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code, "admin routes should require a client certificate")
+}
+
+func TestNew_TLSClientCert(t *testing.T) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir)
+	os.Setenv("TLS_CERT_FILE", certFile)
+	os.Setenv("TLS_KEY_FILE", keyFile)
+	defer os.Unsetenv("TLS_CERT_FILE")
+	defer os.Unsetenv("TLS_KEY_FILE")
+
+	ca, caKey := buildTestCA(t)
+	caFile := filepath.Join(dir, "admin-ca.pem")
+	assert.Nil(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600))
+	os.Setenv("ADMIN_CLIENT_CA_FILE", caFile)
+	defer os.Unsetenv("ADMIN_CLIENT_CA_FILE")
+
+	var subject string
+	servlet := srvutil.InlineServlet(func(r *mux.Router) {
+		adminRouter(r).HandleFunc("/admin-ping", func(w http.ResponseWriter, r *http.Request) {
+			subject, _ = clientCertSubject(r.Context())
+			w.WriteHeader(http.StatusOK)
+		})
+	})
+	srv := New("127.0.0.1:0", []srvutil.Servlet{NewServicesServlet(), servlet})
+	go func() { _ = srv.Run() }()
+	defer srv.Tomb().Kill(nil)
+	base := "https://" + srv.Addr().String()
+
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       certs,
+		}}}
+	}
+
+	cert, key := buildTestClientKeyPair(t, ca, caKey)
+	withCert := client(tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key})
+
+	// The certificate presented in the handshake reaches the middleware
+	resp, err := withCert.Do(adminRequest("GET", base+"/admin-ping"))
+	assert.Nil(t, err)
+	if resp != nil {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "CN=admin", subject)
+	}
+
+	// Admin routes still need one
+	resp, err = client().Do(adminRequest("GET", base+"/admin-ping"))
+	assert.Nil(t, err)
+	if resp != nil {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// Other routes don't
+	resp, err = client().Get(base + "/services/ping")
+	assert.Nil(t, err)
+	if resp != nil {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// A certificate from another CA fails the handshake
+	untrustedCA, untrustedCAKey := buildTestCA(t)
+	cert, key = buildTestClientKeyPair(t, untrustedCA, untrustedCAKey)
+	_, err = client(tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}).Do(adminRequest("GET", base+"/admin-ping"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Shopify/goose/srvutil"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/keyclaim"
+	"github.com/gorilla/mux"
+)
+
+// NewConfigServlet registers the admin route that reports the configuration
+// the server is running with, so env wiring can be checked without a shell
+// on the box
+func NewConfigServlet(auth keyclaim.Authenticator) srvutil.Servlet {
+	return &configServlet{auth: auth}
+}
+
+type configServlet struct {
+	auth keyclaim.Authenticator
+}
+
+func (s *configServlet) RegisterRouting(r *mux.Router) {
+	r = adminRouter(prefixedRouter(r))
+	r.HandleFunc("/config", s.config).Methods(http.MethodGet)
+}
+
+// config responds with config.Export, which redacts secrets
+func (s *configServlet) config(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	hdr := r.Header.Get("Authorization")
+	region, token, ok := s.auth.RegionFromAuthHeader(hdr)
+	if !ok {
+		log(ctx, nil).WithField("header", authHeaderForLogs(hdr)).Info("bad auth header")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	js, err := json.Marshal(config.Export())
+	auditAction(r, auditActor(r, region, token), "export-config", "config", err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Cache-Control", "no-store")
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	if _, err := w.Write(js); err != nil {
+		log(ctx, err).Info("error writing response")
+	}
+}
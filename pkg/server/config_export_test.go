@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	keyclaim "github.com/cds-snc/covid-alert-server/mocks/pkg/keyclaim"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestConfigServlet(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+	auditHook, oldAuditLog := testhelpers.SetupTestLogging(&auditLog)
+	defer func() { auditLog = *oldAuditLog }()
+
+	for name, value := range map[string]string{
+		"DATABASE_URL":      "user:hunter2@tcp(db:3306)/covidshield",
+		"RETRIEVE_HMAC_KEY": "abcdef0123456789",
+		"KEY_CLAIM_TOKEN":   "goodtoken=302",
+	} {
+		old, set := os.LookupEnv(name)
+		os.Setenv(name, value)
+		defer func(name string) {
+			if set {
+				os.Setenv(name, old)
+			} else {
+				os.Unsetenv(name)
+			}
+		}(name)
+	}
+
+	auth := &keyclaim.Authenticator{}
+	auth.On("RegionFromAuthHeader", "Bearer goodtoken").Return("302", "goodtoken", true)
+	auth.On("RegionFromAuthHeader", mock.Anything).Return("", "", false)
+
+	router := Router()
+	NewConfigServlet(auth).RegisterRouting(router)
+
+	request := func(token string) *httptest.ResponseRecorder {
+		req := adminRequest("GET", "/config")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := request("")
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "bad auth header")
+
+	resp = request("goodtoken")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "no-store", resp.Header().Get("Cache-Control"))
+	assert.NotContains(t, resp.Body.String(), "hunter2")
+	assert.NotContains(t, resp.Body.String(), "abcdef0123456789")
+
+	var exported struct {
+		Constants   map[string]interface{} `json:"constants"`
+		Environment map[string]string      `json:"environment"`
+	}
+	assert.Nil(t, json.Unmarshal(resp.Body.Bytes(), &exported))
+	assert.Equal(t, config.Redacted, exported.Environment["DATABASE_URL"])
+	assert.Equal(t, config.Redacted, exported.Environment["RETRIEVE_HMAC_KEY"])
+	assert.Equal(t, config.Redacted, exported.Environment["KEY_CLAIM_TOKEN"])
+	assert.Contains(t, exported.Constants, "MaxUploadPayloadBytes")
+
+	entry := auditHook.LastEntry()
+	assert.Equal(t, "export-config", entry.Data["action"])
+	assert.Equal(t, "success", entry.Data["result"])
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/metric"
+)
+
+var connectionRejections = metric.Must(global.Meter("covidshield")).NewInt64Counter("covidshield.connections.rejected",
+	metric.WithDescription("Number of connections closed because maxConnections were already open"),
+)
+
+// connLimiter caps the number of connections a server holds open, so a flood
+// of slow or idle clients can't exhaust file descriptors. srvutil owns the
+// listener, so rather than wrapping it the limit is enforced from
+// http.Server.ConnState: a connection accepted over the limit is closed before
+// any request is read from it.
+type connLimiter struct {
+	max  int64
+	open int64
+}
+
+// newConnLimiter returns nil, meaning no limit, when max is 0 or less
+func newConnLimiter(max int) *connLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &connLimiter{max: int64(max)}
+}
+
+func (l *connLimiter) connState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		if atomic.AddInt64(&l.open, 1) > l.max {
+			connectionRejections.Add(context.Background(), 1)
+			log(nil, nil).WithField("remote_addr", conn.RemoteAddr().String()).Debug("too many open connections, closing")
+			// Closing makes the server's read fail, which reports
+			// StateClosed and gives the slot back
+			conn.Close()
+		}
+	case http.StateHijacked, http.StateClosed:
+		atomic.AddInt64(&l.open, -1)
+	}
+}
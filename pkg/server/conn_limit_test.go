@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnLimit(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	assert.Nil(t, connLimit(":8000", 0), "no limit by default")
+	assert.Equal(t, 0, len(hook.Entries))
+
+	assert.NotNil(t, connLimit(":8000", 2))
+	assert.Equal(t, 2, hook.LastEntry().Data["max_connections"])
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "limiting open connections")
+}
+
+func TestServerFactory(t *testing.T) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	server := serverFactory(":8000", 0)(http.NotFoundHandler())
+	assert.Nil(t, server.ConnState)
+	assert.Equal(t, time.Duration(0), server.ReadHeaderTimeout)
+	assert.Equal(t, time.Duration(0), server.IdleTimeout)
+
+	// Slow and idle connections can't hold the limited slots
+	server = serverFactory(":8000", 2)(http.NotFoundHandler())
+	assert.NotNil(t, server.ConnState)
+	assert.Equal(t, limitedReadHeaderTimeout, server.ReadHeaderTimeout)
+	assert.Equal(t, limitedIdleTimeout, server.IdleTimeout)
+}
+
+func TestConnLimiter(t *testing.T) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	srv.Config.ConnState = newConnLimiter(1).connState
+	srv.Start()
+	defer srv.Close()
+
+	// The first connection holds the only slot
+	first, err := net.Dial("tcp", srv.Listener.Addr().String())
+	assert.Nil(t, err)
+	defer first.Close()
+	requestOverConn(t, first, http.StatusNoContent)
+
+	// The second is closed without being served
+	second, err := net.Dial("tcp", srv.Listener.Addr().String())
+	assert.Nil(t, err)
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = second.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	// Once the first closes its slot is given back
+	first.Close()
+	assert.Eventually(t, func() bool {
+		third, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			return false
+		}
+		defer third.Close()
+		third.SetDeadline(time.Now().Add(time.Second))
+		if _, err := third.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n")); err != nil {
+			return false
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(third), nil)
+		return err == nil && resp.StatusCode == http.StatusNoContent
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func requestOverConn(t *testing.T, conn net.Conn, expected int) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+	assert.Nil(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, resp.StatusCode)
+}
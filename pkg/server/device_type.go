@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/persistence"
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+)
+
+// requestDeviceType guesses which platform sent r from its User-Agent. The
+// app doesn't identify itself explicitly, but the iOS and Android HTTP stacks
+// send recognisably different agents.
+func requestDeviceType(r *http.Request) (persistence.DeviceType, bool) {
+	ua := strings.ToLower(r.Header.Get("User-Agent"))
+	switch {
+	case strings.Contains(ua, "android"), strings.Contains(ua, "okhttp"):
+		return persistence.Android, true
+	case strings.Contains(ua, "iphone"), strings.Contains(ua, "ipad"), strings.Contains(ua, "ios"),
+		strings.Contains(ua, "cfnetwork"), strings.Contains(ua, "darwin"):
+		return persistence.IOS, true
+	}
+	return "", false
+}
+
+// deviceTypeLimit returns the value configured for deviceType in entries,
+// DEVICETYPE=N pairs, or def if there is none. Values outside [min, max] are
+// ignored with a warning.
+func deviceTypeLimit(ctx context.Context, entries []string, deviceType persistence.DeviceType, def, min, max int) int {
+	if deviceType == "" {
+		return def
+	}
+	for _, entry := range entries {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 || !strings.EqualFold(strings.TrimSpace(parts[0]), string(deviceType)) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || n < min || n > max {
+			log(ctx, err).WithField("entry", entry).Warn("ignoring invalid per-device-type upload limit")
+			continue
+		}
+		return n
+	}
+	return def
+}
+
+// uploadKeyLimits returns the minimum and maximum number of keys an upload
+// from deviceType may carry
+func uploadKeyLimits(ctx context.Context, deviceType persistence.DeviceType) (int, int) {
+	maxKeys := deviceTypeLimit(ctx, config.AppConstants.MaxKeysInUploadByDeviceType, deviceType, pb.MaxKeysInUpload, 1, pb.MaxKeysInUpload)
+	minKeys := deviceTypeLimit(ctx, config.AppConstants.MinKeysInUploadByDeviceType, deviceType, config.AppConstants.MinKeysInUpload, 1, maxKeys)
+	return minKeys, maxKeys
+}
+
+// uploadSkewLimits returns how far an upload timestamp from deviceType may be
+// behind and ahead of now, falling back to uploadMaxPastSkew and
+// uploadMaxFutureSkew
+func uploadSkewLimits(ctx context.Context, deviceType persistence.DeviceType) (time.Duration, time.Duration) {
+	past := deviceTypeLimit(ctx, config.AppConstants.UploadMaxPastSkewByDeviceType, deviceType, int(config.AppConstants.UploadMaxPastSkew), 0, math.MaxInt32)
+	future := deviceTypeLimit(ctx, config.AppConstants.UploadMaxFutureSkewByDeviceType, deviceType, int(config.AppConstants.UploadMaxFutureSkew), 0, math.MaxInt32)
+	return time.Duration(past) * time.Second, time.Duration(future) * time.Second
+}
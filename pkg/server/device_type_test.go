@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/persistence"
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/crypto/nacl/box"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestRequestDeviceType(t *testing.T) {
+	agents := map[string]persistence.DeviceType{
+		"okhttp/4.9.0": persistence.Android,
+		"Dalvik/2.1.0 (Linux; U; Android 11; Pixel)":  persistence.Android,
+		"CovidAlert/1 CFNetwork/1220.1 Darwin/20.3.0": persistence.IOS,
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 14_4)":    persistence.IOS,
+	}
+	for agent, expected := range agents {
+		req, _ := http.NewRequest("POST", "/upload", nil)
+		req.Header.Set("User-Agent", agent)
+		deviceType, ok := requestDeviceType(req)
+		assert.True(t, ok, agent)
+		assert.Equal(t, expected, deviceType, agent)
+	}
+
+	req, _ := http.NewRequest("POST", "/upload", nil)
+	req.Header.Set("User-Agent", "curl/7.64.1")
+	_, ok := requestDeviceType(req)
+	assert.False(t, ok, "unrecognised agents have no device type")
+}
+
+func TestUploadKeyLimits(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	oldMax := config.AppConstants.MaxKeysInUploadByDeviceType
+	oldMin := config.AppConstants.MinKeysInUploadByDeviceType
+	defer func() {
+		config.AppConstants.MaxKeysInUploadByDeviceType = oldMax
+		config.AppConstants.MinKeysInUploadByDeviceType = oldMin
+	}()
+	config.AppConstants.MaxKeysInUploadByDeviceType = []string{"iOS=14", "Android=40"}
+	config.AppConstants.MinKeysInUploadByDeviceType = []string{"android=2"}
+
+	minKeys, maxKeys := uploadKeyLimits(nil, persistence.IOS)
+	assert.Equal(t, config.AppConstants.MinKeysInUpload, minKeys)
+	assert.Equal(t, 14, maxKeys)
+	assert.Equal(t, 0, len(hook.Entries))
+
+	// Maximums above the protocol limit are ignored
+	minKeys, maxKeys = uploadKeyLimits(nil, persistence.Android)
+	assert.Equal(t, 2, minKeys)
+	assert.Equal(t, pb.MaxKeysInUpload, maxKeys)
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "ignoring invalid per-device-type upload limit")
+
+	// Undetected device types keep the defaults
+	minKeys, maxKeys = uploadKeyLimits(nil, "")
+	assert.Equal(t, config.AppConstants.MinKeysInUpload, minKeys)
+	assert.Equal(t, pb.MaxKeysInUpload, maxKeys)
+}
+
+func TestUpload_KeyLimitsByDeviceType(t *testing.T) {
+	hook, oldLog, db, router := setupUploadTest()
+	defer func() { log = *oldLog }()
+
+	oldMax := config.AppConstants.MaxKeysInUploadByDeviceType
+	config.AppConstants.MaxKeysInUploadByDeviceType = []string{"iOS=2", "Android=5"}
+	defer func() { config.AppConstants.MaxKeysInUploadByDeviceType = oldMax }()
+
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(1), int64(0), nil)
+
+	post := func(agent string) *httptest.ResponseRecorder {
+		var (
+			nonce [24]byte
+			msg   []byte
+		)
+		io.ReadFull(rand.Reader, nonce[:])
+		upload := buildUpload(3, timestamppb.Timestamp{Seconds: time.Now().Unix()})
+		marshalledUpload, _ := proto.Marshal(upload)
+		encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
+
+		payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
+		req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+		req.Header.Set("User-Agent", agent)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Over the iOS limit
+	resp := post("CovidAlert/1 CFNetwork/1220.1 Darwin/20.3.0")
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_TOO_MANY_KEYS))
+	db.AssertNotCalled(t, "StoreKeys", mock.Anything, mock.Anything, mock.Anything)
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "too many keys provided")
+
+	// Within the Android limit
+	resp = post("okhttp/4.9.0")
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_NONE))
+}
+
+func TestUploadSkewLimits(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	oldPast := config.AppConstants.UploadMaxPastSkewByDeviceType
+	oldFuture := config.AppConstants.UploadMaxFutureSkewByDeviceType
+	defer func() {
+		config.AppConstants.UploadMaxPastSkewByDeviceType = oldPast
+		config.AppConstants.UploadMaxFutureSkewByDeviceType = oldFuture
+	}()
+	config.AppConstants.UploadMaxPastSkewByDeviceType = []string{"iOS=300", "Android=-1"}
+	config.AppConstants.UploadMaxFutureSkewByDeviceType = []string{"ios=60", "Android=7200"}
+
+	global := func(s uint32) time.Duration { return time.Duration(s) * time.Second }
+
+	past, future := uploadSkewLimits(nil, persistence.IOS)
+	assert.Equal(t, 300*time.Second, past)
+	assert.Equal(t, 60*time.Second, future)
+	assert.Equal(t, 0, len(hook.Entries))
+
+	// Negative skews are ignored
+	past, future = uploadSkewLimits(nil, persistence.Android)
+	assert.Equal(t, global(config.AppConstants.UploadMaxPastSkew), past)
+	assert.Equal(t, 7200*time.Second, future)
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "ignoring invalid per-device-type upload limit")
+
+	// Undetected device types keep the global tolerance
+	past, future = uploadSkewLimits(nil, "")
+	assert.Equal(t, global(config.AppConstants.UploadMaxPastSkew), past)
+	assert.Equal(t, global(config.AppConstants.UploadMaxFutureSkew), future)
+}
+
+func TestUpload_SkewByDeviceType(t *testing.T) {
+	hook, oldLog, db, router := setupUploadTest()
+	defer func() { log = *oldLog }()
+
+	oldFuture := config.AppConstants.UploadMaxFutureSkewByDeviceType
+	config.AppConstants.UploadMaxFutureSkewByDeviceType = []string{"iOS=300"}
+	defer func() { config.AppConstants.UploadMaxFutureSkewByDeviceType = oldFuture }()
+
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(1), int64(0), nil)
+
+	// Ten minutes ahead: past the iOS tolerance, within the global one
+	post := func(agent string) *httptest.ResponseRecorder {
+		var (
+			nonce [24]byte
+			msg   []byte
+		)
+		io.ReadFull(rand.Reader, nonce[:])
+		upload := buildUpload(3, timestamppb.Timestamp{Seconds: time.Now().Add(10 * time.Minute).Unix()})
+		marshalledUpload, _ := proto.Marshal(upload)
+		encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
+
+		payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
+		req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+		req.Header.Set("User-Agent", agent)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := post("CovidAlert/1 CFNetwork/1220.1 Darwin/20.3.0")
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_TIMESTAMP))
+	db.AssertNotCalled(t, "StoreKeys", mock.Anything, mock.Anything, mock.Anything)
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "invalid timestamp")
+
+	resp = post("okhttp/4.9.0")
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_NONE))
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/Shopify/goose/srvutil"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/keyclaim"
+	"github.com/cds-snc/covid-alert-server/pkg/persistence"
+	"github.com/gorilla/mux"
+)
+
+var (
+	errInvalidRetentionDays = errors.New("invalid retentionDays")
+	errNoRegion             = errors.New("token has no region")
+)
+
+// NewKeyCleanupServlet registers the admin route that runs the expiration
+// worker's diagnosis key cleanup on demand, for the caller's region only
+func NewKeyCleanupServlet(db persistence.Conn, auth keyclaim.Authenticator) srvutil.Servlet {
+	return &keyCleanupServlet{db: db, auth: auth}
+}
+
+type keyCleanupServlet struct {
+	db   persistence.Conn
+	auth keyclaim.Authenticator
+}
+
+type keyCleanupResult struct {
+	Deleted int64 `json:"deleted"`
+}
+
+func (s *keyCleanupServlet) RegisterRouting(r *mux.Router) {
+	r = adminRouter(prefixedRouter(r))
+	r.HandleFunc("/cleanup/diagnosis-keys", s.cleanup).Methods(http.MethodPost)
+}
+
+// cleanup deletes the caller's region's diagnosis keys past its configured
+// retention, or past the retentionDays query parameter if given, and responds
+// with how many were deleted. retentionDays can only keep keys longer than
+// configured, never delete ones the region would still serve.
+func (s *keyCleanupServlet) cleanup(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	hdr := r.Header.Get("Authorization")
+	region, token, ok := s.auth.RegionFromAuthHeader(hdr)
+	if !ok {
+		log(ctx, nil).WithField("header", authHeaderForLogs(hdr)).Info("bad auth header")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	actor := auditActor(r, region, token)
+
+	if region == "" || region == config.AppConstants.RegionCode {
+		auditAction(r, actor, "cleanup-diagnosis-keys", "region", errNoRegion)
+		http.Error(w, "token has no region", http.StatusForbidden)
+		return
+	}
+
+	days := persistence.RegionRetentionDays(region)
+	target := region + " configured retention"
+	if v := r.URL.Query().Get("retentionDays"); v != "" {
+		target = region + " retentionDays=" + v
+		override, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || override < uint64(days) {
+			auditAction(r, actor, "cleanup-diagnosis-keys", target, errInvalidRetentionDays)
+			http.Error(w, "invalid retentionDays", http.StatusBadRequest)
+			return
+		}
+		days = uint32(override)
+	}
+
+	deleted, err := s.db.DeleteDiagnosisKeysOlderThan(ctx, region, days)
+	auditAction(r, actor, "cleanup-diagnosis-keys", target, err)
+	if err != nil {
+		log(ctx, err).Error("failed to delete old diagnosis keys")
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	log(ctx, nil).WithField("count", deleted).Info("deleted old diagnosis keys")
+
+	js, err := json.Marshal(keyCleanupResult{Deleted: deleted})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Cache-Control", "no-store")
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	if _, err := w.Write(js); err != nil {
+		log(ctx, err).Info("error writing response")
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	keyclaim "github.com/cds-snc/covid-alert-server/mocks/pkg/keyclaim"
+	persistence "github.com/cds-snc/covid-alert-server/mocks/pkg/persistence"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func setupKeyCleanupRouter(db *persistence.Conn) http.Handler {
+	auth := &keyclaim.Authenticator{}
+	auth.On("RegionFromAuthHeader", "Bearer goodtoken").Return("ONApi", "goodtoken", true)
+	auth.On("RegionFromAuthHeader", mock.Anything).Return("", "", false)
+
+	router := Router()
+	NewKeyCleanupServlet(db, auth).RegisterRouting(router)
+	return router
+}
+
+func keyCleanupRequest(router http.Handler, query, token string) *httptest.ResponseRecorder {
+	req := adminRequest("POST", "/cleanup/diagnosis-keys"+query)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestKeyCleanup(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+	auditHook, oldAuditLog := testhelpers.SetupTestLogging(&auditLog)
+	defer func() { auditLog = *oldAuditLog }()
+
+	oldRetention := config.AppConstants.DiagnosisKeyRetentionDaysByRegion
+	config.AppConstants.DiagnosisKeyRetentionDaysByRegion = []string{"ONApi=20"}
+	defer func() { config.AppConstants.DiagnosisKeyRetentionDaysByRegion = oldRetention }()
+
+	db := &persistence.Conn{}
+	db.On("DeleteDiagnosisKeysOlderThan", mock.Anything, "ONApi", uint32(20)).Return(int64(12), nil)
+	db.On("DeleteDiagnosisKeysOlderThan", mock.Anything, "ONApi", uint32(30)).Return(int64(40), nil)
+	router := setupKeyCleanupRouter(db)
+
+	// The region's configured retention
+	resp := keyCleanupRequest(router, "", "goodtoken")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "no-store", resp.Header().Get("Cache-Control"))
+	assert.JSONEq(t, `{"deleted":12}`, resp.Body.String())
+	db.AssertCalled(t, "DeleteDiagnosisKeysOlderThan", mock.Anything, "ONApi", uint32(20))
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "deleted old diagnosis keys")
+
+	entry := auditHook.LastEntry()
+	assert.Equal(t, "token:ONApi", entry.Data["actor"])
+	assert.Equal(t, "cleanup-diagnosis-keys", entry.Data["action"])
+	assert.Equal(t, "ONApi configured retention", entry.Data["target"])
+	assert.Equal(t, "success", entry.Data["result"])
+	testhelpers.AssertLog(t, auditHook, 1, logrus.InfoLevel, "admin action")
+
+	// A longer retention
+	resp = keyCleanupRequest(router, "?retentionDays=30", "goodtoken")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.JSONEq(t, `{"deleted":40}`, resp.Body.String())
+	assert.Equal(t, "ONApi retentionDays=30", auditHook.LastEntry().Data["target"])
+	db.AssertNotCalled(t, "DeleteOldDiagnosisKeys")
+}
+
+func TestKeyCleanup_Rejected(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+	auditHook, oldAuditLog := testhelpers.SetupTestLogging(&auditLog)
+	defer func() { auditLog = *oldAuditLog }()
+
+	db := &persistence.Conn{}
+	auth := &keyclaim.Authenticator{}
+	auth.On("RegionFromAuthHeader", "Bearer goodtoken").Return("ONApi", "goodtoken", true)
+	auth.On("RegionFromAuthHeader", "Bearer unmappedtoken").Return("302", "unmappedtoken", true)
+	auth.On("RegionFromAuthHeader", mock.Anything).Return("", "", false)
+	router := Router()
+	NewKeyCleanupServlet(db, auth).RegisterRouting(router)
+
+	resp := keyCleanupRequest(router, "", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "bad auth header")
+
+	// A health authority token alone isn't enough
+	req, _ := http.NewRequest("POST", "/cleanup/diagnosis-keys", nil)
+	req.Header.Set("Authorization", "Bearer goodtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "bad admin token")
+
+	// Nor is a token without a region to limit the delete to
+	resp = keyCleanupRequest(router, "", "unmappedtoken")
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Equal(t, "failure", auditHook.LastEntry().Data["result"])
+
+	// Nothing the region would still serve can be deleted
+	retention := config.AppConstants.MaxDiagnosisKeyRetentionDays
+	for _, query := range []string{
+		"?retentionDays=0", "?retentionDays=1", fmt.Sprintf("?retentionDays=%d", retention-1),
+		"?retentionDays=-1", "?retentionDays=ten",
+	} {
+		resp = keyCleanupRequest(router, query, "goodtoken")
+		assert.Equal(t, http.StatusBadRequest, resp.Code, query)
+		assert.Equal(t, "failure", auditHook.LastEntry().Data["result"])
+	}
+	db.AssertNotCalled(t, "DeleteOldDiagnosisKeys")
+	db.AssertNotCalled(t, "DeleteDiagnosisKeysOlderThan", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestKeyCleanup_DeleteFails(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+	_, oldAuditLog := testhelpers.SetupTestLogging(&auditLog)
+	defer func() { auditLog = *oldAuditLog }()
+
+	db := &persistence.Conn{}
+	db.On("DeleteDiagnosisKeysOlderThan", mock.Anything, "ONApi", mock.Anything).Return(int64(0), fmt.Errorf("db error"))
+	router := setupKeyCleanupRouter(db)
+
+	resp := keyCleanupRequest(router, "", "goodtoken")
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	testhelpers.AssertLog(t, hook, 1, logrus.ErrorLevel, "failed to delete old diagnosis keys")
+}
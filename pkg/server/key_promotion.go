@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/Shopify/goose/srvutil"
+	"github.com/cds-snc/covid-alert-server/pkg/keyclaim"
+	"github.com/cds-snc/covid-alert-server/pkg/persistence"
+	"github.com/gorilla/mux"
+)
+
+// NewKeyPromotionServlet registers the admin route a health authority uses to
+// make the keys a diagnosed user uploaded retrievable once it has confirmed
+// them, for when requireKeyPromotion is set. Keys are stored under
+// regionCode, so they're scoped to the health authority by the bearer token
+// their one time code was issued with rather than by region.
+func NewKeyPromotionServlet(db persistence.Conn, auth keyclaim.Authenticator) srvutil.Servlet {
+	return &keyPromotionServlet{db: db, auth: auth}
+}
+
+type keyPromotionServlet struct {
+	db   persistence.Conn
+	auth keyclaim.Authenticator
+}
+
+type keyPromotionResult struct {
+	Promoted int64 `json:"promoted"`
+}
+
+func (s *keyPromotionServlet) RegisterRouting(r *mux.Router) {
+	r = adminRouter(prefixedRouter(r))
+	r.HandleFunc("/promote-keys/{appPublicKey:[0-9a-fA-F]{64}}", s.promote).Methods(http.MethodPost)
+}
+
+// promote makes the pending keys uploaded with the hex-encoded app public key
+// in the path retrievable, if their one time code was issued with the
+// caller's bearer token, and responds with how many were promoted
+func (s *keyPromotionServlet) promote(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	hdr := r.Header.Get("Authorization")
+	region, token, ok := s.auth.RegionFromAuthHeader(hdr)
+	if !ok {
+		log(ctx, nil).WithField("header", authHeaderForLogs(hdr)).Info("bad auth header")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	actor := auditActor(r, region, token)
+
+	// The route only matches 64 hex digits, so this can't fail
+	target := strings.ToLower(mux.Vars(r)["appPublicKey"])
+	var appPubKey [32]byte
+	hex.Decode(appPubKey[:], []byte(target))
+
+	promoted, err := s.db.PromoteKeys(ctx, token, &appPubKey)
+	auditAction(r, actor, "promote-keys", target, err)
+	if err != nil {
+		log(ctx, err).Error("failed to promote keys")
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	log(ctx, nil).WithField("count", promoted).Info("promoted keys")
+
+	js, err := json.Marshal(keyPromotionResult{Promoted: promoted})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Cache-Control", "no-store")
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	if _, err := w.Write(js); err != nil {
+		log(ctx, err).Info("error writing response")
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	keyclaim "github.com/cds-snc/covid-alert-server/mocks/pkg/keyclaim"
+	persistence "github.com/cds-snc/covid-alert-server/mocks/pkg/persistence"
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func setupKeyPromotionRouter(db *persistence.Conn) http.Handler {
+	auth := &keyclaim.Authenticator{}
+	auth.On("RegionFromAuthHeader", "Bearer goodtoken").Return("ONApi", "goodtoken", true)
+	auth.On("RegionFromAuthHeader", mock.Anything).Return("", "", false)
+
+	router := Router()
+	NewKeyPromotionServlet(db, auth).RegisterRouting(router)
+	return router
+}
+
+func keyPromotionRequest(router http.Handler, appPubKey, token string) *httptest.ResponseRecorder {
+	req := adminRequest("POST", "/promote-keys/"+appPubKey)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestKeyPromotion(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+	auditHook, oldAuditLog := testhelpers.SetupTestLogging(&auditLog)
+	defer func() { auditLog = *oldAuditLog }()
+
+	pub := [32]byte{0xab, 0x01}
+	db := &persistence.Conn{}
+	db.On("PromoteKeys", mock.Anything, "goodtoken", &pub).Return(int64(3), nil)
+	router := setupKeyPromotionRouter(db)
+
+	resp := keyPromotionRequest(router, fmt.Sprintf("%x", pub), "goodtoken")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "no-store", resp.Header().Get("Cache-Control"))
+	assert.JSONEq(t, `{"promoted":3}`, resp.Body.String())
+	db.AssertCalled(t, "PromoteKeys", mock.Anything, "goodtoken", &pub)
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "promoted keys")
+
+	entry := auditHook.LastEntry()
+	assert.Equal(t, "token:ONApi", entry.Data["actor"])
+	assert.Equal(t, "promote-keys", entry.Data["action"])
+	assert.Equal(t, fmt.Sprintf("%x", pub), entry.Data["target"])
+	assert.Equal(t, "success", entry.Data["result"])
+
+	// Upper case hex is the same key
+	resp = keyPromotionRequest(router, strings.ToUpper(fmt.Sprintf("%x", pub)), "goodtoken")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	db.AssertNumberOfCalls(t, "PromoteKeys", 2)
+}
+
+func TestKeyPromotion_Rejected(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+	_, oldAuditLog := testhelpers.SetupTestLogging(&auditLog)
+	defer func() { auditLog = *oldAuditLog }()
+
+	db := &persistence.Conn{}
+	router := setupKeyPromotionRouter(db)
+	key := strings.Repeat("ab", 32)
+
+	resp := keyPromotionRequest(router, key, "")
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "bad auth header")
+
+	// A health authority token alone isn't enough
+	req, _ := http.NewRequest("POST", "/promote-keys/"+key, nil)
+	req.Header.Set("Authorization", "Bearer goodtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "bad admin token")
+
+	// Only a whole app public key is accepted
+	for _, bad := range []string{key[:62], key + "ab", strings.Repeat("zz", 32)} {
+		resp = keyPromotionRequest(router, bad, "goodtoken")
+		assert.Equal(t, http.StatusNotFound, resp.Code, bad)
+	}
+	db.AssertNotCalled(t, "PromoteKeys", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestKeyPromotion_PromoteFails(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+	_, oldAuditLog := testhelpers.SetupTestLogging(&auditLog)
+	defer func() { auditLog = *oldAuditLog }()
+
+	db := &persistence.Conn{}
+	db.On("PromoteKeys", mock.Anything, "goodtoken", mock.Anything).Return(int64(0), fmt.Errorf("db error"))
+	router := setupKeyPromotionRouter(db)
+
+	resp := keyPromotionRequest(router, strings.Repeat("ab", 32), "goodtoken")
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	testhelpers.AssertLog(t, hook, 1, logrus.ErrorLevel, "failed to promote keys")
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/json"
 	"github.com/cds-snc/covid-alert-server/pkg/config"
 	"github.com/cds-snc/covid-alert-server/pkg/keyclaim"
 	"github.com/cds-snc/covid-alert-server/pkg/persistence"
@@ -28,9 +29,49 @@ type keyClaimServlet struct {
 // POST /new-key-claim
 
 func (s *keyClaimServlet) RegisterRouting(r *mux.Router) {
+	r = prefixedRouter(r)
 	r.HandleFunc("/new-key-claim", s.newKeyClaim)
 	r.HandleFunc("/new-key-claim/{hashID:[0-9,a-z]{128}}", s.newKeyClaim)
 	r.HandleFunc("/claim-key", s.claimKeyWrapper)
+	r.HandleFunc("/verify-token", s.verifyToken).Methods(http.MethodGet)
+}
+
+type tokenRegion struct {
+	Region string `json:"region"`
+	// Mapped is false for tokens that are valid but were never assigned a PT
+	// and so report the Canada-wide "302"
+	Mapped bool `json:"mapped"`
+}
+
+// verifyToken reports the region the bearer token resolves to, so tooling
+// can check a newly issued token without claiming a key with it
+func (s *keyClaimServlet) verifyToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	region, token, ok := s.auth.RegionFromAuthHeader(r.Header.Get("Authorization"))
+	if !ok {
+		log(ctx, nil).Info("bad auth header")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	resp := tokenRegion{Region: region, Mapped: region != "302"}
+	log(ctx, nil).WithFields(map[string]interface{}{
+		"originator": persistence.TokenForLogs(token),
+		"mapped":     resp.Mapped,
+	}).Info("verified bearer token")
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Cache-Control", "no-store")
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	if _, err := w.Write(js); err != nil {
+		log(ctx, err).Info("error writing response")
+	}
 }
 
 func (s *keyClaimServlet) newKeyClaim(w http.ResponseWriter, r *http.Request) {
@@ -56,7 +97,7 @@ func (s *keyClaimServlet) newKeyClaim(w http.ResponseWriter, r *http.Request) {
 	hdr := r.Header.Get("Authorization")
 	region, originator, ok := s.auth.RegionFromAuthHeader(hdr)
 	if !ok {
-		log(ctx, nil).WithField("header", hdr).Info("bad auth header")
+		log(ctx, nil).WithField("header", authHeaderForLogs(hdr)).Info("bad auth header")
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -155,6 +196,11 @@ func (s *keyClaimServlet) claimKey(w http.ResponseWriter, r *http.Request) resul
 			ctx, w, err, "duplicate key",
 			http.StatusUnauthorized, kcrError(pb.KeyClaimResponse_INVALID_KEY, triesRemaining),
 		)
+	} else if err == persistence.ErrTooManyAppKeys {
+		return requestError(
+			ctx, w, err, "originator app key cap exceeded",
+			http.StatusTooManyRequests, kcrError(pb.KeyClaimResponse_TEMPORARY_BAN, triesRemaining),
+		)
 	} else if err == persistence.ErrInvalidOneTimeCode {
 		triesRemaining, banDuration, err := s.db.ClaimKeyFailure(ip)
 		if err != nil {
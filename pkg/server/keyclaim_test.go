@@ -50,6 +50,7 @@ func TestRegisterRoutingKeyClaim(t *testing.T) {
 	assert.Contains(t, expectedPaths, "/new-key-claim", "should include a /new-key-claim path")
 	assert.Contains(t, expectedPaths, "/new-key-claim/{hashID:[0-9,a-z]{128}}", "should include a /new-key-claim/{hashID:[0-9,a-z]{128}} path")
 	assert.Contains(t, expectedPaths, "/claim-key", "should include a claim-key path")
+	assert.Contains(t, expectedPaths, "/verify-token", "should include a verify-token path")
 }
 
 func TestCORS(t *testing.T) {
@@ -123,6 +124,46 @@ func TestBadAuthToken(t *testing.T) {
 	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "bad auth header")
 }
 
+func TestVerifyToken(t *testing.T) {
+
+	auth := &keyclaim.Authenticator{}
+	auth.On("RegionFromAuthHeader", "Bearer goodtoken").Return("ONApi", "goodtoken", true)
+	auth.On("RegionFromAuthHeader", "Bearer unmappedtoken").Return("302", "unmappedtoken", true)
+	auth.On("RegionFromAuthHeader", "Bearer badtoken").Return("", "", false)
+
+	db := &persistence.Conn{}
+	router := buildNewKeyClaimServletRouter(db, auth)
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	verify := func(token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/verify-token", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Known token
+	resp := verify("goodtoken")
+	assert.Equal(t, 200, resp.Code, "OK response is expected")
+	assert.JSONEq(t, `{"region":"ONApi","mapped":true}`, resp.Body.String())
+	assert.Equal(t, "g...n", hook.LastEntry().Data["originator"], "token should be redacted")
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "verified bearer token")
+
+	// Valid but never mapped to a PT
+	resp = verify("unmappedtoken")
+	assert.Equal(t, 200, resp.Code, "OK response is expected")
+	assert.JSONEq(t, `{"region":"302","mapped":false}`, resp.Body.String())
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "verified bearer token")
+
+	// Unknown token
+	resp = verify("badtoken")
+	assert.Equal(t, 401, resp.Code, "Unauthorized response is expected")
+	assert.NotContains(t, fmt.Sprint(hook.LastEntry().Data), "badtoken", "token should not be logged")
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "bad auth header")
+}
+
 func TestGoodAuthToken_NoHashID(t *testing.T) {
 
 	db := &persistence.Conn{}
@@ -316,6 +357,7 @@ func TestClaimKey(t *testing.T) {
 	db.On("ClaimKey", "CCCCCCCCCC", appPub[:], mock.Anything).Return(nil, err.ErrDuplicateKey)
 	db.On("ClaimKey", "DDDDDDDDDD", appPub[:], mock.Anything).Return(nil, err.ErrInvalidOneTimeCode)
 	db.On("ClaimKey", "EEEEEEEEEE", appPub[:], mock.Anything).Return(nil, fmt.Errorf("Generic Error"))
+	db.On("ClaimKey", "FFFFFFFFFF", appPub[:], mock.Anything).Return(nil, err.ErrTooManyAppKeys)
 
 	// Mock failure log
 	db.On("ClaimKeyFailure", "3.3.3.3").Return(triesRemaining-1, banDuration, nil)
@@ -428,6 +470,22 @@ func TestClaimKey(t *testing.T) {
 
 	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "duplicate key")
 
+	// Originator over its daily app key cap
+	code = "FFFFFFFFFF"
+	upload = buildKeyClaimRequest(&code, appPub[:])
+	marshalledUpload, _ = proto.Marshal(upload)
+
+	req, _ = http.NewRequest("POST", "/claim-key", bytes.NewReader(marshalledUpload))
+	req.Header.Set("X-FORWARDED-FOR", "3.3.3.3")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 429, resp.Code, "Too many requests response is expected")
+	assert.True(t, checkClaimKeyResponseError(resp.Body.Bytes(), pb.KeyClaimResponse_TEMPORARY_BAN))
+	assert.True(t, checkClaimKeyResponseTriesRemaining(resp.Body.Bytes(), uint32(triesRemaining)))
+
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "originator app key cap exceeded")
+
 	// Invalid one time code
 	code = "DDDDDDDDDD"
 	upload = buildKeyClaimRequest(&code, appPub[:])
@@ -3,12 +3,30 @@ package server
 import (
 	"github.com/cds-snc/covid-alert-server/pkg/config"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/exporters/metric/prometheus"
+	"go.opentelemetry.io/otel/sdk/metric/controller/pull"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 )
 
+// testAdminToken is ADMIN_TOKEN for every test, see adminRequest
+const testAdminToken = "admintoken"
+
+// adminRequest is http.NewRequest with the admin token admin routes require
+func adminRequest(method, url string) *http.Request {
+	req, _ := http.NewRequest(method, url, nil)
+	req.Header.Set(adminTokenHeader, testAdminToken)
+	return req
+}
+
 func Router() *mux.Router {
 	router := mux.NewRouter()
+	setRouterDefaults(router)
 	return router
 }
 
@@ -17,7 +35,8 @@ func GetPaths(router *mux.Router) []string {
 	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
 		path, err := route.GetPathTemplate()
 		if err != nil {
-			return err
+			// subrouters without a path of their own, like adminRouter's
+			return nil
 		}
 		paths = append(paths, path)
 		return nil
@@ -25,12 +44,53 @@ func GetPaths(router *mux.Router) []string {
 	return paths
 }
 
+var (
+	testMeterOnce     sync.Once
+	testMeterExporter *prometheus.Exporter
+)
+
+// ScrapeMetrics installs a prometheus pipeline as the global meter provider
+// (once per test run, since it can only be delegated to once) and returns the
+// current exposition text
+func ScrapeMetrics() string {
+	testMeterOnce.Do(func() {
+		exporter, err := prometheus.InstallNewPipeline(prometheus.Config{}, pull.WithCachePeriod(0))
+		if err != nil {
+			panic(err)
+		}
+		testMeterExporter = exporter
+	})
+
+	resp := httptest.NewRecorder()
+	testMeterExporter.ServeHTTP(resp, httptest.NewRequest("GET", "/metrics", nil))
+	return resp.Body.String()
+}
+
+// metricValue returns the value of the first sample in the exposition text whose
+// name and labels start with prefix, or 0 if there is none
+func metricValue(exposition, prefix string) float64 {
+	for _, line := range strings.Split(exposition, "\n") {
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		fields := strings.Fields(line)
+		value, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+		if err != nil {
+			return 0
+		}
+		return value
+	}
+	return 0
+}
+
 // TestMain this gets called instead of the regular testing main method and allows us to run setup code
 func TestMain(m *testing.M) {
 
 	// We need to run init config before any of the server tests
 	config.InitConfig()
+	ScrapeMetrics()
 	os.Setenv("METRICS_USERNAME", "foo")
 	os.Setenv("METRICS_PASSWORD", "bar")
+	os.Setenv("ADMIN_TOKEN", testAdminToken)
 	os.Exit(m.Run())
 }
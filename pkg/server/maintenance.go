@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Shopify/goose/srvutil"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/keyclaim"
+	"github.com/cds-snc/covid-alert-server/pkg/persistence"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/metric"
+)
+
+var maintenanceRejections = metric.Must(global.Meter("covidshield")).NewInt64Counter("covidshield.maintenance.rejections",
+	metric.WithDescription("Number of requests turned away while in maintenance mode"),
+)
+
+// maintenanceCacheTTL is how long a read of maintenance mode is reused, so
+// checking it doesn't cost a query per request. Toggling it reaches every
+// replica within this long.
+const maintenanceCacheTTL = 5 * time.Second
+
+// maintenanceMode reads and sets maintenance mode, which is kept in the
+// database so every replica agrees and a restart doesn't clear it. While it is
+// on uploads are rejected with a 503 and MAINTENANCE, and retrieves too if
+// maintenanceBlocksRetrieve is set.
+type maintenanceMode struct {
+	db persistence.Conn
+
+	mu      sync.Mutex
+	on      bool
+	checked time.Time
+}
+
+func newMaintenanceMode(db persistence.Conn) *maintenanceMode {
+	return &maintenanceMode{db: db, on: config.AppConstants.MaintenanceMode}
+}
+
+// enabled reports whether maintenance mode is on. If it can't be read the last
+// known state is kept until the next check.
+func (m *maintenanceMode) enabled(ctx context.Context) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.checked.IsZero() && time.Since(m.checked) < maintenanceCacheTTL {
+		return m.on
+	}
+	m.checked = time.Now()
+
+	on, err := m.db.MaintenanceMode(ctx)
+	if err != nil {
+		log(ctx, err).Warn("unable to read maintenance mode")
+		return m.on
+	}
+	m.on = on
+	return on
+}
+
+// set turns maintenance mode on or off for every replica. It can't be turned
+// off while maintenanceMode is set in the config, which always wins.
+func (m *maintenanceMode) set(ctx context.Context, on bool) error {
+	if err := m.db.SetMaintenanceMode(ctx, on); err != nil {
+		return err
+	}
+
+	forced := config.AppConstants.MaintenanceMode
+	m.mu.Lock()
+	m.on, m.checked = on || forced, time.Now()
+	m.mu.Unlock()
+
+	switch {
+	case on:
+		log(ctx, nil).Warn("maintenance mode enabled")
+	case forced:
+		log(ctx, nil).Warn("maintenance mode still enabled by config")
+	default:
+		log(ctx, nil).Warn("maintenance mode disabled")
+	}
+	return nil
+}
+
+// setRetryAfter tells the client when to try again after a maintenance
+// rejection and counts the rejection
+func setRetryAfter(ctx context.Context, w http.ResponseWriter, endpoint string) {
+	maintenanceRejections.Add(ctx, 1, kv.String("endpoint", endpoint))
+	if seconds := config.AppConstants.MaintenanceRetryAfterSeconds; seconds > 0 {
+		w.Header().Set("Retry-After", strconv.FormatUint(uint64(seconds), 10))
+	}
+}
+
+// NewMaintenanceServlet registers the admin routes that toggle maintenance
+// mode
+func NewMaintenanceServlet(db persistence.Conn, auth keyclaim.Authenticator) srvutil.Servlet {
+	return &maintenanceServlet{auth: auth, maintenance: newMaintenanceMode(db)}
+}
+
+type maintenanceServlet struct {
+	auth        keyclaim.Authenticator
+	maintenance *maintenanceMode
+}
+
+func (m *maintenanceServlet) RegisterRouting(r *mux.Router) {
+	r = adminRouter(prefixedRouter(r))
+	r.HandleFunc("/maintenance", m.handle).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
+}
+
+// handle reports the current mode on GET, enables it on PUT and disables it
+// on DELETE
+func (m *maintenanceServlet) handle(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	hdr := r.Header.Get("Authorization")
+	region, token, ok := m.auth.RegionFromAuthHeader(hdr)
+	if !ok {
+		log(ctx, nil).WithField("header", authHeaderForLogs(hdr)).Info("bad auth header")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		err = m.maintenance.set(ctx, true)
+		auditAction(r, auditActor(r, region, token), "enable-maintenance", "uploads", err)
+	case http.MethodDelete:
+		err = m.maintenance.set(ctx, false)
+		auditAction(r, auditActor(r, region, token), "disable-maintenance", "uploads", err)
+	}
+	if err != nil {
+		log(ctx, err).Error("failed to set maintenance mode")
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Cache-Control", "no-store")
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	body := "off\n"
+	if m.maintenance.enabled(ctx) {
+		body = "on\n"
+	}
+	if _, err := w.Write([]byte(body)); err != nil {
+		log(ctx, err).Info("error writing response")
+	}
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	keyclaim "github.com/cds-snc/covid-alert-server/mocks/pkg/keyclaim"
+	persistence "github.com/cds-snc/covid-alert-server/mocks/pkg/persistence"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/cds-snc/covid-alert-server/pkg/timemath"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestMaintenanceServlet(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	auth := &keyclaim.Authenticator{}
+	auth.On("RegionFromAuthHeader", "Bearer goodtoken").Return("302", "goodtoken", true)
+	auth.On("RegionFromAuthHeader", "").Return("", "", false)
+
+	db := &persistence.Conn{}
+	db.On("MaintenanceMode", mock.Anything).Return(false, nil).Once()
+	db.On("SetMaintenanceMode", mock.Anything, true).Return(nil)
+	db.On("SetMaintenanceMode", mock.Anything, false).Return(nil)
+
+	router := Router()
+	NewMaintenanceServlet(db, auth).RegisterRouting(router)
+
+	request := func(method, token string) *httptest.ResponseRecorder {
+		req := adminRequest(method, "/maintenance")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Unauthorized
+	resp := request("PUT", "")
+	assert.Equal(t, 401, resp.Code)
+	db.AssertNotCalled(t, "SetMaintenanceMode", mock.Anything, mock.Anything)
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "bad auth header")
+
+	// Read from the database
+	resp = request("GET", "goodtoken")
+	assert.Equal(t, "off\n", resp.Body.String())
+
+	// Enable
+	resp = request("PUT", "goodtoken")
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, "on\n", resp.Body.String())
+	db.AssertCalled(t, "SetMaintenanceMode", mock.Anything, true)
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "maintenance mode enabled")
+
+	resp = request("GET", "goodtoken")
+	assert.Equal(t, "on\n", resp.Body.String())
+
+	// Disable
+	resp = request("DELETE", "goodtoken")
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, "off\n", resp.Body.String())
+	db.AssertCalled(t, "SetMaintenanceMode", mock.Anything, false)
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "maintenance mode disabled")
+}
+
+func TestMaintenanceServlet_ForcedByConfig(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	config.AppConstants.MaintenanceMode = true
+	defer func() { config.AppConstants.MaintenanceMode = false }()
+
+	auth := &keyclaim.Authenticator{}
+	auth.On("RegionFromAuthHeader", "Bearer goodtoken").Return("302", "goodtoken", true)
+
+	db := &persistence.Conn{}
+	db.On("SetMaintenanceMode", mock.Anything, false).Return(nil)
+
+	router := Router()
+	NewMaintenanceServlet(db, auth).RegisterRouting(router)
+
+	// The config wins over the admin route
+	req := adminRequest("DELETE", "/maintenance")
+	req.Header.Set("Authorization", "Bearer goodtoken")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, "on\n", resp.Body.String())
+	db.AssertCalled(t, "SetMaintenanceMode", mock.Anything, false)
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "maintenance mode still enabled by config")
+}
+
+func TestMaintenanceServlet_SetFails(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+	_, oldAuditLog := testhelpers.SetupTestLogging(&auditLog)
+	defer func() { auditLog = *oldAuditLog }()
+
+	auth := &keyclaim.Authenticator{}
+	auth.On("RegionFromAuthHeader", "Bearer goodtoken").Return("302", "goodtoken", true)
+
+	db := &persistence.Conn{}
+	db.On("SetMaintenanceMode", mock.Anything, true).Return(fmt.Errorf("db error"))
+
+	router := Router()
+	NewMaintenanceServlet(db, auth).RegisterRouting(router)
+
+	req := adminRequest("PUT", "/maintenance")
+	req.Header.Set("Authorization", "Bearer goodtoken")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 500, resp.Code)
+	testhelpers.AssertLog(t, hook, 1, logrus.ErrorLevel, "failed to set maintenance mode")
+}
+
+func TestMaintenanceMode_SharedAndCached(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db := &persistence.Conn{}
+	db.On("MaintenanceMode", mock.Anything).Return(true, nil).Once()
+	db.On("MaintenanceMode", mock.Anything).Return(false, fmt.Errorf("db error"))
+
+	// Another replica's toggle is read from the database, and reused
+	m := newMaintenanceMode(db)
+	assert.True(t, m.enabled(context.Background()))
+	assert.True(t, m.enabled(context.Background()))
+	db.AssertNumberOfCalls(t, "MaintenanceMode", 1)
+
+	// Failed reads keep the last known state
+	m.checked = time.Now().Add(-maintenanceCacheTTL)
+	assert.True(t, m.enabled(context.Background()))
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "unable to read maintenance mode")
+}
+
+func TestUpload_Maintenance(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db := &persistence.Conn{}
+	db.On("MaintenanceMode", mock.Anything).Return(true, nil)
+	router := setupUploadRouter(db)
+
+	req, _ := http.NewRequest("POST", "/upload", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 503, resp.Code, "503 response is expected")
+	assert.Equal(t, "300", resp.Header().Get("Retry-After"))
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_MAINTENANCE))
+
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "upload rejected during maintenance")
+}
+
+func TestRetrieve_Maintenance(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	hook.Reset()
+
+	db, auth, signer := setupRetrieveMockers()
+	db.On("MaintenanceMode", mock.Anything).Return(true, nil)
+	router := setupRetrieveRouter(db, auth, signer)
+
+	yesterdaysDate := fmt.Sprint(timemath.CurrentDateNumber() - 1)
+	auth.On("Authenticate", "302", yesterdaysDate, "abcd").Return(true)
+
+	// Retrieves are only turned away when configured to be
+	config.AppConstants.MaintenanceBlocksRetrieve = true
+	defer func() { config.AppConstants.MaintenanceBlocksRetrieve = false }()
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/retrieve/302/%s/abcd", yesterdaysDate), nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 503, resp.Code, "503 response is expected")
+	assert.Equal(t, "300", resp.Header().Get("Retry-After"))
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "retrieve rejected during maintenance")
+	db.AssertNotCalled(t, "FetchKeysForHours", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	db.AssertNotCalled(t, "StreamKeysForHours", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
@@ -1,15 +1,19 @@
 package server
 
 import (
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/Shopify/goose/srvutil"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
 	"github.com/cds-snc/covid-alert-server/pkg/keyclaim"
 	"github.com/cds-snc/covid-alert-server/pkg/persistence"
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
 	"github.com/gorilla/mux"
 
 	"context"
@@ -31,11 +35,52 @@ type metricsServlet struct {
 const DATEFORMAT string = "\\d{4,4}-\\d{2,2}-\\d{2,2}"
 
 func (m metricsServlet) RegisterRouting(r *mux.Router) {
+	r = prefixedRouter(r)
 	log(nil, nil).Info("registering metrics route")
 	r.HandleFunc(fmt.Sprintf("/events/{startDate:%s}", DATEFORMAT), m.handleEventRequest)
 	r.HandleFunc(fmt.Sprintf("/events/uploads/{startDate:%s}", DATEFORMAT), m.handleTEKUploadsRequest)
 	log(nil, nil).Info("registering otkdurations")
 	r.HandleFunc(fmt.Sprintf("/events/otkdurations/{startDate:%s}", DATEFORMAT), m.handleOtkDurationsRequest)
+	r.HandleFunc(fmt.Sprintf("/events/otkfunnel/{startDate:%s}/{endDate:%s}", DATEFORMAT, DATEFORMAT), m.handleOtkFunnelRequest)
+	r.HandleFunc(fmt.Sprintf("/events/export/{startDate:%s}/{endDate:%s}", DATEFORMAT, DATEFORMAT), m.handleEventsExportRequest)
+	r.HandleFunc(fmt.Sprintf("/events/rejections/{reason:[A-Z_]+}/{startDate:%s}", DATEFORMAT), m.handleRejectionsRequest)
+}
+
+// parseDateRange reads the startDate and endDate route variables, writing a
+// 400 and returning false if they aren't a valid range of at most
+// EventQueryRangeDates days
+func parseDateRange(ctx context.Context, w http.ResponseWriter, r *http.Request) (time.Time, time.Time, bool) {
+	vars := mux.Vars(r)
+
+	startDateVal := vars["startDate"]
+	startDate, err := time.Parse(ISODATE, startDateVal)
+	if err != nil {
+		log(ctx, err).Errorf("issue parsing %s", startDateVal)
+		http.Error(w, "error parsing date", http.StatusBadRequest)
+		return time.Time{}, time.Time{}, false
+	}
+
+	endDateVal := vars["endDate"]
+	endDate, err := time.Parse(ISODATE, endDateVal)
+	if err != nil {
+		log(ctx, err).Errorf("issue parsing %s", endDateVal)
+		http.Error(w, "error parsing date", http.StatusBadRequest)
+		return time.Time{}, time.Time{}, false
+	}
+
+	if endDate.Before(startDate) {
+		log(ctx, nil).Errorf("end date %s before start date %s", endDateVal, startDateVal)
+		http.Error(w, "end date before start date", http.StatusBadRequest)
+		return time.Time{}, time.Time{}, false
+	}
+
+	if endDate.Sub(startDate) > time.Duration(config.AppConstants.EventQueryRangeDates)*24*time.Hour {
+		log(ctx, nil).Errorf("date range %s to %s too large", startDateVal, endDateVal)
+		http.Error(w, "date range too large", http.StatusBadRequest)
+		return time.Time{}, time.Time{}, false
+	}
+
+	return startDate, endDate, true
 }
 
 func authorizeRequest(r *http.Request) error {
@@ -220,3 +265,199 @@ func (m *metricsServlet) getDurationData(ctx context.Context, w http.ResponseWri
 	}
 	return
 }
+
+func (m *metricsServlet) handleOtkFunnelRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if err := authorizeRequest(r); err != nil {
+		log(ctx, err).Info("Unauthorized BasicAuth")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != "GET" {
+		log(ctx, nil).WithField("method", r.Method).Info("disallowed method")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	m.getOtkFunnelData(ctx, w, r)
+	return
+}
+
+func (m *metricsServlet) getOtkFunnelData(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	startDate, endDate, ok := parseDateRange(ctx, w, r)
+	if !ok {
+		return
+	}
+
+	funnel, err := m.db.GetOtkFunnel(startDate.Format(ISODATE), endDate.Format(ISODATE))
+	if err != nil {
+		log(ctx, err).Errorf("issue getting otk funnel events")
+		http.Error(w, "error retrieving otk funnel events", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	js, err := json.Marshal(funnel)
+	if err != nil {
+		log(ctx, err).WithField("EventFunnelResults", funnel).Errorf("error marshaling events")
+		http.Error(w, "error building json object", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(js)
+	if err != nil {
+		log(ctx, err).Errorf("error writing json")
+		http.Error(w, "error retrieving results", http.StatusInternalServerError)
+	}
+	return
+}
+
+func (m *metricsServlet) handleEventsExportRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if err := authorizeRequest(r); err != nil {
+		log(ctx, err).Info("Unauthorized BasicAuth")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != "GET" {
+		log(ctx, nil).WithField("method", r.Method).Info("disallowed method")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	m.exportEvents(ctx, w, r)
+	return
+}
+
+var eventsExportHeader = []string{"date", "source", "device_type", "identifier", "count"}
+
+// exportEvents streams the aggregated events for a date range as CSV, one
+// day and device type at a time, optionally filtered with the source and
+// deviceType query parameters. Rows are flushed as they are read so the
+// whole range is never held in memory.
+func (m *metricsServlet) exportEvents(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	startDate, endDate, ok := parseDateRange(ctx, w, r)
+	if !ok {
+		return
+	}
+
+	source := r.URL.Query().Get("source")
+	deviceTypes := []persistence.DeviceType{persistence.Android, persistence.IOS, persistence.Server}
+	if dt := r.URL.Query().Get("deviceType"); dt != "" {
+		if err := persistence.DeviceType(dt).IsValid(); err != nil {
+			log(ctx, err).Errorf("issue parsing device type %s", dt)
+			http.Error(w, "invalid device type", http.StatusBadRequest)
+			return
+		}
+		deviceTypes = []persistence.DeviceType{persistence.DeviceType(dt)}
+	}
+
+	w.Header().Add("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=\"events-%s-%s.csv\"", startDate.Format(ISODATE), endDate.Format(ISODATE)))
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	cw := csv.NewWriter(w)
+	if err := cw.Write(eventsExportHeader); err != nil {
+		log(ctx, err).Errorf("error writing csv")
+		return
+	}
+
+	// The status is already sent, so a failure part way through can only be
+	// logged and the export cut short
+	for day := startDate; !day.After(endDate); day = day.AddDate(0, 0, 1) {
+		for _, deviceType := range deviceTypes {
+			events, err := m.db.GetEvents(day.Format(ISODATE), deviceType)
+			if err != nil {
+				log(ctx, err).Errorf("issue getting events")
+				return
+			}
+
+			for _, e := range events {
+				if source != "" && e.Source != source {
+					continue
+				}
+				row := []string{e.Date, e.Source, string(deviceType), e.Identifier, strconv.FormatInt(e.Count, 10)}
+				if err := cw.Write(row); err != nil {
+					log(ctx, err).Errorf("error writing csv")
+					return
+				}
+			}
+
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				log(ctx, err).Errorf("error writing csv")
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// rejectionCount is the response to /events/rejections/{reason}/{startDate}
+type rejectionCount struct {
+	Reason string `json:"reason"`
+	Since  string `json:"since"`
+	Count  int64  `json:"count"`
+}
+
+// handleRejectionsRequest reports how many uploads have been rejected with an
+// error code since a date, as recorded when recordUploadRejections is set
+func (m *metricsServlet) handleRejectionsRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if err := authorizeRequest(r); err != nil {
+		log(ctx, err).Info("Unauthorized BasicAuth")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != "GET" {
+		log(ctx, nil).WithField("method", r.Method).Info("disallowed method")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	reason := vars["reason"]
+	if _, ok := pb.EncryptedUploadResponse_ErrorCode_value[reason]; !ok {
+		log(ctx, nil).WithField("reason", reason).Info("unknown rejection reason")
+		http.Error(w, "unknown rejection reason", http.StatusBadRequest)
+		return
+	}
+
+	startDateVal := vars["startDate"]
+	since, err := time.Parse(ISODATE, startDateVal)
+	if err != nil {
+		log(ctx, err).Errorf("issue parsing %s", startDateVal)
+		http.Error(w, "error parsing date", http.StatusBadRequest)
+		return
+	}
+
+	count, err := m.db.CountRejections(ctx, reason, since)
+	if err != nil {
+		log(ctx, err).Errorf("issue counting rejections")
+		http.Error(w, "error retrieving rejections", http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(rejectionCount{Reason: reason, Since: startDateVal, Count: count})
+	if err != nil {
+		http.Error(w, "error building json object", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	if _, err := w.Write(js); err != nil {
+		log(ctx, err).Errorf("error writing json")
+	}
+}
@@ -5,12 +5,14 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	keyclaim "github.com/cds-snc/covid-alert-server/mocks/pkg/keyclaim"
 	persistence "github.com/cds-snc/covid-alert-server/mocks/pkg/persistence"
 	persistence2 "github.com/cds-snc/covid-alert-server/pkg/persistence"
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 func createRouter(db *persistence.Conn, auth *keyclaim.Authenticator) *mux.Router {
@@ -122,10 +124,13 @@ func TestMetricsServlet_RegisterRoutingMetrics(t *testing.T) {
 	router := createRouter(db, auth)
 
 	expectedPaths := GetPaths(router)
-	assert.Equal(t, len(expectedPaths), 3)
+	assert.Equal(t, len(expectedPaths), 6)
 	assert.Contains(t, expectedPaths, fmt.Sprintf("/events/{startDate:%s}", DATEFORMAT), "Should contain claimed-keys endpoint")
 	assert.Contains(t, expectedPaths, fmt.Sprintf("/events/uploads/{startDate:%s}", DATEFORMAT), "Should contain TEK uploads endpoint")
 	assert.Contains(t, expectedPaths, fmt.Sprintf("/events/otkdurations/{startDate:%s}", DATEFORMAT), "Should contain TEK uploads endpoint")
+	assert.Contains(t, expectedPaths, fmt.Sprintf("/events/otkfunnel/{startDate:%s}/{endDate:%s}", DATEFORMAT, DATEFORMAT), "Should contain OTK funnel endpoint")
+	assert.Contains(t, expectedPaths, fmt.Sprintf("/events/export/{startDate:%s}/{endDate:%s}", DATEFORMAT, DATEFORMAT), "Should contain events export endpoint")
+	assert.Contains(t, expectedPaths, fmt.Sprintf("/events/rejections/{reason:[A-Z_]+}/{startDate:%s}", DATEFORMAT), "Should contain rejections endpoint")
 }
 
 func TestMetricsServlet_DBError(t *testing.T) {
@@ -257,3 +262,143 @@ func TestMetricsServlet_GetOtkDurationsData(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.Code)
 	assert.Equal(t, "[{\"source\":\"foo\",\"date\":\"bar\",\"hours\":1,\"count\":1},{\"source\":\"foo\",\"date\":\"bar\",\"hours\":12,\"count\":1}]", string(resp.Body.Bytes()))
 }
+
+func TestMetricsServlet_GetOtkFunnelData(t *testing.T) {
+
+	db, auth := createMocks()
+	router := createRouter(db, auth)
+
+	db.On("GetOtkFunnel", "2020-01-01", "2020-01-02").
+		Return(
+			[]persistence2.OtkFunnel{{
+				Date:      "2020-01-01",
+				Generated: 5,
+				Claimed:   3,
+				Expired:   0,
+			}, {
+				Date:      "2020-01-02",
+				Generated: 6,
+				Claimed:   4,
+				Expired:   1,
+			}},
+			nil,
+		)
+
+	req, _ := http.NewRequest("GET", "/events/otkfunnel/2020-01-01/2020-01-02", nil)
+	req.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "[{\"date\":\"2020-01-01\",\"generated\":5,\"claimed\":3,\"expired\":0},{\"date\":\"2020-01-02\",\"generated\":6,\"claimed\":4,\"expired\":1}]", string(resp.Body.Bytes()))
+}
+
+func TestMetricsServlet_OtkFunnelInvalidRange(t *testing.T) {
+
+	db, auth := createMocks()
+	router := createRouter(db, auth)
+
+	ranges := map[string]string{
+		"2020-01-02/2020-01-01": "end date before start date\n",
+		"2020-01-01/2020-02-01": "date range too large\n",
+		"2020-01-01/2020-13-01": "error parsing date\n",
+	}
+
+	for dates, expected := range ranges {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/events/otkfunnel/%s", dates), nil)
+		req.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+		assert.Equal(t, expected, string(resp.Body.Bytes()))
+	}
+}
+
+func TestMetricsServlet_ExportEvents(t *testing.T) {
+
+	db, auth := createMocks()
+	router := createRouter(db, auth)
+
+	db.On("GetEvents", "2020-01-01", persistence2.Android).
+		Return([]persistence2.Events{{
+			Identifier: "OTKClaimed",
+			Source:     "ON",
+			Date:       "2020-01-01",
+			Count:      3,
+		}, {
+			Identifier: "OTKClaimed",
+			Source:     "QC",
+			Date:       "2020-01-01",
+			Count:      2,
+		}}, nil)
+	db.On("GetEvents", "2020-01-02", persistence2.Android).
+		Return([]persistence2.Events{{
+			Identifier: "OTKGenerated",
+			Source:     "ON",
+			Date:       "2020-01-02",
+			Count:      5,
+		}}, nil)
+
+	req, _ := http.NewRequest("GET", "/events/export/2020-01-01/2020-01-02?deviceType=Android&source=ON", nil)
+	req.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.Equal(t, "date,source,device_type,identifier,count\n"+
+		"2020-01-01,ON,Android,OTKClaimed,3\n"+
+		"2020-01-02,ON,Android,OTKGenerated,5\n", resp.Body.String())
+}
+
+func TestMetricsServlet_ExportEventsInvalidDeviceType(t *testing.T) {
+
+	db, auth := createMocks()
+	router := createRouter(db, auth)
+
+	req, _ := http.NewRequest("GET", "/events/export/2020-01-01/2020-01-02?deviceType=Windows", nil)
+	req.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Equal(t, "invalid device type\n", string(resp.Body.Bytes()))
+}
+
+func TestMetricsServlet_CountRejections(t *testing.T) {
+
+	db, auth := createMocks()
+	router := createRouter(db, auth)
+
+	since, _ := time.Parse(ISODATE, "2020-01-01")
+	db.On("CountRejections", mock.Anything, "INVALID_TIMESTAMP", since).Return(int64(12), nil)
+
+	req, _ := http.NewRequest("GET", "/events/rejections/INVALID_TIMESTAMP/2020-01-01", nil)
+	req.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, `{"reason":"INVALID_TIMESTAMP","since":"2020-01-01","count":12}`, resp.Body.String())
+}
+
+func TestMetricsServlet_CountRejectionsUnknownReason(t *testing.T) {
+
+	db, auth := createMocks()
+	router := createRouter(db, auth)
+
+	req, _ := http.NewRequest("GET", "/events/rejections/NOT_A_REASON/2020-01-01", nil)
+	req.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	db.AssertNotCalled(t, "CountRejections", mock.Anything, mock.Anything, mock.Anything)
+}
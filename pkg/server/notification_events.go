@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/Shopify/goose/srvutil"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/persistence"
+	"github.com/cds-snc/covid-alert-server/pkg/retrieval"
+	"github.com/cds-snc/covid-alert-server/pkg/timemath"
+	"github.com/gorilla/mux"
+)
+
+// NewNotificationEventServlet registers the route apps use to report how many
+// exposure notifications were shown to users. Apps authenticate with the same
+// HMAC they sign retrieve requests with, since they hold no bearer token.
+func NewNotificationEventServlet(db persistence.Conn, auth retrieval.Authenticator) srvutil.Servlet {
+	return &notificationEventServlet{db: db, auth: auth, clock: systemClock{}}
+}
+
+type notificationEventServlet struct {
+	db    persistence.Conn
+	auth  retrieval.Authenticator
+	clock Clock
+}
+
+// notificationShownReport is the whole request body: an aggregate count, and
+// optionally the platform it was counted on. Nothing in it identifies a user.
+type notificationShownReport struct {
+	Count      int                    `json:"count"`
+	DeviceType persistence.DeviceType `json:"deviceType,omitempty"`
+}
+
+func (s *notificationEventServlet) RegisterRouting(r *mux.Router) {
+	r = prefixedRouter(r)
+	r.HandleFunc("/events/notification-shown/{region:[0-9]{3}}/{day:[0-9]{5}}/{auth:.*}", s.notificationShown).Methods(http.MethodPost)
+}
+
+// notificationShown records the reported count as a NotificationShown event
+// for the region in the path. day must be the current UTC date number, or the
+// one before it for apps that cross midnight while reporting, and auth the
+// retrieve HMAC for region and day. The device type comes from the body, or
+// from the User-Agent when the body doesn't give one.
+func (s *notificationEventServlet) notificationShown(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	region, day := vars["region"], vars["day"]
+
+	today := timemath.DateNumber(s.clock.Now())
+	if day != strconv.FormatUint(uint64(today), 10) && day != strconv.FormatUint(uint64(today-1), 10) {
+		log(ctx, nil).WithField("day", day).Info("invalid notification report day")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !s.auth.Authenticate(region, day, vars["auth"]) {
+		log(ctx, nil).WithField("auth", secretForLogs(vars["auth"])).Info("invalid auth parameter")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Anything else in the body, such as an identifier, is refused rather
+	// than ignored
+	var report notificationShownReport
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 256))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&report); err != nil {
+		log(ctx, err).Info("error reading notification report")
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if report.Count < 1 || report.Count > config.AppConstants.MaxNotificationShownCount {
+		log(ctx, nil).WithField("count", report.Count).Info("invalid notification count")
+		http.Error(w, "invalid count", http.StatusBadRequest)
+		return
+	}
+
+	deviceType := report.DeviceType
+	if deviceType == "" {
+		deviceType, _ = requestDeviceType(r)
+	}
+	if deviceType != persistence.Android && deviceType != persistence.IOS {
+		log(ctx, nil).WithField("deviceType", deviceType).Info("invalid notification device type")
+		http.Error(w, "invalid deviceType", http.StatusBadRequest)
+		return
+	}
+
+	event := persistence.Event{
+		Identifier: persistence.NotificationShown,
+		DeviceType: deviceType,
+		Date:       s.clock.Now(),
+		Count:      report.Count,
+		Originator: region,
+	}
+	if err := s.db.SaveEvent(event); err != nil {
+		persistence.LogEvent(ctx, err, event)
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	persistence "github.com/cds-snc/covid-alert-server/mocks/pkg/persistence"
+	retrieval "github.com/cds-snc/covid-alert-server/mocks/pkg/retrieval"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	persistenceErrors "github.com/cds-snc/covid-alert-server/pkg/persistence"
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// notificationNow is on UTC day 18518
+var notificationNow = time.Unix(1600000000, 0)
+
+func setupNotificationEventRouter(db *persistence.Conn) http.Handler {
+	auth := &retrieval.Authenticator{}
+	auth.On("Authenticate", "302", "18518", "goodauth").Return(true)
+	auth.On("Authenticate", "302", "18517", "goodauth").Return(true)
+	auth.On("Authenticate", mock.Anything, mock.Anything, mock.Anything).Return(false)
+
+	router := Router()
+	(&notificationEventServlet{db: db, auth: auth, clock: fixedClock(notificationNow)}).RegisterRouting(router)
+	return router
+}
+
+func notificationShownRequest(router http.Handler, path, body, userAgent string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/events/notification-shown/"+path, strings.NewReader(body))
+	req.Header.Set("User-Agent", userAgent)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestNotificationShown(t *testing.T) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db := &persistence.Conn{}
+	db.On("SaveEvent", persistenceErrors.Event{
+		Identifier: persistenceErrors.NotificationShown,
+		DeviceType: persistenceErrors.IOS,
+		Date:       notificationNow,
+		Count:      12,
+		Originator: "302",
+	}).Return(nil)
+	db.On("SaveEvent", persistenceErrors.Event{
+		Identifier: persistenceErrors.NotificationShown,
+		DeviceType: persistenceErrors.Android,
+		Date:       notificationNow,
+		Count:      3,
+		Originator: "302",
+	}).Return(nil)
+	router := setupNotificationEventRouter(db)
+
+	// The device type from the body
+	resp := notificationShownRequest(router, "302/18518/goodauth", `{"count":12,"deviceType":"iOS"}`, "okhttp/3.12")
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+
+	// The device type from the User-Agent, signed before midnight
+	resp = notificationShownRequest(router, "302/18517/goodauth", `{"count":3}`, "okhttp/3.12")
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+
+	db.AssertNumberOfCalls(t, "SaveEvent", 2)
+}
+
+func TestNotificationShown_Rejected(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db := &persistence.Conn{}
+	router := setupNotificationEventRouter(db)
+
+	resp := notificationShownRequest(router, "302/18518/badauth", `{"count":1,"deviceType":"iOS"}`, "")
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Equal(t, "b...h", hook.LastEntry().Data["auth"])
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "invalid auth parameter")
+
+	// Health authority bearer tokens aren't accepted
+	req, _ := http.NewRequest("POST", "/events/notification-shown/302/18518/", strings.NewReader(`{"count":1,"deviceType":"iOS"}`))
+	req.Header.Set("Authorization", "Bearer goodtoken")
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "invalid auth parameter")
+
+	// Nor are HMACs for any other day
+	for _, day := range []string{"18516", "18519"} {
+		resp = notificationShownRequest(router, "302/"+day+"/goodauth", `{"count":1,"deviceType":"iOS"}`, "")
+		assert.Equal(t, http.StatusUnauthorized, resp.Code, day)
+		testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "invalid notification report day")
+	}
+
+	// Malformed bodies, and bodies carrying anything but the count
+	for _, body := range []string{`{"count":`, `{"count":1,"deviceType":"iOS","installId":"abc"}`} {
+		resp = notificationShownRequest(router, "302/18518/goodauth", body, "")
+		assert.Equal(t, http.StatusBadRequest, resp.Code, body)
+		testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "error reading notification report")
+	}
+
+	tooMany := fmt.Sprintf(`{"count":%d,"deviceType":"iOS"}`, config.AppConstants.MaxNotificationShownCount+1)
+	for _, body := range []string{`{"count":0,"deviceType":"iOS"}`, `{"count":-4,"deviceType":"iOS"}`, tooMany} {
+		resp = notificationShownRequest(router, "302/18518/goodauth", body, "")
+		assert.Equal(t, http.StatusBadRequest, resp.Code, body)
+		testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "invalid notification count")
+	}
+
+	for _, body := range []string{`{"count":1}`, `{"count":1,"deviceType":"Server"}`, `{"count":1,"deviceType":"Windows"}`} {
+		resp = notificationShownRequest(router, "302/18518/goodauth", body, "curl/7.64.1")
+		assert.Equal(t, http.StatusBadRequest, resp.Code, body)
+		testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "invalid notification device type")
+	}
+
+	db.AssertNotCalled(t, "SaveEvent", mock.Anything)
+}
+
+func TestNotificationShown_SaveFails(t *testing.T) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db := &persistence.Conn{}
+	db.On("SaveEvent", mock.Anything).Return(fmt.Errorf("db error"))
+	router := setupNotificationEventRouter(db)
+
+	resp := notificationShownRequest(router, "302/18518/goodauth", `{"count":1,"deviceType":"Android"}`, "")
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type regionUpdate struct {
+	Region      string `json:"region"`
+	LastUpdated string `json:"lastUpdated"`
+}
+
+// lastUpdated reports when keys were last stored for the region in the path,
+// as JSON and as Last-Modified, answering If-Modified-Since with a 304. It
+// needs no auth: it gives away no more than whether a batch has new keys.
+func (s *retrieveServlet) lastUpdated(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	region := mux.Vars(r)["region"]
+
+	updatedAt, err := s.db.RegionLastUpdated(ctx, region)
+	if err == sql.ErrNoRows {
+		s.fail(log(ctx, nil).WithField("region", region), w, "no keys stored for region", "not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		s.fail(log(ctx, err), w, "database error", "", http.StatusInternalServerError)
+		return
+	}
+
+	// Last-Modified only has second precision
+	updatedAt = updatedAt.UTC().Truncate(time.Second)
+	w.Header().Add("Cache-Control", "public, max-age=60")
+	w.Header().Set("Last-Modified", updatedAt.Format(http.TimeFormat))
+
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !updatedAt.After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	js, err := json.Marshal(regionUpdate{Region: region, LastUpdated: updatedAt.Format(time.RFC3339)})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	if _, err := w.Write(js); err != nil {
+		log(ctx, err).Info("error writing response")
+	}
+}
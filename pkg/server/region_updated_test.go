@@ -0,0 +1,61 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRetrieveLastUpdated(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db, auth, signer := setupRetrieveMockers()
+	updatedAt := time.Date(2020, 9, 14, 12, 30, 15, 500, time.UTC)
+	db.On("RegionLastUpdated", mock.Anything, "302").Return(updatedAt, nil)
+	db.On("RegionLastUpdated", mock.Anything, "999").Return(time.Time{}, sql.ErrNoRows)
+	db.On("RegionLastUpdated", mock.Anything, "500").Return(time.Time{}, fmt.Errorf("db error"))
+	router := setupRetrieveRouter(db, auth, signer)
+
+	lastUpdated := func(region, ifModifiedSince string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/retrieve/"+region+"/last-updated", nil)
+		if ifModifiedSince != "" {
+			req.Header.Set("If-Modified-Since", ifModifiedSince)
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := lastUpdated("302", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.JSONEq(t, `{"region":"302","lastUpdated":"2020-09-14T12:30:15Z"}`, resp.Body.String())
+	assert.Equal(t, "Mon, 14 Sep 2020 12:30:15 GMT", resp.Header().Get("Last-Modified"))
+	assert.Equal(t, "public, max-age=60", resp.Header().Get("Cache-Control"))
+
+	// Clients that already have the latest time get a 304
+	resp = lastUpdated("302", "Mon, 14 Sep 2020 12:30:15 GMT")
+	assert.Equal(t, http.StatusNotModified, resp.Code)
+	assert.Empty(t, resp.Body.String())
+
+	resp = lastUpdated("302", "Mon, 14 Sep 2020 12:00:00 GMT")
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	resp = lastUpdated("999", "")
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "no keys stored for region")
+
+	resp = lastUpdated("500", "")
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	testhelpers.AssertLog(t, hook, 1, logrus.ErrorLevel, "database error")
+
+	auth.AssertNotCalled(t, "Authenticate", mock.Anything, mock.Anything, mock.Anything)
+}
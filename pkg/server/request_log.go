@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Shopify/goose/metrics"
+	"github.com/Shopify/goose/redact"
+	"github.com/Shopify/goose/statsd"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// requestLogMiddleware times and logs each request the way
+// srvutil.RequestMetricsMiddleware does, except that the "http request" and
+// "http response" entries are logged at the level configured for the route,
+// so a high volume route like retrieve can be quietened without losing the
+// admin routes' logs
+func requestLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		level := requestLogLevel(routeName(r))
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		ctx = statsd.WatchingTagLoggable(ctx, recorder)
+		r = r.WithContext(ctx)
+
+		log(ctx, nil).
+			WithField("method", r.Method).
+			WithField("headers", redact.Headers(r.Header)).
+			Log(level, "http request")
+
+		_ = metrics.HTTPRequest.Time(ctx, func() error {
+			next.ServeHTTP(recorder, r)
+			return nil
+		})
+
+		log(ctx, nil).
+			WithField("headers", redact.Headers(w.Header())).
+			Log(level, "http response")
+	})
+}
+
+// routeName names the matched route by its mux name if it has one, otherwise
+// by the first segment of its path after ROUTE_PREFIX, e.g. retrieve, upload
+// or services
+func routeName(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	if name := route.GetName(); name != "" {
+		return name
+	}
+	tpl, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	tpl = strings.TrimPrefix(tpl, os.Getenv("ROUTE_PREFIX"))
+	return strings.SplitN(strings.TrimPrefix(tpl, "/"), "/", 2)[0]
+}
+
+// requestLogLevel returns the level configured for route in
+// requestLogLevels, falling back to requestLogLevel
+func requestLogLevel(route string) logrus.Level {
+	for _, entry := range config.AppConstants.RequestLogLevels {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != route {
+			continue
+		}
+		level, err := logrus.ParseLevel(strings.TrimSpace(parts[1]))
+		if err != nil {
+			log(nil, err).WithField("entry", entry).Warn("ignoring invalid requestLogLevels entry")
+			break
+		}
+		return level
+	}
+
+	level, err := logrus.ParseLevel(config.AppConstants.RequestLogLevel)
+	if err != nil {
+		return logrus.InfoLevel
+	}
+	return level
+}
+
+// statusRecorder captures the response status so it is added to the request's
+// log entries and stats tags
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (w *statusRecorder) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusRecorder) Write(data []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *statusRecorder) LogFields() logrus.Fields {
+	if w.statusCode > 0 {
+		return logrus.Fields{
+			"statusCode":  w.statusCode,
+			"statusClass": fmt.Sprintf("%dxx", w.statusCode/100),
+		}
+	}
+	return nil
+}
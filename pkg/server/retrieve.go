@@ -1,8 +1,17 @@
 package server
 
 import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cds-snc/covid-alert-server/pkg/config"
@@ -15,6 +24,7 @@ import (
 
 	"github.com/Shopify/goose/srvutil"
 	"github.com/gorilla/mux"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
@@ -23,18 +33,24 @@ const (
 )
 
 func NewRetrieveServlet(db persistence.Conn, auth retrieval.Authenticator, signer retrieval.Signer) srvutil.Servlet {
-	return &retrieveServlet{db: db, auth: auth, signer: signer}
+	return &retrieveServlet{db: db, auth: auth, signer: signer, maintenance: newMaintenanceMode(db)}
 }
 
 type retrieveServlet struct {
-	db     persistence.Conn
-	auth   retrieval.Authenticator
-	signer retrieval.Signer
+	db          persistence.Conn
+	auth        retrieval.Authenticator
+	signer      retrieval.Signer
+	maintenance *maintenanceMode
 }
 
 func (s *retrieveServlet) RegisterRouting(r *mux.Router) {
+	r = prefixedRouter(r)
 	// becomes 7 digits in 2084
 	r.HandleFunc("/retrieve/{region:[0-9]{3}}/{day:[0-9]{5}}/{auth:.*}", s.retrieveWrapper)
+	// a comma separated list of regions, served as a zip of per-region batches
+	r.HandleFunc("/retrieve/{regions:[0-9]{3}(?:,[0-9]{3})+}/{day:[0-9]{5}}/{auth:.*}", s.retrieveWrapper)
+	// when keys were last stored for a region, so clients can poll cheaply
+	r.HandleFunc("/retrieve/{region:[0-9]{3}}/last-updated", s.lastUpdated).Methods(http.MethodGet, http.MethodHead)
 }
 
 func (s *retrieveServlet) fail(logger *logrus.Entry, w http.ResponseWriter, logMsg string, responseMsg string, responseCode int) result {
@@ -59,20 +75,40 @@ func (s *retrieveServlet) retrieve(w http.ResponseWriter, r *http.Request) resul
 	ctx := r.Context()
 	vars := mux.Vars(r)
 
-	/* Hardcode the region as 302 (Canada MCC)
-	You can see the reason for this in pkg/server/keyclaim.go
-	As stated there I'm going to open an issue to continue this work instead of just
-	relying on the hardcoded value.
-	*/
-	region := config.AppConstants.RegionCode
-	if !s.auth.Authenticate(region, vars["day"], vars["auth"]) {
+	// The HMAC covers the regions as they appear in the path, a single
+	// region or the whole comma separated list
+	pathRegions := vars["region"]
+	if pathRegions == "" {
+		pathRegions = vars["regions"]
+	}
+	if !s.auth.Authenticate(pathRegions, vars["day"], vars["auth"]) {
 		return s.fail(log(ctx, nil), w, "invalid auth parameter", "unauthorized", http.StatusUnauthorized)
 	}
 
-	if r.Method != "GET" {
+	if r.Method != "GET" && r.Method != "HEAD" {
 		return s.fail(log(ctx, nil).WithField("method", r.Method), w, "method not allowed", "", http.StatusMethodNotAllowed)
 	}
 
+	if config.AppConstants.MaintenanceBlocksRetrieve && s.maintenance.enabled(ctx) {
+		setRetryAfter(ctx, w, "retrieve")
+		return s.fail(log(ctx, nil), w, "retrieve rejected during maintenance", "", http.StatusServiceUnavailable)
+	}
+
+	regions := strings.Split(pathRegions, ",")
+	if len(regions) > 1 && len(regions) > config.AppConstants.MaxRetrieveRegions {
+		return s.fail(log(ctx, nil).WithField("regions", len(regions)), w, "too many regions requested", "", http.StatusBadRequest)
+	}
+	seen := make(map[string]bool, len(regions))
+	for _, code := range regions {
+		if !retrieveRegionKnown(code) {
+			return s.fail(log(ctx, nil).WithField("region", code), w, "unknown region requested", "", http.StatusBadRequest)
+		}
+		if seen[code] {
+			return s.fail(log(ctx, nil).WithField("region", code), w, "duplicate region requested", "", http.StatusBadRequest)
+		}
+		seen[code] = true
+	}
+
 	var startTimestamp time.Time
 	var endTimestamp time.Time
 	var dateNumber uint32
@@ -108,6 +144,8 @@ func (s *retrieveServlet) retrieve(w http.ResponseWriter, r *http.Request) resul
 
 	}
 
+	format := exportFormat(w, r)
+
 	currentRSIN := pb.CurrentRollingStartIntervalNumber()
 	currentDateNumber := timemath.CurrentDateNumber()
 
@@ -119,18 +157,319 @@ func (s *retrieveServlet) retrieve(w http.ResponseWriter, r *http.Request) resul
 		return s.fail(log(ctx, nil), w, "request for too-old data", "requested data no longer valid", http.StatusGone)
 	}
 
-	keys, err := s.db.FetchKeysForHours(region, startHour, endHour, currentRSIN)
+	keyRange, msg, ok := parseKeyRange(r, currentDateNumber)
+	if !ok {
+		return s.fail(log(ctx, nil), w, msg, "", http.StatusBadRequest)
+	}
+
+	// Ranged batches are meant to be small, so they're always buffered
+	if config.AppConstants.StreamRetrieveExport && keyRange == nil {
+		batch := retrieveBatch{regions, startHour, endHour, currentRSIN, startTimestamp, endTimestamp, format}
+		return s.streamRetrieve(w, r, batch)
+	}
+
+	var buf bytes.Buffer
+	var zipw *zip.Writer
+	if len(regions) > 1 {
+		zipw = zip.NewWriter(&buf)
+	}
+
+	var etags []string
+	size, keyCount := 0, 0
+	for _, region := range regions {
+		var keys []*pb.TemporaryExposureKey
+		var err error
+		if keyRange != nil {
+			keys, err = s.db.FetchKeysForHoursInRange(region, startHour, endHour, currentRSIN, keyRange.startRSIN, keyRange.endRSIN)
+		} else {
+			keys, err = s.db.FetchKeysForHours(region, startHour, endHour, currentRSIN)
+		}
+		if dbUnavailable(err) {
+			return s.fail(log(ctx, err), w, "database unavailable", "", http.StatusServiceUnavailable)
+		} else if err != nil {
+			return s.fail(log(ctx, err), w, "database error", "", http.StatusInternalServerError)
+		}
+		keys = format.Keys(keys)
+
+		// The export is signed on every request, so the ETag is derived from the
+		// batch contents rather than the response bytes, which change each time.
+		etag, err := batchETag(keys, region, startTimestamp, endTimestamp)
+		if err != nil {
+			return s.fail(log(ctx, err), w, "error computing etag", "", http.StatusInternalServerError)
+		}
+		etags = append(etags, etag)
+
+		var out io.Writer = &buf
+		if zipw != nil {
+			if out, err = zipw.Create(region + ".zip"); err != nil {
+				return s.fail(log(ctx, err), w, "error serializing keys", "", http.StatusInternalServerError)
+			}
+		}
+
+		n, err := retrieval.SerializeTo(ctx, out, keys, region, startTimestamp, endTimestamp, s.signer)
+		if err != nil {
+			return s.fail(log(ctx, err), w, "error serializing keys", "", http.StatusInternalServerError)
+		}
+		size += n
+		keyCount += len(keys)
+	}
+
+	etag := etags[0]
+	if zipw != nil {
+		if err := zipw.Close(); err != nil {
+			return s.fail(log(ctx, err), w, "error serializing keys", "", http.StatusInternalServerError)
+		}
+		etag = fmt.Sprintf("\"%x\"", sha256.Sum256([]byte(strings.Join(etags, ","))))
+	}
+
+	setRetrieveHeaders(w, etag, endTimestamp)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+
+	if r.Method == "HEAD" {
+		w.WriteHeader(http.StatusOK)
+		log(ctx, nil).WithField("keys", keyCount).Info("Wrote retrieval headers")
+		return result(struct{}{})
+	}
+
+	if _, err := buf.WriteTo(w); err != nil {
+		log(ctx, err).Info("error writing response")
+	}
+	log(ctx, nil).WithField("unzipped-size", size).WithField("keys", keyCount).WithField("regions", len(regions)).Info("Wrote retrieval")
+	return result(struct{}{})
+}
+
+// rsinRange is the rolling start interval numbers in [startRSIN, endRSIN)
+type rsinRange struct {
+	startRSIN, endRSIN int32
+}
+
+// parseKeyRange reads the startDate and endDate query parameters, inclusive
+// date numbers that restrict the batch to keys whose interval starts on those
+// days. It returns nil if enableRetrieveDateRange is off or neither is set,
+// and false with the reason if the range is invalid or reaches outside the
+// days retrieve serves.
+func parseKeyRange(r *http.Request, currentDateNumber uint32) (*rsinRange, string, bool) {
+	if !config.AppConstants.EnableRetrieveDateRange {
+		return nil, "", true
+	}
+	query := r.URL.Query()
+	startParam, endParam := query.Get("startDate"), query.Get("endDate")
+	if startParam == "" && endParam == "" {
+		return nil, "", true
+	}
+	if startParam == "" || endParam == "" {
+		return nil, "startDate and endDate must both be set", false
+	}
+
+	startDate, err := strconv.ParseUint(startParam, 10, 32)
 	if err != nil {
-		return s.fail(log(ctx, err), w, "database error", "", http.StatusInternalServerError)
+		return nil, "invalid startDate", false
+	}
+	endDate, err := strconv.ParseUint(endParam, 10, 32)
+	if err != nil {
+		return nil, "invalid endDate", false
+	}
+	if startDate > endDate {
+		return nil, "startDate is after endDate", false
+	}
+	if startDate < uint64(currentDateNumber-numberOfDaysToServe) || endDate > uint64(currentDateNumber) {
+		return nil, "date range outside retention window", false
+	}
+
+	// ENIntervalNumbers are 600s long, so there are 144 to a day
+	return &rsinRange{
+		startRSIN: int32(startDate * 144),
+		endRSIN:   int32((endDate + 1) * 144),
+	}, "", true
+}
+
+// retrieveRegionKnown reports whether retrieve serves region: one of
+// retrieveRegions, or regionCode when none are configured
+func retrieveRegionKnown(region string) bool {
+	if len(config.AppConstants.RetrieveRegions) == 0 {
+		return region == config.AppConstants.RegionCode
+	}
+	for _, known := range config.AppConstants.RetrieveRegions {
+		if region == known {
+			return true
+		}
+	}
+	return false
+}
+
+// exportFormat picks the export layout from the enVersion query parameter,
+// or failing that the X-EN-Version header, if negotiateExportFormat is set.
+// Anything else gets the current layout.
+func exportFormat(w http.ResponseWriter, r *http.Request) retrieval.ExportFormat {
+	if !config.AppConstants.NegotiateExportFormat {
+		return retrieval.FormatCurrent
+	}
+	// The layout can change with the header, so caches must key on it
+	w.Header().Add("Vary", "X-EN-Version")
+	version := r.URL.Query().Get("enVersion")
+	if version == "" {
+		version = r.Header.Get("X-EN-Version")
+	}
+	return retrieval.ParseENVersion(version)
+}
+
+func setRetrieveHeaders(w http.ResponseWriter, etag string, endTimestamp time.Time) {
+	// Keys are bucketed by the hour they were received, so a batch stops
+	// changing once its period is over.
+	lastModified := endTimestamp
+	if now := time.Now(); lastModified.After(now) {
+		lastModified = now
 	}
 
 	w.Header().Add("Content-Type", "application/zip")
 	w.Header().Add("Cache-Control", "public, max-age=3600, max-stale=600")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+}
+
+func batchETag(keys []*pb.TemporaryExposureKey, region string, startTimestamp, endTimestamp time.Time) (string, error) {
+	etag, _, err := streamETag(retrieval.SliceKeyStream(keys), region, startTimestamp, endTimestamp)
+	return etag, err
+}
+
+// streamETag is batchETag over a KeyStream, also returning the number of keys
+func streamETag(keys retrieval.KeyStream, region string, startTimestamp, endTimestamp time.Time) (string, int, error) {
+	h := newBatchHash(region, startTimestamp, endTimestamp)
+	count := 0
+	if err := hashedStream(keys, h, &count)(func(*pb.TemporaryExposureKey) error { return nil }); err != nil {
+		return "", 0, err
+	}
+	return batchHashETag(h), count, nil
+}
+
+func newBatchHash(region string, startTimestamp, endTimestamp time.Time) hash.Hash {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s:%d:%d", region, startTimestamp.Unix(), endTimestamp.Unix())
+	return h
+}
+
+func batchHashETag(h hash.Hash) string {
+	return fmt.Sprintf("\"%x\"", h.Sum(nil))
+}
+
+// hashedStream passes keys on unchanged, adding each to the batch hash h and
+// counting it in count
+func hashedStream(keys retrieval.KeyStream, h hash.Hash, count *int) retrieval.KeyStream {
+	return func(fn func(*pb.TemporaryExposureKey) error) error {
+		return keys(func(key *pb.TemporaryExposureKey) error {
+			data, err := proto.Marshal(key)
+			if err != nil {
+				return err
+			}
+			h.Write(data)
+			*count++
+			return fn(key)
+		})
+	}
+}
+
+// retrieveBatch is the validated scope of a retrieve request
+type retrieveBatch struct {
+	regions                      []string
+	startHour, endHour           uint32
+	currentRSIN                  int32
+	startTimestamp, endTimestamp time.Time
+	format                       retrieval.ExportFormat
+}
+
+func (s *retrieveServlet) keyStream(b retrieveBatch, region string) retrieval.KeyStream {
+	return b.format.Stream(func(fn func(*pb.TemporaryExposureKey) error) error {
+		return s.db.StreamKeysForHours(region, b.startHour, b.endHour, b.currentRSIN, fn)
+	})
+}
 
-	size, err := retrieval.SerializeTo(ctx, w, keys, region, startTimestamp, endTimestamp, s.signer)
+// streamRetrieve writes the export to a temporary file as it is read from
+// the database instead of assembling it in memory, then sends that. It can't
+// write StreamTo's output straight to the client, even though StreamTo
+// already signs export.bin as it goes: the ETag and Content-Length headers
+// have to precede the body and both depend on the whole read of the keys, and
+// reading the keys twice could give an ETag that doesn't match the body. A
+// database error part way through would also only be able to truncate a 200,
+// which the CDN would cache as a complete export. The temporary file keeps
+// memory flat on large batches at the cost of the first byte waiting for the
+// export, as it does without streaming.
+func (s *retrieveServlet) streamRetrieve(w http.ResponseWriter, r *http.Request, b retrieveBatch) result {
+	ctx := r.Context()
+
+	// HEAD only needs the ETag
+	var body *os.File
+	if r.Method != "HEAD" {
+		f, err := ioutil.TempFile("", "retrieve-*.zip")
+		if err != nil {
+			return s.fail(log(ctx, err), w, "error streaming keys", "", http.StatusInternalServerError)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		body = f
+	}
+
+	var zipw *zip.Writer
+	if body != nil && len(b.regions) > 1 {
+		zipw = zip.NewWriter(body)
+	}
+
+	var etags []string
+	size, keyCount := 0, 0
+	for _, region := range b.regions {
+		h := newBatchHash(region, b.startTimestamp, b.endTimestamp)
+		keys := hashedStream(s.keyStream(b, region), h, &keyCount)
+
+		var err error
+		if body == nil {
+			err = keys(func(*pb.TemporaryExposureKey) error { return nil })
+		} else {
+			var out io.Writer = body
+			if zipw != nil {
+				out, err = zipw.Create(region + ".zip")
+			}
+			if err == nil {
+				var n int
+				n, err = retrieval.StreamTo(ctx, out, keys, region, b.startTimestamp, b.endTimestamp, s.signer)
+				size += n
+			}
+		}
+		if dbUnavailable(err) {
+			return s.fail(log(ctx, err), w, "database unavailable", "", http.StatusServiceUnavailable)
+		} else if err != nil {
+			return s.fail(log(ctx, err), w, "error streaming keys", "", http.StatusInternalServerError)
+		}
+		etags = append(etags, batchHashETag(h))
+	}
+
+	etag := etags[0]
+	if len(b.regions) > 1 {
+		etag = fmt.Sprintf("\"%x\"", sha256.Sum256([]byte(strings.Join(etags, ","))))
+	}
+	setRetrieveHeaders(w, etag, b.endTimestamp)
+
+	if body == nil {
+		w.WriteHeader(http.StatusOK)
+		log(ctx, nil).WithField("keys", keyCount).Info("Wrote retrieval headers")
+		return result(struct{}{})
+	}
+
+	if zipw != nil {
+		if err := zipw.Close(); err != nil {
+			return s.fail(log(ctx, err), w, "error streaming keys", "", http.StatusInternalServerError)
+		}
+	}
+	length, err := body.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = body.Seek(0, io.SeekStart)
+	}
 	if err != nil {
+		return s.fail(log(ctx, err), w, "error streaming keys", "", http.StatusInternalServerError)
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+
+	if _, err := io.Copy(w, body); err != nil {
 		log(ctx, err).Info("error writing response")
 	}
-	log(ctx, nil).WithField("unzipped-size", size).WithField("keys", len(keys)).Info("Wrote retrieval")
+	log(ctx, nil).WithField("unzipped-size", size).WithField("keys", keyCount).WithField("regions", len(b.regions)).Info("Wrote retrieval")
 	return result(struct{}{})
 }
@@ -1,21 +1,27 @@
 package server
 
 import (
+	"archive/zip"
+	"bytes"
 	"crypto/rand"
 	"fmt"
 	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
 	"github.com/gorilla/mux"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	persistence "github.com/cds-snc/covid-alert-server/mocks/pkg/persistence"
 	retrieval "github.com/cds-snc/covid-alert-server/mocks/pkg/retrieval"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
 	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
 	"github.com/cds-snc/covid-alert-server/pkg/timemath"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestNewRetrieveServlet(t *testing.T) {
@@ -25,9 +31,10 @@ func TestNewRetrieveServlet(t *testing.T) {
 	signer := &retrieval.Signer{}
 
 	expected := &retrieveServlet{
-		db:     db,
-		auth:   auth,
-		signer: signer,
+		db:          db,
+		auth:        auth,
+		signer:      signer,
+		maintenance: newMaintenanceMode(db),
 	}
 	assert.Equal(t, expected, NewRetrieveServlet(db, auth, signer), "should return a new retrieveServlet struct")
 
@@ -41,6 +48,8 @@ func TestRegisterRoutingRetrieve(t *testing.T) {
 
 	expectedPaths := GetPaths(router)
 	assert.Contains(t, expectedPaths, "/retrieve/{region:[0-9]{3}}/{day:[0-9]{5}}/{auth:.*}", "should include a retrieve path")
+	assert.Contains(t, expectedPaths, "/retrieve/{regions:[0-9]{3}(?:,[0-9]{3})+}/{day:[0-9]{5}}/{auth:.*}", "should include a multi-region retrieve path")
+	assert.Contains(t, expectedPaths, "/retrieve/{region:[0-9]{3}}/last-updated", "should include a last-updated path")
 
 }
 
@@ -127,6 +136,466 @@ func TestRetrieve_AllKeysDownload(t *testing.T) {
 	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "Wrote retrieval")
 }
 
+func TestRetrieve_Head(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db, auth, signer := setupRetrieveMockers()
+	router := setupRetrieveRouter(db, auth, signer)
+
+	region := "302"
+	goodAuth := "abcd"
+	currentRSIN := pb.CurrentRollingStartIntervalNumber()
+	yesterdaysDate := fmt.Sprint(timemath.CurrentDateNumber() - 1)
+
+	auth.On("Authenticate", region, yesterdaysDate, goodAuth).Return(true)
+	startHour := (timemath.CurrentDateNumber() - 1) * 24
+	endHour := timemath.CurrentDateNumber() * 24
+
+	db.On("FetchKeysForHours", region, startHour, endHour, currentRSIN).Return([]*pb.TemporaryExposureKey{randomTestKey(), randomTestKey()}, nil)
+
+	signer.On("Sign", mock.AnythingOfType("[]uint8")).Return(make([]byte, 64), nil)
+
+	path := fmt.Sprintf("/retrieve/%s/%s/%s", region, yesterdaysDate, goodAuth)
+
+	req, _ := http.NewRequest("GET", path, nil)
+	getResp := httptest.NewRecorder()
+	router.ServeHTTP(getResp, req)
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "Wrote retrieval")
+
+	req, _ = http.NewRequest("HEAD", path, nil)
+	headResp := httptest.NewRecorder()
+	router.ServeHTTP(headResp, req)
+
+	assert.Equal(t, 200, headResp.Code, "Success response is expected")
+	assert.Empty(t, headResp.Body.Bytes(), "HEAD response should not have a body")
+	assert.NotEmpty(t, headResp.Header().Get("ETag"), "ETag should be set")
+	assert.Equal(t, getResp.Header().Get("ETag"), headResp.Header().Get("ETag"), "ETag should match the GET response")
+	assert.Equal(t, getResp.Header().Get("Last-Modified"), headResp.Header().Get("Last-Modified"), "Last-Modified should match the GET response")
+	assert.Equal(t, fmt.Sprint(getResp.Body.Len()), headResp.Header().Get("Content-Length"), "Content-Length should match the GET body size")
+	assert.Contains(t, headResp.Header()["Content-Type"], "application/zip", "Content-Type should be set to application/zip")
+
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "Wrote retrieval headers")
+}
+
+func TestRetrieve_SingleRegion(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db, auth, signer := setupRetrieveMockers()
+	router := setupRetrieveRouter(db, auth, signer)
+
+	region := "302"
+	goodAuth := "abcd"
+	currentRSIN := pb.CurrentRollingStartIntervalNumber()
+	yesterdaysDate := fmt.Sprint(timemath.CurrentDateNumber() - 1)
+
+	auth.On("Authenticate", region, yesterdaysDate, goodAuth).Return(true)
+	startHour := (timemath.CurrentDateNumber() - 1) * 24
+	endHour := timemath.CurrentDateNumber() * 24
+
+	db.On("FetchKeysForHours", region, startHour, endHour, currentRSIN).Return([]*pb.TemporaryExposureKey{randomTestKey()}, nil)
+
+	signer.On("Sign", mock.AnythingOfType("[]uint8")).Return(make([]byte, 64), nil)
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/retrieve/%s/%s/%s", region, yesterdaysDate, goodAuth), nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "Success response is expected")
+
+	zipr, err := zip.NewReader(bytes.NewReader(resp.Body.Bytes()), int64(resp.Body.Len()))
+	assert.Nil(t, err)
+	var names []string
+	for _, f := range zipr.File {
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, []string{"export.bin", "export.sig"}, names, "single region should be a plain export")
+
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "Wrote retrieval")
+}
+
+func TestRetrieve_MultiRegion(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	oldRegions := config.AppConstants.RetrieveRegions
+	config.AppConstants.RetrieveRegions = []string{"302", "303", "304"}
+	defer func() { config.AppConstants.RetrieveRegions = oldRegions }()
+
+	db, auth, signer := setupRetrieveMockers()
+	router := setupRetrieveRouter(db, auth, signer)
+
+	goodAuth := "abcd"
+	currentRSIN := pb.CurrentRollingStartIntervalNumber()
+	yesterdaysDate := fmt.Sprint(timemath.CurrentDateNumber() - 1)
+
+	auth.On("Authenticate", "302,303", yesterdaysDate, goodAuth).Return(true)
+	startHour := (timemath.CurrentDateNumber() - 1) * 24
+	endHour := timemath.CurrentDateNumber() * 24
+
+	db.On("FetchKeysForHours", "302", startHour, endHour, currentRSIN).Return([]*pb.TemporaryExposureKey{randomTestKey()}, nil)
+	db.On("FetchKeysForHours", "303", startHour, endHour, currentRSIN).Return([]*pb.TemporaryExposureKey{randomTestKey(), randomTestKey()}, nil)
+
+	signer.On("Sign", mock.AnythingOfType("[]uint8")).Return(make([]byte, 64), nil)
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/retrieve/%s/%s/%s", "302,303", yesterdaysDate, goodAuth), nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "Success response is expected")
+	assert.Contains(t, resp.Header()["Content-Type"], "application/zip", "Content-Type should be set to application/zip")
+
+	zipr, err := zip.NewReader(bytes.NewReader(resp.Body.Bytes()), int64(resp.Body.Len()))
+	assert.Nil(t, err)
+	var names []string
+	for _, f := range zipr.File {
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, []string{"302.zip", "303.zip"}, names, "should contain a batch per region")
+
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "Wrote retrieval")
+	db.AssertExpectations(t)
+}
+
+// streamKeys has db stream keys for region, as StreamKeysForHours would
+func streamKeys(db *persistence.Conn, region string, startHour, endHour uint32, currentRSIN int32, keys []*pb.TemporaryExposureKey) *mock.Call {
+	return db.On("StreamKeysForHours", region, startHour, endHour, currentRSIN, mock.Anything).Return(
+		func(_ string, _, _ uint32, _ int32, fn func(*pb.TemporaryExposureKey) error) error {
+			for _, key := range keys {
+				if err := fn(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	)
+}
+
+func TestRetrieve_Streamed(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	config.AppConstants.StreamRetrieveExport = true
+	defer func() { config.AppConstants.StreamRetrieveExport = false }()
+
+	oldRegions := config.AppConstants.RetrieveRegions
+	config.AppConstants.RetrieveRegions = []string{"302", "303", "304"}
+	defer func() { config.AppConstants.RetrieveRegions = oldRegions }()
+
+	db, auth, signer := setupRetrieveMockers()
+	router := setupRetrieveRouter(db, auth, signer)
+
+	goodAuth := "abcd"
+	currentRSIN := pb.CurrentRollingStartIntervalNumber()
+	yesterdaysDate := fmt.Sprint(timemath.CurrentDateNumber() - 1)
+
+	auth.On("Authenticate", "302", yesterdaysDate, goodAuth).Return(true)
+	auth.On("Authenticate", "302,303", yesterdaysDate, goodAuth).Return(true)
+	startHour := (timemath.CurrentDateNumber() - 1) * 24
+	endHour := timemath.CurrentDateNumber() * 24
+
+	// Each batch is read once per request
+	keys := []*pb.TemporaryExposureKey{randomTestKey(), randomTestKey()}
+	streamKeys(db, "302", startHour, endHour, currentRSIN, keys).Twice()
+	streamKeys(db, "303", startHour, endHour, currentRSIN, keys[:1]).Once()
+
+	signer.On("Sign", mock.AnythingOfType("[]uint8")).Return(make([]byte, 64), nil)
+
+	// Single region
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/retrieve/%s/%s/%s", "302", yesterdaysDate, goodAuth), nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "Success response is expected")
+	assert.Equal(t, fmt.Sprint(resp.Body.Len()), resp.Header().Get("Content-Length"))
+	assert.Contains(t, resp.Header()["Content-Type"], "application/zip", "Content-Type should be set to application/zip")
+
+	// The ETag is the same as for a buffered response
+	expectedETag, _ := batchETag(keys, "302", time.Unix(int64((timemath.CurrentDateNumber()-1)*86400), 0), time.Unix(int64(timemath.CurrentDateNumber()*86400), 0))
+	assert.Equal(t, expectedETag, resp.Header().Get("ETag"))
+
+	zipr, err := zip.NewReader(bytes.NewReader(resp.Body.Bytes()), int64(resp.Body.Len()))
+	assert.Nil(t, err)
+	var names []string
+	for _, f := range zipr.File {
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, []string{"export.bin", "export.sig"}, names, "single region should be a plain export")
+
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "Wrote retrieval")
+
+	// Multiple regions
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/retrieve/%s/%s/%s", "302,303", yesterdaysDate, goodAuth), nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "Success response is expected")
+
+	zipr, err = zip.NewReader(bytes.NewReader(resp.Body.Bytes()), int64(resp.Body.Len()))
+	assert.Nil(t, err)
+	names = nil
+	for _, f := range zipr.File {
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, []string{"302.zip", "303.zip"}, names, "should contain a batch per region")
+
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "Wrote retrieval")
+	db.AssertExpectations(t)
+}
+
+func TestRetrieve_ENVersion(t *testing.T) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	config.AppConstants.NegotiateExportFormat = true
+	defer func() { config.AppConstants.NegotiateExportFormat = false }()
+
+	db, auth, signer := setupRetrieveMockers()
+	router := setupRetrieveRouter(db, auth, signer)
+
+	goodAuth := "abcd"
+	currentRSIN := pb.CurrentRollingStartIntervalNumber()
+	yesterdaysDate := fmt.Sprint(timemath.CurrentDateNumber() - 1)
+
+	auth.On("Authenticate", "302", yesterdaysDate, goodAuth).Return(true)
+	startHour := (timemath.CurrentDateNumber() - 1) * 24
+	endHour := timemath.CurrentDateNumber() * 24
+
+	// A key as storage returns it
+	onset := int32(0)
+	stored := randomTestKey()
+	stored.ReportType = pb.TemporaryExposureKey_CONFIRMED_TEST.Enum()
+	stored.DaysSinceOnsetOfSymptoms = &onset
+	db.On("FetchKeysForHours", "302", startHour, endHour, currentRSIN).Return([]*pb.TemporaryExposureKey{stored}, nil)
+
+	signer.On("Sign", mock.AnythingOfType("[]uint8")).Return(make([]byte, 64), nil)
+
+	retrieveKey := func(query, header string) (*pb.TemporaryExposureKey, *httptest.ResponseRecorder) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/retrieve/302/%s/%s%s", yesterdaysDate, goodAuth, query), nil)
+		if header != "" {
+			req.Header.Set("X-EN-Version", header)
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		assert.Equal(t, 200, resp.Code, "Success response is expected")
+
+		zipr, err := zip.NewReader(bytes.NewReader(resp.Body.Bytes()), int64(resp.Body.Len()))
+		assert.Nil(t, err)
+		rc, _ := zipr.File[0].Open()
+		defer rc.Close()
+		bin, _ := ioutil.ReadAll(rc)
+
+		var export pb.TemporaryExposureKeyExport
+		assert.Nil(t, proto.Unmarshal(bin[16:], &export))
+		assert.Len(t, export.Keys, 1)
+		return export.Keys[0], resp
+	}
+
+	// Absent, v1.5 and unknown versions get keys as stored
+	var current *httptest.ResponseRecorder
+	for _, header := range []string{"", "1.5", "9.9"} {
+		key, resp := retrieveKey("", header)
+		assert.Equal(t, pb.TemporaryExposureKey_CONFIRMED_TEST, key.GetReportType())
+		assert.Equal(t, int32(0), *key.DaysSinceOnsetOfSymptoms)
+		assert.Equal(t, "X-EN-Version", resp.Header().Get("Vary"))
+		current = resp
+	}
+
+	// v1 has only the transmission risk
+	key, v1 := retrieveKey("", "1.0")
+	assert.Nil(t, key.ReportType)
+	assert.Nil(t, key.DaysSinceOnsetOfSymptoms)
+	assert.Equal(t, int32(2), key.GetTransmissionRiskLevel())
+	assert.NotEqual(t, current.Header().Get("ETag"), v1.Header().Get("ETag"), "formats are cached separately")
+
+	// The query parameter wins over the header
+	key, _ = retrieveKey("?enVersion=1", "1.5")
+	assert.Nil(t, key.ReportType)
+}
+
+func TestRetrieve_DateRange(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	config.AppConstants.EnableRetrieveDateRange = true
+	defer func() { config.AppConstants.EnableRetrieveDateRange = false }()
+	// Ranged batches are buffered even when streaming is on
+	config.AppConstants.StreamRetrieveExport = true
+	defer func() { config.AppConstants.StreamRetrieveExport = false }()
+
+	db, auth, signer := setupRetrieveMockers()
+	router := setupRetrieveRouter(db, auth, signer)
+
+	goodAuth := "abcd"
+	currentRSIN := pb.CurrentRollingStartIntervalNumber()
+	today := timemath.CurrentDateNumber()
+	yesterdaysDate := fmt.Sprint(today - 1)
+
+	auth.On("Authenticate", "302", yesterdaysDate, goodAuth).Return(true)
+	startHour := (today - 1) * 24
+	endHour := today * 24
+
+	startRSIN, endRSIN := int32((today-5)*144), int32((today-2)*144)
+	db.On("FetchKeysForHoursInRange", "302", startHour, endHour, currentRSIN, startRSIN, endRSIN).Return([]*pb.TemporaryExposureKey{randomTestKey()}, nil)
+	signer.On("Sign", mock.AnythingOfType("[]uint8")).Return(make([]byte, 64), nil)
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/retrieve/302/%s/%s?startDate=%d&endDate=%d", yesterdaysDate, goodAuth, today-5, today-3), nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "Success response is expected")
+	assert.NotEmpty(t, resp.Header().Get("Content-Length"), "ranged response is buffered")
+	db.AssertNotCalled(t, "StreamKeysForHours", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "Wrote retrieval")
+}
+
+func TestRetrieve_InvalidDateRange(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	config.AppConstants.EnableRetrieveDateRange = true
+	defer func() { config.AppConstants.EnableRetrieveDateRange = false }()
+
+	db, auth, signer := setupRetrieveMockers()
+	router := setupRetrieveRouter(db, auth, signer)
+
+	goodAuth := "abcd"
+	today := timemath.CurrentDateNumber()
+	yesterdaysDate := fmt.Sprint(today - 1)
+	auth.On("Authenticate", "302", yesterdaysDate, goodAuth).Return(true)
+
+	for query, expected := range map[string]string{
+		fmt.Sprintf("startDate=%d", today-3):                      "startDate and endDate must both be set",
+		fmt.Sprintf("startDate=abc&endDate=%d", today-3):          "invalid startDate",
+		fmt.Sprintf("startDate=%d&endDate=%d", today-2, today-3):  "startDate is after endDate",
+		fmt.Sprintf("startDate=%d&endDate=%d", today-15, today-3): "date range outside retention window",
+		fmt.Sprintf("startDate=%d&endDate=%d", today-3, today+1):  "date range outside retention window",
+	} {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/retrieve/302/%s/%s?%s", yesterdaysDate, goodAuth, query), nil)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+
+		assert.Equal(t, 400, resp.Code, "400 response is expected for %s", query)
+		assert.Equal(t, expected+"\n", resp.Body.String())
+		testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, expected)
+	}
+	db.AssertNotCalled(t, "FetchKeysForHoursInRange", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestRetrieve_StreamedFailure(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	config.AppConstants.StreamRetrieveExport = true
+	defer func() { config.AppConstants.StreamRetrieveExport = false }()
+
+	db, auth, signer := setupRetrieveMockers()
+	router := setupRetrieveRouter(db, auth, signer)
+
+	region := "302"
+	goodAuth := "abcd"
+	currentRSIN := pb.CurrentRollingStartIntervalNumber()
+	yesterdaysDate := fmt.Sprint(timemath.CurrentDateNumber() - 1)
+
+	auth.On("Authenticate", region, yesterdaysDate, goodAuth).Return(true)
+	startHour := (timemath.CurrentDateNumber() - 1) * 24
+	endHour := timemath.CurrentDateNumber() * 24
+
+	// Fails before the headers are written: a normal error response
+	db.On("StreamKeysForHours", region, startHour, endHour, currentRSIN, mock.Anything).Return(fmt.Errorf("error")).Once()
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/retrieve/%s/%s/%s", region, yesterdaysDate, goodAuth), nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 500, resp.Code, "500 response is expected")
+	testhelpers.AssertLog(t, hook, 1, logrus.ErrorLevel, "error streaming keys")
+
+	// Fails part way through the keys: nothing has been sent yet either
+	db.On("StreamKeysForHours", region, startHour, endHour, currentRSIN, mock.Anything).Return(
+		func(_ string, _, _ uint32, _ int32, fn func(*pb.TemporaryExposureKey) error) error {
+			if err := fn(randomTestKey()); err != nil {
+				return err
+			}
+			return fmt.Errorf("error")
+		},
+	).Once()
+
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 500, resp.Code, "500 response is expected")
+	assert.Empty(t, resp.Header().Get("ETag"))
+	testhelpers.AssertLog(t, hook, 1, logrus.ErrorLevel, "error streaming keys")
+}
+
+func TestRetrieve_MultiRegionInvalid(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db, auth, signer := setupRetrieveMockers()
+	router := setupRetrieveRouter(db, auth, signer)
+
+	goodAuth := "abcd"
+	yesterdaysDate := fmt.Sprint(timemath.CurrentDateNumber() - 1)
+
+	oldRegions := config.AppConstants.RetrieveRegions
+	config.AppConstants.RetrieveRegions = []string{"302", "303", "304"}
+	defer func() { config.AppConstants.RetrieveRegions = oldRegions }()
+
+	auth.On("Authenticate", "302,303,304", yesterdaysDate, goodAuth).Return(true)
+	auth.On("Authenticate", "302,302", yesterdaysDate, goodAuth).Return(true)
+	auth.On("Authenticate", "302,305", yesterdaysDate, goodAuth).Return(true)
+	auth.On("Authenticate", "305", yesterdaysDate, goodAuth).Return(true)
+	auth.On("Authenticate", mock.Anything, mock.Anything, mock.Anything).Return(false)
+
+	oldMax := config.AppConstants.MaxRetrieveRegions
+	config.AppConstants.MaxRetrieveRegions = 2
+	defer func() { config.AppConstants.MaxRetrieveRegions = oldMax }()
+
+	// Too many regions
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/retrieve/%s/%s/%s", "302,303,304", yesterdaysDate, goodAuth), nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "too many regions requested")
+
+	// Duplicate regions
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/retrieve/%s/%s/%s", "302,302", yesterdaysDate, goodAuth), nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "duplicate region requested")
+
+	// Unknown regions, alone or in a list
+	for _, regions := range []string{"305", "302,305"} {
+		req, _ = http.NewRequest("GET", fmt.Sprintf("/retrieve/%s/%s/%s", regions, yesterdaysDate, goodAuth), nil)
+		resp = httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+
+		assert.Equal(t, 400, resp.Code, regions)
+		testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "unknown region requested")
+	}
+
+	// The HMAC has to cover the whole list
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/retrieve/%s/%s/%s", "302,303", yesterdaysDate, goodAuth), nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "401 response is expected")
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "invalid auth parameter")
+
+	// Malformed region list doesn't match a route
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/retrieve/%s/%s/%s", "302,30", yesterdaysDate, goodAuth), nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 404, resp.Code, "404 response is expected")
+}
+
 func TestRetrieve_FutureDate(t *testing.T) {
 
 	hook, oldLog := testhelpers.SetupTestLogging(&log)
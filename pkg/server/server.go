@@ -2,16 +2,23 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/Shopify/goose/genmain"
 	"github.com/Shopify/goose/logger"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
 	"github.com/cds-snc/covid-alert-server/pkg/telemetry"
 
 	// "github.com/Shopify/goose/profiler"
 	"github.com/Shopify/goose/safely"
 	"github.com/Shopify/goose/srvutil"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
 	"google.golang.org/protobuf/proto"
 	"gopkg.in/tomb.v2"
 )
@@ -28,12 +35,176 @@ func New(bind string, servlets []srvutil.Servlet) Server {
 
 	sl = srvutil.UseServlet(sl,
 		srvutil.RequestContextMiddleware,
-		srvutil.RequestMetricsMiddleware,
+		logContextMiddleware,
+		requestLogMiddleware,
 		safely.Middleware,
 		telemetry.OpenTelemetryMiddleware,
 	)
 
-	return srvutil.NewServer(&tomb.Tomb{}, bind, sl)
+	factory := serverFactory(bind, config.AppConstants.MaxConnections)
+
+	// TLS is usually terminated in front of the server. TLS_CERT_FILE and
+	// TLS_KEY_FILE are only for deployments that terminate it here.
+	// Client certificates for admin routes can only be asked for here too.
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	clientCAs := adminClientCAs()
+	if certFile != "" || keyFile != "" {
+		cfg, err := tlsConfig(config.AppConstants.TLSMinVersion, config.AppConstants.TLSCipherSuites)
+		if err != nil {
+			log(nil, err).Fatal("invalid TLS configuration")
+		}
+		if clientCAs != nil {
+			// Only admin routes need a certificate, so one is verified if
+			// given and ClientCertMiddleware rejects requests without
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+			cfg.ClientCAs = clientCAs
+		}
+		return newTLSServer(withRouterDefaults(sl), factory, cfg, certFile, keyFile)
+	}
+	if clientCAs != nil {
+		log(nil, nil).Fatal("ADMIN_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+
+	return srvutil.NewServerFromFactory(&tomb.Tomb{}, withRouterDefaults(sl), factory)
+}
+
+// Timeouts for servers with a connection limit, so that slow header writers
+// and idle keep-alive connections can't hold every slot
+const (
+	limitedReadHeaderTimeout = 10 * time.Second
+	limitedIdleTimeout       = 60 * time.Second
+)
+
+// serverFactory returns the factory building the http.Server for bind, capped
+// at maxConnections open connections when that isn't 0
+func serverFactory(bind string, maxConnections int) func(http.Handler) http.Server {
+	var readHeaderTimeout, idleTimeout time.Duration
+	if maxConnections > 0 {
+		readHeaderTimeout, idleTimeout = limitedReadHeaderTimeout, limitedIdleTimeout
+	}
+	return func(handler http.Handler) http.Server {
+		return http.Server{
+			Addr:              bind,
+			Handler:           handler,
+			ConnState:         connLimit(bind, maxConnections),
+			ReadHeaderTimeout: readHeaderTimeout,
+			IdleTimeout:       idleTimeout,
+		}
+	}
+}
+
+// connLimit returns the http.Server ConnState hook that caps the server at
+// maxConnections open connections, or nil if it is 0
+func connLimit(bind string, maxConnections int) func(net.Conn, http.ConnState) {
+	limiter := newConnLimiter(maxConnections)
+	if limiter == nil {
+		return nil
+	}
+	log(nil, nil).WithField("bind", bind).WithField("max_connections", maxConnections).Info("limiting open connections")
+	return limiter.connState
+}
+
+// logContextMiddleware attaches fields to the request context that every
+// log(ctx, ...) call downstream should carry. srvutil.RequestContextMiddleware
+// already adds the request ID, path and route variables; this adds the region
+// and the client's app version so call sites don't each repeat them.
+func logContextMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fields := logrus.Fields{}
+		if region := mux.Vars(r)["region"]; region != "" {
+			fields["region"] = region
+		}
+		if version := r.Header.Get("X-App-Version"); version != "" {
+			fields["app_version"] = version
+		}
+		if len(fields) > 0 {
+			r = r.WithContext(logger.WithFields(r.Context(), fields))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withRouterDefaults installs our fallback handlers on the root router before
+// the servlets register their routes.
+func withRouterDefaults(s srvutil.Servlet) srvutil.Servlet {
+	return srvutil.InlineServlet(func(r *mux.Router) {
+		setRouterDefaults(r)
+		s.RegisterRouting(r)
+	})
+}
+
+func setRouterDefaults(r *mux.Router) {
+	r.NotFoundHandler = http.HandlerFunc(notFound)
+	r.MethodNotAllowedHandler = methodNotAllowed(r)
+}
+
+// notFound replaces mux's plain-text 404 so unknown paths get the same small
+// JSON shape across the API. The path is logged at debug to help spot
+// misrouted clients and scanners without flooding the logs.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log(ctx, nil).WithField("path", r.URL.Path).Debug("no route for path")
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusNotFound)
+	if _, err := w.Write([]byte(`{"error":"not found"}` + "\n")); err != nil {
+		log(ctx, err).Info("error writing response")
+	}
+}
+
+// methodNotAllowed answers requests whose path matched a route restricted with
+// Methods() but whose method did not. mux doesn't tell the handler which
+// methods would have matched, so they are worked out again from root to fill
+// in the Allow header.
+func methodNotAllowed(root *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log(ctx, nil).WithField("method", r.Method).WithField("path", r.URL.Path).Info("method not allowed")
+
+		w.Header().Set("Allow", strings.Join(allowedMethods(root, r), ", "))
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		if _, err := w.Write([]byte(`{"error":"method not allowed"}` + "\n")); err != nil {
+			log(ctx, err).Info("error writing response")
+		}
+	})
+}
+
+func allowedMethods(root *mux.Router, r *http.Request) []string {
+	var allowed []string
+	seen := map[string]bool{}
+	root.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			if seen[method] {
+				continue
+			}
+			probe := r.Clone(r.Context())
+			probe.Method = method
+			var match mux.RouteMatch
+			if route.Match(probe, &match) && match.MatchErr == nil {
+				seen[method] = true
+				allowed = append(allowed, method)
+			}
+		}
+		return nil
+	})
+	return allowed
+}
+
+// prefixedRouter returns a subrouter mounted under ROUTE_PREFIX (e.g. "/v1"),
+// for deployments behind a gateway that forwards a path prefix unchanged.
+// With no prefix set the router is returned as is and paths are unchanged.
+func prefixedRouter(r *mux.Router) *mux.Router {
+	if prefix := os.Getenv("ROUTE_PREFIX"); prefix != "" {
+		return r.PathPrefix(prefix).Subrouter()
+	}
+	return r
 }
 
 func requestError(
@@ -11,6 +11,7 @@ import (
 	"github.com/Shopify/goose/logger"
 	"github.com/Shopify/goose/safely"
 	"github.com/Shopify/goose/srvutil"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
 	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
 	"github.com/cds-snc/covid-alert-server/pkg/telemetry"
 	"github.com/sirupsen/logrus"
@@ -29,7 +30,8 @@ func TestNew(t *testing.T) {
 
 	sl = srvutil.UseServlet(sl,
 		srvutil.RequestContextMiddleware,
-		srvutil.RequestMetricsMiddleware,
+		logContextMiddleware,
+		requestLogMiddleware,
 		safely.Middleware,
 		telemetry.OpenTelemetryMiddleware,
 	)
@@ -39,6 +41,107 @@ func TestNew(t *testing.T) {
 
 }
 
+func TestLogContextMiddleware(t *testing.T) {
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logger.ContextLog(ctx, err, logrus.NewEntry(nullLog))
+	}
+
+	router := Router()
+	router.Use(srvutil.RequestContextMiddleware, logContextMiddleware)
+	router.HandleFunc("/retrieve/{region}", func(w http.ResponseWriter, r *http.Request) {
+		log(r.Context(), nil).Info("handled")
+	})
+
+	req, _ := http.NewRequest("GET", "/retrieve/302", nil)
+	req.Header.Set(srvutil.UUIDHeaderKey, "abc-123")
+	req.Header.Set("X-App-Version", "1.2.0")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	entry := hook.LastEntry()
+	assert.Equal(t, "handled", entry.Message)
+	assert.Equal(t, "abc-123", entry.Data[logger.UUIDKey])
+	assert.Equal(t, "/retrieve/302", entry.Data[srvutil.PathKey])
+	assert.Equal(t, "302", entry.Data["region"])
+	assert.Equal(t, "1.2.0", entry.Data["app_version"])
+}
+
+func TestRequestLogMiddleware(t *testing.T) {
+	oldLog := log
+	defer func() { log = oldLog }()
+
+	nullLog, hook := test.NewNullLogger()
+	log = func(ctx logger.Valuer, err ...error) *logrus.Entry {
+		return logger.ContextLog(ctx, err, logrus.NewEntry(nullLog))
+	}
+
+	oldLevels := config.AppConstants.RequestLogLevels
+	config.AppConstants.RequestLogLevels = []string{"retrieve=debug", "upload=warn"}
+	defer func() { config.AppConstants.RequestLogLevels = oldLevels }()
+
+	router := Router()
+	router.Use(requestLogMiddleware)
+	handler := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) }
+	router.HandleFunc("/retrieve/{region}", handler)
+	router.HandleFunc("/upload", handler)
+	router.HandleFunc("/claim-key", handler)
+
+	serve := func(path string) {
+		req, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Configured to debug, so nothing is emitted at the default info level
+	serve("/retrieve/302")
+	assert.Equal(t, 0, len(hook.Entries))
+
+	serve("/upload")
+	assert.Equal(t, logrus.WarnLevel, hook.Entries[0].Level)
+	assert.Equal(t, "http request", hook.Entries[0].Message)
+	testhelpers.AssertLog(t, hook, 2, logrus.WarnLevel, "http response")
+
+	// Unlisted routes use the default level
+	serve("/claim-key")
+	assert.Equal(t, 418, hook.LastEntry().Data["statusCode"])
+	testhelpers.AssertLog(t, hook, 2, logrus.InfoLevel, "http response")
+}
+
+func TestRequestLogLevel(t *testing.T) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	oldLevel, oldLevels := config.AppConstants.RequestLogLevel, config.AppConstants.RequestLogLevels
+	config.AppConstants.RequestLogLevel = "warn"
+	config.AppConstants.RequestLogLevels = []string{"retrieve=loud", " events = debug "}
+	defer func() {
+		config.AppConstants.RequestLogLevel = oldLevel
+		config.AppConstants.RequestLogLevels = oldLevels
+	}()
+
+	assert.Equal(t, logrus.DebugLevel, requestLogLevel("events"))
+	assert.Equal(t, logrus.WarnLevel, requestLogLevel("retrieve"), "invalid entries fall back to the default")
+	assert.Equal(t, logrus.WarnLevel, requestLogLevel("upload"))
+
+	config.AppConstants.RequestLogLevel = ""
+	assert.Equal(t, logrus.InfoLevel, requestLogLevel("upload"))
+}
+
+func TestNotFound(t *testing.T) {
+	router := Router()
+	NewUploadServlet(nil, nil).RegisterRouting(router)
+
+	req, _ := http.NewRequest("GET", "/no/such/route", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"error":"not found"}`, resp.Body.String())
+}
+
 func TestRequestError(t *testing.T) {
 	// Capture logs
 	oldLog := log
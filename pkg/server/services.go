@@ -3,8 +3,10 @@ package server
 import (
 	"encoding/json"
 	"net/http"
+	"sync/atomic"
 
 	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/telemetry"
 
 	"github.com/Shopify/goose/srvutil"
 	"github.com/gorilla/mux"
@@ -13,6 +15,23 @@ import (
 var branch string
 var revision string
 
+func init() {
+	telemetry.SetBuildInfo(branch, revision)
+}
+
+// ready is set once startup warmup is done, see MarkReady
+var ready int32
+
+// MarkReady makes /services/ready report healthy
+func MarkReady() {
+	atomic.StoreInt32(&ready, 1)
+}
+
+// IsReady reports whether MarkReady has been called
+func IsReady() bool {
+	return atomic.LoadInt32(&ready) == 1
+}
+
 func NewServicesServlet() srvutil.Servlet {
 	s := &servicesServlet{}
 	return srvutil.PrefixServlet(s, "/services")
@@ -31,6 +50,7 @@ type featureFlags struct {
 
 func (s *servicesServlet) RegisterRouting(r *mux.Router) {
 	r.HandleFunc("/ping", s.ping)
+	r.HandleFunc("/ready", s.ready)
 	r.HandleFunc("/present", s.exposurePresence)
 	r.HandleFunc("/version.json", s.version)
 	r.HandleFunc("/featureFlags.json", s.featureFlags)
@@ -50,6 +70,23 @@ func (s *servicesServlet) ping(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ready is the readiness check: unlike ping it fails until warmup is done,
+// so the load balancer holds traffic back while pools are still cold
+func (s *servicesServlet) ready(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	w.Header().Add("Cache-Control", "no-store")
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+
+	body := "OK\n"
+	if !IsReady() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		body = "warming up\n"
+	}
+	if _, err := w.Write([]byte(body)); err != nil {
+		log(ctx, err).Info("error writing response")
+	}
+}
+
 func (s *servicesServlet) featureFlags(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
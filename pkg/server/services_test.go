@@ -6,6 +6,7 @@ import (
 	"net/http/httptest"
 	"reflect"
 	"runtime"
+	"sync/atomic"
 	"testing"
 
 	"github.com/Shopify/goose/srvutil"
@@ -29,6 +30,7 @@ func TestRegisterRoutingServices(t *testing.T) {
 
 	expectedPaths := GetPaths(router)
 	assert.Contains(t, expectedPaths, "/services/ping", "should include a ping path")
+	assert.Contains(t, expectedPaths, "/services/ready", "should include a ready path")
 	assert.Contains(t, expectedPaths, "/services/version.json", "should include a version.json path")
 	assert.Contains(t, expectedPaths, "/services/present", "should include a present path")
 
@@ -51,6 +53,29 @@ func TestPing(t *testing.T) {
 	assert.Contains(t, resp.Header()["Content-Type"], "text/plain; charset=utf-8", "Cache-Type should be set to text/plain; charset=utf-8")
 }
 
+func TestReady(t *testing.T) {
+	defer atomic.StoreInt32(&ready, 0)
+
+	servlet := NewServicesServlet()
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	req, _ := http.NewRequest("GET", "/services/ready", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 503, resp.Code, "not ready before warmup is done")
+	assert.Equal(t, "warming up\n", string(resp.Body.Bytes()))
+
+	MarkReady()
+
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "ready after warmup is done")
+	assert.Equal(t, "OK\n", string(resp.Body.Bytes()))
+}
+
 func TestPresent(t *testing.T) {
 	servlet := NewServicesServlet()
 	router := Router()
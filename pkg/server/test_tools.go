@@ -27,6 +27,7 @@ func (t testToolsServlet) RegisterRouting(r *mux.Router) {
 		panic("attempting to enable test tools in production")
 	}
 	log(nil, nil).Info("registering admin routes")
+	r = adminRouter(prefixedRouter(r))
 	r.HandleFunc("/clear-diagnosis-keys", t.clearDiagnosisKeys)
 
 }
@@ -46,14 +47,16 @@ func (t *testToolsServlet) clearDiagnosisKeys(w http.ResponseWriter, r *http.Req
 	}
 
 	hdr := r.Header.Get("Authorization")
-	_, _, ok := t.auth.RegionFromAuthHeader(hdr)
+	region, token, ok := t.auth.RegionFromAuthHeader(hdr)
 	if !ok {
-		log(ctx, nil).WithField("header", hdr).Info("bad auth header")
+		log(ctx, nil).WithField("header", authHeaderForLogs(hdr)).Info("bad auth header")
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	if err := t.db.ClearDiagnosisKeys(ctx); err != nil {
+	err := t.db.ClearDiagnosisKeys(ctx)
+	auditAction(r, auditActor(r, region, token), "clear-diagnosis-keys", "diagnosis_keys", err)
+	if err != nil {
 		log(ctx, err).Error("unable to clear diagnosis_keys")
 		http.Error(w, "unable to clear diagnosis_keys", http.StatusInternalServerError)
 		return
@@ -77,7 +77,7 @@ func TestTestToolsServlet_BadAuthToken(t *testing.T) {
 	defer func() { log = *oldLog }()
 
 	// Bad auth token
-	req, _ := http.NewRequest("POST", "/clear-diagnosis-keys", nil)
+	req := adminRequest("POST", "/clear-diagnosis-keys")
 	req.Header.Set("Authorization", "Bearer badtoken")
 
 	resp := httptest.NewRecorder()
@@ -101,7 +101,7 @@ func TestTestToolsServlet_NoAuthHeader(t *testing.T) {
 	hook, oldLog := testhelpers.SetupTestLogging(&log)
 	defer func() { log = *oldLog }()
 
-	req, _ := http.NewRequest("POST", "/clear-diagnosis-keys", nil)
+	req := adminRequest("POST", "/clear-diagnosis-keys")
 	resp := httptest.NewRecorder()
 	router.ServeHTTP(resp, req)
 
@@ -121,7 +121,7 @@ func TestTestToolsServlet_GET(t *testing.T) {
 	hook, oldLog := testhelpers.SetupTestLogging(&log)
 	defer func() { log = *oldLog }()
 
-	req, _ := http.NewRequest("GET", "/clear-diagnosis-keys", nil)
+	req := adminRequest("GET", "/clear-diagnosis-keys")
 	resp := httptest.NewRecorder()
 	router.ServeHTTP(resp, req)
 
@@ -144,7 +144,7 @@ func TestTestToolsServlet_ClearDiagnosisKeys(t *testing.T) {
 	hook, oldLog := testhelpers.SetupTestLogging(&log)
 	defer func() { log = *oldLog }()
 
-	req, _ := http.NewRequest("POST", "/clear-diagnosis-keys", nil)
+	req := adminRequest("POST", "/clear-diagnosis-keys")
 	req.Header.Set("Authorization", "Bearer goodtoken")
 	resp := httptest.NewRecorder()
 	router.ServeHTTP(resp, req)
@@ -169,7 +169,7 @@ func TestTestToolsServlet_ClearDiagnosisKeysFailed(t *testing.T) {
 	hook, oldLog := testhelpers.SetupTestLogging(&log)
 	defer func() { log = *oldLog }()
 
-	req, _ := http.NewRequest("POST", "/clear-diagnosis-keys", nil)
+	req := adminRequest("POST", "/clear-diagnosis-keys")
 	req.Header.Set("Authorization", "Bearer goodtoken")
 	resp := httptest.NewRecorder()
 	router.ServeHTTP(resp, req)
@@ -180,3 +180,35 @@ func TestTestToolsServlet_ClearDiagnosisKeysFailed(t *testing.T) {
 	testhelpers.AssertLog(t, hook, 1, logrus.ErrorLevel, "unable to clear diagnosis_keys")
 
 }
+
+func TestTestToolsServlet_ClearDiagnosisKeysAudited(t *testing.T) {
+	os.Setenv("ENABLE_TEST_TOOLS", "true")
+
+	db := &persistence.Conn{}
+	db.On("ClearDiagnosisKeys", mock.Anything).Return(nil)
+
+	auth := &keyclaim.Authenticator{}
+	auth.On("RegionFromAuthHeader", "Bearer goodtoken").Return("ONApi", "goodtoken", true)
+
+	router := buildAdminToolsServletRouter(db, auth)
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+	auditHook, oldAuditLog := testhelpers.SetupTestLogging(&auditLog)
+	defer func() { auditLog = *oldAuditLog }()
+
+	req := adminRequest("POST", "/clear-diagnosis-keys")
+	req.Header.Set("Authorization", "Bearer goodtoken")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code, "OK status expected")
+
+	entry := auditHook.LastEntry()
+	assert.Equal(t, "token:ONApi", entry.Data["actor"])
+	assert.Equal(t, "clear-diagnosis-keys", entry.Data["action"])
+	assert.Equal(t, "diagnosis_keys", entry.Data["target"])
+	assert.Equal(t, "success", entry.Data["result"])
+	assert.NotEmpty(t, entry.Data["timestamp"])
+
+	testhelpers.AssertLog(t, auditHook, 1, logrus.InfoLevel, "admin action")
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Shopify/goose/logger"
+	"github.com/Shopify/goose/srvutil"
+	"github.com/gorilla/mux"
+	"gopkg.in/tomb.v2"
+)
+
+// tlsVersions are the values tlsMinVersion accepts. Anything older than TLS
+// 1.2 is refused outright.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// defaultCipherSuites is used when tlsCipherSuites is empty: forward secret
+// AEAD suites only
+var defaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// tlsConfig builds the TLS settings from tlsMinVersion and tlsCipherSuites.
+// Cipher suites are named as in crypto/tls, and those it considers insecure
+// are rejected. They only apply up to TLS 1.2; TLS 1.3 suites are fixed.
+func tlsConfig(minVersion string, cipherSuites []string) (*tls.Config, error) {
+	version, ok := tlsVersions[strings.TrimSpace(minVersion)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported tlsMinVersion %q", minVersion)
+	}
+
+	suites := defaultCipherSuites
+	if len(cipherSuites) > 0 {
+		byName := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			byName[suite.Name] = suite.ID
+		}
+		suites = make([]uint16, 0, len(cipherSuites))
+		for _, name := range cipherSuites {
+			id, ok := byName[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+			}
+			suites = append(suites, id)
+		}
+	}
+
+	return &tls.Config{
+		MinVersion:               version,
+		CipherSuites:             suites,
+		PreferServerCipherSuites: true,
+	}, nil
+}
+
+// tlsServer is srvutil's server for when TLS is terminated in-process: it
+// serves over TLS with certFile and keyFile and shuts down the same way.
+type tlsServer struct {
+	server            http.Server
+	certFile, keyFile string
+	tomb              *tomb.Tomb
+
+	haveAddr chan struct{}
+	addr     *net.TCPAddr
+}
+
+func newTLSServer(servlet srvutil.Servlet, factory srvutil.ServerFactory, cfg *tls.Config, certFile, keyFile string) *tlsServer {
+	router := mux.NewRouter()
+	servlet.RegisterRouting(router)
+
+	s := &tlsServer{
+		server:   factory(router),
+		certFile: certFile,
+		keyFile:  keyFile,
+		tomb:     &tomb.Tomb{},
+		haveAddr: make(chan struct{}),
+	}
+	s.server.TLSConfig = cfg
+	return s
+}
+
+func (s *tlsServer) Tomb() *tomb.Tomb {
+	return s.tomb
+}
+
+// Addr blocks until Run is listening, and returns nil if it failed to
+func (s *tlsServer) Addr() *net.TCPAddr {
+	<-s.haveAddr
+	return s.addr
+}
+
+func (s *tlsServer) Run() error {
+	ctx := logger.WithField(context.Background(), "bind", s.server.Addr)
+
+	ln, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		close(s.haveAddr)
+		return err
+	}
+	s.addr = ln.Addr().(*net.TCPAddr)
+	close(s.haveAddr)
+
+	log(ctx, nil).WithField("addr", s.addr.String()).Info("started TLS server")
+
+	shutdown := make(chan error, 1)
+	go func() {
+		<-s.tomb.Dying()
+		log(ctx, s.tomb.Err()).Info("shutting down server")
+		shutdown <- s.server.Shutdown(context.Background())
+	}()
+
+	if err := s.server.ServeTLS(ln, s.certFile, s.keyFile); err != http.ErrServerClosed {
+		return err
+	}
+	return <-shutdown
+}
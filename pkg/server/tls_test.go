@@ -0,0 +1,137 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shopify/goose/srvutil"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSConfig(t *testing.T) {
+	cfg, err := tlsConfig("1.2", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), cfg.MinVersion)
+	assert.Equal(t, defaultCipherSuites, cfg.CipherSuites)
+
+	cfg, err = tlsConfig("1.3", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", " TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), cfg.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, cfg.CipherSuites)
+
+	for _, version := range []string{"", "1.0", "1.1", "TLS1.2"} {
+		_, err = tlsConfig(version, nil)
+		assert.NotNil(t, err, version)
+	}
+
+	for _, suite := range []string{"TLS_RSA_WITH_RC4_128_SHA", "TLS_MADE_UP"} {
+		_, err = tlsConfig("1.2", []string{suite})
+		assert.NotNil(t, err, suite)
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key to
+// dir
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	assert.Nil(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestNew_TLS(t *testing.T) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir)
+
+	os.Setenv("TLS_CERT_FILE", certFile)
+	os.Setenv("TLS_KEY_FILE", keyFile)
+	defer os.Unsetenv("TLS_CERT_FILE")
+	defer os.Unsetenv("TLS_KEY_FILE")
+
+	config.AppConstants.TLSMinVersion = "1.3"
+	defer func() { config.AppConstants.TLSMinVersion = "1.2" }()
+
+	srv := New("127.0.0.1:0", []srvutil.Servlet{NewServicesServlet()})
+	tlsSrv, ok := srv.(*tlsServer)
+	assert.True(t, ok, "expected a TLS server")
+	assert.Equal(t, uint16(tls.VersionTLS13), tlsSrv.server.TLSConfig.MinVersion)
+
+	go func() { _ = srv.Run() }()
+	defer srv.Tomb().Kill(nil)
+	addr := "https://" + srv.Addr().String() + "/services/ping"
+
+	client := func(maxVersion uint16) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			MaxVersion:         maxVersion,
+		}}}
+	}
+
+	// Clients that can't meet the minimum version are refused
+	_, err := client(tls.VersionTLS12).Get(addr)
+	assert.NotNil(t, err)
+
+	resp, err := client(tls.VersionTLS13).Get(addr)
+	assert.Nil(t, err)
+	if resp != nil {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, uint16(tls.VersionTLS13), resp.TLS.Version)
+	}
+}
+
+func TestTLSServer_ListenError(t *testing.T) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	servlet := srvutil.InlineServlet(func(r *mux.Router) {})
+	factory := func(handler http.Handler) http.Server {
+		return http.Server{Addr: "256.0.0.1:0", Handler: handler}
+	}
+	srv := newTLSServer(servlet, factory, &tls.Config{}, "cert.pem", "key.pem")
+
+	assert.NotNil(t, srv.Run())
+
+	addr := make(chan *net.TCPAddr)
+	go func() { addr <- srv.Addr() }()
+	select {
+	case a := <-addr:
+		assert.Nil(t, a, "no address when listening failed")
+	case <-time.After(time.Second):
+		t.Fatal("Addr blocked after Run failed to listen")
+	}
+}
@@ -1,113 +1,338 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io/ioutil"
-	"math"
 	"net/http"
-	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/cds-snc/covid-alert-server/pkg/config"
 	"github.com/cds-snc/covid-alert-server/pkg/persistence"
 	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
 
 	"github.com/Shopify/goose/srvutil"
 	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/metric"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/api/unit"
 	"golang.org/x/crypto/nacl/box"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-func NewUploadServlet(db persistence.Conn) srvutil.Servlet {
-	return &uploadServlet{db: db}
+var uploadRequestSize = metric.Must(global.Meter("covidshield")).NewInt64ValueRecorder("covidshield.upload.request.size",
+	metric.WithDescription("Size of upload request bodies"),
+	metric.WithUnit(unit.Bytes),
+)
+
+var uploadRejections = metric.Must(global.Meter("covidshield")).NewInt64Counter("covidshield.upload.rejections",
+	metric.WithDescription("Number of rejected uploads by error code"),
+)
+
+var uploadLateRejections = metric.Must(global.Meter("covidshield")).NewInt64Counter("covidshield.upload.late",
+	metric.WithDescription("Number of uploads rejected for a timestamp too far in the past"),
+)
+
+var uploadKeyCount = metric.Must(global.Meter("covidshield")).NewInt64ValueRecorder("covidshield.upload.keys",
+	metric.WithDescription("Number of keys in each valid upload"),
+)
+
+var uploadStoredKeys = metric.Must(global.Meter("covidshield")).NewInt64Counter("covidshield.upload.stored_keys",
+	metric.WithDescription("Number of uploaded keys stored, or skipped because their data was already stored, by result"),
+)
+
+// Clock supplies the current time to the upload timestamp check, so tests
+// can pin it rather than offset against the real time.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func NewUploadServlet(db persistence.Conn, resolver persistence.KeyResolver) srvutil.Servlet {
+	SetUploadEnabledRegions(context.Background(), config.AppConstants.UploadEnabledRegions)
+	return &uploadServlet{
+		db:          db,
+		resolver:    resolver,
+		clock:       systemClock{},
+		storeSlots:  newStoreSlots(config.AppConstants.MaxConcurrentStoreKeys),
+		maintenance: newMaintenanceMode(db),
+		guard:       uploadGuardFromConfig(db),
+		rejections:  rejectionBufferFromConfig(db),
+	}
 }
 
 type uploadServlet struct {
-	db persistence.Conn
+	db       persistence.Conn
+	resolver persistence.KeyResolver
+	clock    Clock
+	// storeSlots bounds the number of StoreKeys calls in flight; nil means no limit
+	storeSlots  chan struct{}
+	maintenance *maintenanceMode
+	// guard and rejections see every rejected upload, see uploadRejected; nil
+	// means none
+	guard      *uploadGuard
+	rejections *rejectionBuffer
+}
+
+type uploadServletKey struct{}
+
+// withUploadServlet records the servlet handling the upload, so uploadRejected
+// can reach it
+func withUploadServlet(ctx context.Context, s *uploadServlet) context.Context {
+	return context.WithValue(ctx, uploadServletKey{}, s)
+}
+
+func newStoreSlots(limit int) chan struct{} {
+	if limit <= 0 {
+		return nil
+	}
+	return make(chan struct{}, limit)
+}
+
+// acquireStoreSlot waits up to StoreKeysWaitMilliseconds for a free slot so a
+// surge of uploads queues briefly instead of piling onto the database. The
+// returned release func must be called once the store is done.
+func (s *uploadServlet) acquireStoreSlot(ctx context.Context) (func(), bool) {
+	if s.storeSlots == nil {
+		return func() {}, true
+	}
+
+	timer := time.NewTimer(time.Duration(config.AppConstants.StoreKeysWaitMilliseconds) * time.Millisecond)
+	defer timer.Stop()
+
+	select {
+	case s.storeSlots <- struct{}{}:
+		return func() { <-s.storeSlots }, true
+	case <-timer.C:
+		return nil, false
+	case <-ctx.Done():
+		return nil, false
+	}
 }
 
 func (s *uploadServlet) RegisterRouting(r *mux.Router) {
-	r.HandleFunc("/upload", s.upload)
+	r = prefixedRouter(r)
+	r.HandleFunc("/upload", s.upload).Methods(http.MethodPost)
+	if config.AppConstants.AnswerUploadOptions {
+		r.HandleFunc("/upload", uploadOptions).Methods(http.MethodOptions)
+	}
+}
+
+// uploadOptions answers a preflight with the methods /upload accepts
+func uploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", http.MethodPost)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadErrorCodeKey is the span attribute recording how an upload ended
+const uploadErrorCodeKey = kv.Key("upload.error_code")
+
+// uploadSpan starts a span for the upload handler or one of its stages. It is
+// a no-op unless a trace provider has been configured.
+func uploadSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return global.Tracer("covidshield/upload").Start(ctx, name)
 }
 
 func uploadError(errCode pb.EncryptedUploadResponse_ErrorCode) *pb.EncryptedUploadResponse {
 	return &pb.EncryptedUploadResponse{Error: &errCode}
 }
 
+// uploadRejected counts the rejection by error code and writes it as the response
+func uploadRejected(
+	ctx context.Context, w http.ResponseWriter, err error,
+	logMessage string, code int, errCode pb.EncryptedUploadResponse_ErrorCode,
+) result {
+	uploadRejections.Add(ctx, 1, kv.String("reason", errCode.String()))
+	if s, ok := ctx.Value(uploadServletKey{}).(*uploadServlet); ok {
+		s.rejections.record(errCode.String(), s.clock.Now())
+		s.guard.observe(ctx, errCode, s.clock.Now())
+	}
+	trace.SpanFromContext(ctx).SetAttributes(uploadErrorCodeKey.String(errCode.String()))
+	if code == http.StatusBadRequest {
+		code = uploadErrorStatus(ctx, errCode)
+	}
+	return requestError(ctx, w, err, logMessage, code, uploadError(errCode))
+}
+
+// dbUnavailable reports whether err means the database can't serve the call
+// right now, so the client should retry later rather than give up
+func dbUnavailable(err error) bool {
+	return err == persistence.ErrCircuitOpen ||
+		errors.Is(err, persistence.ErrDBUnavailable) ||
+		errors.Is(err, persistence.ErrDBTimeout) ||
+		errors.Is(err, persistence.ErrDBConflict)
+}
+
+// uploadErrorStatus returns the HTTP status configured for errCode in
+// uploadErrorStatuses, or 400 if there is none
+func uploadErrorStatus(ctx context.Context, errCode pb.EncryptedUploadResponse_ErrorCode) int {
+	for _, entry := range config.AppConstants.UploadErrorStatuses {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != errCode.String() {
+			continue
+		}
+		status, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || status < 400 || status > 499 {
+			log(ctx, err).WithField("entry", entry).Warn("ignoring invalid uploadErrorStatuses entry")
+			continue
+		}
+		return status
+	}
+	return http.StatusBadRequest
+}
+
 func (s *uploadServlet) upload(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+	ctx, span := uploadSpan(r.Context(), "upload")
+	defer span.End()
+	ctx = withUploadSource(withUploadServlet(ctx, s), getIP(r))
 
 	w.Header().Add("Content-Type", "application/x-protobuf")
 
+	if s.maintenance.enabled(ctx) {
+		setRetryAfter(ctx, w, "upload")
+		uploadRejected(
+			ctx, w, nil, "upload rejected during maintenance",
+			http.StatusServiceUnavailable, pb.EncryptedUploadResponse_MAINTENANCE,
+		)
+		return
+	}
+
+	if s.guard.blocks(uploadSource(ctx), s.clock.Now()) {
+		uploadRejected(
+			ctx, w, nil, "upload source is blocked",
+			http.StatusUnauthorized, pb.EncryptedUploadResponse_INVALID_KEYPAIR,
+		)
+		return
+	}
+
+	if !appVersionAccepted(r.Header.Get("X-App-Version")) {
+		uploadRejected(
+			ctx, w, nil, "app version below minimum, app must be updated",
+			http.StatusBadRequest, pb.EncryptedUploadResponse_APP_VERSION_TOO_OLD,
+		)
+		return
+	}
+
 	reader := http.MaxBytesReader(w, r.Body, 1024)
 	data, err := ioutil.ReadAll(reader)
+	// Recorded before any error handling so oversized and malformed requests are included
+	uploadRequestSize.Record(ctx, int64(len(data)))
 	if err != nil {
-		requestError(
+		uploadRejected(
 			ctx, w, err, "error reading request",
-			http.StatusBadRequest, uploadError(pb.EncryptedUploadResponse_UNKNOWN),
+			http.StatusBadRequest, pb.EncryptedUploadResponse_UNKNOWN,
 		)
 		return
 	}
 
 	var seu pb.EncryptedUploadRequest
 	if err := proto.Unmarshal(data, &seu); err != nil {
-		requestError(
+		uploadRejected(
 			ctx, w, err, "error unmarshalling request",
-			http.StatusBadRequest, uploadError(pb.EncryptedUploadResponse_UNKNOWN),
+			http.StatusBadRequest, pb.EncryptedUploadResponse_UNKNOWN,
+		)
+		return
+	}
+
+	if config.AppConstants.StrictUploadUnmarshal && hasUnknownFields(seu.ProtoReflect()) {
+		uploadRejected(
+			ctx, w, nil, "unknown fields in request",
+			http.StatusBadRequest, pb.EncryptedUploadResponse_INVALID_PAYLOAD,
 		)
 		return
 	}
 
 	serverPub := seu.ServerPublicKey
 	if len(serverPub) != pb.KeyLength {
-		requestError(
+		uploadRejected(
 			ctx, w, err, "server public key was not expected length",
-			http.StatusBadRequest, uploadError(pb.EncryptedUploadResponse_INVALID_CRYPTO_PARAMETERS),
+			http.StatusBadRequest, pb.EncryptedUploadResponse_INVALID_CRYPTO_PARAMETERS,
 		)
 		return
 	}
 
-	serverPriv, err := s.db.PrivForPub(serverPub)
-	if err != nil {
-		requestError(
+	if !serverKeyAllowed(ctx, serverPub) {
+		log(ctx, nil).WithField("security", true).Error("upload presented a server public key outside the allowlist")
+		uploadRejected(
+			ctx, w, nil, "server public key not allowed",
+			http.StatusUnauthorized, pb.EncryptedUploadResponse_INVALID_KEYPAIR,
+		)
+		return
+	}
+
+	serverPriv, err := s.resolver.PrivForPub(serverPub)
+	if dbUnavailable(err) {
+		uploadRejected(
+			ctx, w, err, "database unavailable",
+			http.StatusServiceUnavailable, pb.EncryptedUploadResponse_SERVER_ERROR,
+		)
+		return
+	} else if err != nil {
+		uploadRejected(
 			ctx, w, err, "failure to resolve client keypair",
-			http.StatusUnauthorized, uploadError(pb.EncryptedUploadResponse_INVALID_KEYPAIR),
+			http.StatusUnauthorized, pb.EncryptedUploadResponse_INVALID_KEYPAIR,
 		)
 		return
 	}
 
 	nonce, err := pb.IntoNonce(seu.Nonce)
 	if err != nil {
-		requestError(
+		uploadRejected(
 			ctx, w, err, "nonce was not expected length",
-			http.StatusBadRequest, uploadError(pb.EncryptedUploadResponse_INVALID_CRYPTO_PARAMETERS),
+			http.StatusBadRequest, pb.EncryptedUploadResponse_INVALID_CRYPTO_PARAMETERS,
 		)
 		return
 	}
 
 	appPubKey, err := pb.IntoKey(seu.AppPublicKey)
 	if err != nil {
-		requestError(
+		uploadRejected(
 			ctx, w, err, "app public key key was not expected length",
-			http.StatusBadRequest, uploadError(pb.EncryptedUploadResponse_INVALID_CRYPTO_PARAMETERS),
+			http.StatusBadRequest, pb.EncryptedUploadResponse_INVALID_CRYPTO_PARAMETERS,
 		)
 		return
 	}
+	ctx = withUploadKeypair(ctx, appPubKey)
 
 	privKey, err := pb.IntoKey(serverPriv)
 	if err != nil {
-		requestError(
+		uploadRejected(
 			ctx, w, err, "server private key was not expected length",
-			http.StatusInternalServerError, uploadError(pb.EncryptedUploadResponse_SERVER_ERROR),
+			http.StatusInternalServerError, pb.EncryptedUploadResponse_SERVER_ERROR,
 		)
 		return
 	}
 
 	// decrypt payload
+	_, decryptSpan := uploadSpan(ctx, "decrypt")
 	plaintext, ok := box.Open(nil, seu.Payload, nonce, appPubKey, privKey)
+	decryptSpan.End()
 	if !ok {
-		requestError(
+		uploadRejected(
 			ctx, w, nil, "failure to decrypt payload",
-			http.StatusBadRequest, uploadError(pb.EncryptedUploadResponse_DECRYPTION_FAILED),
+			http.StatusBadRequest, pb.EncryptedUploadResponse_DECRYPTION_FAILED,
+		)
+		return
+	}
+
+	// reject oversized payloads before spending time unmarshalling them
+	if len(plaintext) > config.AppConstants.MaxUploadPayloadBytes {
+		uploadRejected(
+			ctx, w, nil, "decrypted payload too large",
+			http.StatusBadRequest, pb.EncryptedUploadResponse_INVALID_PAYLOAD,
 		)
 		return
 	}
@@ -115,69 +340,231 @@ func (s *uploadServlet) upload(w http.ResponseWriter, r *http.Request) {
 	// unmarshall into Upload
 	var upload pb.Upload
 	if err := proto.Unmarshal(plaintext, &upload); err != nil {
-		requestError(
+		uploadRejected(
 			ctx, w, err, "error unmarshalling request payload",
-			http.StatusBadRequest, uploadError(pb.EncryptedUploadResponse_INVALID_PAYLOAD),
+			http.StatusBadRequest, pb.EncryptedUploadResponse_INVALID_PAYLOAD,
+		)
+		return
+	}
+
+	if config.AppConstants.StrictUploadUnmarshal && hasUnknownFields(upload.ProtoReflect()) {
+		uploadRejected(
+			ctx, w, nil, "unknown fields in request payload",
+			http.StatusBadRequest, pb.EncryptedUploadResponse_INVALID_PAYLOAD,
 		)
 		return
 	}
 
+	if len(upload.GetKeys()) == 0 && config.AppConstants.AcceptEmptyUploads {
+		log(ctx, nil).Info("accepted upload with no keys")
+		span.SetAttributes(uploadErrorCodeKey.String(pb.EncryptedUploadResponse_NONE.String()))
+		data, err = proto.Marshal(uploadError(pb.EncryptedUploadResponse_NONE))
+		if err != nil {
+			uploadRejected(
+				ctx, w, err, "error marshalling response",
+				http.StatusInternalServerError, pb.EncryptedUploadResponse_SERVER_ERROR,
+			)
+			return
+		}
+		if _, err := w.Write(data); err != nil {
+			log(ctx, err).Info("error writing response")
+		}
+		return
+	}
+
 	if len(upload.GetKeys()) == 0 {
-		requestError(
+		uploadRejected(
 			ctx, w, err, "no keys provided",
-			http.StatusBadRequest, uploadError(pb.EncryptedUploadResponse_NO_KEYS_IN_PAYLOAD),
+			http.StatusBadRequest, pb.EncryptedUploadResponse_NO_KEYS_IN_PAYLOAD,
 		)
 		return
 	}
 
-	if len(upload.GetKeys()) > pb.MaxKeysInUpload {
-		requestError(
+	deviceType, _ := requestDeviceType(r)
+	minKeys, maxKeys := uploadKeyLimits(ctx, deviceType)
+
+	if len(upload.GetKeys()) < minKeys {
+		uploadRejected(
+			ctx, w, err, "too few keys provided",
+			http.StatusBadRequest, pb.EncryptedUploadResponse_TOO_FEW_KEYS,
+		)
+		return
+	}
+
+	if len(upload.GetKeys()) > maxKeys {
+		uploadRejected(
 			ctx, w, err, "too many keys provided",
-			http.StatusBadRequest, uploadError(pb.EncryptedUploadResponse_TOO_MANY_KEYS),
+			http.StatusBadRequest, pb.EncryptedUploadResponse_TOO_MANY_KEYS,
 		)
 		return
 	}
 
 	ts := upload.GetTimestamp()
-	if ts == nil || math.Abs(time.Since(time.Unix(ts.Seconds, 0)).Seconds()) > 3600 {
-		requestError(
+	if ts != nil {
+		logLocalTimeOffset(ctx, deviceType, s.clock.Now(), time.Unix(ts.Seconds, 0))
+	}
+	if ts == nil || !timestampWithinSkew(ctx, deviceType, s.clock.Now(), time.Unix(ts.Seconds, 0)) {
+		if ts != nil && time.Unix(ts.Seconds, 0).Before(s.clock.Now()) {
+			uploadLateRejections.Add(ctx, 1)
+		}
+		uploadRejected(
 			ctx, w, err, "invalid timestamp",
-			http.StatusBadRequest, uploadError(pb.EncryptedUploadResponse_INVALID_TIMESTAMP),
+			http.StatusBadRequest, pb.EncryptedUploadResponse_INVALID_TIMESTAMP,
+		)
+		return
+	}
+	logTimestampSkew(ctx, s.clock.Now(), time.Unix(ts.Seconds, 0))
+
+	_, validateSpan := uploadSpan(ctx, "validate")
+	ok = validateKeys(ctx, w, upload.GetKeys())
+	validateSpan.End()
+	if !ok {
+		return // uploadRejected done by validateKeys
+	}
+
+	if keyStartsInFuture(s.clock.Now(), upload.GetKeys()) {
+		uploadRejected(
+			ctx, w, nil, "rollingStartIntervalNumber is in the future",
+			http.StatusBadRequest, pb.EncryptedUploadResponse_INVALID_ROLLING_START_INTERVAL_NUMBER,
+		)
+		return
+	}
+
+	if keyTooOld(s.clock.Now(), upload.GetKeys()) {
+		uploadRejected(
+			ctx, w, nil, "rollingStartIntervalNumber is too old",
+			http.StatusBadRequest, pb.EncryptedUploadResponse_INVALID_ROLLING_START_INTERVAL_NUMBER,
+		)
+		return
+	}
+
+	if !timestampMatchesKeys(time.Unix(ts.Seconds, 0), upload.GetKeys()) {
+		uploadRejected(
+			ctx, w, nil, "timestamp inconsistent with key intervals",
+			http.StatusBadRequest, pb.EncryptedUploadResponse_INVALID_TIMESTAMP,
 		)
 		return
 	}
 
-	if ok := validateKeys(ctx, w, upload.GetKeys()); !ok {
-		return // requestError done by validateKeys
+	uploadKeyCount.Record(ctx, int64(len(upload.GetKeys())))
+
+	denylisted, err := s.db.IsDenylisted(ctx, appPubKey[:])
+	if err != nil {
+		uploadRejected(
+			ctx, w, err, "failed to check keypair denylist",
+			http.StatusInternalServerError, pb.EncryptedUploadResponse_SERVER_ERROR,
+		)
+		return
+	} else if denylisted {
+		uploadRejected(
+			ctx, w, nil, "keypair is denylisted",
+			http.StatusUnauthorized, pb.EncryptedUploadResponse_INVALID_KEYPAIR,
+		)
+		return
 	}
 
-	err = s.db.StoreKeys(appPubKey, upload.GetKeys(), ctx)
-	if err == persistence.ErrKeyConsumed {
-		requestError(
+	if uploadRegionsRestricted() {
+		region, err := s.db.OriginatorRegion(ctx, appPubKey)
+		if err != nil {
+			uploadRejected(
+				ctx, w, err, "failed to look up originator region",
+				http.StatusInternalServerError, pb.EncryptedUploadResponse_SERVER_ERROR,
+			)
+			return
+		} else if !uploadRegionEnabled(region) {
+			uploadRejected(
+				ctx, w, nil, "uploads not enabled for region",
+				http.StatusForbidden, pb.EncryptedUploadResponse_REGION_NOT_ENABLED,
+			)
+			return
+		}
+	}
+
+	release, ok := s.acquireStoreSlot(ctx)
+	if !ok {
+		uploadRejected(
+			ctx, w, nil, "timed out waiting to store diagnosis keys",
+			http.StatusServiceUnavailable, pb.EncryptedUploadResponse_SERVER_ERROR,
+		)
+		return
+	}
+	storeCtx, storeSpan := uploadSpan(ctx, "StoreKeys")
+	stored, skipped, err := s.db.StoreKeys(appPubKey, upload.GetKeys(), storeCtx)
+	storeSpan.End()
+	release()
+	if dbUnavailable(err) {
+		uploadRejected(
+			ctx, w, err, "database unavailable",
+			http.StatusServiceUnavailable, pb.EncryptedUploadResponse_SERVER_ERROR,
+		)
+		return
+	} else if err == persistence.ErrUploadTooSoon {
+		uploadRejected(
+			ctx, w, err, "keypair uploaded too recently",
+			http.StatusTooManyRequests, pb.EncryptedUploadResponse_UPLOAD_TOO_SOON,
+		)
+		return
+	} else if err == persistence.ErrKeyConsumed {
+		uploadRejected(
 			ctx, w, err, "key is used up",
-			http.StatusBadRequest, uploadError(pb.EncryptedUploadResponse_INVALID_KEYPAIR),
+			http.StatusBadRequest, pb.EncryptedUploadResponse_INVALID_KEYPAIR,
 		)
 		return
 	} else if err == persistence.ErrTooManyKeys {
-		requestError(
+		uploadRejected(
 			ctx, w, err, "not enough keys remaining",
-			http.StatusBadRequest, uploadError(pb.EncryptedUploadResponse_TOO_MANY_KEYS),
+			http.StatusBadRequest, pb.EncryptedUploadResponse_TOO_MANY_KEYS,
 		)
 		return
 	} else if err != nil {
-		requestError(
+		uploadRejected(
 			ctx, w, err, "failed to store diagnosis keys",
-			http.StatusInternalServerError, uploadError(pb.EncryptedUploadResponse_SERVER_ERROR),
+			http.StatusInternalServerError, pb.EncryptedUploadResponse_SERVER_ERROR,
 		)
 		return
 	}
 
+	uploadStoredKeys.Add(ctx, stored, kv.String("result", "stored"))
+	uploadStoredKeys.Add(ctx, skipped, kv.String("result", "skipped"))
+	// Keys whose data is already stored, from this or another keypair, aren't
+	// stored again, so a client resubmitting keys isn't charged for them twice
+	if skipped > 0 {
+		log(ctx, nil).WithFields(logrus.Fields{
+			"stored":  stored,
+			"skipped": skipped,
+		}).Info("skipped diagnosis keys that were already stored")
+	}
+
+	if cohort := r.Header.Get("X-Cohort"); cohortAllowed(cohort) {
+		event := persistence.Event{
+			Identifier: persistence.UploadCohort,
+			DeviceType: persistence.Server,
+			Date:       s.clock.Now(),
+			Count:      1,
+			Originator: cohort,
+		}
+		if err := s.db.SaveEvent(event); err != nil {
+			persistence.LogEvent(ctx, err, event)
+		}
+	}
+
+	span.SetAttributes(uploadErrorCodeKey.String(pb.EncryptedUploadResponse_NONE.String()))
 	resp := uploadError(pb.EncryptedUploadResponse_NONE)
+	if r.Header.Get("X-Upload-Quota") == "true" {
+		resp.Quota = s.uploadQuota(ctx, appPubKey, len(upload.GetKeys()))
+	}
+	if config.AppConstants.DebugUploadOriginatorRegion {
+		if region, err := s.db.OriginatorRegion(ctx, appPubKey); err != nil {
+			log(ctx, err).Warn("unable to look up originator region")
+		} else {
+			resp.OriginatorRegion = &region
+		}
+	}
 	data, err = proto.Marshal(resp)
 	if err != nil {
-		requestError(
+		uploadRejected(
 			ctx, w, err, "error marshalling response",
-			http.StatusInternalServerError, uploadError(pb.EncryptedUploadResponse_SERVER_ERROR),
+			http.StatusInternalServerError, pb.EncryptedUploadResponse_SERVER_ERROR,
 		)
 		return
 	}
@@ -187,71 +574,410 @@ func (s *uploadServlet) upload(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func validateKey(ctx context.Context, w http.ResponseWriter, key *pb.TemporaryExposureKey) bool {
-	if key.GetRollingPeriod() < 1 || key.GetRollingPeriod() > 144 {
-		requestError(
-			ctx, w, nil, "missing or invalid rollingPeriod",
-			http.StatusBadRequest, uploadError(pb.EncryptedUploadResponse_INVALID_ROLLING_PERIOD),
-		)
+// uploadQuota describes what is left of the keypair after a successful upload
+// of accepted keys. The keys are already stored, so if the keypair can't be
+// looked up the upload still succeeds, just without a quota.
+func (s *uploadServlet) uploadQuota(ctx context.Context, appPubKey *[32]byte, accepted int) *pb.UploadQuota {
+	remaining, expiresAt, err := s.db.KeypairQuota(ctx, appPubKey)
+	if err != nil {
+		log(ctx, err).Warn("unable to look up keypair quota")
+		return nil
+	}
+
+	acceptedKeys := uint32(accepted)
+	remainingKeys := uint32(remaining)
+	return &pb.UploadQuota{
+		AcceptedKeys:  &acceptedKeys,
+		RemainingKeys: &remainingKeys,
+		ExpiresAt:     &timestamppb.Timestamp{Seconds: expiresAt.Unix()},
+	}
+}
+
+// hasUnknownFields reports whether m, or any message nested in it, carries
+// fields that aren't in the schema. proto.Unmarshal keeps these rather than
+// failing, but no client built from covidshield.proto sends them.
+func hasUnknownFields(m protoreflect.Message) bool {
+	if len(m.GetUnknown()) > 0 {
+		return true
+	}
+	unknown := false
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap() || fd.Message() == nil:
+		case fd.IsList():
+			list := v.List()
+			for i := 0; i < list.Len() && !unknown; i++ {
+				unknown = hasUnknownFields(list.Get(i).Message())
+			}
+		default:
+			unknown = hasUnknownFields(v.Message())
+		}
+		return !unknown
+	})
+	return unknown
+}
+
+// timestampWithinSkew reports whether an upload timestamp from deviceType is
+// no further behind or ahead of now than uploadSkewLimits allows
+func timestampWithinSkew(ctx context.Context, deviceType persistence.DeviceType, now, ts time.Time) bool {
+	past, future := uploadSkewLimits(ctx, deviceType)
+	if ts.Before(now) {
+		return now.Sub(ts) <= past
+	}
+	return ts.Sub(now) <= future
+}
+
+// logTimestampSkew logs accepted uploads whose timestamp is more than
+// uploadSkewLogThresholdSeconds off now, leaving small skews unlogged
+func logTimestampSkew(ctx context.Context, now, ts time.Time) {
+	threshold := time.Duration(config.AppConstants.UploadSkewLogThresholdSeconds) * time.Second
+	if threshold == 0 {
+		return
+	}
+	skew := ts.Sub(now)
+	if skew <= threshold && skew >= -threshold {
+		return
+	}
+	log(ctx, nil).WithField("skew_seconds", int64(skew/time.Second)).Warn("upload timestamp skewed")
+}
+
+// maxZoneOffset is the furthest a local time zone is from UTC (UTC+14)
+const maxZoneOffset = 14 * time.Hour
+
+// localTimeOffset reports whether ts is within localTimeSkewToleranceSeconds
+// of a whole or half hour ahead of or behind now, which is what a client that
+// builds its timestamp from local time rather than UTC produces, and returns
+// that offset in minutes. Half hours are included for zones like Newfoundland.
+func localTimeOffset(now, ts time.Time) (int, bool) {
+	tolerance := time.Duration(config.AppConstants.LocalTimeSkewToleranceSeconds) * time.Second
+	if tolerance == 0 {
+		return 0, false
+	}
+
+	skew := ts.Sub(now)
+	offset := skew.Round(30 * time.Minute)
+	if offset == 0 || offset > maxZoneOffset || offset < -maxZoneOffset {
+		return 0, false
+	}
+	if diff := skew - offset; diff > tolerance || diff < -tolerance {
+		return 0, false
+	}
+	return int(offset / time.Minute), true
+}
+
+// logLocalTimeOffset logs uploads whose timestamp looks like local time, so
+// the client builds producing them can be found from the app_version and
+// device_type. It doesn't affect whether the upload is accepted.
+func logLocalTimeOffset(ctx context.Context, deviceType persistence.DeviceType, now, ts time.Time) {
+	offset, ok := localTimeOffset(now, ts)
+	if !ok {
+		return
+	}
+	log(ctx, nil).WithFields(logrus.Fields{
+		"offset_minutes": offset,
+		"device_type":    deviceType,
+		"within_skew":    timestampWithinSkew(ctx, deviceType, now, ts),
+	}).Warn("upload timestamp looks like local time")
+}
+
+// keyStartsInFuture reports whether any key's interval starts more than
+// uploadFutureKeyGraceIntervals intervals after the one now is in
+func keyStartsInFuture(now time.Time, keys []*pb.TemporaryExposureKey) bool {
+	// ENIntervalNumbers are 600s long
+	latest := now.Unix()/600 + int64(config.AppConstants.UploadFutureKeyGraceIntervals)
+	for _, key := range keys {
+		if int64(key.GetRollingStartIntervalNumber()) > latest {
+			return true
+		}
+	}
+	return false
+}
+
+// keyTooOld reports whether any key's interval starts more than maxKeyAgeDays
+// before now, or false if the check is disabled
+func keyTooOld(now time.Time, keys []*pb.TemporaryExposureKey) bool {
+	days := int64(config.AppConstants.MaxKeyAgeDays)
+	if days == 0 {
 		return false
 	}
+	// ENIntervalNumbers are 600s long
+	earliest := (now.Unix() - days*24*60*60) / 600
+	for _, key := range keys {
+		if int64(key.GetRollingStartIntervalNumber()) < earliest {
+			return true
+		}
+	}
+	return false
+}
 
-	if len(key.GetKeyData()) != 16 {
-		requestError(
-			ctx, w, nil, "invalid key data",
-			http.StatusBadRequest, uploadError(pb.EncryptedUploadResponse_INVALID_KEY_DATA),
-		)
+// timestampMatchesKeys reports whether an upload timestamp is within
+// uploadMaxKeyTimestampSkew seconds of the start of the newest key's
+// interval, or true if the check is disabled
+func timestampMatchesKeys(ts time.Time, keys []*pb.TemporaryExposureKey) bool {
+	window := int64(config.AppConstants.UploadMaxKeyTimestampSkew)
+	if window == 0 {
+		return true
+	}
+
+	var newest int32
+	for _, key := range keys {
+		if rsin := key.GetRollingStartIntervalNumber(); rsin > newest {
+			newest = rsin
+		}
+	}
+
+	// ENIntervalNumbers are 600s long
+	diff := ts.Unix() - int64(newest)*600
+	return diff >= -window && diff <= window
+}
+
+// appVersionAccepted checks the X-App-Version header against the configured
+// minimum. Versions that can't be parsed are treated as too old.
+func appVersionAccepted(header string) bool {
+	minimum := config.AppConstants.MinimumAppVersion
+	if minimum == "" {
+		return true
+	}
+
+	if header == "" {
+		return !config.AppConstants.RejectMissingAppVersion
+	}
+
+	minimumVersion, ok := parseVersion(minimum)
+	if !ok {
+		log(nil, nil).WithField("minimumAppVersion", minimum).Error("invalid minimum app version configured")
+		return true
+	}
+
+	version, ok := parseVersion(header)
+	if !ok {
 		return false
 	}
 
+	for i := range version {
+		if version[i] != minimumVersion[i] {
+			return version[i] > minimumVersion[i]
+		}
+	}
+	return true
+}
+
+// parseVersion parses a MAJOR.MINOR.PATCH version, with an optional leading v.
+// Missing MINOR or PATCH parts count as 0 and pre-release or build metadata is
+// ignored.
+func parseVersion(v string) ([3]int, bool) {
+	var version [3]int
+
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+
+	parts := strings.Split(v, ".")
+	if len(parts) > len(version) {
+		return version, false
+	}
+
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return version, false
+		}
+		version[i] = n
+	}
+	return version, true
+}
+
+// ValidateKey checks a single key against the upload validation policy,
+// returning the error code to reject it with if it fails. An omitted
+// rollingPeriod is filled in on key with the default.
+func ValidateKey(key *pb.TemporaryExposureKey) (pb.EncryptedUploadResponse_ErrorCode, bool) {
+	errCode, _, ok := checkKey(key)
+	return errCode, ok
+}
+
+// validateKey adapts checkKey to the handler, writing the rejection to w
+func validateKey(ctx context.Context, w http.ResponseWriter, key *pb.TemporaryExposureKey) bool {
+	errCode, logMessage, ok := checkKey(key)
+	if !ok {
+		uploadRejected(ctx, w, nil, logMessage, http.StatusBadRequest, errCode)
+	}
+	return ok
+}
+
+func checkKey(key *pb.TemporaryExposureKey) (pb.EncryptedUploadResponse_ErrorCode, string, bool) {
+	// Exposure Notification defines an omitted rollingPeriod as a full day, so
+	// only an explicit value outside 1-144 is invalid. The default is filled in
+	// here so the stored key carries it.
+	if key.RollingPeriod == nil {
+		rollingPeriod := int32(pb.MaxTEKRollingPeriod)
+		key.RollingPeriod = &rollingPeriod
+	}
+
+	if key.GetRollingPeriod() < 1 || key.GetRollingPeriod() > 144 {
+		return pb.EncryptedUploadResponse_INVALID_ROLLING_PERIOD, "missing or invalid rollingPeriod", false
+	}
+
+	if rollingPeriodDenied(key.GetRollingPeriod()) {
+		return pb.EncryptedUploadResponse_INVALID_ROLLING_PERIOD, fmt.Sprintf("denylisted rollingPeriod %d", key.GetRollingPeriod()), false
+	}
+
+	if len(key.GetKeyData()) != config.AppConstants.KeyDataLength {
+		return pb.EncryptedUploadResponse_INVALID_KEY_DATA, "invalid key data", false
+	}
+
 	if key.GetRollingStartIntervalNumber() == 0 {
-		requestError(
-			ctx, w, nil, "invalid rolling start number",
-			http.StatusBadRequest, uploadError(pb.EncryptedUploadResponse_INVALID_ROLLING_START_INTERVAL_NUMBER),
-		)
-		return false
+		return pb.EncryptedUploadResponse_INVALID_ROLLING_START_INTERVAL_NUMBER, "invalid rolling start number", false
 	}
 
-	level := key.GetTransmissionRiskLevel()
-	if level < 0 || level > 8 {
-		requestError(
-			ctx, w, nil, "invalid transmission risk level",
-			http.StatusBadRequest, uploadError(pb.EncryptedUploadResponse_INVALID_TRANSMISSION_RISK_LEVEL),
-		)
+	// Likewise an omitted transmissionRiskLevel takes the configured default,
+	// and only an explicit value outside 0-8 is invalid
+	omitted := key.TransmissionRiskLevel == nil
+	if omitted {
+		level := config.AppConstants.DefaultTransmissionRiskLevel
+		key.TransmissionRiskLevel = &level
+	}
+
+	if level := key.GetTransmissionRiskLevel(); level < 0 || level > 8 {
+		// allowMissingTransmissionRisk only ever accepts more keys: one that
+		// left its level out but has a valid ReportType is stored at 0 rather
+		// than rejected for an out of range default
+		if !omitted || !config.AppConstants.AllowMissingTransmissionRisk || !validReportType(key.GetReportType()) {
+			return pb.EncryptedUploadResponse_INVALID_TRANSMISSION_RISK_LEVEL, "invalid transmission risk level", false
+		}
+		var missing int32
+		key.TransmissionRiskLevel = &missing
+	}
+
+	if key.ReportType != nil && !reportTypeAllowed(key.GetReportType()) {
+		return pb.EncryptedUploadResponse_INVALID_REPORT_TYPE, "report type not accepted", false
+	}
+
+	return pb.EncryptedUploadResponse_NONE, "", true
+}
+
+// rollingPeriodDenied reports whether p is one of the configured
+// deniedRollingPeriods, values known to come from buggy client builds
+func rollingPeriodDenied(p int32) bool {
+	for _, denied := range config.AppConstants.DeniedRollingPeriods {
+		if p == denied {
+			return true
+		}
+	}
+	return false
+}
+
+// validReportType reports whether t is a report type a client may submit
+func validReportType(t pb.TemporaryExposureKey_ReportType) bool {
+	switch t {
+	case pb.TemporaryExposureKey_CONFIRMED_TEST,
+		pb.TemporaryExposureKey_CONFIRMED_CLINICAL_DIAGNOSIS,
+		pb.TemporaryExposureKey_SELF_REPORT:
+		return true
+	}
+	return false
+}
+
+// reportTypeAllowed reports whether t is in the configured allowedReportTypes,
+// or true if none are configured
+func reportTypeAllowed(t pb.TemporaryExposureKey_ReportType) bool {
+	if len(config.AppConstants.AllowedReportTypes) == 0 {
+		return true
+	}
+	for _, allowed := range config.AppConstants.AllowedReportTypes {
+		if strings.TrimSpace(allowed) == t.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// cohortAllowed reports whether an X-Cohort header value is one of the
+// configured allowedCohorts. Only allowlisted labels are recorded, so a client
+// can't use the header to smuggle identifying data into the events table.
+func cohortAllowed(cohort string) bool {
+	if cohort == "" {
 		return false
 	}
+	for _, allowed := range config.AppConstants.AllowedCohorts {
+		if strings.TrimSpace(allowed) == cohort {
+			return true
+		}
+	}
+	return false
+}
 
-	return true
+// serverKeyAllowed reports whether serverPub is one of the hex-encoded
+// allowedServerPublicKeys, or true if none are configured. Every key claim
+// normally mints its own server keypair, so this only suits deployments that
+// issue from a fixed set of server keys.
+func serverKeyAllowed(ctx context.Context, serverPub []byte) bool {
+	if len(config.AppConstants.AllowedServerPublicKeys) == 0 {
+		return true
+	}
+	for _, entry := range config.AppConstants.AllowedServerPublicKeys {
+		allowed, err := hex.DecodeString(strings.TrimSpace(entry))
+		if err != nil || len(allowed) != pb.KeyLength {
+			log(ctx, err).WithField("entry", entry).Warn("ignoring invalid allowedServerPublicKeys entry")
+			continue
+		}
+		if bytes.Equal(allowed, serverPub) {
+			return true
+		}
+	}
+	return false
 }
 
+// ValidateKeys checks an upload's keys against the upload validation policy
+// without any HTTP handling, so tools outside the upload handler apply exactly
+// the same rules. It returns the error code to reject the upload with if any
+// key, or the keys as a set, fail.
+func ValidateKeys(keys []*pb.TemporaryExposureKey) (pb.EncryptedUploadResponse_ErrorCode, bool) {
+	errCode, _, ok := checkKeys(keys)
+	return errCode, ok
+}
+
+// validateKeys adapts checkKeys to the handler, writing the rejection to w
 func validateKeys(ctx context.Context, w http.ResponseWriter, keys []*pb.TemporaryExposureKey) bool {
-	for _, key := range keys {
-		if ok := validateKey(ctx, w, key); !ok {
-			return false
-		}
+	errCode, logMessage, ok := checkKeys(keys)
+	if !ok {
+		uploadRejected(ctx, w, nil, logMessage, http.StatusBadRequest, errCode)
+	}
+	return ok
+}
+
+func checkKeys(keys []*pb.TemporaryExposureKey) (pb.EncryptedUploadResponse_ErrorCode, string, bool) {
+	if len(keys) == 0 {
+		return pb.EncryptedUploadResponse_NO_KEYS_IN_PAYLOAD, "no keys provided", false
 	}
 
-	var ints []int
+	// Track the RSIN spread as keys are checked rather than sorting them, as
+	// this runs on every upload
+	min := int(keys[0].GetRollingStartIntervalNumber())
+	max := min
 	for _, key := range keys {
+		if errCode, logMessage, ok := checkKey(key); !ok {
+			return errCode, logMessage, false
+		}
+		if config.AppConstants.RequireSingleReportType && key.GetReportType() != keys[0].GetReportType() {
+			return pb.EncryptedUploadResponse_MIXED_REPORT_TYPES, "keys have different report types", false
+		}
 		rsin := int(key.GetRollingStartIntervalNumber())
-		ints = append(ints, rsin)
+		if rsin < min {
+			min = rsin
+		}
+		if rsin > max {
+			max = rsin
+		}
 	}
 
-	sort.Ints(ints)
-
-	min := ints[0]
-	max := ints[len(ints)-1]
 	maxEnd := max + 144
 
 	// Changed from 14 to 15 because you can have a case where you submit for the
 	// past 14 days plus part of today
 	if maxEnd-min > (144 * 15) {
-		requestError(
-			ctx, w, nil, "sequence of rollingStartIntervalNumbers exceeds 15 days",
-			http.StatusBadRequest, uploadError(pb.EncryptedUploadResponse_INVALID_ROLLING_START_INTERVAL_NUMBER),
-		)
-		return false
+		return pb.EncryptedUploadResponse_INVALID_ROLLING_START_INTERVAL_NUMBER, "sequence of rollingStartIntervalNumbers exceeds 15 days", false
 	}
 
-	return true
+	return pb.EncryptedUploadResponse_NONE, "", true
 }
@@ -0,0 +1,79 @@
+//go:build go1.18
+// +build go1.18
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	persistence "github.com/cds-snc/covid-alert-server/mocks/pkg/persistence"
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/crypto/nacl/box"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// FuzzUpload feeds arbitrary request bodies to the upload handler and checks
+// it always answers with a known status and a well-formed response. Run it
+// with `go test ./pkg/server -run '^$' -fuzz FuzzUpload`; without -fuzz only
+// the seed corpus below is run.
+func FuzzUpload(f *testing.F) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	serverPub, serverPriv, _ := box.GenerateKey(rand.Reader)
+	appPub, appPriv, _ := box.GenerateKey(rand.Reader)
+
+	db := &persistence.Conn{}
+	allowKeypairs(db)
+	db.On("PrivForPub", serverPub[:]).Return(serverPriv[:], nil)
+	db.On("PrivForPub", mock.Anything).Return(nil, fmt.Errorf("no record"))
+	db.On("StoreKeys", mock.Anything, mock.Anything, mock.Anything).Return(int64(1), int64(0), nil)
+
+	router := setupUploadRouter(db)
+
+	// Seed with a valid upload so mutations reach the decrypted payload checks
+	var nonce [24]byte
+	io.ReadFull(rand.Reader, nonce[:])
+	upload := &pb.Upload{
+		Keys:      []*pb.TemporaryExposureKey{randomTestKey(), randomTestKey()},
+		Timestamp: &timestamppb.Timestamp{Seconds: time.Now().Unix()},
+	}
+	marshalledUpload, _ := proto.Marshal(upload)
+	encrypted := box.Seal(nil, marshalledUpload, &nonce, serverPub, appPriv)
+	valid, _ := proto.Marshal(buildUploadRequest(serverPub[:], nonce[:], appPub[:], encrypted))
+
+	f.Add(valid)
+	f.Add([]byte{})
+	f.Add([]byte("sd"))
+	f.Add(bytes.Repeat([]byte{0xff}, 2048))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(body))
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+
+		switch resp.Code {
+		case http.StatusOK, http.StatusBadRequest, http.StatusUnauthorized:
+		default:
+			t.Fatalf("unexpected status %d", resp.Code)
+		}
+
+		var result pb.EncryptedUploadResponse
+		if err := proto.Unmarshal(resp.Body.Bytes(), &result); err != nil {
+			t.Fatalf("response is not an EncryptedUploadResponse: %v", err)
+		}
+		if (resp.Code == http.StatusOK) != (result.GetError() == pb.EncryptedUploadResponse_NONE) {
+			t.Fatalf("status %d does not match error code %s", resp.Code, result.GetError())
+		}
+	})
+}
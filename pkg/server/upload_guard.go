@@ -0,0 +1,209 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/persistence"
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+)
+
+// uploadGuardMaxSources bounds the sources an uploadGuard keeps counts and
+// blocks for, so rotating sources can't grow it without limit
+const uploadGuardMaxSources = 10000
+
+// uploadGuard blocks an upload source (the client IP, see getIP) for a while
+// once its uploads are rejected for one of autoDenylistReasons more than
+// autoDenylistThreshold times within autoDenylistWindowSeconds, as happens
+// when a stolen or forged key is used to hammer the server. The app public key
+// of the upload that crossed the threshold is denylisted too. Counts are kept
+// in memory, so each instance counts only the uploads it handles. A nil
+// *uploadGuard does nothing.
+type uploadGuard struct {
+	db        persistence.Conn
+	reasons   map[string]bool
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	mu      sync.Mutex
+	counts  *expiringCache
+	blocked *expiringCache
+}
+
+// newUploadGuard returns nil, meaning no guard, when there are no reasons or
+// the threshold is 0 or less
+func newUploadGuard(db persistence.Conn, reasons []string, threshold int, window, cooldown time.Duration) *uploadGuard {
+	if len(reasons) == 0 || threshold <= 0 {
+		return nil
+	}
+	g := &uploadGuard{
+		db:        db,
+		reasons:   make(map[string]bool, len(reasons)),
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		counts:    newExpiringCache(uploadGuardMaxSources),
+		blocked:   newExpiringCache(uploadGuardMaxSources),
+	}
+	for _, reason := range reasons {
+		g.reasons[reason] = true
+	}
+	return g
+}
+
+// uploadGuardFromConfig builds the guard NewUploadServlet installs
+func uploadGuardFromConfig(db persistence.Conn) *uploadGuard {
+	return newUploadGuard(
+		db,
+		config.AppConstants.AutoDenylistReasons,
+		config.AppConstants.AutoDenylistThreshold,
+		time.Duration(config.AppConstants.AutoDenylistWindowSeconds)*time.Second,
+		time.Duration(config.AppConstants.AutoDenylistCooldownSeconds)*time.Second,
+	)
+}
+
+type uploadKeypairKey struct{}
+
+// withUploadKeypair records the app public key of the upload being handled,
+// so its rejections can be attributed to it
+func withUploadKeypair(ctx context.Context, appPubKey *[pb.KeyLength]byte) context.Context {
+	return context.WithValue(ctx, uploadKeypairKey{}, appPubKey)
+}
+
+func uploadKeypair(ctx context.Context) *[pb.KeyLength]byte {
+	key, _ := ctx.Value(uploadKeypairKey{}).(*[pb.KeyLength]byte)
+	return key
+}
+
+type uploadSourceKey struct{}
+
+// withUploadSource records where the upload being handled came from
+func withUploadSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, uploadSourceKey{}, source)
+}
+
+func uploadSource(ctx context.Context) string {
+	source, _ := ctx.Value(uploadSourceKey{}).(string)
+	return source
+}
+
+// blocks reports whether the guard has blocked source and the cooldown hasn't
+// passed yet. Those uploads can be refused without reading them.
+func (g *uploadGuard) blocks(source string, now time.Time) bool {
+	if g == nil || source == "" {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	_, blocked := g.blocked.get(source, now)
+	return blocked
+}
+
+// observe counts a rejection of the upload in ctx against its source, and
+// blocks the source and denylists the upload's app public key until the
+// cooldown has passed if that takes it over the threshold for errCode
+func (g *uploadGuard) observe(ctx context.Context, errCode pb.EncryptedUploadResponse_ErrorCode, now time.Time) {
+	if g == nil || !g.reasons[errCode.String()] {
+		return
+	}
+	source := uploadSource(ctx)
+	if source == "" {
+		return
+	}
+
+	until := now.Add(g.cooldown)
+	g.mu.Lock()
+	if _, blocked := g.blocked.get(source, now); blocked {
+		g.mu.Unlock()
+		return
+	}
+	counter := source + "/" + errCode.String()
+	count, ok := g.counts.get(counter, now)
+	if !ok {
+		g.counts.put(counter, 1, now.Add(g.window))
+		g.mu.Unlock()
+		return
+	}
+	if count.n < g.threshold {
+		count.n++
+		g.mu.Unlock()
+		return
+	}
+	g.counts.remove(counter)
+	g.blocked.put(source, 0, until)
+	g.mu.Unlock()
+
+	if appPubKey := uploadKeypair(ctx); appPubKey != nil {
+		if err := g.db.AddToDenylistUntil(ctx, appPubKey[:], until); err != nil {
+			log(ctx, err).Warn("unable to auto-denylist keypair")
+		}
+	}
+	log(ctx, nil).WithFields(map[string]interface{}{
+		"source":   source,
+		"reason":   errCode.String(),
+		"until":    until.UTC().Format(time.RFC3339),
+		"security": true,
+	}).Warn("auto-blocked upload source")
+}
+
+// expiringCache holds at most size counters, each until its expiry. Adding to
+// a full cache evicts the least recently used counter, and expired ones are
+// dropped when they are looked up, so no call scans the whole cache. It isn't
+// safe for concurrent use.
+type expiringCache struct {
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+type expiringCounter struct {
+	key     string
+	n       int
+	expires time.Time
+}
+
+func newExpiringCache(size int) *expiringCache {
+	return &expiringCache{size: size, order: list.New(), items: map[string]*list.Element{}}
+}
+
+// get returns key's counter, which may be updated in place, unless it's
+// missing or expired at now
+func (c *expiringCache) get(key string, now time.Time) (*expiringCounter, bool) {
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	counter := elem.Value.(*expiringCounter)
+	if !now.Before(counter.expires) {
+		c.remove(key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return counter, true
+}
+
+// put sets key's counter to n until expires
+func (c *expiringCache) put(key string, n int, expires time.Time) {
+	if elem, ok := c.items[key]; ok {
+		counter := elem.Value.(*expiringCounter)
+		counter.n, counter.expires = n, expires
+		c.order.MoveToFront(elem)
+		return
+	}
+	if c.order.Len() >= c.size {
+		c.remove(c.order.Back().Value.(*expiringCounter).key)
+	}
+	c.items[key] = c.order.PushFront(&expiringCounter{key: key, n: n, expires: expires})
+}
+
+func (c *expiringCache) remove(key string) {
+	if elem, ok := c.items[key]; ok {
+		c.order.Remove(elem)
+		delete(c.items, key)
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	persistence "github.com/cds-snc/covid-alert-server/mocks/pkg/persistence"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/crypto/nacl/box"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestUploadGuard(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	now := time.Unix(1600000000, 0)
+	key := [32]byte{1}
+
+	db := &persistence.Conn{}
+	db.On("AddToDenylistUntil", mock.Anything, key[:], now.Add(time.Hour)).Return(nil)
+
+	g := newUploadGuard(db, []string{"DECRYPTION_FAILED"}, 2, time.Minute, time.Hour)
+	ctx := withUploadKeypair(withUploadSource(context.Background(), "10.0.0.1"), &key)
+
+	// Other reasons and uploads without a source aren't counted
+	for i := 0; i < 5; i++ {
+		g.observe(ctx, pb.EncryptedUploadResponse_INVALID_TIMESTAMP, now)
+		g.observe(withUploadKeypair(context.Background(), &key), pb.EncryptedUploadResponse_DECRYPTION_FAILED, now)
+	}
+	g.observe(ctx, pb.EncryptedUploadResponse_DECRYPTION_FAILED, now)
+	g.observe(ctx, pb.EncryptedUploadResponse_DECRYPTION_FAILED, now)
+	assert.False(t, g.blocks("10.0.0.1", now))
+	db.AssertNotCalled(t, "AddToDenylistUntil", mock.Anything, mock.Anything, mock.Anything)
+
+	// Crossing the threshold blocks the source and denylists the key, once
+	g.observe(ctx, pb.EncryptedUploadResponse_DECRYPTION_FAILED, now)
+	g.observe(ctx, pb.EncryptedUploadResponse_DECRYPTION_FAILED, now)
+	assert.True(t, g.blocks("10.0.0.1", now))
+	assert.False(t, g.blocks("10.0.0.2", now))
+	assert.False(t, g.blocks("", now))
+	db.AssertNumberOfCalls(t, "AddToDenylistUntil", 1)
+	assert.Equal(t, "10.0.0.1", hook.LastEntry().Data["source"])
+	assert.Equal(t, "DECRYPTION_FAILED", hook.LastEntry().Data["reason"])
+	assert.Equal(t, true, hook.LastEntry().Data["security"])
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "auto-blocked upload source")
+
+	// The block lifts after the cooldown
+	assert.True(t, g.blocks("10.0.0.1", now.Add(time.Hour-time.Second)))
+	assert.False(t, g.blocks("10.0.0.1", now.Add(time.Hour)))
+
+	disabled := newUploadGuard(db, nil, 2, time.Minute, time.Hour)
+	assert.Nil(t, disabled)
+	disabled.observe(ctx, pb.EncryptedUploadResponse_DECRYPTION_FAILED, now)
+	assert.False(t, disabled.blocks("10.0.0.1", now))
+}
+
+func TestUploadGuard_RotatingKeys(t *testing.T) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	now := time.Unix(1600000000, 0)
+
+	db := &persistence.Conn{}
+	db.On("AddToDenylistUntil", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+
+	// A new key for every upload still counts against the source
+	g := newUploadGuard(db, []string{"DECRYPTION_FAILED"}, 2, time.Minute, time.Hour)
+	for i := 0; i < 3; i++ {
+		key := [32]byte{byte(i)}
+		ctx := withUploadKeypair(withUploadSource(context.Background(), "10.0.0.1"), &key)
+		g.observe(ctx, pb.EncryptedUploadResponse_DECRYPTION_FAILED, now)
+	}
+	assert.True(t, g.blocks("10.0.0.1", now))
+
+	// Counts outside the window don't add up
+	g.observe(withUploadSource(context.Background(), "10.0.0.2"), pb.EncryptedUploadResponse_DECRYPTION_FAILED, now)
+	g.observe(withUploadSource(context.Background(), "10.0.0.2"), pb.EncryptedUploadResponse_DECRYPTION_FAILED, now)
+	g.observe(withUploadSource(context.Background(), "10.0.0.2"), pb.EncryptedUploadResponse_DECRYPTION_FAILED, now.Add(time.Minute))
+	assert.False(t, g.blocks("10.0.0.2", now.Add(time.Minute)))
+}
+
+func TestUploadGuard_DenylistFails(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	now := time.Unix(1600000000, 0)
+	key := [32]byte{1}
+
+	db := &persistence.Conn{}
+	db.On("AddToDenylistUntil", mock.Anything, mock.Anything, mock.Anything).Return(fmt.Errorf("db error"))
+
+	g := newUploadGuard(db, []string{"DECRYPTION_FAILED"}, 1, time.Minute, time.Hour)
+	ctx := withUploadKeypair(withUploadSource(context.Background(), "10.0.0.1"), &key)
+	g.observe(ctx, pb.EncryptedUploadResponse_DECRYPTION_FAILED, now)
+	g.observe(ctx, pb.EncryptedUploadResponse_DECRYPTION_FAILED, now)
+
+	// The source is still refused by this instance
+	assert.True(t, g.blocks("10.0.0.1", now))
+	assert.Equal(t, "unable to auto-denylist keypair", hook.Entries[0].Message)
+	testhelpers.AssertLog(t, hook, 2, logrus.WarnLevel, "auto-blocked upload source")
+}
+
+func TestExpiringCache(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	c := newExpiringCache(2)
+
+	c.put("a", 1, now.Add(time.Minute))
+	c.put("b", 2, now.Add(time.Minute))
+
+	// Looking a up makes b the least recently used, so c evicts it
+	_, ok := c.get("a", now)
+	assert.True(t, ok)
+	c.put("c", 3, now.Add(time.Second))
+	_, ok = c.get("b", now)
+	assert.False(t, ok)
+	assert.Equal(t, 2, c.order.Len())
+
+	counter, ok := c.get("a", now)
+	assert.True(t, ok)
+	assert.Equal(t, 1, counter.n)
+
+	// Expired counters are dropped when looked up
+	_, ok = c.get("c", now.Add(time.Second))
+	assert.False(t, ok)
+	assert.Equal(t, 1, c.order.Len())
+	assert.Len(t, c.items, 1)
+}
+
+func TestUpload_AutoDenylist(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	config.AppConstants.AutoDenylistReasons = []string{"DECRYPTION_FAILED"}
+	config.AppConstants.AutoDenylistThreshold = 2
+	config.AppConstants.AutoDenylistWindowSeconds = 60
+	config.AppConstants.AutoDenylistCooldownSeconds = 3600
+	defer func() {
+		config.AppConstants.AutoDenylistReasons = []string{}
+		config.AppConstants.AutoDenylistThreshold = 10
+		config.AppConstants.AutoDenylistWindowSeconds = 300
+		config.AppConstants.AutoDenylistCooldownSeconds = 3600
+	}()
+
+	appPub, _, _ := box.GenerateKey(rand.Reader)
+	badServerPub, _, _ := box.GenerateKey(rand.Reader)
+	serverPub, serverPriv, _ := box.GenerateKey(rand.Reader)
+
+	db := &persistence.Conn{}
+	db.On("PrivForPub", serverPub[:]).Return(serverPriv[:], nil)
+	db.On("AddToDenylistUntil", mock.Anything, appPub[:], mock.Anything).Return(nil)
+	router := setupUploadRouter(db)
+
+	var (
+		nonce [24]byte
+		msg   []byte
+	)
+	io.ReadFull(rand.Reader, nonce[:])
+	encrypted := box.Seal(msg[:], []byte("hello world"), &nonce, appPub, badServerPub)
+	payload, _ := proto.Marshal(buildUploadRequest(serverPub[:], nonce[:], appPub[:], encrypted))
+
+	upload := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+		req.RemoteAddr = "10.0.0.1:1234"
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	for i := 0; i < 3; i++ {
+		resp := upload()
+		assert.Equal(t, 400, resp.Code, "400 response is expected")
+		assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_DECRYPTION_FAILED))
+	}
+	db.AssertNumberOfCalls(t, "AddToDenylistUntil", 1)
+	assert.Equal(t, "auto-blocked upload source", hook.Entries[2].Message)
+	testhelpers.AssertLog(t, hook, 4, logrus.WarnLevel, "failure to decrypt payload")
+
+	// Later uploads from the source are refused before being read
+	resp := upload()
+	assert.Equal(t, 401, resp.Code, "401 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_KEYPAIR))
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "upload source is blocked")
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+)
+
+// uploadRegions holds the map[string]bool set by SetUploadEnabledRegions;
+// until it is first called every region is enabled
+var uploadRegions atomic.Value
+
+// SetUploadEnabledRegions restricts uploads to keypairs issued for one of
+// regions, as their originator is translated. An empty list enables every
+// region. It can be called again at any time, e.g. when the config is reloaded.
+func SetUploadEnabledRegions(ctx context.Context, regions []string) {
+	enabled := map[string]bool{}
+	for _, region := range regions {
+		if region = strings.TrimSpace(region); region != "" {
+			enabled[region] = true
+		}
+	}
+	previous, _ := uploadRegions.Load().(map[string]bool)
+	uploadRegions.Store(enabled)
+	if !sameRegions(previous, enabled) {
+		log(ctx, nil).WithField("regions", regions).Info("upload enabled regions changed")
+	}
+}
+
+func sameRegions(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for region := range a {
+		if !b[region] {
+			return false
+		}
+	}
+	return true
+}
+
+// uploadRegionsRestricted reports whether only some regions may upload
+func uploadRegionsRestricted() bool {
+	enabled, _ := uploadRegions.Load().(map[string]bool)
+	return len(enabled) > 0
+}
+
+// uploadRegionEnabled reports whether keypairs issued for region may upload
+func uploadRegionEnabled(region string) bool {
+	enabled, _ := uploadRegions.Load().(map[string]bool)
+	return len(enabled) == 0 || enabled[region]
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	persistence "github.com/cds-snc/covid-alert-server/mocks/pkg/persistence"
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/crypto/nacl/box"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestSetUploadEnabledRegions(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+	defer SetUploadEnabledRegions(context.Background(), nil)
+
+	assert.False(t, uploadRegionsRestricted())
+	assert.True(t, uploadRegionEnabled("ON"), "every region is enabled by default")
+
+	SetUploadEnabledRegions(context.Background(), []string{"ON", " QC "})
+	assert.True(t, uploadRegionsRestricted())
+	assert.True(t, uploadRegionEnabled("ON"))
+	assert.True(t, uploadRegionEnabled("QC"))
+	assert.False(t, uploadRegionEnabled("NS"))
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "upload enabled regions changed")
+
+	// Reloading the same set isn't logged again
+	SetUploadEnabledRegions(context.Background(), []string{"QC", "ON"})
+	assert.Equal(t, 0, len(hook.Entries))
+
+	SetUploadEnabledRegions(context.Background(), []string{})
+	assert.True(t, uploadRegionEnabled("NS"))
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "upload enabled regions changed")
+}
+
+func TestUpload_RegionEnabled(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db := &persistence.Conn{}
+	router := setupUploadRouter(db)
+
+	// After setupUploadRouter, which starts from the config
+	SetUploadEnabledRegions(context.Background(), []string{"ON"})
+	defer SetUploadEnabledRegions(context.Background(), nil)
+
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	enabledAppPub, enabledAppPriv, _ := box.GenerateKey(rand.Reader)
+	disabledAppPub, disabledAppPriv, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+	db.On("OriginatorRegion", mock.Anything, enabledAppPub).Return("ON", nil)
+	db.On("OriginatorRegion", mock.Anything, disabledAppPub).Return("NS", nil)
+	db.On("StoreKeys", enabledAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(1), int64(0), nil)
+
+	upload := func(appPub, appPriv *[32]byte) *httptest.ResponseRecorder {
+		var (
+			nonce [24]byte
+			msg   []byte
+		)
+		io.ReadFull(rand.Reader, nonce[:])
+		marshalledUpload, _ := proto.Marshal(buildUpload(1, timestamppb.Timestamp{Seconds: time.Now().Unix()}))
+		encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, appPriv)
+		payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], appPub[:], encrypted))
+
+		req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := upload(enabledAppPub, enabledAppPriv)
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_NONE))
+	db.AssertCalled(t, "StoreKeys", enabledAppPub, mock.Anything, mock.Anything)
+
+	hook.Reset()
+	resp = upload(disabledAppPub, disabledAppPriv)
+	assert.Equal(t, 403, resp.Code, "403 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_REGION_NOT_ENABLED))
+	db.AssertNotCalled(t, "StoreKeys", disabledAppPub, mock.Anything, mock.Anything)
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "uploads not enabled for region")
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/persistence"
+)
+
+// rejectionFlushInterval is how often a rejectionBuffer writes its counts
+const rejectionFlushInterval = 10 * time.Second
+
+// rejectionBuffer keeps daily counts of upload rejections by error code in
+// memory and adds them to the database in the background, so rejecting an
+// upload, including to shed load, never waits on a write. Counts that fail to
+// be written are kept for the next flush. A nil *rejectionBuffer records
+// nothing.
+type rejectionBuffer struct {
+	db persistence.Conn
+
+	mu     sync.Mutex
+	counts map[rejectionDay]int64
+}
+
+type rejectionDay struct {
+	reason string
+	day    time.Time
+}
+
+func newRejectionBuffer(db persistence.Conn) *rejectionBuffer {
+	return &rejectionBuffer{db: db, counts: map[rejectionDay]int64{}}
+}
+
+// rejectionBufferFromConfig builds the buffer NewUploadServlet installs, and
+// starts flushing it, when recordUploadRejections is set
+func rejectionBufferFromConfig(db persistence.Conn) *rejectionBuffer {
+	if !config.AppConstants.RecordUploadRejections {
+		return nil
+	}
+	b := newRejectionBuffer(db)
+	go func() {
+		for range time.Tick(rejectionFlushInterval) {
+			b.flush(context.Background())
+		}
+	}()
+	return b
+}
+
+// record counts a rejection with reason at now
+func (b *rejectionBuffer) record(reason string, now time.Time) {
+	if b == nil {
+		return
+	}
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	b.mu.Lock()
+	b.counts[rejectionDay{reason: reason, day: day}]++
+	b.mu.Unlock()
+}
+
+// flush writes the counts recorded since the last flush
+func (b *rejectionBuffer) flush(ctx context.Context) {
+	b.mu.Lock()
+	counts := b.counts
+	b.counts = map[rejectionDay]int64{}
+	b.mu.Unlock()
+
+	for key, count := range counts {
+		if err := b.db.RecordUploadRejections(ctx, key.reason, key.day, count); err != nil {
+			log(ctx, err).WithField("reason", key.reason).Warn("unable to record upload rejections")
+			b.mu.Lock()
+			b.counts[key] += count
+			b.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	persistence "github.com/cds-snc/covid-alert-server/mocks/pkg/persistence"
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRejectionBuffer(t *testing.T) {
+	day1 := time.Date(2020, 9, 13, 0, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+
+	db := &persistence.Conn{}
+	db.On("RecordUploadRejections", mock.Anything, "INVALID_TIMESTAMP", day1, int64(2)).Return(nil).Once()
+	db.On("RecordUploadRejections", mock.Anything, "INVALID_TIMESTAMP", day2, int64(1)).Return(nil).Once()
+	db.On("RecordUploadRejections", mock.Anything, "TOO_MANY_KEYS", day1, int64(1)).Return(nil).Once()
+
+	// Counted by UTC day
+	b := newRejectionBuffer(db)
+	b.record("INVALID_TIMESTAMP", day1.Add(time.Hour))
+	b.record("INVALID_TIMESTAMP", day1.Add(23*time.Hour).In(time.FixedZone("EDT", -4*3600)))
+	b.record("INVALID_TIMESTAMP", day2.Add(time.Hour))
+	b.record("TOO_MANY_KEYS", day1)
+	b.flush(context.Background())
+	db.AssertExpectations(t)
+
+	// Nothing left to write
+	b.flush(context.Background())
+	db.AssertNumberOfCalls(t, "RecordUploadRejections", 3)
+
+	var disabled *rejectionBuffer
+	assert.NotPanics(t, func() { disabled.record("INVALID_TIMESTAMP", day1) })
+}
+
+func TestRejectionBuffer_WriteFails(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	day := time.Date(2020, 9, 13, 0, 0, 0, 0, time.UTC)
+
+	db := &persistence.Conn{}
+	db.On("RecordUploadRejections", mock.Anything, "INVALID_TIMESTAMP", day, int64(1)).Return(fmt.Errorf("db error")).Once()
+	db.On("RecordUploadRejections", mock.Anything, "INVALID_TIMESTAMP", day, int64(2)).Return(nil).Once()
+
+	// A failed write is kept and added to the next one
+	b := newRejectionBuffer(db)
+	b.record("INVALID_TIMESTAMP", day)
+	b.flush(context.Background())
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "unable to record upload rejections")
+
+	b.record("INVALID_TIMESTAMP", day)
+	b.flush(context.Background())
+	db.AssertExpectations(t)
+}
@@ -2,10 +2,12 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"fmt"
 	"github.com/Shopify/goose/logger"
 	persistence "github.com/cds-snc/covid-alert-server/mocks/pkg/persistence"
+	"github.com/cds-snc/covid-alert-server/pkg/config"
 	persistenceErrors "github.com/cds-snc/covid-alert-server/pkg/persistence"
 	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
 	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
@@ -14,11 +16,13 @@ import (
 	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/mock"
 	"golang.org/x/crypto/nacl/box"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -26,9 +30,23 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// allowKeypairs makes every keypair pass the denylist check, for tests that
+// aren't about the denylist
+func allowKeypairs(db *persistence.Conn) {
+	db.On("IsDenylisted", mock.Anything, mock.Anything).Return(false, nil).Maybe()
+}
+
+// notInMaintenance makes maintenance mode read as off, for tests that aren't
+// about maintenance
+func notInMaintenance(db *persistence.Conn) {
+	db.On("MaintenanceMode", mock.Anything).Return(false, nil).Maybe()
+}
+
 func setupUploadRouter(db *persistence.Conn) *mux.Router {
 
-	servlet := NewUploadServlet(db)
+	allowKeypairs(db)
+	notInMaintenance(db)
+	servlet := NewUploadServlet(db, db)
 	router := Router()
 	servlet.RegisterRouting(router)
 
@@ -39,17 +57,73 @@ func TestNewUploadServlet(t *testing.T) {
 	db := &persistence.Conn{}
 
 	expected := &uploadServlet{
-		db: db,
+		db:          db,
+		resolver:    db,
+		clock:       systemClock{},
+		maintenance: newMaintenanceMode(db),
 	}
-	assert.Equal(t, expected, NewUploadServlet(db), "should return a new uploadServlet struct")
+	assert.Equal(t, expected, NewUploadServlet(db, db), "should return a new uploadServlet struct")
+}
+
+func TestUpload_MethodNotAllowed(t *testing.T) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	router := setupUploadRouter(&persistence.Conn{})
+
+	req, _ := http.NewRequest("GET", "/upload", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+	assert.Equal(t, "POST", resp.Header().Get("Allow"))
+	assert.JSONEq(t, `{"error":"method not allowed"}`, resp.Body.String())
+}
+
+func TestUpload_Options(t *testing.T) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	// Off by default
+	router := setupUploadRouter(&persistence.Conn{})
+	req, _ := http.NewRequest("OPTIONS", "/upload", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+
+	config.AppConstants.AnswerUploadOptions = true
+	defer func() { config.AppConstants.AnswerUploadOptions = false }()
+
+	router = setupUploadRouter(&persistence.Conn{})
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, "POST", resp.Header().Get("Allow"))
+	assert.Empty(t, resp.Body.String())
+	assert.Empty(t, resp.Header().Get("Access-Control-Allow-Origin"))
 }
 
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
 func TestRegisterRoutingUpload(t *testing.T) {
 	router := setupUploadRouter(&persistence.Conn{})
 	expectedPaths := GetPaths(router)
 	assert.Contains(t, expectedPaths, "/upload", "should include an upload path")
 }
 
+func TestRegisterRoutingUploadWithPrefix(t *testing.T) {
+	os.Setenv("ROUTE_PREFIX", "/v1")
+	defer os.Unsetenv("ROUTE_PREFIX")
+
+	router := setupUploadRouter(&persistence.Conn{})
+	expectedPaths := GetPaths(router)
+	assert.Contains(t, expectedPaths, "/v1/upload", "should include the prefixed upload path")
+	assert.NotContains(t, expectedPaths, "/upload", "should not include the unprefixed upload path")
+}
+
 func TestUploadError(t *testing.T) {
 	err := pb.EncryptedUploadResponse_UNKNOWN
 	expected := &pb.EncryptedUploadResponse{Error: &err}
@@ -81,6 +155,78 @@ func TestUpload_NonProtoBufPayload(t *testing.T) {
 	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "error unmarshalling request")
 }
 
+func TestUpload_AppVersionBelowMinimum(t *testing.T) {
+	hook, oldLog, _, router := setupUploadTest()
+	defer func() { log = *oldLog }()
+
+	config.AppConstants.MinimumAppVersion = "1.2.0"
+	defer func() { config.AppConstants.MinimumAppVersion = "" }()
+
+	for _, version := range []string{"1.1.9", "0.9", "not-a-version"} {
+		req, _ := http.NewRequest("POST", "/upload", strings.NewReader("sd"))
+		req.Header.Set("X-App-Version", version)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+
+		assert.Equal(t, 400, resp.Code, "400 response is expected")
+		assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_APP_VERSION_TOO_OLD))
+
+		testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "app version below minimum, app must be updated")
+	}
+}
+
+func TestUpload_AppVersionAtMinimum(t *testing.T) {
+	hook, oldLog, _, router := setupUploadTest()
+	defer func() { log = *oldLog }()
+
+	config.AppConstants.MinimumAppVersion = "1.2.0"
+	defer func() { config.AppConstants.MinimumAppVersion = "" }()
+
+	for _, version := range []string{"1.2.0", "v1.2", "1.2.0-rc1", "1.10.0", "2.0.0"} {
+		// Passes the version check and fails on the non-protobuf payload instead
+		req, _ := http.NewRequest("POST", "/upload", strings.NewReader("sd"))
+		req.Header.Set("X-App-Version", version)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+
+		assert.Equal(t, 400, resp.Code, "400 response is expected")
+		assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_UNKNOWN))
+
+		testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "error unmarshalling request")
+	}
+}
+
+func TestUpload_AppVersionMissing(t *testing.T) {
+	hook, oldLog, _, router := setupUploadTest()
+	defer func() { log = *oldLog }()
+
+	config.AppConstants.MinimumAppVersion = "1.2.0"
+	defer func() { config.AppConstants.MinimumAppVersion = "" }()
+
+	// Accepted by default
+	req, _ := http.NewRequest("POST", "/upload", strings.NewReader("sd"))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_UNKNOWN))
+
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "error unmarshalling request")
+
+	// Rejected when configured
+	config.AppConstants.RejectMissingAppVersion = true
+	defer func() { config.AppConstants.RejectMissingAppVersion = false }()
+
+	req, _ = http.NewRequest("POST", "/upload", strings.NewReader("sd"))
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_APP_VERSION_TOO_OLD))
+
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "app version below minimum, app must be updated")
+}
+
 func TestUpload_PublicCertTooShort(t *testing.T) {
 
 	hook, oldLog, _, router := setupUploadTest()
@@ -98,6 +244,43 @@ func TestUpload_PublicCertTooShort(t *testing.T) {
 	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "server public key was not expected length")
 }
 
+func TestUpload_ServerPublicKeyNotAllowed(t *testing.T) {
+
+	hook, oldLog, db, router := setupUploadTest()
+	defer func() { log = *oldLog }()
+
+	allowedPub, _, _ := box.GenerateKey(rand.Reader)
+	otherPub, _, _ := box.GenerateKey(rand.Reader)
+
+	oldAllowed := config.AppConstants.AllowedServerPublicKeys
+	config.AppConstants.AllowedServerPublicKeys = []string{"not-hex", fmt.Sprintf("%x", allowedPub[:])}
+	defer func() { config.AppConstants.AllowedServerPublicKeys = oldAllowed }()
+
+	payload, _ := proto.Marshal(buildUploadRequest(otherPub[:], nil, nil, nil))
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "401 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_KEYPAIR))
+	db.AssertNotCalled(t, "PrivForPub", mock.Anything)
+
+	assert.Equal(t, logrus.ErrorLevel, hook.Entries[1].Level)
+	assert.Equal(t, "upload presented a server public key outside the allowlist", hook.Entries[1].Message)
+	assert.Equal(t, true, hook.Entries[1].Data["security"])
+	testhelpers.AssertLog(t, hook, 3, logrus.WarnLevel, "server public key not allowed")
+
+	// An allowlisted key goes on to the database lookup
+	db.On("PrivForPub", allowedPub[:]).Return(nil, fmt.Errorf("no record"))
+
+	payload, _ = proto.Marshal(buildUploadRequest(allowedPub[:], nil, nil, nil))
+	req, _ = http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	db.AssertCalled(t, "PrivForPub", allowedPub[:])
+}
+
 func TestUpload_PublicCertNotFound(t *testing.T) {
 
 	hook, oldLog, db, router := setupUploadTest()
@@ -238,28 +421,29 @@ func TestUpload_FailsUnmarshalIntoUpload(t *testing.T) {
 	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "error unmarshalling request payload")
 }
 
-func TestUpload_NoKeysInPayload(t *testing.T) {
+func TestUpload_OversizedPayload(t *testing.T) {
+
 	hook, oldLog, db, router := setupUploadTest()
 	defer func() { log = *oldLog }()
+
+	oldMax := config.AppConstants.MaxUploadPayloadBytes
+	config.AppConstants.MaxUploadPayloadBytes = 64
+	defer func() { config.AppConstants.MaxUploadPayloadBytes = oldMax }()
+
 	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
 	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
 
 	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
-	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(nil)
 
 	var (
 		nonce [24]byte
 		msg   []byte
 	)
-	// No keys in payload
 	io.ReadFull(rand.Reader, nonce[:])
-	ts := time.Now()
-	pbts := timestamppb.Timestamp{
-		Seconds: ts.Unix(),
-	}
-	upload := buildUpload(0, pbts)
-	marshalledUpload, _ := proto.Marshal(upload)
-	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
+
+	// Inner payload larger than the configured maximum
+	inner := make([]byte, 65)
+	encrypted := box.Seal(msg[:], inner, &nonce, goodServerPub, goodAppPriv)
 
 	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
 	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
@@ -267,33 +451,104 @@ func TestUpload_NoKeysInPayload(t *testing.T) {
 	router.ServeHTTP(resp, req)
 
 	assert.Equal(t, 400, resp.Code, "400 response is expected")
-	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_NO_KEYS_IN_PAYLOAD))
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_PAYLOAD))
 
-	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "no keys provided")
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "decrypted payload too large")
 }
 
-func TestUpload_TooManyKeys(t *testing.T) {
+// withUnknownField appends a varint field with a number covidshield.proto
+// doesn't use to a marshalled message
+func withUnknownField(b []byte) []byte {
+	b = protowire.AppendTag(b, 99, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
 
+func TestUpload_UnknownFields(t *testing.T) {
+	hook, oldLog, db, router := setupUploadTest()
+	defer func() { log = *oldLog }()
+
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(1), int64(0), nil)
+
+	upload := func(outer, inner, key bool) *httptest.ResponseRecorder {
+		var (
+			nonce [24]byte
+			msg   []byte
+		)
+		io.ReadFull(rand.Reader, nonce[:])
+		upload := buildUpload(1, timestamppb.Timestamp{Seconds: time.Now().Unix()})
+		if key {
+			upload.Keys[0].ProtoReflect().SetUnknown(withUnknownField(nil))
+		}
+		marshalledUpload, _ := proto.Marshal(upload)
+		if inner {
+			marshalledUpload = withUnknownField(marshalledUpload)
+		}
+		encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
+
+		payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
+		if outer {
+			payload = withUnknownField(payload)
+		}
+		req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	// Lenient by default
+	resp := upload(true, true, true)
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_NONE))
+	hook.Reset()
+
+	config.AppConstants.StrictUploadUnmarshal = true
+	defer func() { config.AppConstants.StrictUploadUnmarshal = false }()
+
+	resp = upload(true, false, false)
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_PAYLOAD))
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "unknown fields in request")
+
+	resp = upload(false, true, false)
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_PAYLOAD))
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "unknown fields in request payload")
+
+	// Unknown fields nested in a key count too
+	resp = upload(false, false, true)
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_PAYLOAD))
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "unknown fields in request payload")
+
+	resp = upload(false, false, false)
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	db.AssertNumberOfCalls(t, "StoreKeys", 2)
+}
+
+func TestUpload_NoKeysInPayload(t *testing.T) {
 	hook, oldLog, db, router := setupUploadTest()
 	defer func() { log = *oldLog }()
-	// Set up PrivForPub
 	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
 	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
 
 	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
-	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(nil)
+	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(1), int64(0), nil)
+
 	var (
 		nonce [24]byte
 		msg   []byte
 	)
-	// Too many keys in payload
-
+	// No keys in payload
 	io.ReadFull(rand.Reader, nonce[:])
 	ts := time.Now()
 	pbts := timestamppb.Timestamp{
 		Seconds: ts.Unix(),
 	}
-	upload := buildUpload(pb.MaxKeysInUpload+1, pbts)
+	upload := buildUpload(0, pbts)
 	marshalledUpload, _ := proto.Marshal(upload)
 	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
 
@@ -303,33 +558,62 @@ func TestUpload_TooManyKeys(t *testing.T) {
 	router.ServeHTTP(resp, req)
 
 	assert.Equal(t, 400, resp.Code, "400 response is expected")
-	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_TOO_MANY_KEYS))
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_NO_KEYS_IN_PAYLOAD))
 
-	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "too many keys provided")
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "no keys provided")
 }
 
-func TestUpload_InvalidTimestamp(t *testing.T) {
+func TestUpload_RecordsRejection(t *testing.T) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db := &persistence.Conn{}
+
+	// Off by default
+	servlet := NewUploadServlet(db, db).(*uploadServlet)
+	assert.Nil(t, servlet.rejections)
+
+	// Rejections are only counted in memory as uploads are handled
+	now := time.Date(2020, 9, 13, 23, 0, 0, 0, time.UTC)
+	allowKeypairs(db)
+	notInMaintenance(db)
+	servlet = &uploadServlet{db: db, resolver: db, clock: fixedClock(now), maintenance: newMaintenanceMode(db), rejections: newRejectionBuffer(db)}
+	router := Router()
+	servlet.RegisterRouting(router)
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", "/upload", strings.NewReader("not a protobuf"))
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		assert.Equal(t, 400, resp.Code, "400 response is expected")
+	}
+	db.AssertNotCalled(t, "RecordUploadRejections", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	// and written together when flushed
+	db.On("RecordUploadRejections", mock.Anything, "UNKNOWN", time.Date(2020, 9, 13, 0, 0, 0, 0, time.UTC), int64(2)).Return(nil).Once()
+	servlet.rejections.flush(context.Background())
+	servlet.rejections.flush(context.Background())
+	db.AssertExpectations(t)
+}
 
+func TestUpload_NoKeysInPayloadAccepted(t *testing.T) {
 	hook, oldLog, db, router := setupUploadTest()
 	defer func() { log = *oldLog }()
-	// Set up PrivForPub
+
+	oldAcceptEmptyUploads := config.AppConstants.AcceptEmptyUploads
+	config.AppConstants.AcceptEmptyUploads = true
+	defer func() { config.AppConstants.AcceptEmptyUploads = oldAcceptEmptyUploads }()
+
 	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
 	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
 
 	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
-	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(nil)
 
 	var (
 		nonce [24]byte
 		msg   []byte
 	)
-	// Invalid timestamp
 	io.ReadFull(rand.Reader, nonce[:])
-	ts := time.Now()
-	pbts := timestamppb.Timestamp{
-		Seconds: ts.Unix() - 4000,
-	}
-	upload := buildUpload(pb.MaxKeysInUpload, pbts)
+	upload := buildUpload(0, timestamppb.Timestamp{Seconds: time.Now().Unix()})
 	marshalledUpload, _ := proto.Marshal(upload)
 	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
 
@@ -338,145 +622,218 @@ func TestUpload_InvalidTimestamp(t *testing.T) {
 	resp := httptest.NewRecorder()
 	router.ServeHTTP(resp, req)
 
-	assert.Equal(t, 400, resp.Code, "400 response is expected")
-	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_TIMESTAMP))
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_NONE))
+	db.AssertNotCalled(t, "StoreKeys", mock.Anything, mock.Anything, mock.Anything)
+	db.AssertNotCalled(t, "IsDenylisted", mock.Anything, mock.Anything)
 
-	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "invalid timestamp")
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "accepted upload with no keys")
 }
 
-func TestUpload_ExpiredKey(t *testing.T) {
+func TestUpload_TooManyKeys(t *testing.T) {
 
 	hook, oldLog, db, router := setupUploadTest()
 	defer func() { log = *oldLog }()
 	// Set up PrivForPub
 	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
-	goodAppPubKeyUsed, goodAppPrivKeyUsed, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
 
 	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
-	db.On("StoreKeys", goodAppPubKeyUsed, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(persistenceErrors.ErrKeyConsumed)
-
+	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(1), int64(0), nil)
 	var (
 		nonce [24]byte
 		msg   []byte
 	)
-	// Expired Key
+	// Too many keys in payload
+
 	io.ReadFull(rand.Reader, nonce[:])
 	ts := time.Now()
 	pbts := timestamppb.Timestamp{
 		Seconds: ts.Unix(),
 	}
-	upload := buildUpload(1, pbts)
+	upload := buildUpload(pb.MaxKeysInUpload+1, pbts)
 	marshalledUpload, _ := proto.Marshal(upload)
-	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPrivKeyUsed)
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
 
-	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPubKeyUsed[:], encrypted))
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
 	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
 	resp := httptest.NewRecorder()
 	router.ServeHTTP(resp, req)
 
 	assert.Equal(t, 400, resp.Code, "400 response is expected")
-	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_KEYPAIR))
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_TOO_MANY_KEYS))
 
-	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "key is used up")
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "too many keys provided")
 }
 
-func TestUpload_GenericDBError(t *testing.T) {
+func TestUpload_TooFewKeys(t *testing.T) {
 
 	hook, oldLog, db, router := setupUploadTest()
 	defer func() { log = *oldLog }()
+
+	oldMin := config.AppConstants.MinKeysInUpload
+	config.AppConstants.MinKeysInUpload = 3
+	defer func() { config.AppConstants.MinKeysInUpload = oldMin }()
+
 	// Set up PrivForPub
 	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
-	goodAppPubDBError, goodAppPrivDBError, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
 
 	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
-	db.On("StoreKeys", goodAppPubDBError, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(fmt.Errorf("generic DB error"))
-
+	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(1), int64(0), nil)
 	var (
 		nonce [24]byte
 		msg   []byte
 	)
-	// Generic DB Error
+	// Fewer keys than the configured minimum
 	io.ReadFull(rand.Reader, nonce[:])
 	ts := time.Now()
 	pbts := timestamppb.Timestamp{
 		Seconds: ts.Unix(),
 	}
-	upload := buildUpload(1, pbts)
+	upload := buildUpload(2, pbts)
 	marshalledUpload, _ := proto.Marshal(upload)
-	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPrivDBError)
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
 
-	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPubDBError[:], encrypted))
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
 	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
 	resp := httptest.NewRecorder()
 	router.ServeHTTP(resp, req)
 
-	assert.Equal(t, 500, resp.Code, "500 response is expected")
-	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_SERVER_ERROR))
-
-	testhelpers.AssertLog(t, hook, 1, logrus.ErrorLevel, "failed to store diagnosis keys")
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_TOO_FEW_KEYS))
+	db.AssertNotCalled(t, "StoreKeys", mock.Anything, mock.Anything, mock.Anything)
 
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "too few keys provided")
 }
 
-func TestUpload_NotEnoughKeysRemaining(t *testing.T) {
+func TestUpload_InvalidTimestamp(t *testing.T) {
 
-	hook, oldLog, db, router := setupUploadTest()
+	hook, oldLog, db, _ := setupUploadTest()
 	defer func() { log = *oldLog }()
+
+	now := time.Unix(1600000000, 0)
+	router := Router()
+	(&uploadServlet{db: db, resolver: db, clock: fixedClock(now), maintenance: newMaintenanceMode(db)}).RegisterRouting(router)
+
 	// Set up PrivForPub
-	goodAppPubNoKeysRemaining, goodAppPrivNoKeysRemaining, _ := box.GenerateKey(rand.Reader)
-	goodServerPubNoKeysRemaining, goodServerPrivNoKeysRemaining, _ := box.GenerateKey(rand.Reader)
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
 
-	db.On("PrivForPub", goodServerPubNoKeysRemaining[:]).Return(goodServerPrivNoKeysRemaining[:], nil)
-	db.On("StoreKeys", goodAppPubNoKeysRemaining, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(persistenceErrors.ErrTooManyKeys)
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(1), int64(0), nil)
 
 	var (
 		nonce [24]byte
 		msg   []byte
 	)
-	// Not enough keys remaining
+	// Invalid timestamp, one second past the allowed hour of skew
 	io.ReadFull(rand.Reader, nonce[:])
-	ts := time.Now()
 	pbts := timestamppb.Timestamp{
-		Seconds: ts.Unix(),
+		Seconds: now.Unix() - 3601,
 	}
-	upload := buildUpload(1, pbts)
+	upload := buildUpload(pb.MaxKeysInUpload, pbts)
 	marshalledUpload, _ := proto.Marshal(upload)
-	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPubNoKeysRemaining, goodAppPrivNoKeysRemaining)
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
 
-	payload, _ := proto.Marshal(buildUploadRequest(goodServerPubNoKeysRemaining[:], nonce[:], goodAppPubNoKeysRemaining[:], encrypted))
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
 	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
 	resp := httptest.NewRecorder()
 	router.ServeHTTP(resp, req)
 
 	assert.Equal(t, 400, resp.Code, "400 response is expected")
-	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_TOO_MANY_KEYS))
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_TIMESTAMP))
 
-	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "not enough keys remaining")
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "invalid timestamp")
 }
 
-func TestUpload(t *testing.T) {
+func TestTimestampWithinSkew(t *testing.T) {
+	oldPast, oldFuture := config.AppConstants.UploadMaxPastSkew, config.AppConstants.UploadMaxFutureSkew
+	defer func() {
+		config.AppConstants.UploadMaxPastSkew = oldPast
+		config.AppConstants.UploadMaxFutureSkew = oldFuture
+	}()
+
+	now := time.Unix(1600000000, 0)
+
+	// Defaults are symmetric
+	config.AppConstants.UploadMaxPastSkew = 3600
+	config.AppConstants.UploadMaxFutureSkew = 3600
+	assert.True(t, timestampWithinSkew(nil, "", now, now.Add(-3600*time.Second)))
+	assert.False(t, timestampWithinSkew(nil, "", now, now.Add(-3601*time.Second)))
+	assert.True(t, timestampWithinSkew(nil, "", now, now.Add(3600*time.Second)))
+	assert.False(t, timestampWithinSkew(nil, "", now, now.Add(3601*time.Second)))
+
+	// Lenient on lateness, strict on the future
+	config.AppConstants.UploadMaxPastSkew = 86400
+	config.AppConstants.UploadMaxFutureSkew = 300
+	assert.True(t, timestampWithinSkew(nil, "", now, now))
+	assert.True(t, timestampWithinSkew(nil, "", now, now.Add(-86400*time.Second)))
+	assert.False(t, timestampWithinSkew(nil, "", now, now.Add(-86401*time.Second)))
+	assert.True(t, timestampWithinSkew(nil, "", now, now.Add(300*time.Second)))
+	assert.False(t, timestampWithinSkew(nil, "", now, now.Add(301*time.Second)))
+	assert.False(t, timestampWithinSkew(nil, "", now, now.Add(3600*time.Second)))
+}
 
-	_, oldLog := testhelpers.SetupTestLogging(&log)
+func TestLocalTimeOffset(t *testing.T) {
+	oldTolerance := config.AppConstants.LocalTimeSkewToleranceSeconds
+	defer func() { config.AppConstants.LocalTimeSkewToleranceSeconds = oldTolerance }()
+
+	now := time.Unix(1600000000, 0)
+
+	// Disabled by default
+	config.AppConstants.LocalTimeSkewToleranceSeconds = 0
+	_, ok := localTimeOffset(now, now.Add(-4*time.Hour))
+	assert.False(t, ok)
+
+	config.AppConstants.LocalTimeSkewToleranceSeconds = 120
+
+	offset, ok := localTimeOffset(now, now.Add(-4*time.Hour+90*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, -240, offset)
+
+	offset, ok = localTimeOffset(now, now.Add(-(2*time.Hour + 30*time.Minute)))
+	assert.True(t, ok, "half hour zones like Newfoundland count")
+	assert.Equal(t, -150, offset)
+
+	offset, ok = localTimeOffset(now, now.Add(9*time.Hour))
+	assert.True(t, ok)
+	assert.Equal(t, 540, offset)
+
+	_, ok = localTimeOffset(now, now.Add(30*time.Second))
+	assert.False(t, ok, "no offset is just clock drift")
+	_, ok = localTimeOffset(now, now.Add(-4*time.Hour+10*time.Minute))
+	assert.False(t, ok, "outside the tolerance")
+	_, ok = localTimeOffset(now, now.Add(-15*time.Hour))
+	assert.False(t, ok, "further than any time zone")
+}
+
+func TestUpload_LocalTimeTimestamp(t *testing.T) {
+
+	hook, oldLog, db, _ := setupUploadTest()
 	defer func() { log = *oldLog }()
 
-	db := &persistence.Conn{}
-	router := setupUploadRouter(db)
+	oldTolerance := config.AppConstants.LocalTimeSkewToleranceSeconds
+	config.AppConstants.LocalTimeSkewToleranceSeconds = 120
+	defer func() { config.AppConstants.LocalTimeSkewToleranceSeconds = oldTolerance }()
+
+	now := time.Unix(1600000000, 0)
+	router := Router()
+	(&uploadServlet{db: db, resolver: db, clock: fixedClock(now), maintenance: newMaintenanceMode(db)}).RegisterRouting(router)
 
-	// Set up PrivForPub
 	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
 	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
 
 	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
-	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(nil)
 
 	var (
 		nonce [24]byte
 		msg   []byte
 	)
-	// Good response
+	// A client four hours behind UTC sending its local time, a few seconds old
 	io.ReadFull(rand.Reader, nonce[:])
-	ts := time.Now()
 	pbts := timestamppb.Timestamp{
-		Seconds: ts.Unix(),
+		Seconds: now.Unix() - 4*3600 - 7,
 	}
 	upload := buildUpload(1, pbts)
 	marshalledUpload, _ := proto.Marshal(upload)
@@ -484,14 +841,1037 @@ func TestUpload(t *testing.T) {
 
 	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
 	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	req.Header.Set("User-Agent", "okhttp/4.9.0")
 	resp := httptest.NewRecorder()
 	router.ServeHTTP(resp, req)
 
-	assert.Equal(t, 200, resp.Code, "200 response is expected")
-	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_NONE))
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_TIMESTAMP))
+
+	assert.Equal(t, 2, len(hook.Entries))
+	classified := hook.Entries[0]
+	assert.Equal(t, logrus.WarnLevel, classified.Level)
+	assert.Equal(t, "upload timestamp looks like local time", classified.Message)
+	assert.Equal(t, -240, classified.Data["offset_minutes"])
+	assert.Equal(t, persistenceErrors.Android, classified.Data["device_type"])
+	assert.Equal(t, false, classified.Data["within_skew"])
+	testhelpers.AssertLog(t, hook, 2, logrus.WarnLevel, "invalid timestamp")
 }
 
-func TestValidateKey_RollingPeriodLT1(t *testing.T) {
+func TestLogTimestampSkew(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	oldThreshold := config.AppConstants.UploadSkewLogThresholdSeconds
+	config.AppConstants.UploadSkewLogThresholdSeconds = 300
+	defer func() { config.AppConstants.UploadSkewLogThresholdSeconds = oldThreshold }()
+
+	now := time.Unix(1600000000, 0)
+
+	// Below the threshold either way nothing is logged
+	logTimestampSkew(context.Background(), now, now.Add(-300*time.Second))
+	logTimestampSkew(context.Background(), now, now.Add(299*time.Second))
+	assert.Equal(t, 0, len(hook.Entries))
+
+	logTimestampSkew(context.Background(), now, now.Add(-301*time.Second))
+	assert.Equal(t, int64(-301), hook.LastEntry().Data["skew_seconds"])
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "upload timestamp skewed")
+
+	logTimestampSkew(context.Background(), now, now.Add(20*time.Minute))
+	assert.Equal(t, int64(1200), hook.LastEntry().Data["skew_seconds"])
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "upload timestamp skewed")
+
+	// Disabled
+	config.AppConstants.UploadSkewLogThresholdSeconds = 0
+	logTimestampSkew(context.Background(), now, now.Add(-20*time.Minute))
+	assert.Equal(t, 0, len(hook.Entries))
+}
+
+func TestTimestampMatchesKeys(t *testing.T) {
+	oldSkew := config.AppConstants.UploadMaxKeyTimestampSkew
+	defer func() { config.AppConstants.UploadMaxKeyTimestampSkew = oldSkew }()
+
+	token := make([]byte, 16)
+	older := buildKey(token, int32(2), int32(2651450-144), int32(144))
+	newest := buildKey(token, int32(2), int32(2651450), int32(144))
+	keys := []*pb.TemporaryExposureKey{&newest, &older}
+	newestStart := time.Unix(2651450*600, 0)
+
+	// Disabled by default
+	config.AppConstants.UploadMaxKeyTimestampSkew = 0
+	assert.True(t, timestampMatchesKeys(newestStart.Add(365*24*time.Hour), keys))
+
+	config.AppConstants.UploadMaxKeyTimestampSkew = 2 * 86400
+	assert.True(t, timestampMatchesKeys(newestStart, keys))
+	assert.True(t, timestampMatchesKeys(newestStart.Add(2*86400*time.Second), keys))
+	assert.False(t, timestampMatchesKeys(newestStart.Add((2*86400+1)*time.Second), keys))
+	assert.True(t, timestampMatchesKeys(newestStart.Add(-2*86400*time.Second), keys))
+	assert.False(t, timestampMatchesKeys(newestStart.Add(-(2*86400+1)*time.Second), keys))
+}
+
+func TestUpload_TimestampInconsistentWithKeys(t *testing.T) {
+
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	oldSkew := config.AppConstants.UploadMaxKeyTimestampSkew
+	config.AppConstants.UploadMaxKeyTimestampSkew = 2 * 86400
+	defer func() { config.AppConstants.UploadMaxKeyTimestampSkew = oldSkew }()
+
+	// Keys from randomTestKey are for RSIN 2651450, in May 2020; the upload
+	// claims to be from 30 days later
+	now := time.Unix(2651450*600, 0).Add(30 * 24 * time.Hour)
+	db := &persistence.Conn{}
+	notInMaintenance(db)
+	allowKeypairs(db)
+	router := Router()
+	(&uploadServlet{db: db, resolver: db, clock: fixedClock(now), maintenance: newMaintenanceMode(db)}).RegisterRouting(router)
+
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+
+	var (
+		nonce [24]byte
+		msg   []byte
+	)
+	io.ReadFull(rand.Reader, nonce[:])
+	upload := buildUpload(1, timestamppb.Timestamp{Seconds: now.Unix()})
+	marshalledUpload, _ := proto.Marshal(upload)
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
+
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
+
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_TIMESTAMP))
+	db.AssertNotCalled(t, "StoreKeys", mock.Anything, mock.Anything, mock.Anything)
+
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "timestamp inconsistent with key intervals")
+}
+
+func TestKeyStartsInFuture(t *testing.T) {
+	oldGrace := config.AppConstants.UploadFutureKeyGraceIntervals
+	defer func() { config.AppConstants.UploadFutureKeyGraceIntervals = oldGrace }()
+
+	token := make([]byte, 16)
+	older := buildKey(token, int32(2), int32(2651450-144), int32(144))
+	newest := buildKey(token, int32(2), int32(2651450), int32(144))
+	keys := []*pb.TemporaryExposureKey{&older, &newest}
+	newestStart := time.Unix(2651450*600, 0)
+
+	// Strict by default: anywhere in the newest key's first interval is fine
+	config.AppConstants.UploadFutureKeyGraceIntervals = 0
+	assert.False(t, keyStartsInFuture(newestStart, keys))
+	assert.False(t, keyStartsInFuture(newestStart.Add(-time.Second).Add(10*time.Minute), keys))
+	assert.True(t, keyStartsInFuture(newestStart.Add(-time.Second), keys))
+
+	// With grace the newest key may start up to that many intervals ahead
+	config.AppConstants.UploadFutureKeyGraceIntervals = 6
+	assert.False(t, keyStartsInFuture(newestStart.Add(-6*10*time.Minute), keys))
+	assert.True(t, keyStartsInFuture(newestStart.Add(-6*10*time.Minute).Add(-time.Second), keys))
+}
+
+func TestUpload_FutureRollingStartIntervalNumber(t *testing.T) {
+
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	// Keys from randomTestKey are for RSIN 2651450; the server clock is one
+	// interval before it starts
+	now := time.Unix(2651450*600, 0).Add(-10 * time.Minute)
+	db := &persistence.Conn{}
+	notInMaintenance(db)
+	allowKeypairs(db)
+	router := Router()
+	(&uploadServlet{db: db, resolver: db, clock: fixedClock(now), maintenance: newMaintenanceMode(db)}).RegisterRouting(router)
+
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+
+	var (
+		nonce [24]byte
+		msg   []byte
+	)
+	io.ReadFull(rand.Reader, nonce[:])
+	upload := buildUpload(1, timestamppb.Timestamp{Seconds: now.Unix()})
+	marshalledUpload, _ := proto.Marshal(upload)
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
+
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
+
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_ROLLING_START_INTERVAL_NUMBER))
+	db.AssertNotCalled(t, "StoreKeys", mock.Anything, mock.Anything, mock.Anything)
+
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "rollingStartIntervalNumber is in the future")
+}
+
+func TestKeyTooOld(t *testing.T) {
+	oldMaxAge := config.AppConstants.MaxKeyAgeDays
+	defer func() { config.AppConstants.MaxKeyAgeDays = oldMaxAge }()
+
+	token := make([]byte, 16)
+	oldest := buildKey(token, int32(2), int32(2651450-144), int32(144))
+	newest := buildKey(token, int32(2), int32(2651450), int32(144))
+	keys := []*pb.TemporaryExposureKey{&oldest, &newest}
+	oldestStart := time.Unix((2651450-144)*600, 0)
+
+	// Disabled by default
+	config.AppConstants.MaxKeyAgeDays = 0
+	assert.False(t, keyTooOld(oldestStart.Add(365*24*time.Hour), keys))
+
+	// Any key starting more than the maximum age ago is too old, whatever the
+	// newer keys in the upload
+	config.AppConstants.MaxKeyAgeDays = 3
+	assert.False(t, keyTooOld(oldestStart.Add(3*24*time.Hour), keys))
+	assert.False(t, keyTooOld(oldestStart.Add(3*24*time.Hour).Add(10*time.Minute).Add(-time.Second), keys))
+	assert.True(t, keyTooOld(oldestStart.Add(3*24*time.Hour).Add(10*time.Minute), keys))
+}
+
+func TestUpload_KeyOlderThanMaxAge(t *testing.T) {
+	oldMaxAge := config.AppConstants.MaxKeyAgeDays
+	defer func() { config.AppConstants.MaxKeyAgeDays = oldMaxAge }()
+	config.AppConstants.MaxKeyAgeDays = 2
+
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	// Keys from randomTestKey are for RSIN 2651450; the server clock is three
+	// days after it starts
+	now := time.Unix(2651450*600, 0).Add(3 * 24 * time.Hour)
+	db := &persistence.Conn{}
+	notInMaintenance(db)
+	allowKeypairs(db)
+	router := Router()
+	(&uploadServlet{db: db, resolver: db, clock: fixedClock(now), maintenance: newMaintenanceMode(db)}).RegisterRouting(router)
+
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+
+	var (
+		nonce [24]byte
+		msg   []byte
+	)
+	io.ReadFull(rand.Reader, nonce[:])
+	upload := buildUpload(1, timestamppb.Timestamp{Seconds: now.Unix()})
+	marshalledUpload, _ := proto.Marshal(upload)
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
+
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
+
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_ROLLING_START_INTERVAL_NUMBER))
+	db.AssertNotCalled(t, "StoreKeys", mock.Anything, mock.Anything, mock.Anything)
+
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "rollingStartIntervalNumber is too old")
+}
+
+func TestUpload_InvalidTimestampCountsRejection(t *testing.T) {
+
+	_, oldLog, db, _ := setupUploadTest()
+	defer func() { log = *oldLog }()
+
+	now := time.Unix(1600000000, 0)
+	router := Router()
+	(&uploadServlet{db: db, resolver: db, clock: fixedClock(now), maintenance: newMaintenanceMode(db)}).RegisterRouting(router)
+
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+
+	var (
+		nonce [24]byte
+		msg   []byte
+	)
+	io.ReadFull(rand.Reader, nonce[:])
+	pbts := timestamppb.Timestamp{
+		Seconds: now.Unix() - 7200,
+	}
+	upload := buildUpload(1, pbts)
+	marshalledUpload, _ := proto.Marshal(upload)
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
+
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
+
+	before := ScrapeMetrics()
+
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+
+	after := ScrapeMetrics()
+	rejections := `covidshield_upload_rejections{reason="INVALID_TIMESTAMP"}`
+	assert.Equal(t, metricValue(before, rejections)+1, metricValue(after, rejections), "should count the rejection by reason")
+	assert.Equal(t, metricValue(before, "covidshield_upload_late")+1, metricValue(after, "covidshield_upload_late"), "should count the late upload")
+}
+
+func TestUpload_ExpiredKey(t *testing.T) {
+
+	hook, oldLog, db, router := setupUploadTest()
+	defer func() { log = *oldLog }()
+	// Set up PrivForPub
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPubKeyUsed, goodAppPrivKeyUsed, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+	db.On("StoreKeys", goodAppPubKeyUsed, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(0), int64(0), persistenceErrors.ErrKeyConsumed)
+
+	var (
+		nonce [24]byte
+		msg   []byte
+	)
+	// Expired Key
+	io.ReadFull(rand.Reader, nonce[:])
+	ts := time.Now()
+	pbts := timestamppb.Timestamp{
+		Seconds: ts.Unix(),
+	}
+	upload := buildUpload(1, pbts)
+	marshalledUpload, _ := proto.Marshal(upload)
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPrivKeyUsed)
+
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPubKeyUsed[:], encrypted))
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_KEYPAIR))
+
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "key is used up")
+}
+
+func TestUpload_UploadTooSoon(t *testing.T) {
+
+	hook, oldLog, db, router := setupUploadTest()
+	defer func() { log = *oldLog }()
+
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(0), int64(0), persistenceErrors.ErrUploadTooSoon)
+
+	var (
+		nonce [24]byte
+		msg   []byte
+	)
+	io.ReadFull(rand.Reader, nonce[:])
+	pbts := timestamppb.Timestamp{
+		Seconds: time.Now().Unix(),
+	}
+	upload := buildUpload(1, pbts)
+	marshalledUpload, _ := proto.Marshal(upload)
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
+
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 429, resp.Code, "429 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_UPLOAD_TOO_SOON))
+
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "keypair uploaded too recently")
+}
+
+func TestUpload_GenericDBError(t *testing.T) {
+
+	hook, oldLog, db, router := setupUploadTest()
+	defer func() { log = *oldLog }()
+	// Set up PrivForPub
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPubDBError, goodAppPrivDBError, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+	db.On("StoreKeys", goodAppPubDBError, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(0), int64(0), fmt.Errorf("generic DB error"))
+
+	var (
+		nonce [24]byte
+		msg   []byte
+	)
+	// Generic DB Error
+	io.ReadFull(rand.Reader, nonce[:])
+	ts := time.Now()
+	pbts := timestamppb.Timestamp{
+		Seconds: ts.Unix(),
+	}
+	upload := buildUpload(1, pbts)
+	marshalledUpload, _ := proto.Marshal(upload)
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPrivDBError)
+
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPubDBError[:], encrypted))
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 500, resp.Code, "500 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_SERVER_ERROR))
+
+	testhelpers.AssertLog(t, hook, 1, logrus.ErrorLevel, "failed to store diagnosis keys")
+
+}
+
+func TestUpload_TemporaryDBError(t *testing.T) {
+
+	for _, kind := range []error{persistenceErrors.ErrDBUnavailable, persistenceErrors.ErrDBTimeout, persistenceErrors.ErrDBConflict} {
+		hook, oldLog, db, router := setupUploadTest()
+
+		goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+		goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
+
+		db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+		db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).
+			Return(int64(0), int64(0), &persistenceErrors.DBError{Kind: kind, Err: fmt.Errorf("driver error")})
+
+		var (
+			nonce [24]byte
+			msg   []byte
+		)
+		io.ReadFull(rand.Reader, nonce[:])
+		pbts := timestamppb.Timestamp{
+			Seconds: time.Now().Unix(),
+		}
+		upload := buildUpload(1, pbts)
+		marshalledUpload, _ := proto.Marshal(upload)
+		encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
+
+		payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
+		req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+
+		assert.Equal(t, 503, resp.Code, "503 response is expected for %v", kind)
+		assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_SERVER_ERROR))
+
+		testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "database unavailable")
+		log = *oldLog
+	}
+}
+
+func TestUpload_TemporaryDBErrorResolvingKeypair(t *testing.T) {
+
+	hook, oldLog, db, router := setupUploadTest()
+	defer func() { log = *oldLog }()
+
+	goodServerPub, _, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, _, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).
+		Return(nil, &persistenceErrors.DBError{Kind: persistenceErrors.ErrDBUnavailable, Err: fmt.Errorf("driver error")})
+
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], make([]byte, 24), goodAppPub[:], []byte("payload")))
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 503, resp.Code, "503 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_SERVER_ERROR))
+
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "database unavailable")
+}
+
+func TestUpload_DenylistedKeypair(t *testing.T) {
+
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+	db := &persistence.Conn{}
+	notInMaintenance(db)
+	router := Router()
+	NewUploadServlet(db, db).RegisterRouting(router)
+	// Set up PrivForPub
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPubDenylisted, goodAppPrivDenylisted, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+	db.On("IsDenylisted", mock.Anything, goodAppPubDenylisted[:]).Return(true, nil)
+
+	var (
+		nonce [24]byte
+		msg   []byte
+	)
+	// Denylisted keypair
+	io.ReadFull(rand.Reader, nonce[:])
+	ts := time.Now()
+	pbts := timestamppb.Timestamp{
+		Seconds: ts.Unix(),
+	}
+	upload := buildUpload(1, pbts)
+	marshalledUpload, _ := proto.Marshal(upload)
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPrivDenylisted)
+
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPubDenylisted[:], encrypted))
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "401 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_KEYPAIR))
+	db.AssertNotCalled(t, "StoreKeys", mock.Anything, mock.Anything, mock.Anything)
+
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "keypair is denylisted")
+
+}
+
+func TestUpload_CircuitOpen(t *testing.T) {
+
+	hook, oldLog, db, router := setupUploadTest()
+	defer func() { log = *oldLog }()
+	// Set up PrivForPub
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPubDBError, goodAppPrivDBError, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+	db.On("StoreKeys", goodAppPubDBError, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(0), int64(0), persistenceErrors.ErrCircuitOpen)
+
+	var (
+		nonce [24]byte
+		msg   []byte
+	)
+	// Database breaker open
+	io.ReadFull(rand.Reader, nonce[:])
+	ts := time.Now()
+	pbts := timestamppb.Timestamp{
+		Seconds: ts.Unix(),
+	}
+	upload := buildUpload(1, pbts)
+	marshalledUpload, _ := proto.Marshal(upload)
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPrivDBError)
+
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPubDBError[:], encrypted))
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 503, resp.Code, "503 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_SERVER_ERROR))
+
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "database unavailable")
+
+}
+
+func TestUpload_NotEnoughKeysRemaining(t *testing.T) {
+
+	hook, oldLog, db, router := setupUploadTest()
+	defer func() { log = *oldLog }()
+	// Set up PrivForPub
+	goodAppPubNoKeysRemaining, goodAppPrivNoKeysRemaining, _ := box.GenerateKey(rand.Reader)
+	goodServerPubNoKeysRemaining, goodServerPrivNoKeysRemaining, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPubNoKeysRemaining[:]).Return(goodServerPrivNoKeysRemaining[:], nil)
+	db.On("StoreKeys", goodAppPubNoKeysRemaining, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(0), int64(0), persistenceErrors.ErrTooManyKeys)
+
+	var (
+		nonce [24]byte
+		msg   []byte
+	)
+	// Not enough keys remaining
+	io.ReadFull(rand.Reader, nonce[:])
+	ts := time.Now()
+	pbts := timestamppb.Timestamp{
+		Seconds: ts.Unix(),
+	}
+	upload := buildUpload(1, pbts)
+	marshalledUpload, _ := proto.Marshal(upload)
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPubNoKeysRemaining, goodAppPrivNoKeysRemaining)
+
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPubNoKeysRemaining[:], nonce[:], goodAppPubNoKeysRemaining[:], encrypted))
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_TOO_MANY_KEYS))
+
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "not enough keys remaining")
+}
+
+func TestUpload(t *testing.T) {
+
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db := &persistence.Conn{}
+	router := setupUploadRouter(db)
+
+	// Set up PrivForPub
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(1), int64(0), nil)
+
+	var (
+		nonce [24]byte
+		msg   []byte
+	)
+	// Good response
+	io.ReadFull(rand.Reader, nonce[:])
+	ts := time.Now()
+	pbts := timestamppb.Timestamp{
+		Seconds: ts.Unix(),
+	}
+	upload := buildUpload(1, pbts)
+	marshalledUpload, _ := proto.Marshal(upload)
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
+
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_NONE))
+}
+
+func TestUpload_SkippedKeys(t *testing.T) {
+
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db := &persistence.Conn{}
+	router := setupUploadRouter(db)
+
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+	// One of the two keys was already stored by an earlier upload
+	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(1), int64(1), nil)
+
+	var (
+		nonce [24]byte
+		msg   []byte
+	)
+	io.ReadFull(rand.Reader, nonce[:])
+	upload := buildUpload(2, timestamppb.Timestamp{Seconds: time.Now().Unix()})
+	marshalledUpload, _ := proto.Marshal(upload)
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
+
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_NONE))
+
+	assert.Equal(t, int64(1), hook.LastEntry().Data["stored"])
+	assert.Equal(t, int64(1), hook.LastEntry().Data["skipped"])
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "skipped diagnosis keys that were already stored")
+}
+
+func TestUpload_StoreKeysSaturated(t *testing.T) {
+
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	oldLimit, oldWait := config.AppConstants.MaxConcurrentStoreKeys, config.AppConstants.StoreKeysWaitMilliseconds
+	config.AppConstants.MaxConcurrentStoreKeys = 1
+	config.AppConstants.StoreKeysWaitMilliseconds = 10
+	defer func() {
+		config.AppConstants.MaxConcurrentStoreKeys = oldLimit
+		config.AppConstants.StoreKeysWaitMilliseconds = oldWait
+	}()
+
+	db := &persistence.Conn{}
+	notInMaintenance(db)
+	allowKeypairs(db)
+	servlet := NewUploadServlet(db, db).(*uploadServlet)
+	router := Router()
+	servlet.RegisterRouting(router)
+
+	// Hold the only slot, as a slow in-flight store would
+	servlet.storeSlots <- struct{}{}
+
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+
+	var (
+		nonce [24]byte
+		msg   []byte
+	)
+	io.ReadFull(rand.Reader, nonce[:])
+	pbts := timestamppb.Timestamp{
+		Seconds: time.Now().Unix(),
+	}
+	upload := buildUpload(1, pbts)
+	marshalledUpload, _ := proto.Marshal(upload)
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
+
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 503, resp.Code, "503 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_SERVER_ERROR))
+	db.AssertNotCalled(t, "StoreKeys", mock.Anything, mock.Anything, mock.Anything)
+
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "timed out waiting to store diagnosis keys")
+}
+
+func uploadWithCohort(t *testing.T, cohort string) *persistence.Conn {
+	db := &persistence.Conn{}
+	router := setupUploadRouter(db)
+
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(1), int64(0), nil)
+	db.On("SaveEvent", mock.AnythingOfType("persistence.Event")).Return(nil)
+
+	var (
+		nonce [24]byte
+		msg   []byte
+	)
+	io.ReadFull(rand.Reader, nonce[:])
+	pbts := timestamppb.Timestamp{
+		Seconds: time.Now().Unix(),
+	}
+	upload := buildUpload(1, pbts)
+	marshalledUpload, _ := proto.Marshal(upload)
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
+
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	req.Header.Set("X-Cohort", cohort)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_NONE))
+	return db
+}
+
+func TestUpload_AllowedCohort(t *testing.T) {
+
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	oldCohorts := config.AppConstants.AllowedCohorts
+	config.AppConstants.AllowedCohorts = []string{"wave-1", "wave-2"}
+	defer func() { config.AppConstants.AllowedCohorts = oldCohorts }()
+
+	db := uploadWithCohort(t, "wave-2")
+
+	db.AssertCalled(t, "SaveEvent", mock.MatchedBy(func(e persistenceErrors.Event) bool {
+		return e.Identifier == persistenceErrors.UploadCohort &&
+			e.DeviceType == persistenceErrors.Server &&
+			e.Originator == "wave-2" &&
+			e.Count == 1
+	}))
+}
+
+func TestUpload_DisallowedCohort(t *testing.T) {
+
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	oldCohorts := config.AppConstants.AllowedCohorts
+	config.AppConstants.AllowedCohorts = []string{"wave-1", "wave-2"}
+	defer func() { config.AppConstants.AllowedCohorts = oldCohorts }()
+
+	db := uploadWithCohort(t, "user-1234")
+
+	db.AssertNotCalled(t, "SaveEvent", mock.Anything)
+}
+
+// fakeKMS "decrypts" by XORing with a fixed byte, standing in for an external key service
+type fakeKMS byte
+
+func (k fakeKMS) Decrypt(ciphertext []byte) ([]byte, error) {
+	plaintext := make([]byte, len(ciphertext))
+	for i, b := range ciphertext {
+		plaintext[i] = b ^ byte(k)
+	}
+	return plaintext, nil
+}
+
+func TestUpload_KMSKeyResolver(t *testing.T) {
+
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db := &persistence.Conn{}
+	notInMaintenance(db)
+	allowKeypairs(db)
+	kms := fakeKMS(0x5a)
+	router := Router()
+	NewUploadServlet(db, persistenceErrors.NewKMSKeyResolver(db, kms)).RegisterRouting(router)
+
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
+
+	// The database only holds the wrapped key; the upload can only be opened
+	// if the resolver unwraps it
+	wrapped, _ := kms.Decrypt(goodServerPriv[:])
+	db.On("PrivForPub", goodServerPub[:]).Return(wrapped, nil)
+	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(1), int64(0), nil)
+
+	var (
+		nonce [24]byte
+		msg   []byte
+	)
+	io.ReadFull(rand.Reader, nonce[:])
+	pbts := timestamppb.Timestamp{
+		Seconds: time.Now().Unix(),
+	}
+	upload := buildUpload(1, pbts)
+	marshalledUpload, _ := proto.Marshal(upload)
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
+
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_NONE))
+}
+
+func TestUpload_RecordsRequestSize(t *testing.T) {
+
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db := &persistence.Conn{}
+	router := setupUploadRouter(db)
+
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(1), int64(0), nil)
+
+	var (
+		nonce [24]byte
+		msg   []byte
+	)
+	io.ReadFull(rand.Reader, nonce[:])
+	pbts := timestamppb.Timestamp{
+		Seconds: time.Now().Unix(),
+	}
+	upload := buildUpload(1, pbts)
+	marshalledUpload, _ := proto.Marshal(upload)
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
+
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
+
+	before := ScrapeMetrics()
+
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+
+	after := ScrapeMetrics()
+	assert.Equal(t, metricValue(before, "covidshield_upload_request_size_count")+1, metricValue(after, "covidshield_upload_request_size_count"), "should record one observation")
+	assert.Equal(t, metricValue(before, "covidshield_upload_request_size_sum")+float64(len(payload)), metricValue(after, "covidshield_upload_request_size_sum"), "should record the request body size")
+}
+
+func TestUpload_RecordsKeyCount(t *testing.T) {
+
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db := &persistence.Conn{}
+	router := setupUploadRouter(db)
+
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(1), int64(0), nil)
+
+	var (
+		nonce [24]byte
+		msg   []byte
+	)
+	io.ReadFull(rand.Reader, nonce[:])
+	pbts := timestamppb.Timestamp{
+		Seconds: time.Now().Unix(),
+	}
+	upload := buildUpload(5, pbts)
+	marshalledUpload, _ := proto.Marshal(upload)
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
+
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
+
+	before := ScrapeMetrics()
+
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+
+	after := ScrapeMetrics()
+	assert.Equal(t, metricValue(before, "covidshield_upload_keys_count")+1, metricValue(after, "covidshield_upload_keys_count"), "should record one observation")
+	assert.Equal(t, metricValue(before, "covidshield_upload_keys_sum")+5, metricValue(after, "covidshield_upload_keys_sum"), "should record the number of keys")
+}
+
+func TestUpload_Quota(t *testing.T) {
+
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db := &persistence.Conn{}
+	router := setupUploadRouter(db)
+
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
+	expiresAt := time.Unix(1600000000, 0)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(1), int64(0), nil)
+	db.On("KeypairQuota", mock.Anything, goodAppPub).Return(int64(23), expiresAt, nil)
+
+	upload := func(header bool) *pb.EncryptedUploadResponse {
+		var (
+			nonce [24]byte
+			msg   []byte
+		)
+		io.ReadFull(rand.Reader, nonce[:])
+		marshalledUpload, _ := proto.Marshal(buildUpload(5, timestamppb.Timestamp{Seconds: time.Now().Unix()}))
+		encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
+		payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
+
+		req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+		if header {
+			req.Header.Set("X-Upload-Quota", "true")
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		assert.Equal(t, 200, resp.Code, "200 response is expected")
+
+		var response pb.EncryptedUploadResponse
+		assert.Nil(t, proto.Unmarshal(resp.Body.Bytes(), &response))
+		assert.Equal(t, pb.EncryptedUploadResponse_NONE, response.GetError())
+		return &response
+	}
+
+	// Without the header the response is unchanged for older clients
+	assert.Nil(t, upload(false).Quota)
+	db.AssertNotCalled(t, "KeypairQuota", mock.Anything, mock.Anything)
+
+	quota := upload(true).GetQuota()
+	assert.Equal(t, uint32(5), quota.GetAcceptedKeys())
+	assert.Equal(t, uint32(23), quota.GetRemainingKeys())
+	assert.Equal(t, expiresAt.Unix(), quota.GetExpiresAt().GetSeconds())
+}
+
+func TestUpload_DebugOriginatorRegion(t *testing.T) {
+
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db := &persistence.Conn{}
+	router := setupUploadRouter(db)
+
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(1), int64(0), nil)
+	db.On("OriginatorRegion", mock.Anything, goodAppPub).Return("ON", nil)
+
+	upload := func() *pb.EncryptedUploadResponse {
+		var (
+			nonce [24]byte
+			msg   []byte
+		)
+		io.ReadFull(rand.Reader, nonce[:])
+		marshalledUpload, _ := proto.Marshal(buildUpload(1, timestamppb.Timestamp{Seconds: time.Now().Unix()}))
+		encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
+		payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
+
+		req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		assert.Equal(t, 200, resp.Code, "200 response is expected")
+
+		var response pb.EncryptedUploadResponse
+		assert.Nil(t, proto.Unmarshal(resp.Body.Bytes(), &response))
+		return &response
+	}
+
+	// Off by default
+	assert.Nil(t, upload().OriginatorRegion)
+	db.AssertNotCalled(t, "OriginatorRegion", mock.Anything, mock.Anything)
+
+	config.AppConstants.DebugUploadOriginatorRegion = true
+	defer func() { config.AppConstants.DebugUploadOriginatorRegion = false }()
+
+	response := upload()
+	assert.Equal(t, pb.EncryptedUploadResponse_NONE, response.GetError())
+	assert.Equal(t, "ON", response.GetOriginatorRegion())
+}
+
+func TestUpload_QuotaLookupFails(t *testing.T) {
+
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db := &persistence.Conn{}
+	router := setupUploadRouter(db)
+
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(1), int64(0), nil)
+	db.On("KeypairQuota", mock.Anything, goodAppPub).Return(int64(0), time.Time{}, fmt.Errorf("generic DB error"))
+
+	var (
+		nonce [24]byte
+		msg   []byte
+	)
+	io.ReadFull(rand.Reader, nonce[:])
+	marshalledUpload, _ := proto.Marshal(buildUpload(1, timestamppb.Timestamp{Seconds: time.Now().Unix()}))
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
+
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	req.Header.Set("X-Upload-Quota", "true")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	// The keys are stored, so the upload still succeeds without a quota
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	var response pb.EncryptedUploadResponse
+	assert.Nil(t, proto.Unmarshal(resp.Body.Bytes(), &response))
+	assert.Equal(t, pb.EncryptedUploadResponse_NONE, response.GetError())
+	assert.Nil(t, response.Quota)
+
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "unable to look up keypair quota")
+}
+
+func TestValidateKey_RollingPeriodLT1(t *testing.T) {
 
 	hook, oldLog := testhelpers.SetupTestLogging(&log)
 	defer func() { log = *oldLog }()
@@ -516,6 +1896,31 @@ func TestValidateKey_RollingPeriodLT1(t *testing.T) {
 	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "missing or invalid rollingPeriod")
 }
 
+func TestValidateKey_RollingPeriodMissing(t *testing.T) {
+
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	req, _ := http.NewRequest("POST", "/upload", nil)
+	resp := httptest.NewRecorder()
+
+	// Omitted RollingPeriod defaults to a full day
+	token := make([]byte, 16)
+	rand.Read(token)
+	key := buildKey(token, int32(2), int32(2651450), int32(144))
+	key.RollingPeriod = nil
+
+	assert.True(t, validateKey(req.Context(), resp, &key))
+	assert.Equal(t, int32(pb.MaxTEKRollingPeriod), key.GetRollingPeriod())
+
+	// Explicit 144 is accepted unchanged
+	key = buildKey(token, int32(2), int32(2651450), int32(144))
+
+	assert.True(t, validateKey(req.Context(), resp, &key))
+	assert.Equal(t, int32(144), key.GetRollingPeriod())
+	assert.Equal(t, 200, resp.Code, "no error response is expected")
+}
+
 func TestValidateKey_RollingPeriodGT144(t *testing.T) {
 
 	hook, oldLog := testhelpers.SetupTestLogging(&log)
@@ -569,6 +1974,81 @@ func TestValidateKey_KeyDataNot16Bytes(t *testing.T) {
 
 }
 
+func TestValidateKey_KeyDataConfiguredLength(t *testing.T) {
+
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	oldLength := config.AppConstants.KeyDataLength
+	config.AppConstants.KeyDataLength = 32
+	defer func() { config.AppConstants.KeyDataLength = oldLength }()
+
+	req, _ := http.NewRequest("POST", "/upload", nil)
+
+	// Key data matches configured length
+	resp := httptest.NewRecorder()
+	token := make([]byte, 32)
+	rand.Read(token)
+	key := buildKey(token, int32(2), int32(2651450), int32(144))
+
+	assert.True(t, validateKey(req.Context(), resp, &key))
+
+	// Standard 16 byte key data no longer matches
+	resp = httptest.NewRecorder()
+	token = make([]byte, 16)
+	rand.Read(token)
+	key = buildKey(token, int32(2), int32(2651450), int32(144))
+
+	assert.False(t, validateKey(req.Context(), resp, &key))
+
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_KEY_DATA))
+
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "invalid key data")
+}
+
+func TestValidateKey_RemappedErrorStatus(t *testing.T) {
+
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	oldStatuses := config.AppConstants.UploadErrorStatuses
+	config.AppConstants.UploadErrorStatuses = []string{"INVALID_KEY_DATA=422", "INVALID_ROLLING_PERIOD=bogus"}
+	defer func() { config.AppConstants.UploadErrorStatuses = oldStatuses }()
+
+	req, _ := http.NewRequest("POST", "/upload", nil)
+
+	// Remapped code uses the configured status
+	resp := httptest.NewRecorder()
+	token := make([]byte, 8)
+	rand.Read(token)
+	key := buildKey(token, int32(2), int32(2651450), int32(144))
+
+	assert.False(t, validateKey(req.Context(), resp, &key))
+
+	assert.Equal(t, 422, resp.Code, "422 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_KEY_DATA))
+
+	// Other codes keep 400
+	resp = httptest.NewRecorder()
+	token = make([]byte, 16)
+	key = buildKey(token, int32(2), int32(0), int32(144))
+
+	assert.False(t, validateKey(req.Context(), resp, &key))
+
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_ROLLING_START_INTERVAL_NUMBER))
+
+	// Invalid entries are ignored
+	resp = httptest.NewRecorder()
+	key = buildKey(token, int32(2), int32(2651450), int32(0))
+
+	assert.False(t, validateKey(req.Context(), resp, &key))
+
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	testhelpers.AssertLog(t, hook, 4, logrus.WarnLevel, "missing or invalid rollingPeriod")
+}
+
 func TestValidateKey_InvalidRSIN(t *testing.T) {
 
 	hook, oldLog := testhelpers.SetupTestLogging(&log)
@@ -647,6 +2127,209 @@ func TestValidateKey_TransmissionRiskLevelGT8(t *testing.T) {
 
 }
 
+func TestValidateKey_DeniedRollingPeriods(t *testing.T) {
+
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	config.AppConstants.DeniedRollingPeriods = []int32{143}
+	defer func() { config.AppConstants.DeniedRollingPeriods = []int32{} }()
+
+	req, _ := http.NewRequest("POST", "/upload", nil)
+	token := make([]byte, 16)
+	rand.Read(token)
+
+	resp := httptest.NewRecorder()
+	key := buildKey(token, int32(2), int32(2651450), int32(143))
+
+	assert.False(t, validateKey(req.Context(), resp, &key))
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_ROLLING_PERIOD))
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "denylisted rollingPeriod 143")
+
+	// Neighbouring values are still accepted
+	for _, period := range []int32{142, 144} {
+		resp = httptest.NewRecorder()
+		key = buildKey(token, int32(2), int32(2651450), period)
+
+		assert.True(t, validateKey(req.Context(), resp, &key))
+	}
+}
+
+func TestValidateKey_DefaultTransmissionRiskLevel(t *testing.T) {
+
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	config.AppConstants.DefaultTransmissionRiskLevel = 3
+	defer func() { config.AppConstants.DefaultTransmissionRiskLevel = 0 }()
+
+	req, _ := http.NewRequest("POST", "/upload", nil)
+	token := make([]byte, 16)
+	rand.Read(token)
+
+	// Omitted, the default is filled in
+	resp := httptest.NewRecorder()
+	key := buildKey(token, int32(0), int32(2651450), int32(144))
+	key.TransmissionRiskLevel = nil
+
+	assert.True(t, validateKey(req.Context(), resp, &key))
+	assert.Equal(t, int32(3), key.GetTransmissionRiskLevel())
+
+	// An explicit level in range is kept, even 0
+	for _, level := range []int32{0, 8} {
+		resp = httptest.NewRecorder()
+		key = buildKey(token, level, int32(2651450), int32(144))
+
+		assert.True(t, validateKey(req.Context(), resp, &key))
+		assert.Equal(t, level, key.GetTransmissionRiskLevel())
+	}
+
+	// An explicit level out of range still fails
+	resp = httptest.NewRecorder()
+	key = buildKey(token, int32(9), int32(2651450), int32(144))
+
+	assert.False(t, validateKey(req.Context(), resp, &key))
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_TRANSMISSION_RISK_LEVEL))
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "invalid transmission risk level")
+
+	// So does an omitted level when the default is out of range
+	config.AppConstants.DefaultTransmissionRiskLevel = 9
+	resp = httptest.NewRecorder()
+	key = buildKey(token, int32(0), int32(2651450), int32(144))
+	key.TransmissionRiskLevel = nil
+
+	assert.False(t, validateKey(req.Context(), resp, &key))
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_TRANSMISSION_RISK_LEVEL))
+}
+
+func TestValidateKey_ModernMissingTransmissionRisk(t *testing.T) {
+
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	oldAllow := config.AppConstants.AllowMissingTransmissionRisk
+	config.AppConstants.AllowMissingTransmissionRisk = true
+	defer func() { config.AppConstants.AllowMissingTransmissionRisk = oldAllow }()
+
+	req, _ := http.NewRequest("POST", "/upload", nil)
+
+	// No TransmissionRiskLevel but has a ReportType
+	resp := httptest.NewRecorder()
+	token := make([]byte, 16)
+	rand.Read(token)
+	key := buildKey(token, int32(0), int32(2651450), int32(144))
+	key.TransmissionRiskLevel = nil
+	reportType := pb.TemporaryExposureKey_CONFIRMED_TEST
+	key.ReportType = &reportType
+
+	assert.True(t, validateKey(req.Context(), resp, &key))
+
+	// Even when the default level is out of range, at level 0
+	oldDefault := config.AppConstants.DefaultTransmissionRiskLevel
+	config.AppConstants.DefaultTransmissionRiskLevel = 9
+	defer func() { config.AppConstants.DefaultTransmissionRiskLevel = oldDefault }()
+
+	resp = httptest.NewRecorder()
+	key.TransmissionRiskLevel = nil
+
+	assert.True(t, validateKey(req.Context(), resp, &key))
+	assert.Equal(t, int32(0), key.GetTransmissionRiskLevel())
+
+	// Neither TransmissionRiskLevel nor ReportType falls back on the default
+	resp = httptest.NewRecorder()
+	key.TransmissionRiskLevel = nil
+	key.ReportType = nil
+
+	assert.False(t, validateKey(req.Context(), resp, &key))
+
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_TRANSMISSION_RISK_LEVEL))
+
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "invalid transmission risk level")
+
+	// A legacy TransmissionRiskLevel is still range checked
+	resp = httptest.NewRecorder()
+	key = buildKey(token, int32(9), int32(2651450), int32(144))
+
+	assert.False(t, validateKey(req.Context(), resp, &key))
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_TRANSMISSION_RISK_LEVEL))
+}
+
+func TestValidateKey_LegacyTransmissionRisk(t *testing.T) {
+
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	req, _ := http.NewRequest("POST", "/upload", nil)
+
+	// Legacy client with a TransmissionRiskLevel and no ReportType
+	resp := httptest.NewRecorder()
+	token := make([]byte, 16)
+	rand.Read(token)
+	key := buildKey(token, int32(4), int32(2651450), int32(144))
+
+	assert.True(t, validateKey(req.Context(), resp, &key))
+
+	// Without the flag a zero TransmissionRiskLevel needs no ReportType
+	resp = httptest.NewRecorder()
+	key = buildKey(token, int32(0), int32(2651450), int32(144))
+
+	assert.True(t, validateKey(req.Context(), resp, &key))
+
+	// Nor with it, which only ever accepts more keys
+	oldAllow := config.AppConstants.AllowMissingTransmissionRisk
+	config.AppConstants.AllowMissingTransmissionRisk = true
+	defer func() { config.AppConstants.AllowMissingTransmissionRisk = oldAllow }()
+
+	for _, level := range []int32{0, 4, 8} {
+		resp = httptest.NewRecorder()
+		key = buildKey(token, level, int32(2651450), int32(144))
+
+		assert.True(t, validateKey(req.Context(), resp, &key), level)
+		assert.Equal(t, level, key.GetTransmissionRiskLevel())
+	}
+}
+
+func TestValidateKey_ReportTypeNotAllowed(t *testing.T) {
+
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	oldAllowed := config.AppConstants.AllowedReportTypes
+	config.AppConstants.AllowedReportTypes = []string{"CONFIRMED_TEST", "CONFIRMED_CLINICAL_DIAGNOSIS"}
+	defer func() { config.AppConstants.AllowedReportTypes = oldAllowed }()
+
+	req, _ := http.NewRequest("POST", "/upload", nil)
+	token := make([]byte, 16)
+	rand.Read(token)
+
+	// Allowed report type
+	resp := httptest.NewRecorder()
+	key := buildKey(token, int32(2), int32(2651450), int32(144))
+	reportType := pb.TemporaryExposureKey_CONFIRMED_TEST
+	key.ReportType = &reportType
+
+	assert.True(t, validateKey(req.Context(), resp, &key))
+
+	// No report type
+	resp = httptest.NewRecorder()
+	key.ReportType = nil
+
+	assert.True(t, validateKey(req.Context(), resp, &key))
+
+	// Self reports are disallowed
+	resp = httptest.NewRecorder()
+	reportType = pb.TemporaryExposureKey_SELF_REPORT
+	key.ReportType = &reportType
+
+	assert.False(t, validateKey(req.Context(), resp, &key))
+
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_INVALID_REPORT_TYPE))
+
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "report type not accepted")
+}
+
 func TestValidateKey(t *testing.T) {
 	_, oldLog := testhelpers.SetupTestLogging(&log)
 	defer func() { log = *oldLog }()
@@ -680,7 +2363,8 @@ func TestValidateKeys(t *testing.T) {
 	}
 
 	db := &persistence.Conn{}
-	servlet := NewUploadServlet(db)
+	notInMaintenance(db)
+	servlet := NewUploadServlet(db, db)
 	router := Router()
 	servlet.RegisterRouting(router)
 
@@ -715,6 +2399,106 @@ func TestValidateKeys(t *testing.T) {
 
 }
 
+func TestValidateKeys_RequireSingleReportType(t *testing.T) {
+
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	token := make([]byte, 16)
+	rand.Read(token)
+
+	confirmed := pb.TemporaryExposureKey_CONFIRMED_TEST
+	selfReport := pb.TemporaryExposureKey_SELF_REPORT
+	keyOne := buildKey(token, int32(2), int32(2651450), int32(144))
+	keyOne.ReportType = &confirmed
+	keyTwo := buildKey(token, int32(2), int32(2651450-144), int32(144))
+	keyTwo.ReportType = &selfReport
+	mixed := []*pb.TemporaryExposureKey{&keyOne, &keyTwo}
+
+	req, _ := http.NewRequest("POST", "/upload", nil)
+
+	// Mixing is allowed by default
+	assert.True(t, validateKeys(req.Context(), httptest.NewRecorder(), mixed))
+
+	config.AppConstants.RequireSingleReportType = true
+	defer func() { config.AppConstants.RequireSingleReportType = false }()
+
+	resp := httptest.NewRecorder()
+	assert.False(t, validateKeys(req.Context(), resp, mixed))
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+	assert.True(t, checkUploadResponse(resp.Body.Bytes(), pb.EncryptedUploadResponse_MIXED_REPORT_TYPES))
+	testhelpers.AssertLog(t, hook, 1, logrus.WarnLevel, "keys have different report types")
+
+	// Keys of a single type are still accepted
+	keyTwo.ReportType = &confirmed
+	assert.True(t, validateKeys(req.Context(), httptest.NewRecorder(), mixed))
+}
+
+func TestValidateKeysPure(t *testing.T) {
+	token := make([]byte, 16)
+	rand.Read(token)
+
+	good := buildKey(token, int32(2), int32(2651450), int32(144))
+	code, ok := ValidateKeys([]*pb.TemporaryExposureKey{&good})
+	assert.True(t, ok)
+	assert.Equal(t, pb.EncryptedUploadResponse_NONE, code)
+
+	badRollingPeriod := buildKey(token, int32(2), int32(2651450), int32(0))
+	code, ok = ValidateKeys([]*pb.TemporaryExposureKey{&good, &badRollingPeriod})
+	assert.False(t, ok)
+	assert.Equal(t, pb.EncryptedUploadResponse_INVALID_ROLLING_PERIOD, code)
+
+	badKeyData := buildKey(make([]byte, 8), int32(2), int32(2651450), int32(144))
+	code, ok = ValidateKeys([]*pb.TemporaryExposureKey{&badKeyData})
+	assert.False(t, ok)
+	assert.Equal(t, pb.EncryptedUploadResponse_INVALID_KEY_DATA, code)
+
+	tooFarApart := buildKey(token, int32(2), int32(2651450-(144*15)), int32(144))
+	code, ok = ValidateKeys([]*pb.TemporaryExposureKey{&good, &tooFarApart})
+	assert.False(t, ok)
+	assert.Equal(t, pb.EncryptedUploadResponse_INVALID_ROLLING_START_INTERVAL_NUMBER, code)
+
+	code, ok = ValidateKeys(nil)
+	assert.False(t, ok)
+	assert.Equal(t, pb.EncryptedUploadResponse_NO_KEYS_IN_PAYLOAD, code)
+}
+
+func BenchmarkValidateKeys(b *testing.B) {
+	keys := make([]*pb.TemporaryExposureKey, pb.MaxKeysInUpload)
+	for i := range keys {
+		token := make([]byte, 16)
+		rand.Read(token)
+		key := buildKey(token, int32(2), int32(2651450-144*(i%14)), int32(144))
+		keys[i] = &key
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := ValidateKeys(keys); !ok {
+			b.Fatal("expected keys to be valid")
+		}
+	}
+}
+
+func TestValidateKeyPure(t *testing.T) {
+	token := make([]byte, 16)
+	rand.Read(token)
+
+	key := buildKey(token, int32(9), int32(2651450), int32(144))
+	code, ok := ValidateKey(&key)
+	assert.False(t, ok)
+	assert.Equal(t, pb.EncryptedUploadResponse_INVALID_TRANSMISSION_RISK_LEVEL, code)
+
+	// An omitted rollingPeriod is defaulted rather than rejected
+	key = buildKey(token, int32(2), int32(2651450), int32(144))
+	key.RollingPeriod = nil
+	code, ok = ValidateKey(&key)
+	assert.True(t, ok)
+	assert.Equal(t, pb.EncryptedUploadResponse_NONE, code)
+	assert.Equal(t, int32(144), key.GetRollingPeriod())
+}
+
 func buildKey(token []byte, transmissionRiskLevel, rollingStartIntervalNumber, rollingPeriod int32) pb.TemporaryExposureKey {
 	return pb.TemporaryExposureKey{
 		KeyData:                    token,
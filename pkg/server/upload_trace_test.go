@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	persistence "github.com/cds-snc/covid-alert-server/mocks/pkg/persistence"
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.opentelemetry.io/otel/api/global"
+	exporttrace "go.opentelemetry.io/otel/sdk/export/trace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/crypto/nacl/box"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// spanRecorder keeps exported spans in memory
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*exporttrace.SpanData
+}
+
+func (r *spanRecorder) ExportSpan(_ context.Context, span *exporttrace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+func (r *spanRecorder) byName() map[string]*exporttrace.SpanData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	spans := make(map[string]*exporttrace.SpanData, len(r.spans))
+	for _, span := range r.spans {
+		spans[span.Name] = span
+	}
+	return spans
+}
+
+func recordSpans(t *testing.T) (*spanRecorder, func()) {
+	recorder := &spanRecorder{}
+	tp, err := sdktrace.NewProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.AlwaysSample()}),
+		sdktrace.WithSyncer(recorder),
+	)
+	assert.Nil(t, err)
+
+	old := global.TraceProvider()
+	global.SetTraceProvider(tp)
+	return recorder, func() { global.SetTraceProvider(old) }
+}
+
+func errorCodeAttribute(span *exporttrace.SpanData) string {
+	for _, attr := range span.Attributes {
+		if attr.Key == uploadErrorCodeKey {
+			return attr.Value.AsString()
+		}
+	}
+	return ""
+}
+
+func TestUpload_Traced(t *testing.T) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	recorder, restore := recordSpans(t)
+	defer restore()
+
+	db := &persistence.Conn{}
+	router := setupUploadRouter(db)
+
+	goodServerPub, goodServerPriv, _ := box.GenerateKey(rand.Reader)
+	goodAppPub, goodAppPriv, _ := box.GenerateKey(rand.Reader)
+
+	db.On("PrivForPub", goodServerPub[:]).Return(goodServerPriv[:], nil)
+	db.On("StoreKeys", goodAppPub, mock.AnythingOfType("[]*covidshield.TemporaryExposureKey"), mock.Anything).Return(int64(1), int64(0), nil)
+
+	var (
+		nonce [24]byte
+		msg   []byte
+	)
+	io.ReadFull(rand.Reader, nonce[:])
+	upload := buildUpload(1, timestamppb.Timestamp{Seconds: time.Now().Unix()})
+	marshalledUpload, _ := proto.Marshal(upload)
+	encrypted := box.Seal(msg[:], marshalledUpload, &nonce, goodServerPub, goodAppPriv)
+
+	payload, _ := proto.Marshal(buildUploadRequest(goodServerPub[:], nonce[:], goodAppPub[:], encrypted))
+	req, _ := http.NewRequest("POST", "/upload", bytes.NewReader(payload))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+
+	spans := recorder.byName()
+	handler, ok := spans["upload"]
+	assert.True(t, ok, "should record a span for the handler")
+	assert.Equal(t, pb.EncryptedUploadResponse_NONE.String(), errorCodeAttribute(handler))
+
+	for _, name := range []string{"decrypt", "validate", "StoreKeys"} {
+		child, ok := spans[name]
+		if assert.True(t, ok, "should record a %s span", name) {
+			assert.Equal(t, handler.SpanContext.SpanID, child.ParentSpanID, "%s should be a child of the handler span", name)
+			assert.Equal(t, handler.SpanContext.TraceID, child.SpanContext.TraceID)
+		}
+	}
+}
+
+func TestUpload_TracedRejection(t *testing.T) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	recorder, restore := recordSpans(t)
+	defer restore()
+
+	router := setupUploadRouter(&persistence.Conn{})
+
+	req, _ := http.NewRequest("POST", "/upload", strings.NewReader("sd"))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, 400, resp.Code, "400 response is expected")
+
+	spans := recorder.byName()
+	assert.Len(t, spans, 1, "nothing past the rejection should be traced")
+	assert.Equal(t, pb.EncryptedUploadResponse_UNKNOWN.String(), errorCodeAttribute(spans["upload"]))
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+
+	"github.com/Shopify/goose/srvutil"
+	"github.com/gorilla/mux"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// maxValidateBodyBytes bounds the JSON body; it is far larger than the
+// protobuf form because key data is base64 encoded and field names are spelled out
+const maxValidateBodyBytes = 64 * 1024
+
+// NewValidateServlet exposes POST /validate for client developers. It takes an
+// unencrypted Upload as protobuf JSON, runs it through the same checks as
+// /upload, and reports the outcome for the upload and for each key. Nothing is
+// decrypted, stored or counted, so it is only registered when
+// enableValidateEndpoint is set and should stay off in production.
+func NewValidateServlet() srvutil.Servlet {
+	return &validateServlet{clock: systemClock{}}
+}
+
+type validateServlet struct {
+	clock Clock
+}
+
+// keyValidation is the outcome of the per-key checks for the key at Index
+type keyValidation struct {
+	Index   int    `json:"index"`
+	Valid   bool   `json:"valid"`
+	Error   string `json:"error,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// validateResponse reports whether /upload would accept the upload and, if
+// not, the error code it would respond with
+type validateResponse struct {
+	Valid   bool            `json:"valid"`
+	Error   string          `json:"error,omitempty"`
+	Message string          `json:"message,omitempty"`
+	Keys    []keyValidation `json:"keys"`
+}
+
+func (s *validateServlet) RegisterRouting(r *mux.Router) {
+	r = prefixedRouter(r)
+	r.HandleFunc("/validate", s.validate).Methods(http.MethodPost)
+}
+
+func (s *validateServlet) validate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxValidateBodyBytes+1))
+	if err != nil || len(body) > maxValidateBodyBytes {
+		log(ctx, err).Info("unreadable or oversized validate request")
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var upload pb.Upload
+	if err := protojson.Unmarshal(body, &upload); err != nil {
+		log(ctx, err).Info("error unmarshalling validate request")
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	resp := validateResponse{Valid: true, Keys: make([]keyValidation, 0, len(upload.GetKeys()))}
+	for i, key := range upload.GetKeys() {
+		errCode, message, ok := checkKey(key)
+		result := keyValidation{Index: i, Valid: ok}
+		if !ok {
+			result.Error, result.Message = errCode.String(), message
+		}
+		resp.Keys = append(resp.Keys, result)
+	}
+
+	if errCode, message, ok := s.checkUpload(ctx, r, &upload); !ok {
+		resp.Valid, resp.Error, resp.Message = false, errCode.String(), message
+	}
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Cache-Control", "no-store")
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	if _, err := w.Write(js); err != nil {
+		log(ctx, err).Info("error writing response")
+	}
+}
+
+// checkUpload applies the upload handler's checks on the decrypted Upload, in
+// the same order, so the first failure is the error /upload would return
+func (s *validateServlet) checkUpload(ctx context.Context, r *http.Request, upload *pb.Upload) (pb.EncryptedUploadResponse_ErrorCode, string, bool) {
+	keys := upload.GetKeys()
+	if len(keys) == 0 && config.AppConstants.AcceptEmptyUploads {
+		return pb.EncryptedUploadResponse_NONE, "", true
+	}
+	if len(keys) == 0 {
+		return pb.EncryptedUploadResponse_NO_KEYS_IN_PAYLOAD, "no keys provided", false
+	}
+
+	deviceType, _ := requestDeviceType(r)
+	minKeys, maxKeys := uploadKeyLimits(ctx, deviceType)
+	if len(keys) < minKeys {
+		return pb.EncryptedUploadResponse_TOO_FEW_KEYS, "too few keys provided", false
+	}
+	if len(keys) > maxKeys {
+		return pb.EncryptedUploadResponse_TOO_MANY_KEYS, "too many keys provided", false
+	}
+
+	ts := upload.GetTimestamp()
+	if ts == nil || !timestampWithinSkew(ctx, deviceType, s.clock.Now(), time.Unix(ts.Seconds, 0)) {
+		return pb.EncryptedUploadResponse_INVALID_TIMESTAMP, "invalid timestamp", false
+	}
+
+	if errCode, message, ok := checkKeys(keys); !ok {
+		return errCode, message, false
+	}
+
+	if keyStartsInFuture(s.clock.Now(), keys) {
+		return pb.EncryptedUploadResponse_INVALID_ROLLING_START_INTERVAL_NUMBER, "rollingStartIntervalNumber is in the future", false
+	}
+
+	if keyTooOld(s.clock.Now(), keys) {
+		return pb.EncryptedUploadResponse_INVALID_ROLLING_START_INTERVAL_NUMBER, "rollingStartIntervalNumber is too old", false
+	}
+
+	if !timestampMatchesKeys(time.Unix(ts.Seconds, 0), keys) {
+		return pb.EncryptedUploadResponse_INVALID_TIMESTAMP, "timestamp inconsistent with key intervals", false
+	}
+
+	return pb.EncryptedUploadResponse_NONE, "", true
+}
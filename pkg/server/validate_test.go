@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	pb "github.com/cds-snc/covid-alert-server/pkg/proto/covidshield"
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func validateRequest(t *testing.T, upload *pb.Upload) (int, validateResponse) {
+	router := Router()
+	NewValidateServlet().RegisterRouting(router)
+
+	body, err := protojson.Marshal(upload)
+	assert.Nil(t, err)
+
+	req, _ := http.NewRequest("POST", "/validate", bytes.NewReader(body))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	var result validateResponse
+	if resp.Code == http.StatusOK {
+		assert.Nil(t, json.Unmarshal(resp.Body.Bytes(), &result))
+	}
+	return resp.Code, result
+}
+
+func TestValidate_ValidKeys(t *testing.T) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	upload := &pb.Upload{
+		Keys:      []*pb.TemporaryExposureKey{randomTestKey(), randomTestKey()},
+		Timestamp: &timestamppb.Timestamp{Seconds: time.Now().Unix()},
+	}
+
+	code, result := validateRequest(t, upload)
+
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, validateResponse{
+		Valid: true,
+		Keys:  []keyValidation{{Index: 0, Valid: true}, {Index: 1, Valid: true}},
+	}, result)
+}
+
+func TestValidate_InvalidKeys(t *testing.T) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	badRisk := randomTestKey()
+	risk := int32(9)
+	badRisk.TransmissionRiskLevel = &risk
+
+	badData := randomTestKey()
+	badData.KeyData = []byte{1, 2, 3}
+
+	upload := &pb.Upload{
+		Keys:      []*pb.TemporaryExposureKey{randomTestKey(), badRisk, badData},
+		Timestamp: &timestamppb.Timestamp{Seconds: time.Now().Unix()},
+	}
+
+	code, result := validateRequest(t, upload)
+
+	// Every key is reported, and the upload fails with the first key's error
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, validateResponse{
+		Valid:   false,
+		Error:   "INVALID_TRANSMISSION_RISK_LEVEL",
+		Message: "invalid transmission risk level",
+		Keys: []keyValidation{
+			{Index: 0, Valid: true},
+			{Index: 1, Valid: false, Error: "INVALID_TRANSMISSION_RISK_LEVEL", Message: "invalid transmission risk level"},
+			{Index: 2, Valid: false, Error: "INVALID_KEY_DATA", Message: "invalid key data"},
+		},
+	}, result)
+}
+
+func TestValidate_UploadLevelChecks(t *testing.T) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	// Valid keys in an upload /upload would still reject for its timestamp
+	upload := &pb.Upload{
+		Keys:      []*pb.TemporaryExposureKey{randomTestKey()},
+		Timestamp: &timestamppb.Timestamp{Seconds: time.Now().Add(-2 * time.Hour).Unix()},
+	}
+
+	code, result := validateRequest(t, upload)
+	assert.Equal(t, http.StatusOK, code)
+	assert.False(t, result.Valid)
+	assert.Equal(t, "INVALID_TIMESTAMP", result.Error)
+	assert.Equal(t, []keyValidation{{Index: 0, Valid: true}}, result.Keys)
+
+	code, result = validateRequest(t, &pb.Upload{Timestamp: &timestamppb.Timestamp{Seconds: time.Now().Unix()}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.False(t, result.Valid)
+	assert.Equal(t, "NO_KEYS_IN_PAYLOAD", result.Error)
+	assert.Equal(t, []keyValidation{}, result.Keys)
+
+	// Deployments accepting empty uploads as pings report them valid
+	oldAcceptEmptyUploads := config.AppConstants.AcceptEmptyUploads
+	config.AppConstants.AcceptEmptyUploads = true
+	defer func() { config.AppConstants.AcceptEmptyUploads = oldAcceptEmptyUploads }()
+
+	code, result = validateRequest(t, &pb.Upload{Timestamp: &timestamppb.Timestamp{Seconds: time.Now().Unix()}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, result.Valid)
+	assert.Equal(t, "", result.Error)
+}
+
+func TestValidate_InvalidJSON(t *testing.T) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	router := Router()
+	NewValidateServlet().RegisterRouting(router)
+
+	req, _ := http.NewRequest("POST", "/validate", strings.NewReader(`{"keys": "nope"}`))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
@@ -0,0 +1,26 @@
+package telemetry
+
+import (
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// buildInfo is the conventional Prometheus build_info gauge: always 1, with
+// the running build in its labels so metric changes can be lined up with
+// deploys. It's registered with the Prometheus client directly since the
+// OpenTelemetry pipeline has no way to export a plain gauge.
+var buildInfo = prom.NewGaugeVec(prom.GaugeOpts{
+	Name: "covidshield_build_info",
+	Help: "Build version of the running server, always 1",
+}, []string{"version", "commit"})
+
+// SetBuildInfo records the build the process is running
+func SetBuildInfo(version, commit string) {
+	buildInfo.Reset()
+	buildInfo.WithLabelValues(version, commit).Set(1)
+}
+
+func newPrometheusRegistry() *prom.Registry {
+	registry := prom.NewRegistry()
+	registry.MustRegister(buildInfo)
+	return registry
+}
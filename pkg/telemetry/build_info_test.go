@@ -0,0 +1,28 @@
+package telemetry
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildInfo(t *testing.T) {
+	registry := newPrometheusRegistry()
+	SetBuildInfo("main", "abc123")
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	assert.Len(t, families, 1)
+
+	family := families[0]
+	assert.Equal(t, "covidshield_build_info", family.GetName())
+	assert.Len(t, family.GetMetric(), 1)
+
+	m := family.GetMetric()[0]
+	labels := map[string]string{}
+	for _, l := range m.GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+	assert.Equal(t, map[string]string{"version": "main", "commit": "abc123"}, labels)
+	assert.Equal(t, float64(1), m.GetGauge().GetValue())
+}
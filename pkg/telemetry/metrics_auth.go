@@ -0,0 +1,37 @@
+package telemetry
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+)
+
+const defaultMetricsListenAddr = ":2222"
+
+// metricsListenAddr is the address the Prometheus /metrics endpoint listens
+// on. Set METRICS_LISTEN_ADDR to an internal interface, e.g.
+// 10.0.0.5:2222, to keep it off the public one.
+func metricsListenAddr() string {
+	if addr := os.Getenv("METRICS_LISTEN_ADDR"); addr != "" {
+		return addr
+	}
+	return defaultMetricsListenAddr
+}
+
+// metricsAuth requires an "Authorization: Bearer <token>" header matching
+// token before serving next. An empty token leaves the endpoint open, which
+// is the default for backward compatibility.
+func metricsAuth(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
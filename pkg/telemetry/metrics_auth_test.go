@@ -0,0 +1,59 @@
+package telemetry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsAuth(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("metrics"))
+	})
+	handler := metricsAuth("s3cret", next)
+
+	// No token
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "401 response is expected")
+	assert.Equal(t, "Bearer", resp.Header().Get("WWW-Authenticate"))
+
+	// Wrong token
+	req.Header.Set("Authorization", "Bearer wrong")
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	assert.Equal(t, 401, resp.Code, "401 response is expected")
+
+	// Correct token
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "200 response is expected")
+	assert.Equal(t, "metrics", resp.Body.String())
+}
+
+func TestMetricsAuthDisabled(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	resp := httptest.NewRecorder()
+	metricsAuth("", next).ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code, "open by default")
+}
+
+func TestMetricsListenAddr(t *testing.T) {
+	os.Unsetenv("METRICS_LISTEN_ADDR")
+	assert.Equal(t, ":2222", metricsListenAddr())
+
+	os.Setenv("METRICS_LISTEN_ADDR", "127.0.0.1:9102")
+	defer os.Unsetenv("METRICS_LISTEN_ADDR")
+	assert.Equal(t, "127.0.0.1:9102", metricsListenAddr())
+}
@@ -12,6 +12,7 @@ import (
 	"go.opentelemetry.io/otel/api/trace"
 	"go.opentelemetry.io/otel/exporters/metric/prometheus"
 	metricstdout "go.opentelemetry.io/otel/exporters/metric/stdout"
+	"go.opentelemetry.io/otel/exporters/otlp"
 	tracerstdout "go.opentelemetry.io/otel/exporters/trace/stdout"
 	"go.opentelemetry.io/otel/plugin/httptrace"
 	"go.opentelemetry.io/otel/sdk/metric/controller/pull"
@@ -24,6 +25,7 @@ import (
 const STDOUT = "stdout"
 const PRETTY = "pretty"
 const PROMETHEUS = "prometheus"
+const OTLP = "otlp"
 
 var log = logger.New("telemetry")
 
@@ -57,11 +59,27 @@ func InitTracer() func() {
 		return cleanupFunc
 	}
 
-	var exporter *tracerstdout.Exporter
+	// The stdout exporter writes each span as it ends. OTLP sends them in
+	// batches, so spans ending in a request don't wait on the collector.
+	var exporter sdktrace.ProviderOption
 	var err error
 	switch tracerProvider {
 	case STDOUT, PRETTY:
-		exporter, err = tracerstdout.NewExporter(tracerstdout.Options{PrettyPrint: tracerProvider == PRETTY})
+		var stdoutExporter *tracerstdout.Exporter
+		stdoutExporter, err = tracerstdout.NewExporter(tracerstdout.Options{PrettyPrint: tracerProvider == PRETTY})
+		exporter = sdktrace.WithSyncer(stdoutExporter)
+	case OTLP:
+		var otlpExporter *otlp.Exporter
+		otlpExporter, err = otlp.NewExporter(otlpOptions()...)
+		if err != nil {
+			break
+		}
+		exporter = sdktrace.WithBatcher(otlpExporter)
+		cleanupFunc = func() {
+			if err := otlpExporter.Stop(); err != nil {
+				log(nil, err).Warn("failed to stop otlp exporter")
+			}
+		}
 	default:
 		log(nil, nil).WithField("provider", tracerProvider).Fatal("Unsupported trace provider")
 	}
@@ -73,7 +91,7 @@ func InitTracer() func() {
 	// For the demonstration, use sdktrace.AlwaysSample sampler to sample all traces.
 	// In a production application, use sdktrace.ProbabilitySampler with a desired probability.
 	tp, err := sdktrace.NewProvider(sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.AlwaysSample()}),
-		sdktrace.WithSyncer(exporter))
+		exporter)
 	if err != nil {
 		log(nil, err)
 	}
@@ -82,6 +100,20 @@ func InitTracer() func() {
 	return cleanupFunc
 }
 
+// otlpOptions configures the OTLP exporter from OTEL_EXPORTER_OTLP_ENDPOINT,
+// a host:port defaulting to the collector's standard port on localhost, and
+// OTEL_EXPORTER_OTLP_INSECURE for collectors without TLS
+func otlpOptions() []otlp.ExporterOption {
+	var opts []otlp.ExporterOption
+	if addr := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); addr != "" {
+		opts = append(opts, otlp.WithAddress(addr))
+	}
+	if os.Getenv("OTEL_EXPORTER_OTLP_INSECURE") == "true" {
+		opts = append(opts, otlp.WithInsecure())
+	}
+	return opts
+}
+
 // InitMeter initializes the global metric progider.
 func InitMeter(db persistence.Conn) func() {
 	cleanupFunc := func() {}
@@ -106,13 +138,13 @@ func InitMeter(db persistence.Conn) func() {
 		cleanupFunc = pusher.Stop
 	case PROMETHEUS:
 		var exporter *prometheus.Exporter
-		exporter, err = prometheus.InstallNewPipeline(prometheus.Config{}, pull.WithStateful(false))
+		exporter, err = prometheus.InstallNewPipeline(prometheus.Config{Registry: newPrometheusRegistry()}, pull.WithStateful(false))
 		if err != nil {
 			break
 		}
-		http.HandleFunc("/metrics", exporter.ServeHTTP)
+		http.Handle("/metrics", metricsAuth(os.Getenv("METRICS_BEARER_TOKEN"), exporter))
 		go func() {
-			_ = http.ListenAndServe(":2222", nil)
+			_ = http.ListenAndServe(metricsListenAddr(), nil)
 		}()
 	default:
 		log(nil, nil).WithField("provider", metricProvider).Fatal("Unsupported metric provider")
@@ -138,12 +170,13 @@ func OpenTelemetryMiddleware(next http.Handler) http.Handler {
 		r = r.WithContext(correlation.ContextWithMap(r.Context(), correlation.NewMap(correlation.MapUpdate{
 			MultiKV: entries,
 		})))
-		_, span := tracer.Start(
+		ctx, span := tracer.Start(
 			trace.ContextWithRemoteSpanContext(r.Context(), spanCtx),
 			"HTTP Request",
 			trace.WithAttributes(attrs...),
 		)
 		defer span.End()
-		next.ServeHTTP(w, r)
+		// Handlers start their own spans as children of this one
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -0,0 +1,192 @@
+package workers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/persistence"
+
+	"gopkg.in/tomb.v2"
+)
+
+var exportedDeviceTypes = []persistence.DeviceType{persistence.Android, persistence.IOS, persistence.Server}
+
+// eventsExport is the body POSTed for each day: the day's aggregated events,
+// grouped by originator
+type eventsExport struct {
+	Date        string                `json:"date"`
+	Originators []originatorEventsRow `json:"originators"`
+}
+
+type originatorEventsRow struct {
+	Originator string           `json:"originator"`
+	Events     []exportedEvents `json:"events"`
+}
+
+type exportedEvents struct {
+	Identifier string `json:"identifier"`
+	DeviceType string `json:"deviceType"`
+	Count      int64  `json:"count"`
+}
+
+// eventsExporter POSTs the previous UTC day's events to url, as a bearer
+// token request if token is set. Failed requests are tried up to attempts
+// times in all, backoff apart.
+type eventsExporter struct {
+	url      string
+	token    string
+	client   *http.Client
+	attempts int
+	backoff  time.Duration
+	now      func() time.Time
+}
+
+// eventsExportClaimTimeout is how long a replica's claim on a day's export
+// holds before another may take it over, in case the first died mid-export
+const eventsExportClaimTimeout = time.Hour
+
+func (e *eventsExporter) run(w *worker, ctx context.Context) error {
+	date := e.now().UTC().AddDate(0, 0, -1).Format("2006-01-02")
+
+	// Every retrieval replica runs this worker, but only one sends each day
+	claimed, err := w.db.ClaimEventsExport(ctx, date, eventsExportClaimTimeout)
+	if err != nil {
+		log(ctx, err).Info("failed to claim events export")
+		return err
+	}
+	if !claimed {
+		log(ctx, nil).WithField("date", date).Info("events export already claimed")
+		return nil
+	}
+
+	err = e.export(w, ctx, date)
+	if finishErr := w.db.FinishEventsExport(ctx, date, err == nil); finishErr != nil {
+		log(ctx, finishErr).WithField("date", date).Warn("failed to record events export")
+	}
+	return err
+}
+
+func (e *eventsExporter) export(w *worker, ctx context.Context, date string) error {
+	export, err := collectEvents(w.db, date)
+	if err != nil {
+		log(ctx, err).Info("failed to read events for export")
+		return err
+	}
+
+	body, err := json.Marshal(export)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err = e.post(body); err == nil {
+			break
+		}
+		if attempt >= e.attempts {
+			log(ctx, err).WithField("date", date).Info("failed to export events")
+			return err
+		}
+		log(ctx, err).WithField("attempt", attempt).Info("retrying events export")
+		select {
+		case <-w.tomb.Dying():
+			return tomb.ErrDying
+		case <-time.After(e.backoff):
+		}
+	}
+
+	log(ctx, nil).WithField("date", date).WithField("originators", len(export.Originators)).Info("exported events")
+	return nil
+}
+
+func (e *eventsExporter) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.token != "" {
+		req.Header.Set("Authorization", "Bearer "+e.token)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("events export failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// collectEvents groups date's events for every device type by originator, in
+// the order the originators are first seen. Originators are exported as
+// persistence.ExportableSource, so raw tokens recorded for unmapped ones are
+// redacted, and those that redact alike are merged.
+func collectEvents(db persistence.Conn, date string) (eventsExport, error) {
+	export := eventsExport{Date: date, Originators: []originatorEventsRow{}}
+	index := map[string]int{}
+
+	for _, deviceType := range exportedDeviceTypes {
+		events, err := db.GetEvents(date, deviceType)
+		if err != nil {
+			return eventsExport{}, err
+		}
+		for _, e := range events {
+			originator := persistence.ExportableSource(e.Source)
+			i, ok := index[originator]
+			if !ok {
+				i = len(export.Originators)
+				index[originator] = i
+				export.Originators = append(export.Originators, originatorEventsRow{Originator: originator})
+			}
+			export.Originators[i].add(exportedEvents{
+				Identifier: e.Identifier,
+				DeviceType: string(deviceType),
+				Count:      e.Count,
+			})
+		}
+	}
+	return export, nil
+}
+
+// add appends events, or adds its count to the same identifier and device type
+func (row *originatorEventsRow) add(events exportedEvents) {
+	for i, existing := range row.Events {
+		if existing.Identifier == events.Identifier && existing.DeviceType == events.DeviceType {
+			row.Events[i].Count += events.Count
+			return
+		}
+	}
+	row.Events = append(row.Events, events)
+}
+
+func StartEventsExportWorker(db persistence.Conn, url, token string) (Worker, error) {
+	exporter := &eventsExporter{
+		url:      url,
+		token:    token,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		attempts: config.AppConstants.EventsExportAttempts,
+		backoff:  time.Duration(config.AppConstants.EventsExportRetryBackoffSeconds) * time.Second,
+		now:      time.Now,
+	}
+	return createEventsExportWorker(db, exporter, time.Duration(config.AppConstants.WorkerExportEventsInterval)*time.Second)
+}
+
+func createEventsExportWorker(db persistence.Conn, exporter *eventsExporter, interval time.Duration) (Worker, error) {
+	worker := &worker{
+		name:     "events-export",
+		db:       db,
+		interval: interval,
+		tomb:     &tomb.Tomb{},
+		runner:   exporter.run,
+	}
+
+	return worker, nil
+}
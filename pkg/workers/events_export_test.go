@@ -0,0 +1,205 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	keyclaim "github.com/cds-snc/covid-alert-server/mocks/pkg/keyclaim"
+	persistence "github.com/cds-snc/covid-alert-server/mocks/pkg/persistence"
+	pkgPersistence "github.com/cds-snc/covid-alert-server/pkg/persistence"
+	"github.com/cds-snc/covid-alert-server/pkg/testhelpers"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"gopkg.in/tomb.v2"
+)
+
+// setupExportLookup makes ON and NB the only regions ExportableSource passes
+// through
+func setupExportLookup() {
+	lookup := &keyclaim.Authenticator{}
+	lookup.On("Regions").Return([]string{"NB", "ON"})
+	pkgPersistence.SetupLookup(lookup)
+}
+
+func TestEventsExport(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+	setupExportLookup()
+	defer pkgPersistence.SetupLookup(nil)
+
+	db := &persistence.Conn{}
+	db.On("ClaimEventsExport", mock.Anything, "2020-09-13", eventsExportClaimTimeout).Return(true, nil)
+	db.On("FinishEventsExport", mock.Anything, "2020-09-13", true).Return(nil).Once()
+	db.On("GetEvents", "2020-09-13", pkgPersistence.Android).Return([]pkgPersistence.Events{
+		{Source: "ON", Date: "2020-09-13", Count: 4, Identifier: "NotificationShown"},
+		{Source: "rawtoken1", Date: "2020-09-13", Count: 1, Identifier: "NotificationShown"},
+	}, nil)
+	db.On("GetEvents", "2020-09-13", pkgPersistence.IOS).Return([]pkgPersistence.Events{}, nil)
+	db.On("GetEvents", "2020-09-13", pkgPersistence.Server).Return([]pkgPersistence.Events{
+		{Source: "NB", Date: "2020-09-13", Count: 2, Identifier: "OTKClaimed"},
+		{Source: "ON", Date: "2020-09-13", Count: 7, Identifier: "OTKGenerated"},
+		{Source: "rawtoken1", Date: "2020-09-13", Count: 3, Identifier: "OTKClaimed"},
+		{Source: "rxxxxxx1", Date: "2020-09-13", Count: 5, Identifier: "OTKClaimed"},
+	}, nil)
+
+	// The first attempt fails and is retried
+	var (
+		requests int
+		auth     string
+		body     []byte
+	)
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		auth = r.Header.Get("Authorization")
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer sink.Close()
+
+	exporter := &eventsExporter{
+		url:      sink.URL,
+		token:    "sinktoken",
+		client:   sink.Client(),
+		attempts: 3,
+		now:      func() time.Time { return time.Date(2020, 9, 14, 2, 0, 0, 0, time.UTC) },
+	}
+	w, _ := createEventsExportWorker(db, exporter, time.Hour)
+
+	assert.Nil(t, w.(*worker).runner(w.(*worker), context.Background()))
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, "Bearer sinktoken", auth)
+	assert.JSONEq(t, `{
+		"date": "2020-09-13",
+		"originators": [
+			{"originator": "ON", "events": [
+				{"identifier": "NotificationShown", "deviceType": "Android", "count": 4},
+				{"identifier": "OTKGenerated", "deviceType": "Server", "count": 7}
+			]},
+			{"originator": "r...1", "events": [
+				{"identifier": "NotificationShown", "deviceType": "Android", "count": 1},
+				{"identifier": "OTKClaimed", "deviceType": "Server", "count": 8}
+			]},
+			{"originator": "NB", "events": [
+				{"identifier": "OTKClaimed", "deviceType": "Server", "count": 2}
+			]}
+		]
+	}`, string(body))
+	assert.NotContains(t, string(body), "rawtoken1")
+	assert.Equal(t, "retrying events export", hook.Entries[0].Message)
+	testhelpers.AssertLog(t, hook, 2, logrus.InfoLevel, "exported events")
+	db.AssertExpectations(t)
+}
+
+func TestEventsExport_AlreadyClaimed(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db := &persistence.Conn{}
+	db.On("ClaimEventsExport", mock.Anything, "2020-09-13", eventsExportClaimTimeout).Return(false, nil)
+
+	requests := 0
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer sink.Close()
+
+	exporter := &eventsExporter{
+		url:      sink.URL,
+		client:   sink.Client(),
+		attempts: 1,
+		now:      func() time.Time { return time.Date(2020, 9, 14, 2, 0, 0, 0, time.UTC) },
+	}
+	w, _ := createEventsExportWorker(db, exporter, time.Hour)
+
+	assert.Nil(t, w.(*worker).runner(w.(*worker), context.Background()))
+	assert.Equal(t, 0, requests)
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "events export already claimed")
+	db.AssertNotCalled(t, "GetEvents", mock.Anything, mock.Anything)
+	db.AssertNotCalled(t, "FinishEventsExport", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestEventsExport_StopsRetryingWhenDying(t *testing.T) {
+	_, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db := &persistence.Conn{}
+	db.On("ClaimEventsExport", mock.Anything, "2020-09-13", eventsExportClaimTimeout).Return(true, nil)
+	db.On("FinishEventsExport", mock.Anything, "2020-09-13", false).Return(nil).Once()
+	db.On("GetEvents", "2020-09-13", mock.Anything).Return([]pkgPersistence.Events{}, nil)
+
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer sink.Close()
+
+	exporter := &eventsExporter{
+		url:      sink.URL,
+		client:   sink.Client(),
+		attempts: 3,
+		backoff:  time.Hour,
+		now:      func() time.Time { return time.Date(2020, 9, 14, 2, 0, 0, 0, time.UTC) },
+	}
+	w, _ := createEventsExportWorker(db, exporter, time.Hour)
+	w.(*worker).tomb.Kill(nil)
+
+	done := make(chan error)
+	go func() { done <- w.(*worker).runner(w.(*worker), context.Background()) }()
+	select {
+	case err := <-done:
+		assert.Equal(t, tomb.ErrDying, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("export kept waiting to retry after the worker started dying")
+	}
+	db.AssertExpectations(t)
+}
+
+func TestEventsExport_Fails(t *testing.T) {
+	hook, oldLog := testhelpers.SetupTestLogging(&log)
+	defer func() { log = *oldLog }()
+
+	db := &persistence.Conn{}
+	db.On("ClaimEventsExport", mock.Anything, "2020-09-13", eventsExportClaimTimeout).Return(true, nil)
+	db.On("FinishEventsExport", mock.Anything, "2020-09-13", false).Return(nil)
+	db.On("GetEvents", "2020-09-13", pkgPersistence.Android).Return([]pkgPersistence.Events{}, nil)
+	db.On("GetEvents", "2020-09-13", pkgPersistence.IOS).Return([]pkgPersistence.Events{}, nil)
+	db.On("GetEvents", "2020-09-13", pkgPersistence.Server).Return([]pkgPersistence.Events{}, nil)
+
+	requests := 0
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer sink.Close()
+
+	exporter := &eventsExporter{
+		url:      sink.URL,
+		client:   sink.Client(),
+		attempts: 2,
+		now:      func() time.Time { return time.Date(2020, 9, 14, 2, 0, 0, 0, time.UTC) },
+	}
+	w, _ := createEventsExportWorker(db, exporter, time.Hour)
+
+	assert.NotNil(t, w.(*worker).runner(w.(*worker), context.Background()))
+	assert.Equal(t, 2, requests)
+	testhelpers.AssertLog(t, hook, 2, logrus.InfoLevel, "failed to export events")
+
+	// Nothing is sent if the events can't be read
+	db = &persistence.Conn{}
+	db.On("ClaimEventsExport", mock.Anything, "2020-09-13", eventsExportClaimTimeout).Return(true, nil)
+	db.On("FinishEventsExport", mock.Anything, "2020-09-13", false).Return(nil).Once()
+	db.On("GetEvents", "2020-09-13", pkgPersistence.Android).Return(nil, fmt.Errorf("db error"))
+	w, _ = createEventsExportWorker(db, exporter, time.Hour)
+
+	assert.NotNil(t, w.(*worker).runner(w.(*worker), context.Background()))
+	assert.Equal(t, 2, requests)
+	testhelpers.AssertLog(t, hook, 1, logrus.InfoLevel, "failed to read events for export")
+}
@@ -0,0 +1,73 @@
+package workers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/persistence"
+
+	"github.com/Shopify/goose/logger"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/metric"
+	"gopkg.in/tomb.v2"
+)
+
+var rowCountTables = []string{"diagnosis_keys", "encryption_keys", "events"}
+
+// The latest counts fetched by the worker; the observer reports these on each
+// scrape rather than querying the database itself.
+var (
+	tableRowCountsLock sync.Mutex
+	tableRowCounts     = map[string]int64{}
+)
+
+var _ = metric.Must(global.Meter("covidshield")).NewInt64ValueObserver("covidshield.db.table.rows",
+	func(_ context.Context, result metric.Int64ObserverResult) {
+		tableRowCountsLock.Lock()
+		defer tableRowCountsLock.Unlock()
+		for table, rows := range tableRowCounts {
+			result.Observe(rows, kv.String("table", table))
+		}
+	},
+	metric.WithDescription("Approximate number of rows per table"),
+)
+
+var tableRowCountsRunner = func(w *worker, ctx context.Context) error {
+	counts, err := w.db.ApproximateTableRowCounts(ctx, rowCountTables)
+	if err != nil {
+		log(ctx, err).Info("failed to count table rows")
+		return err
+	}
+
+	tableRowCountsLock.Lock()
+	defer tableRowCountsLock.Unlock()
+	for _, count := range counts {
+		tableRowCounts[count.Table] = count.Rows
+	}
+	return nil
+}
+
+func StartTableRowCountsWorker(db persistence.Conn) (Worker, error) {
+	return createTableRowCountsWorker(db, time.Duration(config.AppConstants.WorkerTableRowCountsInterval)*time.Second)
+}
+
+func createTableRowCountsWorker(db persistence.Conn, interval time.Duration) (Worker, error) {
+	worker := &worker{
+		name:     "table-row-counts",
+		db:       db,
+		interval: interval,
+		tomb:     &tomb.Tomb{},
+		runner:   tableRowCountsRunner,
+	}
+
+	// Populate the gauges before the first interval elapses
+	ctx, _ := logger.WithUUID(context.Background())
+	if err := worker.runner(worker, ctx); err != nil {
+		return nil, err
+	}
+
+	return worker, nil
+}
@@ -0,0 +1,60 @@
+package workers
+
+import (
+	"context"
+	"time"
+
+	"github.com/cds-snc/covid-alert-server/pkg/config"
+	"github.com/cds-snc/covid-alert-server/pkg/persistence"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/tomb.v2"
+)
+
+// uploadReconciliationRunner checks the previous UTC day, which no more
+// uploads can land in
+var uploadReconciliationRunner = func(w *worker, ctx context.Context) error {
+	drift, err := w.db.ReconcileUploadCounts(ctx, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		log(ctx, err).Info("failed to reconcile upload counts")
+		return err
+	}
+
+	threshold := config.AppConstants.UploadCountDriftThreshold
+	discrepancies := 0
+	for _, d := range drift {
+		diff := d.Difference()
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff <= threshold {
+			continue
+		}
+		discrepancies++
+		log(ctx, nil).WithFields(logrus.Fields{
+			"originator":    d.Originator,
+			"date":          d.Date,
+			"stored_keys":   d.StoredKeys,
+			"recorded_keys": d.RecordedKeys,
+		}).Warn("upload count drift")
+	}
+
+	log(ctx, nil).WithField("originators", len(drift)).WithField("discrepancies", discrepancies).Info("reconciled upload counts")
+	return nil
+}
+
+func StartUploadReconciliationWorker(db persistence.Conn) (Worker, error) {
+	return createUploadReconciliationWorker(db, time.Duration(config.AppConstants.WorkerReconcileUploadsInterval)*time.Second)
+}
+
+func createUploadReconciliationWorker(db persistence.Conn, interval time.Duration) (Worker, error) {
+	worker := &worker{
+		name:     "upload-reconciliation",
+		db:       db,
+		interval: interval,
+		tomb:     &tomb.Tomb{},
+		runner:   uploadReconciliationRunner,
+	}
+
+	return worker, nil
+}
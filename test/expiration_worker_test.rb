@@ -64,6 +64,23 @@ class ExpirationWorkerTest < MiniTest::Test
     expire_and_assert(encryption: 0)
   end
 
+  def test_consumed_encryption_key_grace
+    keyset = new_valid_keyset
+    payload = Covidshield::Upload.new(
+      timestamp: Time.now, keys: (1..43).map { |n| tek(data: n.chr * 16) }
+    ).to_proto
+    resp = @sub_conn.post('/upload', encrypted_request(payload, keyset).to_proto)
+    assert_result(resp, 200, :NONE)
+
+    # The consumed keypair survives the sweep while its retry grace lasts
+    expire_and_assert(encryption: 1)
+    resp = @sub_conn.post('/upload', encrypted_request(payload, keyset).to_proto)
+    assert_result(resp, 200, :NONE)
+
+    @dbconn.query('UPDATE encryption_keys SET consumed_at = consumed_at - INTERVAL 301 SECOND')
+    expire_and_assert(encryption: 0)
+  end
+
   private
 
   def expire
@@ -35,7 +35,7 @@ PERIOD_HOURS = 6
 module Helper
   module Include
     def run
-      Helper.with_server_with_pristine_database do |sub_conn, ret_conn|
+      Helper.with_server_with_pristine_database(server_env) do |sub_conn, ret_conn|
         @sub_conn = sub_conn
         @ret_conn = ret_conn
         @dbconn = Mysql2::Client.new(
@@ -45,6 +45,11 @@ module Helper
       end
     end
 
+    # Extra environment for both servers, for tests that need other config
+    def server_env
+      {}
+    end
+
     def current_date_number
       Time.now.to_i / 86400
     end
@@ -194,25 +199,25 @@ module Helper
   end
 
   class << self
-    def with_server_with_pristine_database(&block)
-      with_pristine_database { with_servers(&block) }
+    def with_server_with_pristine_database(env = {}, &block)
+      with_pristine_database { with_servers(env, &block) }
     end
 
-    def with_servers(&block)
-      with_server(KEY_RETRIEVAL_SERVER, RETRIEVAL_SERVER_ADDR) do |ret_conn|
-        with_server(KEY_SUBMISSION_SERVER, SUBMISSION_SERVER_ADDR) do |sub_conn|
+    def with_servers(env = {}, &block)
+      with_server(KEY_RETRIEVAL_SERVER, RETRIEVAL_SERVER_ADDR, env) do |ret_conn|
+        with_server(KEY_SUBMISSION_SERVER, SUBMISSION_SERVER_ADDR, env) do |sub_conn|
           block.call(sub_conn, ret_conn)
         end
       end
     end
 
-    def with_server(bin, addr, &block)
+    def with_server(bin, addr, env = {}, &block)
       pid = Process.spawn(
         {
           'BIND_ADDR' => addr,
           'KEY_CLAIM_TOKEN' => 'first-very-long-token=302:second-very-long-token=302',
           'DATABASE_URL' => DATABASE_URL,
-        },
+        }.merge(env),
         bin, STDERR => File.open('/dev/null')
       )
       conn = Faraday.new(url: "http://#{addr}")
@@ -33,6 +33,8 @@ Google::Protobuf::DescriptorPool.generated_pool.build do
     end
     add_message "covidshield.EncryptedUploadResponse" do
       optional :error, :enum, 1, "covidshield.EncryptedUploadResponse.ErrorCode"
+      optional :quota, :message, 2, "covidshield.UploadQuota"
+      optional :originator_region, :string, 3
     end
     add_enum "covidshield.EncryptedUploadResponse.ErrorCode" do
       value :NONE, 0
@@ -49,6 +51,18 @@ Google::Protobuf::DescriptorPool.generated_pool.build do
       value :INVALID_ROLLING_START_INTERVAL_NUMBER, 12
       value :INVALID_TRANSMISSION_RISK_LEVEL, 13
       value :NO_KEYS_IN_PAYLOAD, 14
+      value :APP_VERSION_TOO_OLD, 15
+      value :INVALID_REPORT_TYPE, 16
+      value :TOO_FEW_KEYS, 17
+      value :MAINTENANCE, 18
+      value :UPLOAD_TOO_SOON, 19
+      value :REGION_NOT_ENABLED, 20
+      value :MIXED_REPORT_TYPES, 21
+    end
+    add_message "covidshield.UploadQuota" do
+      optional :accepted_keys, :uint32, 1
+      optional :remaining_keys, :uint32, 2
+      optional :expires_at, :message, 3, "google.protobuf.Timestamp"
     end
     add_message "covidshield.Upload" do
       optional :timestamp, :message, 1, "google.protobuf.Timestamp"
@@ -104,6 +118,7 @@ module Covidshield
   EncryptedUploadRequest = ::Google::Protobuf::DescriptorPool.generated_pool.lookup("covidshield.EncryptedUploadRequest").msgclass
   EncryptedUploadResponse = ::Google::Protobuf::DescriptorPool.generated_pool.lookup("covidshield.EncryptedUploadResponse").msgclass
   EncryptedUploadResponse::ErrorCode = ::Google::Protobuf::DescriptorPool.generated_pool.lookup("covidshield.EncryptedUploadResponse.ErrorCode").enummodule
+  UploadQuota = ::Google::Protobuf::DescriptorPool.generated_pool.lookup("covidshield.UploadQuota").msgclass
   Upload = ::Google::Protobuf::DescriptorPool.generated_pool.lookup("covidshield.Upload").msgclass
   TemporaryExposureKeyExport = ::Google::Protobuf::DescriptorPool.generated_pool.lookup("covidshield.TemporaryExposureKeyExport").msgclass
   SignatureInfo = ::Google::Protobuf::DescriptorPool.generated_pool.lookup("covidshield.SignatureInfo").msgclass